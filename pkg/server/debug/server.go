@@ -36,6 +36,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 )
 
@@ -115,6 +116,10 @@ func NewServer(st *cluster.Settings) *Server {
 	// Register the stopper endpoint, which lists all active tasks.
 	mux.HandleFunc("/debug/stopper", stop.HandleDebug)
 
+	// Register the monitors endpoint, which lists the memory monitors and
+	// their usage, or the changes since a previous request with ?diff=<id>.
+	mux.HandleFunc("/debug/monitors", mon.HandleDebug)
+
 	// Set up the log spy, a tool that allows inspecting filtered logs at high
 	// verbosity.
 	spy := logSpy{
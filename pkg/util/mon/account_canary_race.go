@@ -0,0 +1,31 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build race
+
+package mon
+
+// accountCanary makes the race detector flag a BoundAccount used by several
+// goroutines without synchronization. Some of the account's state is only
+// written under the monitor's lock, which hides such misuse from the race
+// detector and turns it into accounting corruption instead; the canary is
+// written without any lock on every operation, so that concurrent
+// operations race on it.
+type accountCanary struct {
+	v int
+}
+
+func (c *accountCanary) touch() {
+	c.v++
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+const accountCanaryChildEnv = "COCKROACH_TEST_ACCOUNT_CANARY_CHILD"
+
+// TestAccountCanary checks that the race detector flags an account used by
+// two goroutines concurrently. Since a detected race fails the test that
+// triggered it, the misuse is performed in a child process running this same
+// test.
+func TestAccountCanary(t *testing.T) {
+	if !util.RaceEnabled {
+		t.Skip("the account canary is only enabled in race builds")
+	}
+
+	if os.Getenv(accountCanaryChildEnv) != "" {
+		ctx := context.Background()
+		st := cluster.MakeTestingClusterSettings()
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(1<<20))
+		acc := m.MakeBoundAccount()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_ = acc.Grow(ctx, 10)
+					acc.Clear(ctx)
+				}
+			}()
+		}
+		wg.Wait()
+		acc.Close(ctx)
+		m.EmergencyStop(ctx)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAccountCanary$")
+	cmd.Env = append(os.Environ(), accountCanaryChildEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the child process to fail, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "DATA RACE") || !strings.Contains(string(out), "accountCanary") {
+		t.Fatalf("expected a race on the account canary, got:\n%s", out)
+	}
+}
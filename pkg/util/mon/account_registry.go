@@ -0,0 +1,203 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+// WithAccountRegistry makes the monitor keep a registry of the accounts
+// opened with OpenAccountAt, so that it can address them individually, e.g.
+// with RequestShrink, and list them with OpenAccounts. The registry costs
+// one map operation and the capture of a stack trace when an account is
+// opened, and one map operation when it is closed; it is meant for
+// debugging. Growing and shrinking accounts costs nothing extra.
+func WithAccountRegistry() MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.accountRegistry = true
+	})
+}
+
+// ShrinkFunc is called by RequestShrink to ask the owner of an account to
+// release the given fraction of the bytes used by the account. It returns
+// the number of bytes actually released, which may be less (or more) than
+// asked. It is called without any monitor lock held, and it must
+// synchronize with the other users of the account.
+type ShrinkFunc func(ctx context.Context, fraction float64) (released int64)
+
+// AccountOption is an option that can be passed to OpenAccountAt.
+type AccountOption interface {
+	apply(*accountEntry)
+}
+
+type accountOptionFunc func(*accountEntry)
+
+func (f accountOptionFunc) apply(e *accountEntry) {
+	f(e)
+}
+
+// WithAccountName sets the name of the account in the registry.
+func WithAccountName(name string) AccountOption {
+	return accountOptionFunc(func(e *accountEntry) {
+		e.name = name
+	})
+}
+
+// WithShrinkFunc registers fn to be called by RequestShrink.
+func WithShrinkFunc(fn ShrinkFunc) AccountOption {
+	return accountOptionFunc(func(e *accountEntry) {
+		e.shrink = fn
+	})
+}
+
+// accountEntry is the record of an account in the account registry.
+type accountEntry struct {
+	// seq orders the entries by the time they were opened.
+	seq     uint64
+	name    string
+	created time.Time
+	stack   []byte
+	shrink  ShrinkFunc
+}
+
+// AccountInfo describes an open account, as listed by OpenAccounts.
+type AccountInfo struct {
+	// Name is the name given with WithAccountName.
+	Name string
+	// Used is the number of bytes used by the account.
+	Used int64
+	// Created is the time at which the account was opened.
+	Created time.Time
+	// Stack is the stack trace of the goroutine that opened the account.
+	Stack []byte
+}
+
+// OpenAccounts lists the accounts in the account registry of the monitor
+// (see WithAccountRegistry), in the order in which they were opened. It
+// returns nil if the monitor has no registry.
+//
+// The usage of the accounts is read without synchronizing with their
+// owners, so it is only approximate for accounts in use concurrently.
+func (mm *BytesMonitor) OpenAccounts() []AccountInfo {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.openAccountsLocked()
+}
+
+// openAccountsLocked is OpenAccounts, with mm.mu held.
+//
+// mm.mu only protects the registry, not the accounts in it: their owners
+// grow and shrink them without taking it, so the Used of an account in use
+// concurrently is a racy read, and may be stale by the time it is returned.
+// Callers must only rely on it for accounts that are not in use, e.g. in
+// tests and debug output.
+func (mm *BytesMonitor) openAccountsLocked() []AccountInfo {
+	if len(mm.mu.accounts) == 0 {
+		return nil
+	}
+	entries := make([]*accountEntry, 0, len(mm.mu.accounts))
+	accs := make(map[*accountEntry]*BoundAccount, len(mm.mu.accounts))
+	for acc, e := range mm.mu.accounts {
+		entries = append(entries, e)
+		accs[e] = acc
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	infos := make([]AccountInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = AccountInfo{
+			Name:    e.name,
+			Used:    accs[e].used,
+			Created: e.created,
+			Stack:   e.stack,
+		}
+	}
+	return infos
+}
+
+// OpenAccountAt is like OpenAccount, but opens the account in place at acc.
+// If the monitor has an account registry (see WithAccountRegistry), the
+// account is recorded in it with the given options, and acc must not be
+// moved until it is closed.
+//
+// acc must not be an account still in use, on this monitor or another one,
+// whether it was opened or made with MakeBoundAccount: opening it again would
+// leak its bytes and its slot in its monitor, so an error is returned
+// instead, and race builds panic.
+func (mm *BytesMonitor) OpenAccountAt(acc *BoundAccount, opts ...AccountOption) error {
+	if acc.opened || acc.used != 0 || acc.reserved != 0 {
+		err := errors.Errorf("%s: opening an account still open on %s with %d bytes",
+			mm.name, acc.monitorName(), acc.allocated())
+		if util.RaceEnabled {
+			panic(err)
+		}
+		return err
+	}
+	a, err := mm.OpenAccount()
+	if err != nil {
+		return err
+	}
+	*acc = a
+	if !mm.accountRegistry {
+		return nil
+	}
+	e := &accountEntry{created: mm.clock().Now(), stack: debug.Stack()}
+	for _, opt := range opts {
+		opt.apply(e)
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.mu.accounts == nil {
+		mm.mu.accounts = make(map[*BoundAccount]*accountEntry)
+	}
+	mm.mu.accountSeq++
+	e.seq = mm.mu.accountSeq
+	mm.mu.accounts[acc] = e
+	return nil
+}
+
+// RequestShrink asks the accounts in the account registry of the monitor to
+// release the given fraction, between 0 and 1, of the bytes they use, e.g.
+// to relieve memory pressure without killing any one of them. Accounts
+// without a ShrinkFunc are skipped. It returns the total number of bytes
+// released.
+func (mm *BytesMonitor) RequestShrink(ctx context.Context, fraction float64) int64 {
+	if fraction <= 0 {
+		return 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	mm.mu.Lock()
+	var fns []ShrinkFunc
+	for _, e := range mm.mu.accounts {
+		if e.shrink != nil {
+			fns = append(fns, e.shrink)
+		}
+	}
+	mm.mu.Unlock()
+
+	var released int64
+	for _, fn := range fns {
+		released += fn(ctx, fraction)
+	}
+	return released
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestRequestShrink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+		WithAccountRegistry(), WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, nil, MakeStandaloneBudget(10000))
+
+	// shrinkBy returns a ShrinkFunc releasing the given share of what is
+	// asked from acc.
+	shrinkBy := func(acc *BoundAccount, share float64, calls *int) ShrinkFunc {
+		return func(ctx context.Context, fraction float64) int64 {
+			*calls++
+			n := int64(float64(acc.Used()) * fraction * share)
+			acc.Shrink(ctx, n)
+			return n
+		}
+	}
+
+	var compliant, half, stubborn, closed, noCallback BoundAccount
+	var compliantCalls, halfCalls, stubbornCalls, closedCalls int
+	for _, tc := range []struct {
+		acc   *BoundAccount
+		opts  []AccountOption
+		bytes int64
+	}{
+		{&compliant, []AccountOption{WithShrinkFunc(shrinkBy(&compliant, 1, &compliantCalls))}, 1000},
+		{&half, []AccountOption{WithShrinkFunc(shrinkBy(&half, 0.5, &halfCalls))}, 2000},
+		{&stubborn, []AccountOption{WithShrinkFunc(shrinkBy(&stubborn, 0, &stubbornCalls))}, 500},
+		{&closed, []AccountOption{WithShrinkFunc(shrinkBy(&closed, 1, &closedCalls))}, 100},
+		{&noCallback, nil, 700},
+	} {
+		if err := m.OpenAccountAt(tc.acc, tc.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.acc.Grow(ctx, tc.bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closed.Close(ctx)
+
+	// 20% of 1000 bytes, and half of 20% of 2000 bytes.
+	if released := m.RequestShrink(ctx, 0.2); released != 400 {
+		t.Fatalf("expected 400 bytes released, got %d", released)
+	}
+	if compliantCalls != 1 || halfCalls != 1 || stubbornCalls != 1 || closedCalls != 0 {
+		t.Fatalf("unexpected calls: %d, %d, %d, %d", compliantCalls, halfCalls, stubbornCalls, closedCalls)
+	}
+	for _, tc := range []struct {
+		acc      *BoundAccount
+		expected int64
+	}{
+		{&compliant, 800},
+		{&half, 1800},
+		{&stubborn, 500},
+		{&noCallback, 700},
+	} {
+		if used := tc.acc.Used(); used != tc.expected {
+			t.Errorf("expected %d bytes used, got %d", tc.expected, used)
+		}
+	}
+	if used := m.AllocBytes(); used != 3800 {
+		t.Fatalf("expected 3800 bytes allocated, got\n%s", m.DebugString())
+	}
+
+	if released := m.RequestShrink(ctx, 0); released != 0 {
+		t.Fatalf("expected nothing released, got %d", released)
+	}
+
+	compliant.Close(ctx)
+	half.Close(ctx)
+	stubborn.Close(ctx)
+	noCallback.Close(ctx)
+	if n := len(m.mu.accounts); n != 0 {
+		t.Fatalf("expected the registry to be empty, got %d entries", n)
+	}
+	m.Stop(ctx)
+}
+
+func TestOpenAccounts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// Without a registry, no accounts are listed.
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(10000))
+	var acc BoundAccount
+	if err := m.OpenAccountAt(&acc, WithAccountName("unlisted")); err != nil {
+		t.Fatal(err)
+	}
+	if infos := m.OpenAccounts(); infos != nil {
+		t.Fatalf("expected no accounts listed, got %+v", infos)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+
+	m = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st, WithAccountRegistry())
+	m.Start(ctx, nil, MakeStandaloneBudget(10000))
+	accs := make([]BoundAccount, 3)
+	names := []string{"hash-table", "sorter", "buffer"}
+	for i := range accs {
+		if err := m.OpenAccountAt(&accs[i], WithAccountName(names[i])); err != nil {
+			t.Fatal(err)
+		}
+		if err := accs[i].Grow(ctx, int64(100*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Accounts made by value are not listed.
+	unlisted := m.MakeBoundAccount()
+	if err := unlisted.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(expected ...int) {
+		t.Helper()
+		infos := m.OpenAccounts()
+		if len(infos) != len(expected) {
+			t.Fatalf("expected %d accounts listed, got %+v", len(expected), infos)
+		}
+		for i, j := range expected {
+			if infos[i].Name != names[j] || infos[i].Used != accs[j].Used() {
+				t.Errorf("expected %s with %d bytes, got %s with %d bytes",
+					names[j], accs[j].Used(), infos[i].Name, infos[i].Used)
+			}
+			if infos[i].Created.IsZero() {
+				t.Errorf("expected a creation time for %s", infos[i].Name)
+			}
+			if !strings.Contains(string(infos[i].Stack), "TestOpenAccounts") {
+				t.Errorf("expected the stack of %s to include the test, got:\n%s",
+					infos[i].Name, infos[i].Stack)
+			}
+		}
+	}
+	check(0, 1, 2)
+	accs[1].Shrink(ctx, 150)
+	check(0, 1, 2)
+	accs[1].Close(ctx)
+	check(0, 2)
+	accs[0].Close(ctx)
+	accs[2].Close(ctx)
+	check()
+
+	unlisted.Close(ctx)
+	m.Stop(ctx)
+}
+
+// TestOpenAccountOfOtherMonitor checks that an account still open on a
+// monitor can't be opened again on another one, or on the same one, which
+// would leak its bytes.
+func TestOpenAccountOfOtherMonitor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	a := MakeMonitor("a", MemoryResource, nil, nil, 1, 1000, st)
+	a.Start(ctx, nil, MakeStandaloneBudget(10000))
+	b := MakeMonitor("b", MemoryResource, nil, nil, 1, 1000, st)
+	b.Start(ctx, nil, MakeStandaloneBudget(10000))
+
+	var acc BoundAccount
+	if err := a.OpenAccountAt(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	openOnB := func() (err error) {
+		if util.RaceEnabled {
+			defer func() {
+				if r := recover(); r != nil {
+					err = r.(error)
+				}
+			}()
+		}
+		return b.OpenAccountAt(&acc)
+	}
+	if err := openOnB(); err == nil ||
+		!strings.Contains(err.Error(), "b: opening an account still open on a with 100 bytes") {
+		t.Fatalf("expected the misuse to be caught, got %v", err)
+	}
+	if acc.Monitor() != &a || a.AllocBytes() != 100 || b.NumOpenAccounts() != 0 {
+		t.Fatalf("expected the account to be left alone")
+	}
+
+	// Nor can it be opened again on its own monitor.
+	openOnA := func(acc *BoundAccount) (err error) {
+		if util.RaceEnabled {
+			defer func() {
+				if r := recover(); r != nil {
+					err = r.(error)
+				}
+			}()
+		}
+		return a.OpenAccountAt(acc)
+	}
+	if err := openOnA(&acc); err == nil ||
+		!strings.Contains(err.Error(), "a: opening an account still open on a with 100 bytes") {
+		t.Fatalf("expected the misuse to be caught, got %v", err)
+	}
+	if a.AllocBytes() != 100 || a.NumOpenAccounts() != 1 {
+		t.Fatalf("expected the account to be left alone")
+	}
+	// The same goes for an account in use that wasn't opened.
+	made := a.MakeBoundAccount()
+	if err := made.Grow(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := openOnA(&made); err == nil ||
+		!strings.Contains(err.Error(), "a: opening an account still open on a with 50 bytes") {
+		t.Fatalf("expected the misuse to be caught, got %v", err)
+	}
+	if made.Used() != 50 || a.AllocBytes() != 150 {
+		t.Fatalf("expected the account to be left alone")
+	}
+	made.Close(ctx)
+	// A standalone budget has no monitor to name.
+	budget := MakeStandaloneBudget(10)
+	if err := openOnA(&budget); err == nil ||
+		!strings.Contains(err.Error(), "a: opening an account still open on standalone budget with 10 bytes") {
+		t.Fatalf("expected the misuse to be caught, got %v", err)
+	}
+
+	// Once closed, the account can be reused with another monitor.
+	acc.Close(ctx)
+	if err := b.OpenAccountAt(&acc); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+	a.Stop(ctx)
+	b.Stop(ctx)
+}
@@ -0,0 +1,403 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// AccountedConn wraps a net.Conn so that the bytes passed to Write are
+// charged to an account until the underlying Write returns, i.e. for as long
+// as the connection holds on to them. When several goroutines write to a
+// slow peer concurrently, the in-flight bytes accumulate on the account and
+// the account's budget provides backpressure: once it denies a write, the
+// write either fails with the budget error or, if blocking was requested via
+// SetHighWater, waits for in-flight writes to complete. A waiting write
+// fails once the connection is closed or its context is done.
+//
+// A connection made with NewBufferedAccountedConn instead copies the bytes
+// passed to Write into buffers that are written to the underlying connection
+// in the background, and charges each buffer as a whole until it is written.
+type AccountedConn struct {
+	net.Conn
+
+	ctx context.Context
+	// bufSize is the size of the buffers of a buffered connection, and 0 for
+	// an unbuffered one.
+	bufSize int64
+	// flusherDone is closed when the goroutine writing the buffers of a
+	// buffered connection exits.
+	flusherDone chan struct{}
+
+	// writeMu serializes the writes of a buffered connection, so that the
+	// bytes of a write are contiguous and only one writer installs a new
+	// buffer at a time.
+	writeMu syncutil.Mutex
+
+	// accMu serializes the uses of the account. It is separate from mu so
+	// that mu isn't held across Grow, which can block on the pool.
+	accMu struct {
+		syncutil.Mutex
+		acc *BoundAccount
+	}
+
+	mu struct {
+		syncutil.Mutex
+		// drained is signaled every time an in-flight write completes, and
+		// when the connection is closed or its context is done.
+		drained sync.Cond
+		// completed counts the in-flight writes completed so far, so that a
+		// write denied by the account can tell whether one completed while
+		// it was being charged.
+		completed int64
+		// closed is set by Close.
+		closed bool
+
+		// inFlight is the number of bytes currently charged, or being
+		// charged, on behalf of writes that haven't returned yet, or of the
+		// buffers of a buffered connection.
+		inFlight int64
+		// highWater, if positive, caps inFlight independently of the
+		// account's budget.
+		highWater int64
+		// block indicates whether writes wait instead of failing when they
+		// can't be charged.
+		block bool
+
+		// The following fields are only used by buffered connections.
+		//
+		// queued is signaled when a buffer is queued, and when the
+		// connection is closed.
+		queued sync.Cond
+		// cur is the buffer being filled by Write.
+		cur []byte
+		// queue holds the buffers waiting to be written.
+		queue [][]byte
+		// flushing is set while a buffer is written.
+		flushing bool
+		// err is the first error returned by the underlying connection. It
+		// is returned by all the subsequent writes and flushes.
+		err error
+	}
+}
+
+// NewAccountedConn wraps conn, charging in-flight writes to acc. The account
+// must not be used by anything else concurrently.
+func NewAccountedConn(ctx context.Context, conn net.Conn, acc *BoundAccount) *AccountedConn {
+	c := &AccountedConn{Conn: conn, ctx: ctx}
+	c.mu.drained.L = &c.mu.Mutex
+	c.mu.queued.L = &c.mu.Mutex
+	c.accMu.acc = acc
+	return c
+}
+
+// NewBufferedAccountedConn is like NewAccountedConn, but Write returns once
+// the bytes are copied into buffers of bufSize bytes, which are written to
+// conn in the background. Each buffer is charged for its whole size from
+// the first byte copied into it until it is written. A partially filled
+// buffer is only written by Flush or once it is full. Errors of the
+// underlying connection are returned by the writes and flushes that follow
+// them. Close releases the buffers that weren't written. Concurrent writes
+// are serialized, so that the bytes of every write are contiguous.
+func NewBufferedAccountedConn(
+	ctx context.Context, conn net.Conn, acc *BoundAccount, bufSize int64,
+) *AccountedConn {
+	c := NewAccountedConn(ctx, conn, acc)
+	c.bufSize = bufSize
+	c.flusherDone = make(chan struct{})
+	go c.flusher()
+	return c
+}
+
+// SetHighWater configures the backpressure behavior of the connection.
+// highWater, if positive, is the maximum number of bytes that may be in
+// flight at once regardless of the account's budget. If block is true, a
+// write that would exceed the high water mark or is denied by the account
+// waits for in-flight writes to complete and retries; a write that cannot be
+// charged while nothing else is in flight fails regardless. If block is false,
+// such writes fail immediately.
+func (c *AccountedConn) SetHighWater(highWater int64, block bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.highWater = highWater
+	c.mu.block = block
+	c.mu.drained.Broadcast()
+}
+
+// InFlight returns the number of bytes currently charged on behalf of
+// in-flight writes.
+func (c *AccountedConn) InFlight() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.inFlight
+}
+
+// Close implements the net.Conn interface. The writes waiting to be charged
+// fail. The buffers of a buffered connection that weren't written are
+// dropped.
+func (c *AccountedConn) Close() error {
+	c.mu.Lock()
+	c.mu.closed = true
+	c.mu.drained.Broadcast()
+	c.mu.queued.Broadcast()
+	c.mu.Unlock()
+	err := c.Conn.Close()
+	if c.flusherDone != nil {
+		<-c.flusherDone
+		c.mu.Lock()
+		var dropped int64
+		for _, buf := range c.mu.queue {
+			dropped += int64(cap(buf))
+		}
+		dropped += int64(cap(c.mu.cur))
+		c.mu.queue, c.mu.cur = nil, nil
+		c.mu.Unlock()
+		if dropped > 0 {
+			c.release(dropped)
+		}
+	}
+	return err
+}
+
+// Write implements the net.Conn interface.
+func (c *AccountedConn) Write(p []byte) (int, error) {
+	if c.bufSize > 0 {
+		return c.writeBuffered(p)
+	}
+	sz := int64(len(p))
+	if err := c.reserve(sz); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(p)
+	c.release(sz)
+	return n, err
+}
+
+// writeBuffered is Write for a buffered connection.
+func (c *AccountedConn) writeBuffered(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var n int
+	for len(p) > 0 {
+		c.mu.Lock()
+		if err := c.bufferedErrLocked(); err != nil {
+			c.mu.Unlock()
+			return n, err
+		}
+		if c.mu.cur != nil {
+			k := copy(c.mu.cur[len(c.mu.cur):cap(c.mu.cur)], p)
+			c.mu.cur = c.mu.cur[:len(c.mu.cur)+k]
+			n += k
+			p = p[k:]
+			if len(c.mu.cur) == cap(c.mu.cur) {
+				c.queueLocked()
+			}
+			c.mu.Unlock()
+			continue
+		}
+		c.mu.Unlock()
+		// The new buffer is charged before it is allocated.
+		if err := c.reserve(c.bufSize); err != nil {
+			return n, err
+		}
+		c.mu.Lock()
+		if c.mu.closed {
+			// Close didn't see the buffer.
+			c.mu.Unlock()
+			c.release(c.bufSize)
+			return n, errors.New("write on closed connection")
+		}
+		c.mu.cur = make([]byte, 0, c.bufSize)
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+// Flush writes the partially filled buffer of a buffered connection, if
+// any, and waits until all the buffers are written. It returns the first
+// error of the underlying connection, if any. It is a no-op on an
+// unbuffered connection.
+func (c *AccountedConn) Flush() error {
+	if c.bufSize <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.mu.cur) > 0 {
+		c.queueLocked()
+	}
+	var wakeup chan struct{}
+	defer func() {
+		if wakeup != nil {
+			close(wakeup)
+		}
+	}()
+	for {
+		if err := c.bufferedErrLocked(); err != nil {
+			return err
+		}
+		if len(c.mu.queue) == 0 && !c.mu.flushing {
+			return nil
+		}
+		if wakeup == nil && c.ctx.Done() != nil {
+			wakeup = make(chan struct{})
+			go c.wakeOnDone(wakeup)
+		}
+		c.mu.drained.Wait()
+	}
+}
+
+// bufferedErrLocked returns the error to return from the writes and flushes
+// of a buffered connection, if any.
+func (c *AccountedConn) bufferedErrLocked() error {
+	if c.mu.err != nil {
+		return c.mu.err
+	}
+	if c.mu.closed {
+		return errors.New("write on closed connection")
+	}
+	return c.ctx.Err()
+}
+
+// queueLocked hands the current buffer over to the flusher.
+func (c *AccountedConn) queueLocked() {
+	c.mu.queue = append(c.mu.queue, c.mu.cur)
+	c.mu.cur = nil
+	c.mu.queued.Signal()
+}
+
+// flusher writes the buffers of a buffered connection until it is closed.
+func (c *AccountedConn) flusher() {
+	defer close(c.flusherDone)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.mu.queue) == 0 && !c.mu.closed {
+			c.mu.queued.Wait()
+		}
+		if c.mu.closed {
+			return
+		}
+		buf := c.mu.queue[0]
+		c.mu.queue = c.mu.queue[1:]
+		c.mu.flushing = true
+		// The buffers queued after an error are dropped.
+		failed := c.mu.err != nil
+		c.mu.Unlock()
+
+		var err error
+		if !failed {
+			_, err = c.Conn.Write(buf)
+		}
+		c.release(int64(cap(buf)))
+
+		c.mu.Lock()
+		c.mu.flushing = false
+		if err != nil && c.mu.err == nil {
+			c.mu.err = err
+		}
+		c.mu.drained.Broadcast()
+	}
+}
+
+// reserve charges sz bytes to the account, once the backpressure configured
+// with SetHighWater lets it.
+func (c *AccountedConn) reserve(sz int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// wakeup, if set, stops the goroutine waking up the write when the
+	// context is done.
+	var wakeup chan struct{}
+	defer func() {
+		if wakeup != nil {
+			close(wakeup)
+		}
+	}()
+	for {
+		if c.mu.closed {
+			return errors.New("write on closed connection")
+		}
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		completed := c.mu.completed
+		if hw := c.mu.highWater; hw > 0 && c.mu.inFlight+sz > hw && c.mu.inFlight > 0 {
+			err = errors.Errorf("in-flight writes would exceed high water mark: %d bytes requested, %d in flight, %d allowed",
+				sz, c.mu.inFlight, hw)
+		} else {
+			// The bytes count as in flight while they are charged, so that
+			// the concurrent writes respect the high water mark.
+			c.mu.inFlight += sz
+			c.mu.Unlock()
+			err = c.grow(sz)
+			c.mu.Lock()
+			if err == nil {
+				return nil
+			}
+			c.mu.inFlight -= sz
+		}
+		if !c.mu.block || c.mu.inFlight == 0 {
+			return err
+		}
+		if c.mu.completed != completed {
+			// Some bytes were released while the account was consulted.
+			continue
+		}
+		if wakeup == nil && c.ctx.Done() != nil {
+			wakeup = make(chan struct{})
+			go c.wakeOnDone(wakeup)
+		}
+		c.mu.drained.Wait()
+	}
+}
+
+func (c *AccountedConn) grow(sz int64) error {
+	c.accMu.Lock()
+	defer c.accMu.Unlock()
+	return c.accMu.acc.Grow(c.ctx, sz)
+}
+
+// release releases sz bytes charged by reserve, and wakes up the waiting
+// writes.
+func (c *AccountedConn) release(sz int64) {
+	c.accMu.Lock()
+	c.accMu.acc.Shrink(c.ctx, sz)
+	c.accMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.inFlight -= sz
+	c.mu.completed++
+	c.mu.drained.Broadcast()
+}
+
+// wakeOnDone wakes up the waiting writes when the context of the connection
+// is done, unless stop is closed first.
+func (c *AccountedConn) wakeOnDone(stop <-chan struct{}) {
+	select {
+	case <-c.ctx.Done():
+		c.mu.Lock()
+		c.mu.drained.Broadcast()
+		c.mu.Unlock()
+	case <-stop:
+	}
+}
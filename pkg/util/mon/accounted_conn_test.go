@@ -0,0 +1,366 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestAccountedConn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+
+	client, server := net.Pipe()
+	c := NewAccountedConn(ctx, client, &acc)
+
+	waitInFlight := func(expected int64) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); c.InFlight() != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d bytes in flight, got %d", expected, c.InFlight())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Nobody reads from the pipe yet, so the first write stays in flight.
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := c.Write(make([]byte, 60))
+		errCh <- err
+	}()
+	waitInFlight(60)
+	if acc.Used() != 60 {
+		t.Fatalf("expected in-flight bytes to be charged, got %d", acc.Used())
+	}
+
+	// A second write doesn't fit in the budget and fails.
+	_, err := c.Write(make([]byte, 60))
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+
+	// The high water mark applies even when the budget has room.
+	c.SetHighWater(70, false /* block */)
+	if _, err := c.Write(make([]byte, 20)); err == nil || !strings.Contains(err.Error(), "high water mark") {
+		t.Fatalf("expected high water mark error, got %v", err)
+	}
+
+	// In blocking mode, the second write waits for the first to drain.
+	c.SetHighWater(0, true /* block */)
+	go func() {
+		_, err := c.Write(make([]byte, 60))
+		errCh <- err
+	}()
+
+	// Slowly drain the pipe.
+	readDone := make(chan int64)
+	go func() {
+		var total int64
+		buf := make([]byte, 10)
+		for {
+			n, err := server.Read(buf)
+			total += int64(n)
+			if err != nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		readDone <- total
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitInFlight(0)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if total := <-readDone; total != 120 {
+		t.Fatalf("expected 120 bytes read, got %d", total)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected account to be empty, got %d", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestAccountedConnUnblock(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	st := cluster.MakeTestingClusterSettings()
+	for _, cancelCtx := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cancel=%t", cancelCtx), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+			m.Start(ctx, nil, MakeStandaloneBudget(100))
+			acc := m.MakeBoundAccount()
+			client, server := net.Pipe()
+			defer server.Close()
+			c := NewAccountedConn(ctx, client, &acc)
+			c.SetHighWater(0, true /* block */)
+
+			// Nobody reads from the pipe, so the first write stays in flight
+			// and the second one waits for it.
+			errCh := make(chan error, 2)
+			go func() {
+				_, err := c.Write(make([]byte, 60))
+				errCh <- err
+			}()
+			for deadline := time.Now().Add(10 * time.Second); c.InFlight() != 60; {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the first write to be in flight, got %d bytes", c.InFlight())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			go func() {
+				_, err := c.Write(make([]byte, 60))
+				errCh <- err
+			}()
+			select {
+			case err := <-errCh:
+				t.Fatalf("expected the second write to wait, got %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			// The waiting write fails when the context is done, or when the
+			// connection is closed, which also fails the first one.
+			if cancelCtx {
+				cancel()
+				if err := <-errCh; err != context.Canceled {
+					t.Fatalf("expected the waiting write to be canceled, got %v", err)
+				}
+				if err := c.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errCh; err == nil {
+					t.Fatal("expected the first write to fail")
+				}
+			} else {
+				if err := c.Close(); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 2; i++ {
+					if err := <-errCh; err == nil {
+						t.Fatal("expected the writes to fail")
+					}
+				}
+			}
+			if _, err := c.Write(make([]byte, 10)); err == nil {
+				t.Fatal("expected writes on a closed connection to fail")
+			}
+			if u := acc.Used(); u != 0 {
+				t.Fatalf("expected the account to be empty, got %d", u)
+			}
+			acc.Close(ctx)
+			m.Stop(ctx)
+		})
+	}
+}
+
+func TestBufferedAccountedConn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+
+	client, server := net.Pipe()
+	c := NewBufferedAccountedConn(ctx, client, &acc, 40 /* bufSize */)
+
+	// Nobody reads from the pipe yet, but the writes return once buffered.
+	// Each buffer is charged as a whole.
+	if n, err := c.Write(make([]byte, 30)); err != nil || n != 30 {
+		t.Fatalf("expected the write to be buffered, got %d, %v", n, err)
+	}
+	if c.InFlight() != 40 || acc.Used() != 40 {
+		t.Fatalf("expected a buffer to be charged, got %d in flight and %d charged",
+			c.InFlight(), acc.Used())
+	}
+	if n, err := c.Write(make([]byte, 30)); err != nil || n != 30 {
+		t.Fatalf("expected the write to be buffered, got %d, %v", n, err)
+	}
+	if c.InFlight() != 80 {
+		t.Fatalf("expected two buffers to be charged, got %d", c.InFlight())
+	}
+
+	// A third buffer doesn't fit in the budget: the write stops at the end
+	// of the second one.
+	n, err := c.Write(make([]byte, 50))
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if n != 20 {
+		t.Fatalf("expected 20 bytes to be buffered, got %d", n)
+	}
+
+	// In blocking mode, the write waits for the buffers to be written.
+	c.SetHighWater(0, true /* block */)
+	readDone := make(chan int64)
+	go func() {
+		var total int64
+		buf := make([]byte, 10)
+		for {
+			n, err := server.Read(buf)
+			total += int64(n)
+			if err != nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		readDone <- total
+	}()
+	if n, err := c.Write(make([]byte, 50)); err != nil || n != 50 {
+		t.Fatalf("expected the write to be buffered, got %d, %v", n, err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if c.InFlight() != 0 || acc.Used() != 0 {
+		t.Fatalf("expected the flushed buffers to be released, got %d in flight and %d charged",
+			c.InFlight(), acc.Used())
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if total := <-readDone; total != 130 {
+		t.Fatalf("expected 130 bytes read, got %d", total)
+	}
+
+	// The errors of the connection are returned by the writes that follow,
+	// and Close releases the buffers that weren't written.
+	client, server = net.Pipe()
+	c = NewBufferedAccountedConn(ctx, client, &acc, 40 /* bufSize */)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	if _, err := c.Write(make([]byte, 10)); err == nil {
+		t.Fatal("expected writes to fail after an error")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected account to be empty, got %d", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestBufferedAccountedConnConcurrentWriters(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(200))
+	acc := m.MakeBoundAccount()
+
+	client, server := net.Pipe()
+	c := NewBufferedAccountedConn(ctx, client, &acc, 40 /* bufSize */)
+	c.SetHighWater(0, true /* block */)
+
+	readDone := make(chan []byte)
+	go func() {
+		var out []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			out = append(out, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		readDone <- out
+	}()
+
+	// Every writer writes its own byte, in writes that straddle buffers.
+	const writers = 8
+	const writes = 50
+	const writeSize = 25
+	errCh := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(b byte) {
+			p := bytes.Repeat([]byte{b}, writeSize)
+			for i := 0; i < writes; i++ {
+				if n, err := c.Write(p); err != nil || n != len(p) {
+					errCh <- fmt.Errorf("wrote %d bytes: %v", n, err)
+					return
+				}
+			}
+			errCh <- nil
+		}(byte('a' + w))
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := <-readDone
+	if len(out) != writers*writes*writeSize {
+		t.Fatalf("expected %d bytes read, got %d", writers*writes*writeSize, len(out))
+	}
+	// The bytes of every write are contiguous.
+	for i := 0; i < len(out); i += writeSize {
+		if w := out[i : i+writeSize]; !bytes.Equal(w, bytes.Repeat(w[:1], writeSize)) {
+			t.Fatalf("expected the bytes of the writes to be contiguous, got %q at %d", w, i)
+		}
+	}
+	if u := acc.Used(); u != 0 {
+		t.Fatalf("expected account to be empty, got %d", u)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Distributed flows run on many nodes, each with its own monitors, while
+// only the gateway knows about the query as a whole. To give the gateway a
+// view of the total footprint of a query, every remote monitor involved
+// produces UsageReports through a UsageReporter, periodically or when its
+// usage changes significantly. The transport layer sends them to the
+// gateway, which feeds them to the AggregateMonitor of the query. The
+// aggregate sums the latest report of every monitor and cancels the query
+// through the registered callbacks when the total exceeds its limit.
+
+// UsageReport is a compact report of the usage of a monitor, meant to be
+// sent across the network.
+type UsageReport struct {
+	// MonitorID identifies the reporting monitor among the ones reporting to
+	// the same aggregate, e.g. by node and processor.
+	MonitorID string
+	// Seq orders the reports of a monitor: reports older than the last one
+	// received are ignored.
+	Seq uint64
+	// Used is the number of bytes allocated through the monitor.
+	Used int64
+	// Max is the maximum number of bytes allocated through the monitor at
+	// one time since it was started.
+	Max int64
+}
+
+// UsageReporter produces the UsageReports of a monitor.
+type UsageReporter struct {
+	mon       *BytesMonitor
+	id        string
+	threshold int64
+
+	mu struct {
+		syncutil.Mutex
+		seq          uint64
+		lastReported int64
+	}
+}
+
+// NewUsageReporter creates a UsageReporter for the monitor m, identified by
+// id in the reports. MaybeReport produces a report when the usage changed by
+// at least threshold bytes since the last report.
+func NewUsageReporter(m *BytesMonitor, id string, threshold int64) *UsageReporter {
+	return &UsageReporter{mon: m, id: id, threshold: threshold}
+}
+
+// Report produces a report of the current usage of the monitor.
+func (r *UsageReporter) Report() UsageReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reportLocked(r.mon.AllocBytes())
+}
+
+// MaybeReport produces a report if the usage of the monitor changed by at
+// least the threshold since the last report.
+func (r *UsageReporter) MaybeReport() (UsageReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	used := r.mon.AllocBytes()
+	delta := used - r.mu.lastReported
+	if delta < r.threshold && -delta < r.threshold {
+		return UsageReport{}, false
+	}
+	return r.reportLocked(used), true
+}
+
+func (r *UsageReporter) reportLocked(used int64) UsageReport {
+	r.mu.seq++
+	r.mu.lastReported = used
+	return UsageReport{
+		MonitorID: r.id,
+		Seq:       r.mu.seq,
+		Used:      used,
+		Max:       r.mon.MaximumBytes(),
+	}
+}
+
+// AggregateMonitor sums the usage reported by the monitors of a distributed
+// query and enforces a limit on the total.
+type AggregateMonitor struct {
+	name     string
+	resource Resource
+	limit    int64
+
+	mu struct {
+		syncutil.Mutex
+		reports map[string]UsageReport
+		total   int64
+		// maxTotal is the high-water mark of total.
+		maxTotal int64
+		// tripped is set once the total exceeded the limit. It is sticky,
+		// as the query is cancelled at that point.
+		tripped bool
+		cancels []func(error)
+	}
+}
+
+// NewAggregateMonitor creates an AggregateMonitor enforcing the given limit
+// on the total usage reported to it. A limit of 0 or less means no limit.
+func NewAggregateMonitor(name string, res Resource, limit int64) *AggregateMonitor {
+	a := &AggregateMonitor{name: name, resource: res, limit: limit}
+	a.mu.reports = make(map[string]UsageReport)
+	return a
+}
+
+// RegisterCancel registers a callback called, with the budget error, when
+// the total usage exceeds the limit. If the limit was already exceeded, fn
+// is called right away.
+func (a *AggregateMonitor) RegisterCancel(fn func(error)) {
+	a.mu.Lock()
+	tripped := a.mu.tripped
+	a.mu.cancels = append(a.mu.cancels, fn)
+	total := a.mu.total
+	a.mu.Unlock()
+	if tripped {
+		fn(a.limitError(0, total))
+	}
+}
+
+// ReportRemoteUsage records a report from a monitor, replacing the previous
+// report of the same monitor. Reports older than the last one received from
+// the same monitor are ignored.
+func (a *AggregateMonitor) ReportRemoteUsage(ctx context.Context, r UsageReport) {
+	a.mu.Lock()
+	prev, ok := a.mu.reports[r.MonitorID]
+	if ok && r.Seq <= prev.Seq {
+		a.mu.Unlock()
+		return
+	}
+	a.mu.reports[r.MonitorID] = r
+	delta := r.Used - prev.Used
+	a.mu.total += delta
+	if a.mu.total > a.mu.maxTotal {
+		a.mu.maxTotal = a.mu.total
+	}
+	var cancels []func(error)
+	if a.limit > 0 && a.mu.total > a.limit && !a.mu.tripped {
+		a.mu.tripped = true
+		cancels = a.mu.cancels
+	}
+	total := a.mu.total
+	a.mu.Unlock()
+
+	if cancels != nil {
+		err := a.limitError(delta, total)
+		DefaultLogger.Warningf(ctx, "%v, reported by %s", err, r.MonitorID)
+		for _, fn := range cancels {
+			fn(err)
+		}
+	}
+}
+
+func (a *AggregateMonitor) limitError(requested, total int64) error {
+	return errors.Wrapf(a.resource.NewBudgetExceededError(requested, total, a.limit),
+		"%s: aggregate limit exceeded", a.name)
+}
+
+// Total returns the sum of the usage last reported by every monitor.
+func (a *AggregateMonitor) Total() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.mu.total
+}
+
+// MaxTotal returns the maximum of Total over time.
+func (a *AggregateMonitor) MaxTotal() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.mu.maxTotal
+}
+
+// Reports returns the last report of every monitor, ordered by monitor ID.
+func (a *AggregateMonitor) Reports() []UsageReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	reports := make([]UsageReport, 0, len(a.mu.reports))
+	for _, r := range a.mu.reports {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].MonitorID < reports[j].MonitorID
+	})
+	return reports
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestAggregateMonitor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// Three nodes run a flow of the query, each with its own monitor.
+	const numNodes = 3
+	var nodes [numNodes]struct {
+		mon      BytesMonitor
+		acc      BoundAccount
+		reporter *UsageReporter
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		n.mon = MakeMonitor(fmt.Sprintf("flow%d", i), MemoryResource, nil, nil, 1, 1000, st,
+			WithReservationPolicy(ReleaseEagerly))
+		n.mon.Start(ctx, nil, MakeStandaloneBudget(1000))
+		n.acc = n.mon.MakeBoundAccount()
+		n.reporter = NewUsageReporter(&n.mon, fmt.Sprintf("n%d", i+1), 100 /* threshold */)
+	}
+
+	agg := NewAggregateMonitor("query", MemoryResource, 1000)
+	var cancelled []error
+	agg.RegisterCancel(func(err error) { cancelled = append(cancelled, err) })
+
+	// grow grows the account of node i and sends a report to the gateway if
+	// the usage changed enough.
+	grow := func(i int, n int64) {
+		if err := nodes[i].acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := nodes[i].reporter.MaybeReport(); ok {
+			agg.ReportRemoteUsage(ctx, r)
+		}
+	}
+
+	grow(0, 300)
+	grow(1, 300)
+	grow(2, 50)
+	if total := agg.Total(); total != 600 {
+		t.Fatalf("expected a total of 600, got %d", total)
+	}
+	// The small change is reported periodically.
+	agg.ReportRemoteUsage(ctx, nodes[2].reporter.Report())
+	if total := agg.Total(); total != 650 {
+		t.Fatalf("expected a total of 650, got %d", total)
+	}
+
+	// Stale reports are ignored.
+	stale := nodes[0].reporter.Report()
+	grow(0, 200)
+	agg.ReportRemoteUsage(ctx, stale)
+	if total := agg.Total(); total != 850 {
+		t.Fatalf("expected a total of 850, got %d", total)
+	}
+	if len(cancelled) != 0 {
+		t.Fatalf("unexpected cancellation: %v", cancelled)
+	}
+
+	// Crossing the limit cancels the query, once.
+	grow(1, 200)
+	grow(2, 500)
+	if len(cancelled) != 1 || !isOutOfMemory(cancelled[0]) {
+		t.Fatalf("expected the query to be cancelled with a budget error, got %v", cancelled)
+	}
+	// Late registrations are notified right away.
+	var lateErr error
+	agg.RegisterCancel(func(err error) { lateErr = err })
+	if !isOutOfMemory(lateErr) {
+		t.Fatalf("expected a budget error, got %v", lateErr)
+	}
+
+	if total, max := agg.Total(), agg.MaxTotal(); total != 1550 || max != 1550 {
+		t.Fatalf("expected a total and maximum of 1550, got %d and %d", total, max)
+	}
+	reports := agg.Reports()
+	if len(reports) != numNodes || reports[0].MonitorID != "n1" || reports[0].Max != 500 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	for i := range nodes {
+		nodes[i].acc.Close(ctx)
+		nodes[i].mon.Stop(ctx)
+	}
+}
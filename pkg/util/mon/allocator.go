@@ -0,0 +1,48 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// Allocator is the minimal interface of an account, for library code that
+// accounts for its allocations without depending on the monitors. The
+// accounts, bound to a monitor or standalone, implement it through a
+// pointer, as their state changes; NoopAllocator implements it for
+// unmonitored callers.
+type Allocator interface {
+	// Grow requests n more bytes, and returns an error if they are denied.
+	Grow(ctx context.Context, n int64) error
+	// Shrink releases n bytes previously granted by Grow.
+	Shrink(ctx context.Context, n int64)
+	// Clear releases all the bytes granted by Grow.
+	Clear(ctx context.Context)
+}
+
+var _ Allocator = (*BoundAccount)(nil)
+var _ Allocator = NoopAllocator{}
+var _ Allocator = (*NoopAllocator)(nil)
+
+// NoopAllocator is an Allocator that grants every request and tracks
+// nothing.
+type NoopAllocator struct{}
+
+// Grow implements the Allocator interface.
+func (NoopAllocator) Grow(context.Context, int64) error { return nil }
+
+// Shrink implements the Allocator interface.
+func (NoopAllocator) Shrink(context.Context, int64) {}
+
+// Clear implements the Allocator interface.
+func (NoopAllocator) Clear(context.Context) {}
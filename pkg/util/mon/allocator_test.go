@@ -0,0 +1,141 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// byteStack is a stack of byte strings accounting for its memory through
+// an Allocator, as library code that doesn't know about monitors would.
+type byteStack struct {
+	alloc mon.Allocator
+	elems [][]byte
+}
+
+func (s *byteStack) push(ctx context.Context, b []byte) error {
+	if err := s.alloc.Grow(ctx, int64(len(b))); err != nil {
+		return err
+	}
+	s.elems = append(s.elems, b)
+	return nil
+}
+
+func (s *byteStack) pop(ctx context.Context) []byte {
+	b := s.elems[len(s.elems)-1]
+	s.elems = s.elems[:len(s.elems)-1]
+	s.alloc.Shrink(ctx, int64(len(b)))
+	return b
+}
+
+func (s *byteStack) reset(ctx context.Context) {
+	s.elems = nil
+	s.alloc.Clear(ctx)
+}
+
+func TestAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	defer m.Stop(ctx)
+	bound := m.MakeBoundAccount()
+	defer bound.Close(ctx)
+	standalone := mon.MakeStandaloneBudget(0)
+
+	testCases := []struct {
+		name  string
+		alloc mon.Allocator
+		used  func() int64
+		// limited is whether pushing 200 bytes is denied.
+		limited bool
+	}{
+		{"bound", &bound, func() int64 { return bound.Used() }, true},
+		{"standalone", &standalone, func() int64 { return standalone.Used() }, false},
+		{"noop", mon.NoopAllocator{}, func() int64 { return 0 }, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := byteStack{alloc: tc.alloc}
+			expectUsed := func(n int64) {
+				t.Helper()
+				if u := tc.used(); u != n {
+					t.Fatalf("expected %d bytes used, got %d", n, u)
+				}
+			}
+			for _, n := range []int{10, 20, 30} {
+				if err := s.push(ctx, make([]byte, n)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.name != "noop" {
+				expectUsed(60)
+			}
+			if err := s.push(ctx, make([]byte, 200)); (err != nil) != tc.limited {
+				t.Fatalf("expected a denial: %t, got %v", tc.limited, err)
+			}
+			if !tc.limited {
+				s.pop(ctx)
+			}
+			s.pop(ctx)
+			if tc.name != "noop" {
+				expectUsed(30)
+			}
+			s.reset(ctx)
+			expectUsed(0)
+		})
+	}
+}
+
+// TestClearStandaloneBudget verifies that clearing a standalone budget
+// empties it, and that the monitors started with a budget, which clear it
+// when they stop, leave the budget of the caller alone.
+func TestClearStandaloneBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	b := mon.MakeStandaloneBudget(100)
+	b.Clear(ctx)
+	if u := b.Used(); u != 0 {
+		t.Fatalf("expected the budget to be emptied, got %d bytes", u)
+	}
+
+	budget := mon.MakeStandaloneBudget(100)
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	for i := 0; i < 2; i++ {
+		m.Start(ctx, nil, budget)
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 100); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+		if u := budget.Used(); u != 100 {
+			t.Fatalf("%d: expected the budget of the caller to be kept, got %d bytes", i, u)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// The accounts of a BoundAccounts are stored inline in chunks, which are
+// never reallocated so that the pointers returned by Alloc stay valid. The
+// chunks double in size, up to a cap.
+const (
+	minBoundAccountsChunk = 16
+	maxBoundAccountsChunk = 1024
+)
+
+// BoundAccounts is a collection of accounts bound to the same monitor, for
+// operators keeping many of them, e.g. one per bucket of a hash joiner, that
+// need to close them all reliably. Like a BoundAccount, it is not safe for
+// concurrent use.
+type BoundAccounts struct {
+	mon    *BytesMonitor
+	chunks [][]BoundAccount
+	// free holds the slots of the accounts released by Free, for reuse.
+	free []*BoundAccount
+}
+
+// MakeBoundAccounts creates an empty collection of accounts bound to the
+// monitor.
+func (mm *BytesMonitor) MakeBoundAccounts() BoundAccounts {
+	return BoundAccounts{mon: mm}
+}
+
+// Alloc returns a new account of the collection, reusing the slot of an
+// account released by Free if there is one. The account is valid until it
+// is released by Free or CloseAll.
+func (a *BoundAccounts) Alloc() *BoundAccount {
+	if n := len(a.free); n > 0 {
+		acc := a.free[n-1]
+		a.free = a.free[:n-1]
+		*acc = a.mon.MakeBoundAccount()
+		return acc
+	}
+	last := len(a.chunks) - 1
+	if last < 0 || len(a.chunks[last]) == cap(a.chunks[last]) {
+		size := minBoundAccountsChunk
+		if last >= 0 {
+			size = 2 * cap(a.chunks[last])
+			if size > maxBoundAccountsChunk {
+				size = maxBoundAccountsChunk
+			}
+		}
+		a.chunks = append(a.chunks, make([]BoundAccount, 0, size))
+		last++
+	}
+	a.chunks[last] = append(a.chunks[last], a.mon.MakeBoundAccount())
+	return &a.chunks[last][len(a.chunks[last])-1]
+}
+
+// Free closes an account of the collection and makes its slot available
+// for reuse by Alloc. Freeing an account again, before its slot is reused,
+// is a no-op.
+func (a *BoundAccounts) Free(ctx context.Context, acc *BoundAccount) {
+	if acc.mon == nil {
+		// The slot was already freed: the accounts allocated by Alloc are
+		// bound to the monitor.
+		return
+	}
+	acc.Close(ctx)
+	*acc = BoundAccount{}
+	a.free = append(a.free, acc)
+}
+
+// Len returns the number of accounts of the collection that weren't
+// released by Free.
+func (a *BoundAccounts) Len() int {
+	n := -len(a.free)
+	for _, c := range a.chunks {
+		n += len(c)
+	}
+	return n
+}
+
+// TotalUsed returns the number of bytes used by the accounts of the
+// collection.
+func (a *BoundAccounts) TotalUsed() int64 {
+	var used int64
+	for _, c := range a.chunks {
+		for i := range c {
+			used += c[i].used
+		}
+	}
+	return used
+}
+
+// CloseAll closes all the accounts of the collection, including those
+// already closed by their users, and empties it.
+func (a *BoundAccounts) CloseAll(ctx context.Context) {
+	for _, c := range a.chunks {
+		for i := range c {
+			c[i].Close(ctx)
+		}
+	}
+	a.chunks = nil
+	a.free = nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestBoundAccounts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+
+	accs := m.MakeBoundAccounts()
+	const n = 500
+	ptrs := make([]*mon.BoundAccount, n)
+	var total int64
+	for i := range ptrs {
+		ptrs[i] = accs.Alloc()
+	}
+	// The accounts are grown after all of them are allocated, so that the
+	// pointers must have stayed valid.
+	for i, acc := range ptrs {
+		sz := int64(i%7) * int64(i)
+		if err := acc.Grow(ctx, sz); err != nil {
+			t.Fatal(err)
+		}
+		total += sz
+	}
+	if l := accs.Len(); l != n {
+		t.Fatalf("expected %d accounts, got %d", n, l)
+	}
+	if u := accs.TotalUsed(); u != total {
+		t.Fatalf("expected %d bytes used, got %d", total, u)
+	}
+
+	// Free some accounts and close others directly.
+	for i := 0; i < n; i += 10 {
+		total -= ptrs[i].Used()
+		accs.Free(ctx, ptrs[i])
+		total -= ptrs[i+1].Used()
+		ptrs[i+1].Close(ctx)
+	}
+	// Freeing an account twice doesn't free its slot twice.
+	accs.Free(ctx, ptrs[0])
+	if l := accs.Len(); l != n-n/10 {
+		t.Fatalf("expected %d accounts, got %d", n-n/10, l)
+	}
+	if u := accs.TotalUsed(); u != total {
+		t.Fatalf("expected %d bytes used, got %d", total, u)
+	}
+
+	// The freed slots are reused, the last freed first.
+	for i := n - 10; i >= 0; i -= 10 {
+		if acc := accs.Alloc(); acc != ptrs[i] {
+			t.Fatalf("expected the slot of account %d to be reused", i)
+		}
+	}
+	if l := accs.Len(); l != n {
+		t.Fatalf("expected %d accounts, got %d", n, l)
+	}
+	if err := accs.Alloc().Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	total += 100
+	if u := accs.TotalUsed(); u != total {
+		t.Fatalf("expected %d bytes used, got %d", total, u)
+	}
+
+	accs.CloseAll(ctx)
+	montest.AssertEmpty(t, &m)
+	if l := accs.Len(); l != 0 {
+		t.Fatalf("expected no accounts after CloseAll, got %d", l)
+	}
+	// Closing the accounts again is harmless.
+	accs.CloseAll(ctx)
+	ptrs[1].Close(ctx)
+}
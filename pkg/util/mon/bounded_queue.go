@@ -0,0 +1,108 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBoundedQueueClosed is returned by BoundedQueue.Add once the queue has
+// been closed.
+var ErrBoundedQueueClosed = errors.New("bounded queue closed")
+
+// BoundedQueueOptions configures a BoundedQueue.
+type BoundedQueueOptions struct {
+	// NonBlocking makes Add return the budget error right away when the
+	// account denies an entry, instead of waiting for entries to be popped.
+	NonBlocking bool
+	// TimeSource measures the time producers spend blocked. It defaults to
+	// DefaultTimeSource.
+	TimeSource TimeSource
+	// CurBytes, if set, tracks the total size of the queued entries, and
+	// BlockedTime, typically created with metric.NewLatency, records the
+	// time every blocked Add waited.
+	CurBytes    BytesGauge
+	BlockedTime LatencyHistogram
+}
+
+// BoundedQueue is a FIFO queue of payloads bounded by the budget of an
+// account: the size of every entry is charged to the account from the time
+// it is added until it is popped. It is a ByteChannel without a limit, whose
+// consumers poll instead of blocking, and whose producers can be made to
+// fail instead of waiting for room.
+type BoundedQueue struct {
+	opts BoundedQueueOptions
+	c    *ByteChannel
+}
+
+// NewBoundedQueue creates a BoundedQueue charging queued entries to acc. The
+// account must not be used by anything else concurrently.
+func NewBoundedQueue(acc *BoundAccount, opts BoundedQueueOptions) *BoundedQueue {
+	if opts.TimeSource == nil {
+		opts.TimeSource = DefaultTimeSource
+	}
+	opts.CurBytes = gaugeOrNil(opts.CurBytes)
+	opts.BlockedTime = latencyHistogramOrNil(opts.BlockedTime)
+	c := NewByteChannel(acc, 0 /* limit */)
+	c.curBytes = opts.CurBytes
+	return &BoundedQueue{opts: opts, c: c}
+}
+
+// Add queues payload, charging size bytes for it. If the account denies the
+// entry, Add blocks until entries are popped, the queue is closed or ctx is
+// canceled, unless the queue is non-blocking, in which case the budget
+// error is returned. The budget error is also returned if the queue is
+// empty, since waiting wouldn't help.
+func (q *BoundedQueue) Add(ctx context.Context, payload interface{}, size int64) error {
+	var blockedSince time.Time
+	var blocked func()
+	if q.opts.BlockedTime != nil {
+		blocked = func() { blockedSince = q.opts.TimeSource.Now() }
+	}
+	err := q.c.send(ctx, payload, size, !q.opts.NonBlocking, blocked)
+	if !blockedSince.IsZero() {
+		q.opts.BlockedTime.RecordValue(q.opts.TimeSource.Now().Sub(blockedSince).Nanoseconds())
+	}
+	if err == ErrByteChannelClosed {
+		return ErrBoundedQueueClosed
+	}
+	return err
+}
+
+// Pop dequeues the oldest entry and releases its size. It returns false if
+// the queue is empty or closed.
+func (q *BoundedQueue) Pop(ctx context.Context) (interface{}, bool) {
+	return q.c.TryRecv(ctx)
+}
+
+// Len returns the number of queued entries.
+func (q *BoundedQueue) Len() int {
+	return q.c.Len()
+}
+
+// Bytes returns the total size of the queued entries.
+func (q *BoundedQueue) Bytes() int64 {
+	return q.c.Bytes()
+}
+
+// Close closes the queue, drops the queued entries and releases their sizes
+// from the account. Blocked producers return ErrBoundedQueueClosed. Close is
+// idempotent.
+func (q *BoundedQueue) Close(ctx context.Context) {
+	q.c.Close(ctx)
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestBoundedQueue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	curBytes := metric.NewGauge(metric.Metadata{Name: "test.queue.cur_bytes"})
+	blockedTime := metric.NewLatency(metric.Metadata{Name: "test.queue.blocked_time"}, time.Minute)
+	m := mon.MakeMonitor("queue", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	q := mon.NewBoundedQueue(&acc, mon.BoundedQueueOptions{
+		TimeSource:  clock,
+		CurBytes:    curBytes,
+		BlockedTime: blockedTime,
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := q.Add(ctx, i, 40); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := curBytes.Value(); v != 80 {
+		t.Fatalf("expected 80 queued bytes, got %d", v)
+	}
+
+	// The third entry doesn't fit until the first one is popped.
+	added := make(chan error, 1)
+	go func() {
+		added <- q.Add(ctx, 2, 40)
+	}()
+	select {
+	case err := <-added:
+		t.Fatalf("expected add to block, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(5 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		payload, ok := q.Pop(ctx)
+		if !ok || payload.(int) != i {
+			t.Fatalf("expected entry %d, got %v", i, payload)
+		}
+		if i == 0 {
+			if err := <-added; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, ok := q.Pop(ctx); ok {
+		t.Fatal("expected the queue to be empty")
+	}
+	if q.Len() != 0 || q.Bytes() != 0 || acc.Used() != 0 || curBytes.Value() != 0 {
+		t.Fatalf("expected empty queue, got %d entries, %d bytes, %d used, %d gauge",
+			q.Len(), q.Bytes(), acc.Used(), curBytes.Value())
+	}
+	if n := blockedTime.TotalCount(); n != 1 {
+		t.Fatalf("expected 1 blocked add recorded, got %d", n)
+	}
+
+	// An entry larger than the budget fails instead of blocking forever.
+	if err := q.Add(ctx, "huge", 200); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	q.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestBoundedQueueNonBlocking(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("queue", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	q := mon.NewBoundedQueue(&acc, mon.BoundedQueueOptions{NonBlocking: true})
+
+	if err := q.Add(ctx, 0, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Add(ctx, 1, 60); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if q.Len() != 1 || acc.Used() != 60 {
+		t.Fatalf("expected only the first entry to be queued, got %d entries, %d used",
+			q.Len(), acc.Used())
+	}
+
+	q.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestBoundedQueueShutdown(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("queue", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	q := mon.NewBoundedQueue(&acc, mon.BoundedQueueOptions{})
+
+	if err := q.Add(ctx, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// A blocked producer returns when its context is canceled.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	added := make(chan error, 1)
+	go func() {
+		added <- q.Add(cancelCtx, 1, 10)
+	}()
+	cancel()
+	if err := <-added; err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if q.Len() != 1 || acc.Used() != 100 {
+		t.Fatalf("expected only the first entry to be queued, got %d entries, %d used",
+			q.Len(), acc.Used())
+	}
+
+	// Blocked producers return when the queue is closed, and the queued
+	// entries are released.
+	go func() {
+		added <- q.Add(ctx, 1, 10)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close(ctx)
+	if err := <-added; err != mon.ErrBoundedQueueClosed {
+		t.Fatalf("expected closed queue error, got %v", err)
+	}
+	if _, ok := q.Pop(ctx); ok {
+		t.Fatal("expected a closed queue to be empty")
+	}
+	montest.AssertAccountUsed(t, &acc, 0)
+	montest.AssertEmpty(t, &m)
+	q.Close(ctx)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
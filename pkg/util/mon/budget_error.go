@@ -0,0 +1,252 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// ErrorVerbosity determines how the budget errors of a monitor render.
+type ErrorVerbosity int
+
+const (
+	// VerboseErrors makes Error return the verbose form of the budget
+	// errors. This is the default.
+	VerboseErrors ErrorVerbosity = iota
+	// TerseErrors makes Error return the terse form of the budget errors,
+	// e.g. for the monitors whose errors are returned to SQL clients.
+	TerseErrors
+)
+
+// WithErrorVerbosity sets the verbosity of the budget errors returned by the
+// monitor, including those of its pools for the requests made through it.
+func WithErrorVerbosity(v ErrorVerbosity) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.errorVerbosity = v
+	})
+}
+
+// DenialCause classifies the denials of allocations, e.g. so that spilling
+// operators can spill to disk when their own limit is hit, but fail fast
+// when the whole pool is exhausted.
+type DenialCause int
+
+const (
+	// LocalLimit is the denial of a request above the limit of the monitor
+	// it was made to, or of one of its categories. The failures injected
+	// with a FailureInjector are also reported as LocalLimit denials.
+	LocalLimit DenialCause = iota
+	// ReservedExhausted is the denial of a request beyond the pre-reserved
+	// budget of a monitor without a pool.
+	ReservedExhausted
+	// PoolExhausted is the denial of a request that the monitor it was made
+	// to forwarded to its pool, whatever the cause of the denial by the
+	// pool.
+	PoolExhausted
+)
+
+func (c DenialCause) String() string {
+	switch c {
+	case LocalLimit:
+		return "local-limit"
+	case ReservedExhausted:
+		return "reserved-exhausted"
+	case PoolExhausted:
+		return "pool-exhausted"
+	}
+	return fmt.Sprintf("DenialCause(%d)", int(c))
+}
+
+// DenialCounters counts the denials of the requests made to a monitor by
+// cause; see WithDenialCounters. Nil counters are ignored.
+type DenialCounters struct {
+	LocalLimit        Counter
+	ReservedExhausted Counter
+	PoolExhausted     Counter
+}
+
+// WithDenialCounters sets the counters of the denials of the requests made
+// to the monitor, including those forwarded by its children.
+func WithDenialCounters(c DenialCounters) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.denialCounts = DenialCounters{
+			LocalLimit:        counterOrNil(c.LocalLimit),
+			ReservedExhausted: counterOrNil(c.ReservedExhausted),
+			PoolExhausted:     counterOrNil(c.PoolExhausted),
+		}
+	})
+}
+
+// count increments the counter of the cause of err, if err is a budget
+// error.
+func (c *DenialCounters) count(err error) {
+	e, ok := err.(*BudgetExceededError)
+	if !ok {
+		return
+	}
+	var counter Counter
+	switch e.DenialCause {
+	case LocalLimit:
+		counter = c.LocalLimit
+	case ReservedExhausted:
+		counter = c.ReservedExhausted
+	case PoolExhausted:
+		counter = c.PoolExhausted
+	}
+	if counter != nil {
+		counter.Inc(1)
+	}
+}
+
+// BudgetExceededError is the error of a monitor denying an allocation. It
+// has two renderings: a terse one for clients, e.g. "memory budget
+// exceeded", and a verbose one for the logs, with the monitors the request
+// went through, the numbers and a hint. Error returns one or the other
+// depending on the verbosity of the monitor the request was made to (see
+// WithErrorVerbosity); the fields are the same either way.
+//
+// The cause of the error is the error of the Resource of the monitor, e.g. a
+// pgerror.Error, so that IsBudgetExceededError and pgerror.GetPGCause see
+// through it.
+type BudgetExceededError struct {
+	// Monitor is the name of the monitor that denied the request.
+	Monitor string
+	// Path is the names of the monitors the request went through, from the
+	// one it was made to up to Monitor.
+	Path []string
+	// Requested is the number of bytes requested from Monitor, and
+	// Allocated and Budget its usage and budget at the time of the denial.
+	Requested int64
+	Allocated int64
+	Budget    int64
+	// Hint suggests why the request was denied, if known.
+	Hint string
+	// DenialCause is the cause of the denial, as seen by the monitor the
+	// request was made to. It is set where the request is denied, and
+	// becomes PoolExhausted when the request was forwarded to a pool.
+	DenialCause DenialCause
+
+	// reason qualifies the denial, e.g. "injected failure".
+	reason    string
+	cause     error
+	verbosity ErrorVerbosity
+}
+
+// newBudgetExceededError returns the error of mm denying a request of x
+// bytes for the given cause.
+func (mm *BytesMonitor) newBudgetExceededError(
+	cause DenialCause, x, allocated, budget int64,
+) *BudgetExceededError {
+	return &BudgetExceededError{
+		Monitor:     mm.name,
+		Path:        []string{mm.name},
+		Requested:   x,
+		Allocated:   allocated,
+		Budget:      budget,
+		DenialCause: cause,
+		cause:       mm.resource.NewBudgetExceededError(x, allocated, budget),
+		verbosity:   mm.errorVerbosity,
+	}
+}
+
+// noPoolErrorLocked returns the error of mm, which has no pool, denying a
+// request of x bytes beyond its pre-reserved budget.
+func (mm *BytesMonitor) noPoolErrorLocked(x, allocated int64) *BudgetExceededError {
+	err := mm.newBudgetExceededError(ReservedExhausted, x, allocated, mm.reserved.used)
+	err.Hint = fmt.Sprintf("%s has no pool to extend its budget", mm.name)
+	return err
+}
+
+// forwardedBy records that the request was forwarded to its pool by mm, if
+// err is a budget error. The verbosity of the error becomes that of mm.
+func forwardedBy(err error, mm *BytesMonitor) error {
+	if e, ok := err.(*BudgetExceededError); ok {
+		e.Path = append([]string{mm.name}, e.Path...)
+		e.DenialCause = PoolExhausted
+		e.verbosity = mm.errorVerbosity
+	}
+	return err
+}
+
+// terseBudgetMessages are the terse renderings of the budget errors of the
+// built-in resources, by code.
+var terseBudgetMessages = map[string]string{
+	pgerror.CodeOutOfMemoryError:           "memory budget exceeded",
+	pgerror.CodeDiskFullError:              "disk budget exceeded",
+	pgerror.CodeInsufficientResourcesError: "quota exceeded",
+}
+
+// Error implements the error interface.
+func (e *BudgetExceededError) Error() string {
+	if e.verbosity == TerseErrors {
+		return e.TerseString()
+	}
+	return e.VerboseString()
+}
+
+// Cause returns the error of the Resource of the denying monitor.
+func (e *BudgetExceededError) Cause() error {
+	return e.cause
+}
+
+// TerseString returns the client-facing rendering of the error, which
+// doesn't reveal the monitors of the server.
+func (e *BudgetExceededError) TerseString() string {
+	if pgErr, ok := pgerror.GetPGCause(e.cause); ok {
+		if msg, ok := terseBudgetMessages[pgErr.Code]; ok {
+			return msg
+		}
+	}
+	return e.cause.Error()
+}
+
+// VerboseString returns the rendering of the error for the logs.
+func (e *BudgetExceededError) VerboseString() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.Monitor)
+	buf.WriteString(": ")
+	if e.reason != "" {
+		buf.WriteString(e.reason)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.cause.Error())
+	if len(e.Path) > 1 {
+		fmt.Fprintf(&buf, " (requested through %s)", strings.Join(e.Path, " -> "))
+	}
+	if e.Hint != "" {
+		fmt.Fprintf(&buf, "; hint: %s", e.Hint)
+	}
+	return buf.String()
+}
+
+// GetBudgetExceededError returns the BudgetExceededError in the chain of
+// causes of err, if any, e.g. to inspect its DenialCause.
+func GetBudgetExceededError(err error) (*BudgetExceededError, bool) {
+	for err != nil {
+		if e, ok := err.(*BudgetExceededError); ok {
+			return e, true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return nil, false
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+func TestBudgetExceededErrorVerbosity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// deny makes a request denied by the root of a hierarchy of three
+	// monitors, through a monitor of the given verbosity.
+	deny := func(v ErrorVerbosity) *BudgetExceededError {
+		t.Helper()
+		root := MakeMonitor("root", MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		root.Start(ctx, nil, MakeStandaloneBudget(1000))
+		session := MakeMonitor("session", MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		session.Start(ctx, &root, BoundAccount{})
+		txn := MakeMonitor("txn", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+			WithErrorVerbosity(v))
+		txn.Start(ctx, &session, BoundAccount{})
+		defer root.Stop(ctx)
+		defer session.Stop(ctx)
+		defer txn.Stop(ctx)
+
+		acc := txn.MakeBoundAccount()
+		defer acc.Close(ctx)
+		if err := acc.Grow(ctx, 600); err != nil {
+			t.Fatal(err)
+		}
+		err := acc.GrowWithContext(ctx, 500, "sorting")
+		if !IsBudgetExceededError(err) {
+			t.Fatalf("expected budget error, got %v", err)
+		}
+		e, ok := GetBudgetExceededError(err)
+		if !ok {
+			t.Fatalf("expected a BudgetExceededError, got %T: %v", err, err)
+		}
+		if err.Error() != "sorting: "+e.Error() {
+			t.Fatalf("expected the description of the operation, got %q", err)
+		}
+		return e
+	}
+
+	verbose := deny(VerboseErrors)
+	const expectedVerbose = "root: memory budget exceeded: 500 bytes requested, " +
+		"600 currently allocated, 1000 bytes in budget (requested through txn -> session -> root); " +
+		"hint: root has no pool to extend its budget"
+	if s := verbose.Error(); s != expectedVerbose {
+		t.Fatalf("expected %q, got %q", expectedVerbose, s)
+	}
+	if s := verbose.TerseString(); s != "memory budget exceeded" {
+		t.Fatalf("expected the terse form, got %q", s)
+	}
+
+	terse := deny(TerseErrors)
+	if s := terse.Error(); s != "memory budget exceeded" {
+		t.Fatalf("expected the terse form, got %q", s)
+	}
+	if s := terse.VerboseString(); s != expectedVerbose {
+		t.Fatalf("expected %q, got %q", expectedVerbose, s)
+	}
+
+	// The fields don't depend on the verbosity.
+	exported := func(e *BudgetExceededError) BudgetExceededError {
+		return BudgetExceededError{
+			Monitor:     e.Monitor,
+			Path:        e.Path,
+			Requested:   e.Requested,
+			Allocated:   e.Allocated,
+			Budget:      e.Budget,
+			Hint:        e.Hint,
+			DenialCause: e.DenialCause,
+		}
+	}
+	expected := BudgetExceededError{
+		Monitor:     "root",
+		Path:        []string{"txn", "session", "root"},
+		Requested:   500,
+		Allocated:   600,
+		Budget:      1000,
+		Hint:        "root has no pool to extend its budget",
+		DenialCause: PoolExhausted,
+	}
+	for _, e := range []*BudgetExceededError{verbose, terse} {
+		if f := exported(e); !reflect.DeepEqual(f, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, f)
+		}
+	}
+}
+
+func TestBudgetExceededErrorLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitorWithLimit("limited", DiskResource, 100, nil, nil, 1, math.MaxInt64, st,
+		WithErrorVerbosity(TerseErrors))
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	acc := m.MakeBoundAccount()
+
+	err := acc.Grow(ctx, 200)
+	e, ok := GetBudgetExceededError(err)
+	if !ok {
+		t.Fatalf("expected a BudgetExceededError, got %v", err)
+	}
+	if s := e.Error(); s != "disk budget exceeded" {
+		t.Fatalf("expected the terse form, got %q", s)
+	}
+	const expected = "limited: disk budget exceeded: 200 bytes requested, 0 currently allocated, " +
+		"100 bytes in budget; hint: limited reached its limit"
+	if s := e.VerboseString(); s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestDenialCause(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	newCounters := func() DenialCounters {
+		return DenialCounters{
+			LocalLimit:        metric.NewCounter(metric.Metadata{Name: "test.local_limit"}),
+			ReservedExhausted: metric.NewCounter(metric.Metadata{Name: "test.reserved_exhausted"}),
+			PoolExhausted:     metric.NewCounter(metric.Metadata{Name: "test.pool_exhausted"}),
+		}
+	}
+	rootCounts, sessionCounts := newCounters(), newCounters()
+	root := MakeMonitor("root", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		WithDenialCounters(rootCounts))
+	root.Start(ctx, nil, MakeStandaloneBudget(1000))
+	session := MakeMonitorWithLimit("session", MemoryResource, 500, nil, nil, 1, math.MaxInt64, st,
+		WithDenialCounters(sessionCounts))
+	session.Start(ctx, &root, BoundAccount{})
+	rootAcc := root.MakeBoundAccount()
+	sessionAcc := session.MakeBoundAccount()
+
+	expectCause := func(err error, expected DenialCause) {
+		t.Helper()
+		e, ok := GetBudgetExceededError(err)
+		if !ok {
+			t.Fatalf("expected a BudgetExceededError, got %v", err)
+		}
+		if e.DenialCause != expected {
+			t.Fatalf("expected cause %d, got %d: %v", expected, e.DenialCause, err)
+		}
+	}
+
+	// The session hits its own limit; the cause is kept when the error is
+	// wrapped.
+	expectCause(sessionAcc.GrowWithContext(ctx, 600, "sorting"), LocalLimit)
+
+	// The session is below its limit, but the root has no budget left.
+	if err := rootAcc.Grow(ctx, 800); err != nil {
+		t.Fatal(err)
+	}
+	expectCause(sessionAcc.Grow(ctx, 300), PoolExhausted)
+	expectCause(rootAcc.Grow(ctx, 300), ReservedExhausted)
+
+	for _, c := range []struct {
+		name     string
+		counter  *metric.Counter
+		expected int64
+	}{
+		{"session local limit", sessionCounts.LocalLimit, 1},
+		{"session pool exhausted", sessionCounts.PoolExhausted, 1},
+		{"session reserved exhausted", sessionCounts.ReservedExhausted, 0},
+		// The request forwarded by the session is a ReservedExhausted denial
+		// for the root.
+		{"root reserved exhausted", rootCounts.ReservedExhausted, 2},
+		{"root local limit", rootCounts.LocalLimit, 0},
+		{"root pool exhausted", rootCounts.PoolExhausted, 0},
+	} {
+		if n := c.counter.Count(); n != c.expected {
+			t.Errorf("expected %d denials for %s, got %d", c.expected, c.name, n)
+		}
+	}
+
+	sessionAcc.Close(ctx)
+	rootAcc.Close(ctx)
+	session.Stop(ctx)
+	root.Stop(ctx)
+}
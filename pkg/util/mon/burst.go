@@ -0,0 +1,76 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+)
+
+type burstConfig struct {
+	bytes     int64
+	duration  time.Duration
+	onExpired func(context.Context)
+}
+
+// WithBurst lets the usage of a monitor exceed its limit by up to bytes for
+// at most d, so that a short spike doesn't fail an operation otherwise well
+// within budget. Once the usage has been above the limit for longer than d,
+// allocations are refused until it goes back below the limit, and onExpired
+// (if not nil) is called. The burst allowance only applies to the limit of
+// the monitor, not to the budget obtained from its pool. Time is measured
+// with the TimeSource of the monitor.
+func WithBurst(bytes int64, d time.Duration, onExpired func(context.Context)) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.burst = burstConfig{bytes: bytes, duration: d, onExpired: onExpired}
+	})
+}
+
+// burstAllowsLocked returns whether the burst allowance admits an
+// allocation of x bytes taking the usage, used before the allocation, above
+// the limit. The second result is set if the allocation is refused because
+// the burst expired; it is up to the caller to record the expiry.
+func (mm *BytesMonitor) burstAllowsLocked(used, x int64) (allowed bool, expired bool) {
+	if mm.burst.bytes <= 0 {
+		return false, false
+	}
+	if mm.mu.burstExpired ||
+		(!mm.mu.burstStart.IsZero() && mm.clock().Now().Sub(mm.mu.burstStart) > mm.burst.duration) {
+		return false, true
+	}
+	// NB: mm.limit-used is at least -mm.burst.bytes, so this can't overflow.
+	return x <= mm.burst.bytes+(mm.limit-used), false
+}
+
+// startBurstLocked records the start of a burst after an allocation took
+// the usage above the limit.
+func (mm *BytesMonitor) startBurstLocked() {
+	if mm.mu.burstStart.IsZero() {
+		mm.mu.burstStart = mm.clock().Now()
+	}
+}
+
+// maybeEndBurstLocked ends the current burst if the usage went back below
+// the limit. Like in admitLocked, the emergency reserve counts against the
+// limit, so that the burst doesn't end while allocations are still refused.
+func (mm *BytesMonitor) maybeEndBurstLocked() {
+	if mm.mu.burstStart.IsZero() {
+		return
+	}
+	if mm.mu.curAllocated+mm.externalUsageLocked() <= mm.limit-mm.mu.emergencyHeld {
+		mm.mu.burstStart = time.Time{}
+		mm.mu.burstExpired = false
+	}
+}
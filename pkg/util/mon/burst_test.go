@@ -0,0 +1,141 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestBurst(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(0, 0))
+	var expiries int
+	m := mon.MakeMonitorWithLimit("test", mon.MemoryResource, 100, nil, nil, 1, 1000, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+		mon.WithBurst(50, time.Second, func(context.Context) { expiries++ }))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	inBurst := func() bool { return m.Snapshot().InBurst }
+
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if inBurst() {
+		t.Fatal("unexpected burst at the limit")
+	}
+
+	// The usage can go above the limit, up to the burst allowance.
+	if err := acc.Grow(ctx, 40); err != nil {
+		t.Fatal(err)
+	}
+	if !inBurst() {
+		t.Fatal("expected a burst above the limit")
+	}
+	if err := acc.Grow(ctx, 11); err == nil {
+		t.Fatal("expected growth beyond the burst allowance to fail")
+	}
+	clock.Advance(time.Second)
+	if err := acc.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	montest.AssertAccountUsed(t, &acc, 150)
+
+	// The burst lasted too long: growths fail and the callback fires, once.
+	clock.Advance(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		err := acc.Grow(ctx, 1)
+		if err == nil || !strings.Contains(err.Error(), "burst above limit lasted more than 1s") {
+			t.Fatalf("expected the burst to expire, got %v", err)
+		}
+	}
+	if expiries != 1 {
+		t.Fatalf("expected the callback to fire once, got %d", expiries)
+	}
+
+	// Once the usage goes back below the limit, a new burst can start.
+	acc.Shrink(ctx, 30)
+	if !inBurst() {
+		t.Fatal("expected the burst to go on above the limit")
+	}
+	acc.Shrink(ctx, 20)
+	if inBurst() {
+		t.Fatal("expected the burst to end at the limit")
+	}
+	if err := acc.Grow(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if !inBurst() {
+		t.Fatal("expected a new burst")
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+// TestBurstEmergencyReserve checks that a burst only ends once the usage
+// went back below the part of the limit not held by the emergency reserve,
+// where allocations are admitted again.
+func TestBurstEmergencyReserve(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitorWithLimit("test", mon.MemoryResource, 100, nil, nil, 1, 1000, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly), mon.WithEmergencyReserve(20),
+		mon.WithBurst(50, time.Second, nil))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	inBurst := func() bool { return m.Snapshot().InBurst }
+
+	if err := acc.Grow(ctx, 80); err != nil {
+		t.Fatal(err)
+	}
+	if inBurst() {
+		t.Fatal("unexpected burst below the limit")
+	}
+	if err := acc.Grow(ctx, 30); err != nil {
+		t.Fatal(err)
+	}
+	if !inBurst() {
+		t.Fatal("expected a burst above the limit left by the reserve")
+	}
+	// Below the limit, but above the part of it not held by the reserve.
+	acc.Shrink(ctx, 20)
+	if !inBurst() {
+		t.Fatal("expected the burst to go on above the limit left by the reserve")
+	}
+	acc.Shrink(ctx, 10)
+	if inBurst() {
+		t.Fatal("expected the burst to end at the limit left by the reserve")
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
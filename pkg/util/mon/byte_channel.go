@@ -0,0 +1,269 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// ErrByteChannelClosed is returned by the methods of a ByteChannel once it
+// has been closed.
+var ErrByteChannelClosed = errors.New("byte channel closed")
+
+// ErrByteChannelFull is returned by TrySend when the channel holds too many
+// bytes to admit the item.
+var ErrByteChannelFull = errors.New("byte channel full")
+
+// ByteChannel is a FIFO queue of variable-sized items with backpressure by
+// bytes rather than by element count. The size of every queued item is
+// charged to an account from the time it is sent until it is received.
+// Senders block while the channel holds limit bytes or while the account
+// denies the item; receivers block while the channel is empty. A sender
+// denied by the account retries whenever an item is received, and also
+// polls the account with an exponential backoff, since the budget can be
+// freed by other accounts of the same monitor without the channel knowing.
+//
+// To share a budget between several channels, give each one an account from
+// the same monitor.
+type ByteChannel struct {
+	limit int64
+	// curBytes, if set, tracks the bytes queued in the channel.
+	curBytes BytesGauge
+
+	mu struct {
+		syncutil.Mutex
+
+		acc   *BoundAccount
+		items []byteChannelItem
+		// bytes is the total size of the queued items, as charged to acc.
+		bytes  int64
+		closed bool
+		// changed is closed and replaced every time an item is sent or
+		// received, or the channel is closed, to wake up waiters.
+		changed chan struct{}
+	}
+}
+
+const (
+	// byteChannelInitialBackoff is the first wait of a sender denied by the
+	// account before it polls the account again.
+	byteChannelInitialBackoff = time.Millisecond
+	// byteChannelMaxBackoff caps the wait of a sender denied by the account
+	// between two polls.
+	byteChannelMaxBackoff = 100 * time.Millisecond
+)
+
+type byteChannelItem struct {
+	item interface{}
+	size int64
+}
+
+// NewByteChannel creates a ByteChannel charging queued items to acc. If limit
+// is positive, it caps the bytes queued at once regardless of the account's
+// budget. The account must not be used by anything else concurrently.
+func NewByteChannel(acc *BoundAccount, limit int64) *ByteChannel {
+	c := &ByteChannel{limit: limit}
+	c.mu.acc = acc
+	c.mu.changed = make(chan struct{})
+	return c
+}
+
+// notifyLocked wakes up all waiters.
+func (c *ByteChannel) notifyLocked() {
+	close(c.mu.changed)
+	c.mu.changed = make(chan struct{})
+}
+
+// SendCtx queues item, charging size bytes for it. It blocks while the item
+// doesn't fit, until items are received, the channel is closed or ctx is
+// canceled. An item is always admitted into an empty channel as far as the
+// limit is concerned, so that items larger than the limit don't block
+// forever; if the account denies an item while the channel is empty, the
+// budget error is returned since waiting wouldn't help.
+func (c *ByteChannel) SendCtx(ctx context.Context, item interface{}, size int64) error {
+	return c.send(ctx, item, size, true /* block */, nil /* blocked */)
+}
+
+// TrySend is like SendCtx, but returns instead of blocking: with the budget
+// error if the account denies the item, or ErrByteChannelFull if the item
+// exceeds the limit of the channel.
+func (c *ByteChannel) TrySend(ctx context.Context, item interface{}, size int64) error {
+	return c.send(ctx, item, size, false /* block */, nil /* blocked */)
+}
+
+// send implements SendCtx and TrySend. If block is set and blocked is not
+// nil, blocked is called the first time the sender waits.
+func (c *ByteChannel) send(
+	ctx context.Context, item interface{}, size int64, block bool, blocked func(),
+) error {
+	var backoff time.Duration
+	c.mu.Lock()
+	for {
+		if c.mu.closed {
+			c.mu.Unlock()
+			return ErrByteChannelClosed
+		}
+		var err error
+		if c.limit <= 0 || c.mu.bytes == 0 || c.mu.bytes+size <= c.limit {
+			err = c.mu.acc.Grow(ctx, size)
+			if err == nil {
+				c.mu.items = append(c.mu.items, byteChannelItem{item: item, size: size})
+				c.addBytesLocked(size)
+				c.notifyLocked()
+				c.mu.Unlock()
+				return nil
+			}
+			if c.mu.bytes == 0 {
+				c.mu.Unlock()
+				return err
+			}
+		} else {
+			err = ErrByteChannelFull
+		}
+		if !block {
+			c.mu.Unlock()
+			return err
+		}
+		if blocked != nil {
+			blocked()
+			blocked = nil
+		}
+		changed := c.mu.changed
+		var poll Timer
+		var polled <-chan time.Time
+		if err != ErrByteChannelFull && c.mu.acc.mon != nil {
+			if backoff = 2 * backoff; backoff < byteChannelInitialBackoff {
+				backoff = byteChannelInitialBackoff
+			} else if backoff > byteChannelMaxBackoff {
+				backoff = byteChannelMaxBackoff
+			}
+			poll = c.mu.acc.mon.clock().NewTimer(backoff)
+			polled = poll.C()
+		}
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-polled:
+		case <-ctx.Done():
+			if poll != nil {
+				poll.Stop()
+			}
+			return ctx.Err()
+		}
+		if poll != nil {
+			poll.Stop()
+		}
+		c.mu.Lock()
+	}
+}
+
+// Recv dequeues the oldest item and releases its size. It blocks while
+// the channel is empty, until an item is sent, the channel is closed or ctx
+// is canceled. Items queued before Close are discarded by it, so Recv
+// returns ErrByteChannelClosed as soon as the channel is closed.
+func (c *ByteChannel) Recv(ctx context.Context) (interface{}, error) {
+	c.mu.Lock()
+	for {
+		if c.mu.closed {
+			c.mu.Unlock()
+			return nil, ErrByteChannelClosed
+		}
+		if len(c.mu.items) > 0 {
+			item := c.popLocked(ctx)
+			c.mu.Unlock()
+			return item, nil
+		}
+		changed := c.mu.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+}
+
+// TryRecv is like Recv, but returns false instead of blocking if the
+// channel is empty, or if it is closed.
+func (c *ByteChannel) TryRecv(ctx context.Context) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.closed || len(c.mu.items) == 0 {
+		return nil, false
+	}
+	return c.popLocked(ctx), true
+}
+
+// popLocked dequeues the oldest item, releases its size and wakes up the
+// waiters.
+func (c *ByteChannel) popLocked(ctx context.Context) interface{} {
+	it := c.mu.items[0]
+	c.mu.items[0] = byteChannelItem{}
+	c.mu.items = c.mu.items[1:]
+	c.mu.acc.Shrink(ctx, it.size)
+	c.addBytesLocked(-it.size)
+	c.notifyLocked()
+	return it.item
+}
+
+// addBytesLocked adds n, which may be negative, to the bytes queued in the
+// channel.
+func (c *ByteChannel) addBytesLocked(n int64) {
+	c.mu.bytes += n
+	if c.curBytes == nil {
+		return
+	}
+	if n > 0 {
+		c.curBytes.Inc(n)
+	} else if n < 0 {
+		c.curBytes.Dec(-n)
+	}
+}
+
+// Len returns the number of queued items.
+func (c *ByteChannel) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mu.items)
+}
+
+// Bytes returns the total size of the queued items.
+func (c *ByteChannel) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.bytes
+}
+
+// Close closes the channel, discards the queued items and releases their
+// sizes from the account. Blocked senders and receivers return
+// ErrByteChannelClosed. Close is idempotent.
+func (c *ByteChannel) Close(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.closed {
+		return
+	}
+	c.mu.closed = true
+	c.mu.acc.Shrink(ctx, c.mu.bytes)
+	c.addBytesLocked(-c.mu.bytes)
+	c.mu.items = nil
+	c.notifyLocked()
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestByteChannel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		name   string
+		budget int64
+		limit  int64
+	}{
+		{"budget", 100, 0},
+		{"limit", 1000, 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+			m.Start(ctx, nil, MakeStandaloneBudget(tc.budget))
+			acc := m.MakeBoundAccount()
+			c := NewByteChannel(&acc, tc.limit)
+
+			for i := 0; i < 2; i++ {
+				if err := c.SendCtx(ctx, i, 40); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The third item doesn't fit until the first one is received.
+			sent := make(chan error, 1)
+			go func() {
+				sent <- c.SendCtx(ctx, 2, 40)
+			}()
+			select {
+			case err := <-sent:
+				t.Fatalf("expected send to block, got %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			for i := 0; i < 3; i++ {
+				item, err := c.Recv(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if item.(int) != i {
+					t.Fatalf("expected item %d, got %v", i, item)
+				}
+				if i == 0 {
+					if err := <-sent; err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if c.Len() != 0 || c.Bytes() != 0 || acc.Used() != 0 {
+				t.Fatalf("expected empty channel, got %d items, %d bytes, %d used",
+					c.Len(), c.Bytes(), acc.Used())
+			}
+
+			c.Close(ctx)
+			acc.Close(ctx)
+			m.Stop(ctx)
+		})
+	}
+}
+
+func TestByteChannelOversized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	c := NewByteChannel(&acc, 50)
+
+	// An item larger than the limit is admitted into an empty channel.
+	if err := c.SendCtx(ctx, "big", 80); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Recv(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// An item larger than the budget fails instead of blocking forever.
+	err := c.SendCtx(ctx, "huge", 200)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+
+	c.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestByteChannelShutdown(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+	c := NewByteChannel(&acc, 100)
+
+	if err := c.SendCtx(ctx, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// A blocked sender returns when its context is canceled.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendCtx(cancelCtx, 1, 10)
+	}()
+	cancel()
+	if err := <-sent; err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if c.Len() != 1 || acc.Used() != 100 {
+		t.Fatalf("expected only the first item to be queued, got %d items, %d used",
+			c.Len(), acc.Used())
+	}
+
+	// Blocked senders and receivers return when the channel is closed, and
+	// the queued items are released.
+	go func() {
+		sent <- c.SendCtx(ctx, 1, 10)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close(ctx)
+	if err := <-sent; err != ErrByteChannelClosed {
+		t.Fatalf("expected closed channel error, got %v", err)
+	}
+	if _, err := c.Recv(ctx); err != ErrByteChannelClosed {
+		t.Fatalf("expected closed channel error, got %v", err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected close to release the queued items, got %d", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestByteChannelTry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	c := NewByteChannel(&acc, 50)
+
+	if _, ok := c.TryRecv(ctx); ok {
+		t.Fatal("expected nothing to receive from an empty channel")
+	}
+	if err := c.TrySend(ctx, 0, 40); err != nil {
+		t.Fatal(err)
+	}
+	// The limit and the budget are reported instead of waited for.
+	if err := c.TrySend(ctx, 1, 20); err != ErrByteChannelFull {
+		t.Fatalf("expected ErrByteChannelFull, got %v", err)
+	}
+	if err := c.TrySend(ctx, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	c.limit = 0
+	err := c.TrySend(ctx, 2, 60)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if item, ok := c.TryRecv(ctx); !ok || item != i {
+			t.Fatalf("expected item %d, got %v, %t", i, item, ok)
+		}
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected the account to be empty, got %d", acc.Used())
+	}
+	c.Close(ctx)
+	if err := c.TrySend(ctx, 3, 10); err != ErrByteChannelClosed {
+		t.Fatalf("expected ErrByteChannelClosed, got %v", err)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+// TestByteChannelSharedBudget checks that a sender denied by the account
+// notices the budget freed by other accounts of the monitor.
+func TestByteChannelSharedBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	other := m.MakeBoundAccount()
+	c := NewByteChannel(&acc, 0 /* limit */)
+
+	if err := other.Grow(ctx, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendCtx(ctx, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendCtx(ctx, 1, 20)
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("expected the sender to block, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Nothing is received from the channel: the sender is unblocked by the
+	// other account.
+	other.Shrink(ctx, 80)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the sender to be unblocked by the freed budget")
+	}
+	if c.Len() != 2 || c.Bytes() != 30 {
+		t.Fatalf("expected both items to be queued, got %d items, %d bytes", c.Len(), c.Bytes())
+	}
+
+	c.Close(ctx)
+	other.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// BytePool is a pool of byte buffers whose memory, whether handed out or
+// retained for reuse, is charged to a BoundAccount. Unlike a sync.Pool, the
+// retained buffers are never dropped silently by the GC, so the account
+// reflects exactly the bytes held by the pool and its clients: the sum of
+// the capacities of the outstanding buffers plus Retained().
+//
+// The pool is registered as an EvictableCache with the monitor of its
+// account, so that the retained buffers are dropped when the monitor, or one
+// of its pools, is under pressure.
+//
+// A BytePool is safe for concurrent use; the account it is configured with
+// must not be used by anything else concurrently.
+type BytePool struct {
+	// retained is the sum of the capacities of the buffers in free. It is
+	// written under mu and read atomically, so that CachedBytes doesn't
+	// block. It comes first to be 64-bit aligned.
+	retained int64
+	// growing is set, atomically, while Get grows the account. The Grow may
+	// ask the other caches of the monitor to evict, and they may themselves
+	// be growing their account under their lock and ask this pool to evict:
+	// Evict gives up instead of waiting for mu then.
+	growing int32
+
+	mu struct {
+		syncutil.Mutex
+		acc *BoundAccount
+		// free contains the buffers available for reuse.
+		free [][]byte
+	}
+
+	// maxRetained is the maximum number of bytes kept in free.
+	maxRetained int64
+	// unregister unregisters the pool from the monitor of its account, if
+	// any.
+	unregister func()
+}
+
+var _ EvictableCache = &BytePool{}
+
+// NewBytePool creates a BytePool charging acc, which retains at most
+// maxRetained bytes of buffers for reuse. The pool must be closed before
+// acc.
+func NewBytePool(acc *BoundAccount, maxRetained int64) *BytePool {
+	p := &BytePool{maxRetained: maxRetained}
+	p.mu.acc = acc
+	if m := acc.Monitor(); m != nil {
+		p.unregister = m.RegisterEvictableCache(acc, p)
+	}
+	return p
+}
+
+// Get returns a buffer of length n. A retained buffer is reused if one is
+// large enough; otherwise a new buffer is allocated after growing the account
+// by its capacity. An error is returned if the account denies the
+// allocation.
+func (p *BytePool) Get(ctx context.Context, n int) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, buf := range p.mu.free {
+		if cap(buf) >= n {
+			last := len(p.mu.free) - 1
+			p.mu.free[i] = p.mu.free[last]
+			p.mu.free[last] = nil
+			p.mu.free = p.mu.free[:last]
+			atomic.AddInt64(&p.retained, -int64(cap(buf)))
+			return buf[:n], nil
+		}
+	}
+	atomic.StoreInt32(&p.growing, 1)
+	err := p.mu.acc.Grow(ctx, int64(n))
+	atomic.StoreInt32(&p.growing, 0)
+	if err != nil {
+		return nil, err
+	}
+	return make([]byte, n), nil
+}
+
+// Put returns a buffer obtained via Get to the pool. The buffer stays charged
+// to the account if it fits under the pool's retention cap; otherwise it is
+// dropped and its bytes are released. The caller must not use buf after Put.
+func (p *BytePool) Put(ctx context.Context, buf []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sz := int64(cap(buf))
+	if atomic.LoadInt64(&p.retained)+sz <= p.maxRetained {
+		p.mu.free = append(p.mu.free, buf[:0])
+		atomic.AddInt64(&p.retained, sz)
+		return
+	}
+	p.mu.acc.Shrink(ctx, sz)
+}
+
+// Retained returns the number of bytes held by the pool for reuse.
+func (p *BytePool) Retained() int64 {
+	return atomic.LoadInt64(&p.retained)
+}
+
+// Trim drops all the retained buffers and releases their bytes from the
+// account, returning the number of bytes released. The monitor of the
+// account trims the pool by itself under pressure, through Evict.
+func (p *BytePool) Trim(ctx context.Context) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	released := atomic.LoadInt64(&p.retained)
+	if released > 0 {
+		p.mu.acc.Shrink(ctx, released)
+	}
+	p.mu.free = nil
+	atomic.StoreInt64(&p.retained, 0)
+	return released
+}
+
+// CachedBytes implements the EvictableCache interface. It returns the bytes
+// retained for reuse, which are the only ones the pool can give back.
+func (p *BytePool) CachedBytes() int64 {
+	return p.Retained()
+}
+
+// Evict implements the EvictableCache interface. It drops retained buffers
+// until targetBytes are released, or none are left. It releases nothing if
+// the pool is growing its account, as the pool then holds its lock across
+// the Grow.
+func (p *BytePool) Evict(ctx context.Context, targetBytes int64) int64 {
+	if atomic.LoadInt32(&p.growing) != 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var released int64
+	for released < targetBytes && len(p.mu.free) > 0 {
+		last := len(p.mu.free) - 1
+		released += int64(cap(p.mu.free[last]))
+		p.mu.free[last] = nil
+		p.mu.free = p.mu.free[:last]
+	}
+	if released > 0 {
+		p.mu.acc.Shrink(ctx, released)
+		atomic.AddInt64(&p.retained, -released)
+	}
+	return released
+}
+
+// Close unregisters the pool from the monitor of its account and releases
+// the retained buffers. Buffers still held by clients remain charged to the
+// account.
+func (p *BytePool) Close(ctx context.Context) {
+	if p.unregister != nil {
+		p.unregister()
+		p.unregister = nil
+	}
+	p.Trim(ctx)
+}
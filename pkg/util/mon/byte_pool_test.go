@@ -0,0 +1,263 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestBytePool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	p := NewBytePool(&acc, 250)
+
+	var outstanding int64
+	check := func() {
+		t.Helper()
+		if expected := outstanding + p.Retained(); acc.Used() != expected {
+			t.Fatalf("expected account at %d (%d outstanding, %d retained), got %d",
+				expected, outstanding, p.Retained(), acc.Used())
+		}
+	}
+
+	b1, err := p.Get(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outstanding += 100
+	check()
+
+	b2, err := p.Get(ctx, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outstanding += 200
+	check()
+
+	p.Put(ctx, b1)
+	outstanding -= 100
+	check()
+	if p.Retained() != 100 {
+		t.Fatalf("expected 100 retained bytes, got %d", p.Retained())
+	}
+
+	// A smaller request reuses the retained buffer without touching the
+	// account.
+	used := acc.Used()
+	b3, err := p.Get(ctx, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b3) != 50 || cap(b3) != 100 {
+		t.Fatalf("expected the retained buffer to be reused, got len %d cap %d", len(b3), cap(b3))
+	}
+	if acc.Used() != used {
+		t.Fatalf("expected reuse not to charge the account, got %d, was %d", acc.Used(), used)
+	}
+	outstanding += 100
+	check()
+
+	// Putting everything back exceeds the retention cap: the excess buffer is
+	// released.
+	p.Put(ctx, b2)
+	outstanding -= 200
+	check()
+	p.Put(ctx, b3)
+	outstanding -= 100
+	check()
+	if p.Retained() != 200 {
+		t.Fatalf("expected 200 retained bytes, got %d", p.Retained())
+	}
+
+	// Requests the budget cannot cover are denied.
+	if _, err := p.Get(ctx, 900); err == nil {
+		t.Fatal("expected budget error")
+	}
+	check()
+
+	if released := p.Trim(ctx); released != 200 {
+		t.Fatalf("expected Trim to release 200 bytes, got %d", released)
+	}
+	check()
+	if acc.Used() != 0 {
+		t.Fatalf("expected empty account after Trim, got %d", acc.Used())
+	}
+
+	p.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestBytePoolEvict(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+	p := NewBytePool(&acc, 1000)
+
+	var bufs [][]byte
+	for i := 0; i < 4; i++ {
+		b, err := p.Get(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufs = append(bufs, b)
+	}
+	for _, b := range bufs[1:] {
+		p.Put(ctx, b)
+	}
+
+	// The retained buffers are dropped to make room for the other accounts
+	// of the monitor, but not the outstanding one.
+	other := m.MakeBoundAccount()
+	if err := other.Grow(ctx, 850); err != nil {
+		t.Fatalf("expected grow to succeed after eviction, got %v", err)
+	}
+	if r := p.Retained(); r != 0 {
+		t.Fatalf("expected the retained buffers to be evicted, got %d bytes", r)
+	}
+	if u := acc.Used(); u != 100 {
+		t.Fatalf("expected the outstanding buffer to stay charged, got %d bytes", u)
+	}
+
+	// Once closed, the pool is no longer asked to evict.
+	p.Put(ctx, bufs[0])
+	p.Close(ctx)
+	if err := other.Grow(ctx, 200); err == nil {
+		t.Fatal("expected grow to be denied")
+	}
+
+	other.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestBytePoolRandom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	rng, _ := randutil.NewPseudoRand()
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1<<20))
+	acc := m.MakeBoundAccount()
+	p := NewBytePool(&acc, 4096)
+
+	var bufs [][]byte
+	var outstanding int64
+	for i := 0; i < 1000; i++ {
+		if len(bufs) > 0 && rng.Intn(2) == 0 {
+			j := rng.Intn(len(bufs))
+			outstanding -= int64(cap(bufs[j]))
+			p.Put(ctx, bufs[j])
+			bufs = append(bufs[:j], bufs[j+1:]...)
+		} else {
+			b, err := p.Get(ctx, 1+rng.Intn(1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outstanding += int64(cap(b))
+			bufs = append(bufs, b)
+		}
+		if expected := outstanding + p.Retained(); acc.Used() != expected {
+			t.Fatalf("%d: expected account at %d, got %d", i, expected, acc.Used())
+		}
+		if p.Retained() > 4096 {
+			t.Fatalf("%d: retained %d exceeds cap", i, p.Retained())
+		}
+	}
+	for _, b := range bufs {
+		p.Put(ctx, b)
+	}
+	p.Close(ctx)
+	if acc.Used() != 0 {
+		t.Fatalf("expected empty account after Close, got %d", acc.Used())
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+// TestBytePoolsSharingMonitor verifies that pools on the same monitor, which
+// ask each other to evict when their account is denied, don't deadlock.
+func TestBytePoolsSharingMonitor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	const pools = 4
+	accs := make([]BoundAccount, pools)
+	ps := make([]*BytePool, pools)
+	for i := range ps {
+		accs[i] = m.MakeBoundAccount()
+		ps[i] = NewBytePool(&accs[i], 400)
+	}
+	var wg sync.WaitGroup
+	for i := range ps {
+		wg.Add(1)
+		go func(p *BytePool) {
+			defer wg.Done()
+			var bufs [][]byte
+			for j := 0; j < 100000; j++ {
+				switch {
+				case j%50 == 49:
+					p.Trim(ctx)
+				case len(bufs) > 0 && j%3 == 2:
+					p.Put(ctx, bufs[len(bufs)-1])
+					bufs = bufs[:len(bufs)-1]
+				default:
+					// Requests are denied once the budget is used up.
+					if b, err := p.Get(ctx, 50+j%200); err == nil {
+						bufs = append(bufs, b)
+					}
+				}
+			}
+			for _, b := range bufs {
+				p.Put(ctx, b)
+			}
+		}(ps[i])
+	}
+	wg.Wait()
+
+	for i, p := range ps {
+		if r := p.Retained(); accs[i].Used() != r {
+			t.Errorf("%d: expected the account to hold the %d retained bytes, got %d", i, r, accs[i].Used())
+		}
+		p.Close(ctx)
+		accs[i].Close(ctx)
+	}
+	m.Stop(ctx)
+}
@@ -19,15 +19,16 @@ import (
 	"fmt"
 	"math"
 	"math/bits"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
-	"github.com/cockroachdb/cockroach/pkg/util/log"
-	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 )
 
@@ -172,6 +173,62 @@ import (
 // before and after use.
 // The various counters express sizes in bytes.
 type BytesMonitor struct {
+	// approxHeadroom is the headroom of the monitor as of its last change,
+	// read by its children without locking the monitor; see ApproxHeadroom.
+	// It is accessed atomically, and comes first for alignment.
+	approxHeadroom int64
+	// approxAllocated is a copy of mu.curAllocated, read by the pool of the
+	// monitor without locking the monitor; see WithTopConsumersLog. It is
+	// accessed atomically.
+	approxAllocated int64
+	// activity is incremented by every allocation and release, so that a
+	// Reclaimer can tell idle monitors without locking them. It is accessed
+	// atomically.
+	activity uint64
+	// reservations counts the calls to reserveBytesForOp, for the moving
+	// average of their rate; see ReservationRate. It is accessed atomically.
+	reservations uint64
+	// stoppedFlag is 1 once the monitor is stopped, and until it is started
+	// again. It is accessed atomically, so that the operations of straggling
+	// accounts can tell they come too late without locking the monitor; it
+	// is set under the lock, so that it also serializes with them.
+	stoppedFlag int32
+
+	// childSet is the set of started monitors using this monitor as their
+	// pool. It has its own lock, which is never held while locking a
+	// monitor, so that the tree of monitors can be walked while some of them
+	// are locked; see childrenSnapshot.
+	childSet struct {
+		syncutil.Mutex
+		monitors map[*BytesMonitor]struct{}
+	}
+
+	// doneWatch closes the accounts registered by CloseOnDone.
+	doneWatch doneWatcher
+
+	// carveOuts are the carve-outs of the monitor by name; see CarveOut.
+	// Like childSet, they have their own lock.
+	carveOuts struct {
+		syncutil.Mutex
+		byName map[string]*BytesMonitor
+	}
+	// carveOutOf is the monitor this monitor is a carve-out of, if any.
+	carveOutOf *BytesMonitor
+
+	// leases are the unreleased leases of the monitor; see Lease. Like
+	// childSet, they have their own lock.
+	leases struct {
+		syncutil.Mutex
+		set map[*Lease]struct{}
+	}
+
+	// semaphores are the semaphores using this monitor as their pool; see
+	// NewSemaphore. Like childSet, they have their own lock.
+	semaphores struct {
+		syncutil.Mutex
+		set map[*Semaphore]struct{}
+	}
+
 	mu struct {
 		syncutil.Mutex
 
@@ -183,9 +240,147 @@ type BytesMonitor struct {
 		// monitoring.
 		maxAllocated int64
 
+		// unflushedDelta is the change of curAllocated not reflected in
+		// curBytesCount yet; see WithDeferredMetrics.
+		unflushedDelta int64
+
+		// gaugedSplit is the split of the usage last reflected in the gauges
+		// set by WithUsageSplitGauges.
+		gaugedSplit struct{ reserved, pool int64 }
+
+		// resRate is the moving average of the rate of reservations.
+		resRate reservationRate
+
+		// draining is set while StopSubtree stops the descendants of the
+		// monitor, and makes it reject new children.
+		draining bool
+
 		// curBudget represents the budget allocated at the pool on behalf of
 		// this monitor.
 		curBudget BoundAccount
+
+		// evictable are the caches registered via RegisterEvictableCache.
+		evictable []*evictableCache
+
+		// external are the reporters registered via RegisterExternalUsage.
+		external []*externalUsage
+
+		// openAccounts is the number of accounts made by OpenAccount that
+		// haven't been closed yet.
+		openAccounts int
+
+		// children is the number of started monitors using this monitor as
+		// their pool.
+		children int
+		// childReserved is the sum of the pre-reserved budgets of the
+		// children, if the monitor has a reservation cap.
+		childReserved int64
+
+		// burstStart is the time at which the usage went above the limit
+		// thanks to the burst allowance, or zero if it is below the limit.
+		burstStart time.Time
+		// burstExpired is set once the burst has lasted too long, until the
+		// usage goes back below the limit.
+		burstExpired bool
+
+		// peaks tracks the recent high-water marks, if enabled with
+		// WithPeakWindow. It is allocated on first use.
+		peaks *peakWindow
+
+		// smoothed is the moving average of the usage, if enabled with
+		// WithSmoothingHalfLife.
+		smoothed smoothedUsage
+
+		// enforcement is the enforcement mode of the limit; see
+		// SetEnforcement.
+		enforcement Enforcement
+		// frozen is set while the monitor denies all new reservations; see
+		// SetFrozen.
+		frozen bool
+		// wouldDeny counts the allocations granted in ReportOnly mode that
+		// the limit would have denied.
+		wouldDeny int64
+		// lastWouldDenyLog is the last time such an allocation was logged.
+		lastWouldDenyLog time.Time
+
+		// emergencyHeld is the part of the budget of the monitor set aside
+		// for GrowEmergency and not used yet. It is not allocated, but
+		// regular allocations can't use it.
+		emergencyHeld int64
+
+		// limitFetched is the last time the limit provider was consulted,
+		// or zero if the limit must be fetched again.
+		limitFetched time.Time
+
+		// labels are the labels of the monitor, including the ones
+		// inherited from its pool when it was started.
+		labels []Label
+
+		// id is the ID assigned to the monitor by the registry when it was
+		// last started.
+		id uint64
+
+		// stopped is set once the monitor is stopped, until it is started
+		// again.
+		stopped bool
+		// stopDone is set once doStop went through, until the monitor is
+		// started again, and stopStats holds the stats it returned, so that
+		// stopping the monitor again is a no-op.
+		stopDone  bool
+		stopStats MonitorStats
+
+		// startStack is the stack that last started the monitor, if
+		// debugMonitorRegistry is set.
+		startStack []byte
+
+		// started is the time at which the monitor was last started.
+		started time.Time
+
+		// tag is the tag the usage of the monitor is attributed to; see
+		// SetCurrentTag.
+		tag string
+
+		// lastTopConsumersLog is the last time the top consumers of the
+		// monitor were logged; see WithTopConsumersLog.
+		lastTopConsumersLog time.Time
+
+		// lastExhaustionDump is the last time the monitor was dumped after
+		// refusing an allocation; see WithExhaustionDumps.
+		lastExhaustionDump time.Time
+
+		// heapProfileDisarmed is set once the heap profile hook fired, until
+		// the pressure goes back down, and lastHeapProfile is the last time
+		// it fired; see WithHeapProfileHook.
+		heapProfileDisarmed bool
+		lastHeapProfile     time.Time
+
+		// lastExhaustionEvent is the last time the monitor logged a
+		// BudgetExhaustedEvent.
+		lastExhaustionEvent time.Time
+
+		// limitHitReported is set once the first denial of the lifetime of
+		// the monitor was counted in telemetry.
+		limitHitReported bool
+
+		// releasedToPool is the number of bytes of budget returned to the
+		// pool since Start, and poolRoundTrips the number of requests for
+		// budget and returns of budget; see WithChurnCounters.
+		releasedToPool int64
+		poolRoundTrips int64
+
+		// categories holds the usage of the categories of allocations,
+		// indexed by Category.
+		categories [MaxCategories]categoryCounters
+
+		// idle tracks the unused budget if the monitor has a delayed release
+		// policy; see ReleaseAfter.
+		idle idleBudget
+
+		// accounts is the account registry, if enabled with
+		// WithAccountRegistry. It is allocated on first use.
+		accounts map[*BoundAccount]*accountEntry
+		// accountSeq is incremented every time an account is registered.
+		accountSeq uint64
 	}
 
 	// name identifies this monitor in logging messages.
@@ -209,30 +404,46 @@ type BytesMonitor struct {
 	// hit constraints on the owner monitor. This is useful to limit allocations
 	// when an owner monitor has a larger capacity than wanted but should still
 	// keep track of allocations made through this monitor. Note that child
-	// monitors are affected by this limit.
+	// monitors are affected by this limit. It can change at runtime (see
+	// SetLimit and WithLimitProvider), so it is protected by mu once the
+	// monitor is started.
 	limit int64
 
-	// poolAllocationSize specifies the allocation unit for requests to the
-	// pool.
-	poolAllocationSize int64
+	// monitorOptions are the tuning parameters of the monitor, set by the
+	// options passed to its constructor.
+	monitorOptions
+
+	// poolReserved is the pre-reserved budget of the monitor counted against
+	// the reservation cap of its pool, if any. It is set when the monitor
+	// starts and cleared when it stops.
+	poolReserved int64
 
 	// noteworthyUsageBytes is the size beyond which total allocations start to
 	// become reported in the logs.
 	noteworthyUsageBytes int64
 
-	curBytesCount *metric.Gauge
-	maxBytesHist  *metric.Histogram
+	curBytesCount BytesGauge
+	maxBytesHist  BytesHistogram
 
 	settings *cluster.Settings
+
+	// testingFailureInjector, if set, is consulted on every reservation; see
+	// TestingSetFailureInjector.
+	testingFailureInjector *FailureInjector
+
+	// testingRecorder, if set, records the operations on the monitor's
+	// accounts; see TestingSetRecorder.
+	testingRecorder *Recorder
 }
 
-// maxAllocatedButUnusedBlocks determines the maximum difference between the
-// amount of bytes used by a monitor and the amount of bytes reserved at the
-// upstream pool before the monitor relinquishes the bytes back to the pool.
-// This is useful so that a monitor currently at the boundary of a block does
-// not cause contention when accounts cause its allocation counter to grow and
-// shrink slightly beyond and beneath an allocation block boundary. The
-// difference is expressed as a number of blocks of size `poolAllocationSize`.
+// maxAllocatedButUnusedBlocks determines the default maximum difference
+// between the amount of bytes used by a monitor and the amount of bytes
+// reserved at the upstream pool before the monitor relinquishes the bytes back
+// to the pool. This is useful so that a monitor currently at the boundary of a
+// block does not cause contention when accounts cause its allocation counter
+// to grow and shrink slightly beyond and beneath an allocation block boundary.
+// The difference is expressed as a number of blocks of size
+// `poolAllocationSize`. It can be overridden per monitor with WithHysteresis.
 var maxAllocatedButUnusedBlocks = envutil.EnvOrDefaultInt("COCKROACH_MAX_ALLOCATED_UNUSED_BLOCKS", 10)
 
 // DefaultPoolAllocationSize specifies the unit of allocation used by a monitor
@@ -248,7 +459,8 @@ var DefaultPoolAllocationSize = envutil.EnvOrDefaultInt64("COCKROACH_ALLOCATION_
 //   allocations for (e.g. memory or disk).
 //
 // - curCount and maxHist are the metric objects to update with usage
-//   statistics. Can be nil.
+//   statistics, typically a *metric.Gauge and a *metric.Histogram. Can be
+//   nil.
 //
 // - increment is the block size used for upstream allocations from
 //   the pool. Note: if set to 0 or lower, the default pool allocation
@@ -257,51 +469,55 @@ var DefaultPoolAllocationSize = envutil.EnvOrDefaultInt64("COCKROACH_ALLOCATION_
 // - noteworthy determines the minimum total allocated size beyond
 //   which the monitor starts to log increases. Use 0 to always log
 //   or math.MaxInt64 to never log.
+//
+// - opts override the defaults of the other tuning parameters.
 func MakeMonitor(
 	name string,
 	res Resource,
-	curCount *metric.Gauge,
-	maxHist *metric.Histogram,
+	curCount BytesGauge,
+	maxHist BytesHistogram,
 	increment int64,
 	noteworthy int64,
 	settings *cluster.Settings,
+	opts ...MonitorOption,
 ) BytesMonitor {
 	return MakeMonitorWithLimit(
-		name, res, math.MaxInt64, curCount, maxHist, increment, noteworthy, settings)
+		name, res, math.MaxInt64, curCount, maxHist, increment, noteworthy, settings, opts...)
 }
 
 // MakeMonitorWithLimit creates a new monitor with a limit local to this
-// monitor.
+// monitor. A limit of 0 or less means no limit.
 func MakeMonitorWithLimit(
 	name string,
 	res Resource,
 	limit int64,
-	curCount *metric.Gauge,
-	maxHist *metric.Histogram,
+	curCount BytesGauge,
+	maxHist BytesHistogram,
 	increment int64,
 	noteworthy int64,
 	settings *cluster.Settings,
+	opts ...MonitorOption,
 ) BytesMonitor {
-	if increment <= 0 {
-		increment = DefaultPoolAllocationSize
-	}
-	if limit <= 0 {
-		limit = math.MaxInt64
-	}
 	return BytesMonitor{
 		name:                 name,
 		resource:             res,
-		limit:                limit,
+		limit:                normalizeLimit(limit),
 		noteworthyUsageBytes: noteworthy,
-		curBytesCount:        curCount,
-		maxBytesHist:         maxHist,
-		poolAllocationSize:   increment,
+		curBytesCount:        gaugeOrNil(curCount),
+		maxBytesHist:         histogramOrNil(maxHist),
+		monitorOptions:       makeMonitorOptions(increment, opts),
 		settings:             settings,
 	}
 }
 
 // MakeMonitorInheritWithLimit creates a new monitor with a limit local to this
-// monitor with all other attributes inherited from the passed in monitor.
+// monitor with all other attributes inherited from the passed in monitor,
+// including its labels, categories, release policy, deferred metrics mode,
+// overhead multiplier, unmarshal expansion factor, page size, logger and
+// error verbosity, except for the caps on open accounts and children, the
+// burst allowance, the limits of the categories, the lifetime histograms,
+// the logging of the top consumers, the exhaustion dumps and the heap
+// profile hook.
 func MakeMonitorInheritWithLimit(name string, limit int64, m *BytesMonitor) BytesMonitor {
 	return MakeMonitorWithLimit(
 		name,
@@ -312,6 +528,19 @@ func MakeMonitorInheritWithLimit(name string, limit int64, m *BytesMonitor) Byte
 		m.poolAllocationSize,
 		m.noteworthyUsageBytes,
 		m.settings,
+		WithHysteresis(m.maxAllocatedButUnusedBlocks),
+		WithMaxUnusedBytes(m.maxUnusedBytes),
+		WithReleasePolicy(m.releasePolicy()),
+		WithReservationPolicy(m.reservationPolicy),
+		WithOverheadMultiplier(m.overheadMultiplier),
+		WithUnmarshalExpansionFactor(m.unmarshalExpansionFactor),
+		WithPageSize(m.pageSize),
+		WithDeferredMetrics(m.metricsFlushThreshold),
+		WithTimeSource(m.clock()),
+		WithLogger(m.log()),
+		WithErrorVerbosity(m.errorVerbosity),
+		WithLabels(m.labels...),
+		WithCategories(m.categories...),
 	)
 }
 
@@ -322,27 +551,89 @@ func MakeMonitorInheritWithLimit(name string, limit int64, m *BytesMonitor) Byte
 //   and the pre-reserved budget determines the entire capacity of this monitor.
 //
 // - reserved is the pre-reserved budget (see above).
+//
+// Start panics if the pool has reached its cap on children or on the
+// pre-reserved budgets of its children, or can't back a budget that must be
+// verified; use TryStart to handle these cases.
 func (mm *BytesMonitor) Start(ctx context.Context, pool *BytesMonitor, reserved BoundAccount) {
+	if err := mm.TryStart(ctx, pool, reserved); err != nil {
+		panic(err)
+	}
+}
+
+// TryStart is like Start, but returns an error if the pool has reached its
+// cap on children (see WithMaxChildren), if the pre-reserved budget would
+// make its children exceed its reservation cap (see WithReservationCap), if
+// the pool can't back the pre-reserved budget (see WithVerifiedBudget), or if
+// the pool is stopped or being stopped by StopSubtree.
+func (mm *BytesMonitor) TryStart(
+	ctx context.Context, pool *BytesMonitor, reserved BoundAccount,
+) error {
 	if mm.mu.curAllocated != 0 {
 		panic(fmt.Sprintf("%s: started with %d bytes left over", mm.name, mm.mu.curAllocated))
 	}
 	if mm.mu.curBudget.mon != nil {
 		panic(fmt.Sprintf("%s: already started with pool %s", mm.name, mm.mu.curBudget.mon.name))
 	}
+	verified := mm.verifyBudget && pool != nil && reserved.mon == nil && reserved.used > 0
+	if verified {
+		backed := pool.makeBudgetAccount()
+		if err := backed.Grow(ctx, reserved.used); err != nil {
+			return errors.Wrapf(err, "%s: pool %s can't back a budget of %s",
+				mm.name, pool.name, humanizeutil.IBytes(reserved.used))
+		}
+		reserved = backed
+	}
+	if err := pool.addChild(mm, reserved.used); err != nil {
+		if verified {
+			reserved.Close(ctx)
+		}
+		return err
+	}
 	mm.mu.curAllocated = 0
 	mm.mu.maxAllocated = 0
-	mm.mu.curBudget = pool.MakeBoundAccount()
+	mm.mu.peaks = nil
+	mm.mu.smoothed = smoothedUsage{}
+	mm.mu.wouldDeny = 0
+	mm.mu.curBudget = pool.makeBudgetAccount()
 	mm.reserved = reserved
-	if log.V(2) {
+	mm.mu.labels = mm.labels
+	if pool != nil {
+		mm.mu.labels = mergeLabels(pool.Labels(), mm.labels)
+	}
+	mm.mu.emergencyHeld = 0
+	mm.mu.stopped = false
+	mm.mu.stopDone = false
+	atomic.StoreInt32(&mm.stoppedFlag, 0)
+	mm.mu.draining = false
+	mm.mu.heapProfileDisarmed = false
+	mm.mu.limitHitReported = false
+	mm.mu.releasedToPool = 0
+	mm.mu.poolRoundTrips = 0
+	mm.mu.categories = [MaxCategories]categoryCounters{}
+	mm.mu.idle = idleBudget{}
+	mm.mu.started = mm.clock().Now()
+	mm.resetReservationRateLocked(mm.mu.started)
+	mm.mu.limitFetched = time.Time{}
+	mm.refreshLimitLocked()
+	if mm.emergencyReserve > 0 {
+		mm.fillEmergencyReserve(ctx)
+	}
+	mm.publishHeadroomLocked()
+	mm.updateUsageSplitLocked()
+	registerMonitor(ctx, mm)
+	mm.logMetamorphicParams(ctx)
+	if mm.log().V(2) {
 		poolname := "(none)"
 		if pool != nil {
 			poolname = pool.name
 		}
-		log.InfofDepth(ctx, 1, "%s: starting monitor, reserved %s, pool %s",
+		mm.log().Infof(ctx, "%s: starting monitor, reserved %s, pool %s",
 			mm.name,
 			humanizeutil.IBytes(mm.reserved.used),
 			poolname)
 	}
+	return nil
 }
 
 // MakeUnlimitedMonitor creates a new monitor and starts the monitor in
@@ -351,13 +642,15 @@ func MakeUnlimitedMonitor(
 	ctx context.Context,
 	name string,
 	res Resource,
-	curCount *metric.Gauge,
-	maxHist *metric.Histogram,
+	curCount BytesGauge,
+	maxHist BytesHistogram,
 	noteworthy int64,
 	settings *cluster.Settings,
+	opts ...MonitorOption,
 ) BytesMonitor {
-	if log.V(2) {
-		log.InfofDepth(ctx, 1, "%s: starting unlimited monitor", name)
+	o := makeMonitorOptions(0 /* increment */, opts)
+	if l := loggerOrDefault(o.logger); l.V(2) {
+		l.Infof(ctx, "%s: starting unlimited monitor", name)
 
 	}
 	return BytesMonitor{
@@ -365,44 +658,76 @@ func MakeUnlimitedMonitor(
 		resource:             res,
 		limit:                math.MaxInt64,
 		noteworthyUsageBytes: noteworthy,
-		curBytesCount:        curCount,
-		maxBytesHist:         maxHist,
-		poolAllocationSize:   DefaultPoolAllocationSize,
+		curBytesCount:        gaugeOrNil(curCount),
+		maxBytesHist:         histogramOrNil(maxHist),
+		monitorOptions:       o,
 		reserved:             MakeStandaloneBudget(math.MaxInt64),
 		settings:             settings,
 	}
 }
 
 // EmergencyStop completes a monitoring region, and disables checking
-// that all accounts have been closed.
+// that all accounts have been closed. The bytes still allocated are
+// released, so that a later Stop by the owner of the monitor, which is then
+// a no-op, doesn't find them leaked.
 func (mm *BytesMonitor) EmergencyStop(ctx context.Context) {
 	mm.doStop(ctx, false)
 }
 
-// Stop completes a monitoring region.
+// Stop completes a monitoring region. Stopping a monitor already stopped is
+// a no-op.
 func (mm *BytesMonitor) Stop(ctx context.Context) {
 	mm.doStop(ctx, true)
 }
 
-func (mm *BytesMonitor) doStop(ctx context.Context, check bool) {
+// stoppedAtomic returns whether the monitor is stopped, without locking it.
+func (mm *BytesMonitor) stoppedAtomic() bool {
+	return atomic.LoadInt32(&mm.stoppedFlag) == 1
+}
+
+// errStopped returns the error of the reservations after the monitor is
+// stopped.
+func (mm *BytesMonitor) errStopped() error {
+	return errors.Wrapf(ErrMonitorStopped, "%s", mm.name)
+}
+
+func (mm *BytesMonitor) doStop(ctx context.Context, check bool) MonitorStats {
 	// NB: No need to lock mm.mu here, when StopMonitor() is called the
-	// monitor is not shared any more.
-	if log.V(1) {
-		log.InfofDepth(ctx, 1, "%s, bytes usage max %s",
+	// monitor is not shared any more. The monitor is unregistered first, so
+	// that MonitorHandles can't access it either. The accounts may still be
+	// used by straggling goroutines though, so the monitor is then marked as
+	// stopped under the lock: their operations find it stopped from then on,
+	// and don't touch the rest of its state.
+	mm.mu.Lock()
+	if mm.mu.stopDone {
+		stats := mm.mu.stopStats
+		mm.mu.Unlock()
+		return stats
+	}
+	mm.mu.Unlock()
+	unregisterMonitor(mm)
+	mm.doneWatch.stop()
+	mm.mu.Lock()
+	mm.mu.stopped = true
+	atomic.StoreInt32(&mm.stoppedFlag, 1)
+	mm.mu.Unlock()
+
+	if mm.log().V(1) {
+		mm.log().Infof(ctx, "%s, bytes usage max %s",
 			mm.name,
 			humanizeutil.IBytes(mm.mu.maxAllocated))
 	}
 
-	if check && mm.mu.curAllocated != 0 {
-		var reportables []interface{}
-		log.ReportOrPanic(
-			ctx, &mm.settings.SV,
-			fmt.Sprintf("%s: unexpected %d leftover bytes", mm.name, mm.mu.curAllocated),
-			reportables)
-		mm.releaseBytes(ctx, mm.mu.curAllocated)
+	if mm.mu.curAllocated != 0 {
+		if check {
+			mm.reactToLeak(ctx)
+		}
+		mm.releaseBytesLocked(ctx, mm.mu.curAllocated)
 	}
 
+	mm.mu.emergencyHeld = 0
 	mm.releaseBudget(ctx)
+	mm.flushMetricsLocked()
 
 	if mm.maxBytesHist != nil && mm.mu.maxAllocated > 0 {
 		// TODO(knz): We record the logarithm because the UI doesn't know
@@ -411,13 +736,63 @@ func (mm *BytesMonitor) doStop(ctx context.Context, check bool) {
 		val := int64(1000 * math.Log(float64(mm.mu.maxAllocated)) / math.Ln10)
 		mm.maxBytesHist.RecordValue(val)
 	}
+	stats := MonitorStats{
+		Lifetime:       mm.clock().Now().Sub(mm.mu.started),
+		MaxAllocated:   mm.mu.maxAllocated,
+		Categories:     mm.categoryUsageLocked(),
+		ReleasedToPool: mm.mu.releasedToPool,
+		PoolRoundTrips: mm.mu.poolRoundTrips,
+	}
+	mm.recordLifetime(stats)
+	// NB: this is only marked once the stop went through, so that a monitor
+	// whose Stop panicked on a leak can still be stopped with EmergencyStop.
+	mm.mu.Lock()
+	mm.mu.stopDone = true
+	mm.mu.stopStats = stats
+	mm.mu.Unlock()
 
 	// Disable the pool for further allocations, so that further
 	// uses outside of monitor control get errors.
+	mm.mu.curBudget.mon.removeChild(mm)
 	mm.mu.curBudget.mon = nil
+	if mm.carveOutOf != nil {
+		mm.carveOutOf.removeCarveOut(mm)
+	}
 
 	// Release the reserved budget to its original pool, if any.
 	mm.reserved.Clear(ctx)
+	atomic.StoreInt64(&mm.approxHeadroom, 0)
+	mm.updateUsageSplitLocked()
+	return stats
+}
+
+// ReleaseReserved gives n bytes of the pre-reserved budget of the monitor
+// back to whoever granted it, for monitors that know they are past their
+// peak usage. The allocations that no longer fit in the remaining
+// pre-reserved budget are moved to the budget obtained from the pool. If the
+// pool refuses them, an error is returned and nothing is released.
+func (mm *BytesMonitor) ReleaseReserved(ctx context.Context, n int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if n < 0 || n > mm.reserved.used {
+		return errors.Errorf("%s: cannot release %d bytes of reserved budget, %d reserved",
+			mm.name, n, mm.reserved.used)
+	}
+	remaining := mm.reserved.used - n
+	if missing := mm.mu.curAllocated + mm.mu.emergencyHeld - mm.mu.curBudget.used - remaining; missing > 0 {
+		if err := mm.increaseBudget(ctx, missing); err != nil {
+			return errors.Wrapf(err, "releasing %d bytes of reserved budget", n)
+		}
+	}
+	if mm.reserved.mon == nil {
+		// A standalone budget has nobody to return the bytes to.
+		mm.reserved.used = remaining
+	} else {
+		mm.reserved.Shrink(ctx, n)
+	}
+	mm.publishHeadroomLocked()
+	mm.updateUsageSplitLocked()
+	return nil
 }
 
 // MaximumBytes returns the maximum number of bytes that were allocated by this
@@ -428,6 +803,134 @@ func (mm *BytesMonitor) MaximumBytes() int64 {
 	return mm.mu.maxAllocated
 }
 
+// AllocBytes returns the number of bytes currently allocated through this
+// monitor.
+func (mm *BytesMonitor) AllocBytes() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.curAllocated
+}
+
+// DebugString returns a one-line description of the state of the monitor,
+// for use in logs and test failures.
+func (mm *BytesMonitor) DebugString() string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	pool := "(none)"
+	if mm.mu.curBudget.mon != nil {
+		pool = mm.mu.curBudget.mon.name
+	}
+	limit := "none"
+	if mm.limit != math.MaxInt64 {
+		limit = fmt.Sprint(mm.limit)
+	}
+	var labels string
+	if len(mm.mu.labels) > 0 {
+		labels = " [" + formatLabels(mm.mu.labels) + "]"
+	}
+	var external string
+	for _, e := range mm.externalSourcesLocked() {
+		external += fmt.Sprintf(", %d bytes of external usage from %s", e.Bytes, e.Name)
+	}
+	var frozen string
+	if mm.mu.frozen {
+		frozen = ", frozen"
+	}
+	return fmt.Sprintf("%s%s: %d bytes allocated (max %d), %d bytes of budget from pool %s, "+
+		"%d bytes pre-reserved, limit %s%s%s",
+		mm.name, labels, mm.mu.curAllocated, mm.mu.maxAllocated, mm.mu.curBudget.allocated(), pool,
+		mm.reserved.used, limit, external, frozen)
+}
+
+// MonitorSnapshot is a snapshot of the counters of a monitor, as taken by
+// Snapshot. It is used by the tests to check the accounting invariants (see
+// package montest) and by the registry to describe the started monitors (see
+// MonitorHandle.Snapshot).
+type MonitorSnapshot struct {
+	// Allocated is the number of bytes allocated through the monitor.
+	Allocated int64
+	// PoolBudget is the number of bytes granted to the monitor by its pool,
+	// including the part not yet parceled out to its accounts.
+	PoolBudget int64
+	// PoolBudgetUsed is the part of PoolBudget in use by the monitor.
+	PoolBudgetUsed int64
+	// Reserved is the pre-reserved budget the monitor was started with.
+	Reserved int64
+	// Pool is the monitor's pool, or nil.
+	Pool *BytesMonitor
+	// InBurst is set if the usage is above the limit of the monitor thanks to
+	// its burst allowance (see WithBurst).
+	InBurst bool
+	// EmergencyReserve is the part of the emergency reserve of the monitor
+	// that is not used (see WithEmergencyReserve).
+	EmergencyReserve int64
+	// WouldDeny is the number of allocations granted in ReportOnly mode that
+	// the limit would have denied (see SetEnforcement).
+	WouldDeny int64
+	// Labels are the labels of the monitor (see WithLabels).
+	Labels []Label
+	// ID is the ID of the monitor (see BytesMonitor.ID).
+	ID uint64
+	// StartStack is the stack that started the monitor, if recorded (see
+	// the COCKROACH_DEBUG_MONITOR_REGISTRY environment variable).
+	StartStack []byte
+	// Categories is the usage of the categories of allocations of the
+	// monitor (see WithCategories).
+	Categories []CategoryUsage
+	// MaxUnusedBytes is the cap on the budget the monitor keeps from its pool
+	// without using it (see WithMaxUnusedBytes).
+	MaxUnusedBytes int64
+	// ReleasedToPool and PoolRoundTrips are the churn of the monitor since
+	// it was started (see WithChurnCounters).
+	ReleasedToPool int64
+	PoolRoundTrips int64
+	// ReservedUsage and PoolUsage split CurAllocated between the
+	// pre-reserved budget and the budget obtained from the pool (see
+	// WithUsageSplitGauges).
+	ReservedUsage int64
+	PoolUsage     int64
+	// ReservationRate is the moving average of the number of reservations
+	// per second (see WithReservationRateHalfLife), as of the last call to
+	// ReservationRate: the state doesn't change with the passage of time.
+	ReservationRate float64
+	// Frozen is set if the monitor denies all new reservations (see
+	// SetFrozen).
+	Frozen bool
+	// External is the usage reported by each of the sources registered via
+	// RegisterExternalUsage.
+	External []ExternalUsageSource
+}
+
+// Snapshot returns a snapshot of the monitor's counters, taken under its
+// lock so that they are consistent with each other.
+func (mm *BytesMonitor) Snapshot() MonitorSnapshot {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	reserved, pool := mm.usageSplitLocked()
+	return MonitorSnapshot{
+		Allocated:        mm.mu.curAllocated,
+		PoolBudget:       mm.mu.curBudget.allocated(),
+		PoolBudgetUsed:   mm.mu.curBudget.used,
+		Reserved:         mm.reserved.used,
+		Pool:             mm.mu.curBudget.mon,
+		InBurst:          !mm.mu.burstStart.IsZero(),
+		WouldDeny:        mm.mu.wouldDeny,
+		EmergencyReserve: mm.mu.emergencyHeld,
+		Labels:           append([]Label(nil), mm.mu.labels...),
+		ID:               mm.mu.id,
+		StartStack:       mm.mu.startStack,
+		Categories:       mm.categoryUsageLocked(),
+		MaxUnusedBytes:   mm.maxUnusedBytes,
+		ReleasedToPool:   mm.mu.releasedToPool,
+		PoolRoundTrips:   mm.mu.poolRoundTrips,
+		ReservedUsage:    reserved,
+		PoolUsage:        pool,
+		ReservationRate:  mm.mu.resRate.value,
+		Frozen:           mm.mu.frozen,
+		External:         mm.externalSourcesLocked(),
+	}
+}
+
 // BoundAccount tracks the cumulated allocations for one client of a pool or
 // monitor. BytesMonitor has an account to its pool; BytesMonitor clients have
 // an account to the monitor. This allows each client to release all the bytes
@@ -438,11 +941,37 @@ func (mm *BytesMonitor) MaximumBytes() int64 {
 // See the comments in bytes_usage.go for a fuller picture of how these accounts
 // are used in CockroachDB.
 type BoundAccount struct {
+	// canary detects concurrent use under the race detector. It is empty in
+	// other builds; it comes first so that it doesn't cause padding.
+	canary accountCanary
+
 	used int64
 	// reserved is a small buffer to amortize the cost of growing an account. It
 	// decreases as used increases (and vice-versa).
 	reserved int64
 	mon      *BytesMonitor
+	// opened is set on accounts made by OpenAccount, which count towards the
+	// cap on open accounts of the monitor until they are closed.
+	opened bool
+	// quantum, if positive, is the minimum step by which the account grows
+	// its reservation from the monitor; see SetQuantum.
+	quantum int64
+	// watch is set on accounts closed when a context is done; see
+	// CloseOnDone.
+	watch *accountWatch
+	// overhead is the number of bytes charged to the monitor on top of used
+	// and reserved, by its overhead multiplier; see WithOverheadMultiplier.
+	overhead int64
+	// noOverhead is set on the accounts holding the budgets of child
+	// monitors, which are charged without overhead.
+	noOverhead bool
+	// pageSize, if positive, puts the account in page mode; see
+	// SetPageSize.
+	pageSize int64
+	// categories, if set, holds the bytes of the account counted in each
+	// category of the monitor; see GrowCategory. They are released from the
+	// categories when the account is cleared or closed.
+	categories *[MaxCategories]int64
 }
 
 // MakeStandaloneBudget creates a BoundAccount suitable for root
@@ -461,47 +990,199 @@ func (b BoundAccount) Monitor() *BytesMonitor {
 	return b.mon
 }
 
-func (b BoundAccount) allocated() int64 {
-	return b.used + b.reserved
+// Allocated returns the number of bytes reserved from the monitor on behalf
+// of this account: the bytes in use plus the unused reservation kept to
+// amortize future growth, plus their overhead (see WithOverheadMultiplier).
+func (b BoundAccount) Allocated() int64 {
+	return b.allocated()
+}
+
+func (b *BoundAccount) allocated() int64 {
+	return b.used + b.reserved + b.overhead
+}
+
+// monitorName returns the name of the monitor of the account, for error
+// messages.
+func (b *BoundAccount) monitorName() string {
+	if b.mon == nil {
+		return "standalone budget"
+	}
+	return b.mon.name
 }
 
 // MakeBoundAccount creates a BoundAccount connected to the given monitor.
 func (mm *BytesMonitor) MakeBoundAccount() BoundAccount {
-	return BoundAccount{mon: mm}
+	return BoundAccount{mon: mm, pageSize: mm.pageSize}
+}
+
+// MakeBoundAccountFor creates a BoundAccount connected to the given monitor
+// and grows it by n bytes, for the common case of an account wrapping an
+// object of known size. If the growth is refused the error is returned along
+// with a zero account, which can safely be closed but must not be used
+// otherwise.
+func (mm *BytesMonitor) MakeBoundAccountFor(ctx context.Context, n int64) (BoundAccount, error) {
+	b := mm.MakeBoundAccount()
+	if err := b.Grow(ctx, n); err != nil {
+		return BoundAccount{}, err
+	}
+	return b, nil
+}
+
+// SetQuantum makes the account grow its reservation from the monitor in
+// steps of at least quantum bytes, independently of the allocation size of
+// the monitor, and keep up to quantum bytes reserved when it shrinks. This
+// lets accounts growing by a handful of bytes at a time, at high frequency,
+// hit the monitor less often, at the cost of up to quantum bytes of slack
+// charged to the monitor but unused; Clear and Close return the slack. 0
+// restores the default.
+func (b *BoundAccount) SetQuantum(quantum int64) {
+	b.quantum = quantum
 }
 
 // Clear releases all the cumulated allocations of an account at once and
 // primes it for reuse.
+//
+// Clear also empties a standalone budget (see MakeStandaloneBudget), as by
+// Shrink, so that it behaves like any other Allocator; it used to leave it
+// untouched. Monitors hold a copy of the budget they are started with, so
+// clearing it on Stop doesn't affect the caller's budget.
 func (b *BoundAccount) Clear(ctx context.Context) {
 	if b.mon == nil {
 		// An account created by MakeStandaloneBudget is disconnected from any
-		// monitor -- "bytes out of the aether". This needs not be closed.
+		// monitor -- "bytes out of the aether". There is nobody to return
+		// them to.
+		b.used = 0
 		return
 	}
-	b.Close(ctx)
+	if w := b.watch; w != nil {
+		if !w.enter() {
+			return
+		}
+		defer w.exit(ctx, b)
+	}
+	b.canary.touch()
+	if r := b.mon.testingRecorder; r != nil {
+		r.record(b, "clear", b.used, nil)
+	}
+	b.close(ctx)
 	b.used = 0
 	b.reserved = 0
+	b.overhead = 0
 }
 
 // Close releases all the cumulated allocations of an account at once.
+// Closing it again is a no-op.
 func (b *BoundAccount) Close(ctx context.Context) {
 	if b.mon == nil {
 		// An account created by MakeStandaloneBudget is disconnected from any
 		// monitor -- "bytes out of the aether". This needs not be closed.
 		return
 	}
+	if w := b.watch; w != nil {
+		b.watch = nil
+		if !w.claimByOwner() {
+			// The account was closed because its context was done.
+			return
+		}
+	}
+	b.closeUnwatched(ctx)
+}
+
+// closeUnwatched is Close, for an account that isn't watched by CloseOnDone
+// or whose watch is over.
+func (b *BoundAccount) closeUnwatched(ctx context.Context) {
+	if r := b.mon.testingRecorder; r != nil {
+		r.record(b, "close", b.used, nil)
+	}
+	b.close(ctx)
+	b.used = 0
+	b.reserved = 0
+	b.overhead = 0
+	if b.opened {
+		b.mon.closeAccount(b)
+		b.opened = false
+	}
+}
+
+func (b *BoundAccount) close(ctx context.Context) {
+	b.releaseCategories()
 	if a := b.allocated(); a > 0 {
 		b.mon.releaseBytes(ctx, a)
 	}
 }
 
+// MergeInto moves all the usage of the account to dst and closes the
+// account, e.g. when two pipelines are fused and one of them hands over its
+// memory to the other. If both accounts are bound to the same monitor, the
+// bytes and their reservation change hands without involving the monitor.
+// Otherwise dst is grown by the usage of the account, which is then closed;
+// if dst can't grow, the error is returned and neither account changes.
+// After a successful merge, the account is reset to a zero account that can
+// be closed as a no-op.
+func (b *BoundAccount) MergeInto(ctx context.Context, dst *BoundAccount) error {
+	if b == dst {
+		return errors.New("cannot merge an account into itself")
+	}
+	if b.mon == nil {
+		// Standalone budgets and already merged accounts have nothing to
+		// hand over.
+		return nil
+	}
+	if w := b.watch; w != nil {
+		// The merge closes the account, so it needs no watching.
+		b.watch = nil
+		if !w.claimByOwner() {
+			// The account was closed because its context was done, and has
+			// nothing to hand over.
+			*b = BoundAccount{}
+			return nil
+		}
+	}
+	b.canary.touch()
+	if b.mon == dst.mon {
+		dst.canary.touch()
+		if r := b.mon.testingRecorder; r != nil {
+			r.record(b, "merge", b.used, nil)
+		}
+		dst.used += b.used
+		dst.reserved += b.reserved
+		dst.overhead += b.overhead
+		dst.mergeCategories(b)
+		if b.opened {
+			b.mon.closeAccount(b)
+		}
+		*b = BoundAccount{}
+		return nil
+	}
+	if err := dst.Grow(ctx, b.used); err != nil {
+		return err
+	}
+	b.Close(ctx)
+	*b = BoundAccount{}
+	return nil
+}
+
 // Resize requests a size change for an object already registered in an
 // account. The reservation is not modified if the new allocation is refused,
 // so that the caller can keep using the original item without an accounting
 // error. This is better than calling ClearAccount then GrowAccount because if
 // the Clear succeeds and the Grow fails the original item becomes invisible
 // from the perspective of the monitor.
+//
+// The old size must be between zero and the usage of the account: otherwise
+// the account would be driven negative, so an assertion error is returned
+// without changing anything. In race builds, Resize panics instead, to catch
+// the bug in tests.
 func (b *BoundAccount) Resize(ctx context.Context, oldSz, newSz int64) error {
+	b.canary.touch()
+	if oldSz < 0 || oldSz > b.used {
+		err := pgerror.NewAssertionErrorf("%s: resizing an item of %d bytes in an account of %d bytes",
+			b.monitorName(), oldSz, b.used)
+		if util.RaceEnabled {
+			panic(err)
+		}
+		return err
+	}
 	delta := newSz - oldSz
 	switch {
 	case delta > 0:
@@ -514,12 +1195,85 @@ func (b *BoundAccount) Resize(ctx context.Context, oldSz, newSz int64) error {
 
 // Grow is an accessor for b.mon.GrowAccount.
 func (b *BoundAccount) Grow(ctx context.Context, x int64) error {
+	if w := b.watch; w != nil {
+		if !w.enter() {
+			return b.errClosedOnDone()
+		}
+		defer w.exit(ctx, b)
+	}
+	b.canary.touch()
+	if b.mon != nil && b.mon.testingRecorder != nil {
+		err := b.grow(ctx, x, "" /* op */)
+		b.mon.testingRecorder.record(b, "grow", x, err)
+		return err
+	}
+	return b.grow(ctx, x, "" /* op */)
+}
+
+// GrowReturning is like Grow, but also returns the number of bytes used by
+// the account after the growth, for callers that compare the usage of the
+// account to their own thresholds. If the growth is refused, the returned
+// usage is the unchanged usage of the account.
+func (b *BoundAccount) GrowReturning(ctx context.Context, x int64) (newUsed int64, _ error) {
+	err := b.Grow(ctx, x)
+	return b.used, err
+}
+
+// GrowWithContext is like Grow, but op describes the operation needing the
+// memory (e.g. "building hash table for join"). The description is added to
+// the error if the growth is refused, and to the log message reporting a
+// noteworthy increase in usage. It must be a constant string without any
+// user data, as it ends up in logs and crash reports.
+func (b *BoundAccount) GrowWithContext(ctx context.Context, x int64, op string) error {
+	if w := b.watch; w != nil {
+		if !w.enter() {
+			return b.errClosedOnDone()
+		}
+		defer w.exit(ctx, b)
+	}
+	b.canary.touch()
+	err := b.grow(ctx, x, op)
+	if b.mon != nil && b.mon.testingRecorder != nil {
+		b.mon.testingRecorder.record(b, "grow", x, err)
+	}
+	if err != nil {
+		return errors.Wrap(err, op)
+	}
+	return nil
+}
+
+func (b *BoundAccount) grow(ctx context.Context, x int64, op string) error {
+	if b.mon == nil {
+		// A standalone budget grows out of the aether.
+		b.used += x
+		return nil
+	}
 	if b.reserved < x {
 		minExtra := b.mon.roundSize(x)
-		if err := b.mon.reserveBytes(ctx, minExtra); err != nil {
-			return err
+		if q := b.quantum; q > 0 && x < math.MaxInt64-q {
+			if r := ((x + q - 1) / q) * q; r > minExtra {
+				minExtra = r
+			}
+		}
+		if b.pageSize > 0 {
+			minExtra = b.pageExtra(x)
 		}
+		overhead := b.overheadCost(minExtra)
+		charged := saturatingAdd(minExtra, overhead)
+		if err := b.mon.reserveBytesForOp(ctx, charged, op); err != nil {
+			// If a limit or a budget was hit, try to make room by evicting
+			// from the caches registered with the monitor and its pools, and
+			// retry once if anything was freed.
+			if !evictionMayHelp(err) || b.mon.evictCaches(ctx, b, charged) == 0 {
+				return err
+			}
+			if err := b.mon.reserveBytesForOp(ctx, charged, op); err != nil {
+				return err
+			}
+		}
+		b.mon.evictAboveSoftLimit(ctx, b)
 		b.reserved += minExtra
+		b.overhead += overhead
 	}
 	b.reserved -= x
 	b.used += x
@@ -528,44 +1282,116 @@ func (b *BoundAccount) Grow(ctx context.Context, x int64) error {
 
 // Shrink releases part of the cumulated allocations by the specified size.
 func (b *BoundAccount) Shrink(ctx context.Context, delta int64) {
+	if w := b.watch; w != nil {
+		if !w.enter() {
+			return
+		}
+		defer w.exit(ctx, b)
+	}
 	if b.used < delta {
 		panic(fmt.Sprintf("%s: no bytes in account to release, current %d, free %d",
-			b.mon.name, b.used, delta))
+			b.monitorName(), b.used, delta))
+	}
+	b.canary.touch()
+	if b.mon == nil {
+		b.used -= delta
+		return
+	}
+	if r := b.mon.testingRecorder; r != nil {
+		r.record(b, "shrink", delta, nil)
 	}
 	b.used -= delta
 	b.reserved += delta
-	if b.reserved >= b.mon.poolAllocationSize {
-		b.mon.releaseBytes(ctx, b.reserved-b.mon.poolAllocationSize)
-		b.reserved = b.mon.poolAllocationSize
+	retain := b.mon.allocationSize()
+	if b.mon.reservationPolicy == ReleaseEagerly {
+		retain = 0
+	}
+	if b.quantum > retain {
+		retain = b.quantum
+	}
+	if b.pageSize > 0 {
+		retain = b.pageRetain()
+	}
+	if b.reserved > retain {
+		released := b.reserved - retain
+		b.reserved = retain
+		b.mon.releaseBytes(ctx, released+b.shedOverhead())
 	}
 }
 
 // reserveBytes declares an allocation to this monitor. An error is returned if
 // the allocation is denied.
 func (mm *BytesMonitor) reserveBytes(ctx context.Context, x int64) error {
+	return mm.reserveBytesForOp(ctx, x, "" /* op */)
+}
+
+// reserveBytesForOp is like reserveBytes, with a description of the
+// operation performing the allocation for logging; see GrowWithContext.
+func (mm *BytesMonitor) reserveBytesForOp(ctx context.Context, x int64, op string) error {
+	// The callback notifying the expiry of a burst, the logging of the top
+	// consumers, the heap profile hook, the dump on exhaustion, the
+	// exhaustion event and the telemetry of denials run after the monitor is
+	// unlocked.
+	var burstExpired, logTopConsumers, captureHeapProfile, limitHit bool
+	var dumpErr error
+	var exhaustionEvent *BudgetExhaustedEvent
+	if mm.stoppedAtomic() {
+		return mm.errStopped()
+	}
+	mm.noteReservation()
+	defer func() {
+		if limitHit {
+			countTelemetry(limitHitTelemetryKey(mm.name))
+		}
+		if burstExpired && mm.burst.onExpired != nil {
+			mm.burst.onExpired(ctx)
+		}
+		if logTopConsumers {
+			mm.logTopConsumers(ctx)
+		}
+		if captureHeapProfile {
+			mm.heapProfile.capture(ctx)
+		}
+		if dumpErr != nil {
+			mm.dumpExhaustion(ctx, x, dumpErr)
+		}
+		if exhaustionEvent != nil {
+			mm.logExhaustionEvent(ctx, exhaustionEvent)
+		}
+	}()
 	mm.mu.Lock()
 	defer mm.mu.Unlock()
-	// Check the local limit first. NB: The condition is written in this manner
-	// so that it handles overflow correctly. Consider what happens if
-	// x==math.MaxInt64. mm.limit-x will be a large negative number.
-	if mm.mu.curAllocated > mm.limit-x {
-		return errors.Wrap(
-			mm.resource.NewBudgetExceededError(x, mm.mu.curAllocated, mm.limit), mm.name,
+	if mm.mu.stopped {
+		// The monitor was stopped since the check above.
+		return mm.errStopped()
+	}
+	if mm.mu.frozen {
+		return mm.errFrozen()
+	}
+	if fi := mm.testingFailureInjector; fi != nil && fi.shouldDeny(x) {
+		err := mm.newBudgetExceededError(
+			LocalLimit, x, mm.mu.curAllocated, mm.mu.curBudget.used+mm.reserved.used,
 		)
+		err.reason = "injected failure"
+		mm.denialCounts.count(err)
+		return err
 	}
-	// Check whether we need to request an increase of our budget.
-	if mm.mu.curAllocated > mm.mu.curBudget.used+mm.reserved.used-x {
-		if err := mm.increaseBudget(ctx, x); err != nil {
-			return err
+	overLimit, burstExpired, err := mm.admitLocked(ctx, x, false /* dryRun */)
+	if err != nil {
+		mm.denialCounts.count(err)
+		limitHit = mm.noteLimitHitLocked()
+		exhaustionEvent = mm.exhaustionEventLocked(err)
+		if mm.shouldDumpExhaustionLocked() {
+			dumpErr = err
 		}
+		return err
 	}
-	mm.mu.curAllocated += x
-	if mm.curBytesCount != nil {
-		mm.curBytesCount.Inc(x)
-	}
-	if mm.mu.maxAllocated < mm.mu.curAllocated {
-		mm.mu.maxAllocated = mm.mu.curAllocated
+	mm.allocateLocked(x)
+	if overLimit {
+		mm.startBurstLocked()
 	}
+	logTopConsumers = mm.shouldLogTopConsumersLocked()
+	captureHeapProfile = mm.shouldCaptureHeapProfileLocked()
 
 	// Report "large" queries to the log for further investigation.
 	if mm.mu.curAllocated > mm.noteworthyUsageBytes {
@@ -573,62 +1399,210 @@ func (mm *BytesMonitor) reserveBytes(ctx context.Context, x int64) error {
 		// limit the amount of log messages when a size blowup is caused by
 		// many small allocations.
 		if bits.Len64(uint64(mm.mu.curAllocated)) != bits.Len64(uint64(mm.mu.curAllocated-x)) {
-			log.Infof(ctx, "%s: bytes usage increases to %s (+%d)",
-				mm.name,
-				humanizeutil.IBytes(mm.mu.curAllocated), x)
+			if op == "" {
+				mm.log().Infof(ctx, "%s: bytes usage increases to %s (+%d)",
+					mm.name,
+					humanizeutil.IBytes(mm.mu.curAllocated), x)
+			} else {
+				mm.log().Infof(ctx, "%s: bytes usage increases to %s (+%d) while %s",
+					mm.name,
+					humanizeutil.IBytes(mm.mu.curAllocated), x, op)
+			}
 		}
 	}
 
-	if log.V(2) {
+	if mm.log().V(2) {
 		// We avoid VEventf here because we want to avoid computing the
 		// trace string if there is nothing to log.
-		log.Infof(ctx, "%s: now at %d bytes (+%d) - %s",
+		mm.log().Infof(ctx, "%s: now at %d bytes (+%d) - %s",
 			mm.name, mm.mu.curAllocated, x, util.GetSmallTrace(3))
 	}
 	return nil
 }
 
+// allocateLocked records an allocation of x bytes, once admitted.
+func (mm *BytesMonitor) allocateLocked(x int64) {
+	mm.mu.curAllocated += x
+	atomic.StoreInt64(&mm.approxAllocated, mm.mu.curAllocated)
+	atomic.AddUint64(&mm.activity, 1)
+	mm.updateCurBytesLocked(x)
+	addTagUsage(mm.mu.tag, x)
+	if mm.tracksUsageHistory() {
+		mm.recordUsageChangeLocked(mm.mu.curAllocated - x)
+	}
+	if mm.mu.maxAllocated < mm.mu.curAllocated {
+		mm.mu.maxAllocated = mm.mu.curAllocated
+	}
+	if mm.releaseKind == releaseDelayed {
+		mm.noteIdleBudgetLocked()
+	}
+	mm.publishHeadroomLocked()
+	mm.updateUsageSplitLocked()
+}
+
+// admitLocked checks whether an allocation of x bytes can be admitted, and
+// increases the budget of the monitor if needed. It returns whether the
+// allocation takes the usage above the limit (thanks to the burst allowance
+// or the ReportOnly mode), and whether the burst allowance just expired.
+//
+// In dryRun mode (see TestReserve), the same checks are performed, and the
+// same error is returned, but the monitor and its pools are not modified.
+func (mm *BytesMonitor) admitLocked(
+	ctx context.Context, x int64, dryRun bool,
+) (overLimit bool, burstExpired bool, _ error) {
+	mm.refreshLimitLocked()
+	// External usage reduces the headroom of the monitor without being
+	// allocated through it.
+	used := mm.mu.curAllocated + mm.externalUsageLocked()
+	// Check the local limit first. NB: The condition is written in this manner
+	// so that it handles overflow correctly. Consider what happens if
+	// x==math.MaxInt64. mm.limit-x will be a large negative number. The
+	// emergency reserve counts against the limit.
+	overLimit = used > mm.limit-mm.mu.emergencyHeld-x
+	if overLimit {
+		allowed, expired := mm.burstAllowsLocked(used+mm.mu.emergencyHeld, x)
+		if !allowed {
+			err := mm.newBudgetExceededError(LocalLimit, x, used, mm.limit)
+			err.Hint = fmt.Sprintf("%s reached its limit", mm.name)
+			if expired {
+				err.reason = fmt.Sprintf("burst above limit lasted more than %s", mm.burst.duration)
+				if !dryRun && !mm.mu.burstExpired {
+					// Notify the expiry once.
+					mm.mu.burstExpired = true
+					burstExpired = true
+				}
+			}
+			if mm.mu.enforcement == Enforced {
+				return false, burstExpired, err
+			}
+			if !dryRun {
+				mm.noteWouldDenyLocked(ctx, err)
+			}
+		}
+	}
+	// Without a pool, the external usage also competes for the reserved
+	// budget.
+	if used != mm.mu.curAllocated && mm.mu.curBudget.mon == nil && used > mm.reserved.used-x {
+		return false, burstExpired, mm.noPoolErrorLocked(x, used)
+	}
+	// Check whether we need to request an increase of our budget.
+	if free := mm.freeBudgetLocked(); free < x {
+		request := x
+		if mm.maxUnusedBytes > 0 && free > 0 {
+			// Only ask for the missing bytes; see WithMaxUnusedBytes.
+			request = x - free
+		}
+		var err error
+		if dryRun {
+			err = mm.testIncreaseBudgetLocked(ctx, request)
+		} else {
+			err = mm.increaseBudget(ctx, request)
+		}
+		if err != nil {
+			return false, burstExpired, err
+		}
+	}
+	return overLimit, burstExpired, nil
+}
+
 // releaseBytes releases bytes previously successfully registered via
-// reserveBytes().
+// reserveBytes(). Releases after the monitor is stopped are ignored: the
+// monitor released all its bytes when it stopped.
 func (mm *BytesMonitor) releaseBytes(ctx context.Context, sz int64) {
 	mm.mu.Lock()
 	defer mm.mu.Unlock()
+	if mm.mu.stopped {
+		mm.log().Warningf(ctx, "%s: ignoring the release of %d bytes after the monitor stopped",
+			mm.name, sz)
+		return
+	}
+	mm.releaseBytesLocked(ctx, sz)
+}
+
+// releaseBytesLocked is like releaseBytes, for a monitor that is locked or
+// being stopped.
+func (mm *BytesMonitor) releaseBytesLocked(ctx context.Context, sz int64) {
 	if mm.mu.curAllocated < sz {
 		panic(fmt.Sprintf("%s: no bytes to release, current %d, free %d",
 			mm.name, mm.mu.curAllocated, sz))
 	}
 	mm.mu.curAllocated -= sz
-	if mm.curBytesCount != nil {
-		mm.curBytesCount.Dec(sz)
+	atomic.StoreInt64(&mm.approxAllocated, mm.mu.curAllocated)
+	atomic.AddUint64(&mm.activity, 1)
+	mm.updateCurBytesLocked(-sz)
+	addTagUsage(mm.mu.tag, -sz)
+	if mm.tracksUsageHistory() {
+		mm.recordUsageChangeLocked(mm.mu.curAllocated + sz)
 	}
+	if mm.heapProfile.capture != nil {
+		mm.maybeRearmHeapProfileLocked()
+	}
+	if mm.emergencyReserve > 0 {
+		mm.refillEmergencyReserveLocked()
+	}
+	// NB: this comes after the refill of the emergency reserve, which counts
+	// against the limit.
+	mm.maybeEndBurstLocked()
 	mm.adjustBudget(ctx)
+	mm.publishHeadroomLocked()
+	mm.updateUsageSplitLocked()
 
-	if log.V(2) {
+	if mm.log().V(2) {
 		// We avoid VEventf here because we want to avoid computing the
 		// trace string if there is nothing to log.
-		log.Infof(ctx, "%s: now at %d bytes (-%d) - %s",
+		mm.log().Infof(ctx, "%s: now at %d bytes (-%d) - %s",
 			mm.name, mm.mu.curAllocated, sz, util.GetSmallTrace(3))
 	}
 }
 
+// tracksUsageHistory returns whether the monitor records the changes of its
+// usage over time, which requires reading the clock.
+func (mm *BytesMonitor) tracksUsageHistory() bool {
+	return mm.peakInterval > 0 || mm.smoothingHalfLife > 0
+}
+
+// recordUsageChangeLocked records a change of the usage of the monitor, from
+// before to the current allocation, for the windowed maximum and the moving
+// average.
+func (mm *BytesMonitor) recordUsageChangeLocked(before int64) {
+	now := mm.clock().Now()
+	if mm.peakInterval > 0 {
+		mm.updatePeaksLocked(now, before)
+	}
+	if mm.smoothingHalfLife > 0 {
+		mm.mu.smoothed.update(now, before, mm.smoothingHalfLife)
+	}
+}
+
 // increaseBudget requests more bytes from the pool.
 func (mm *BytesMonitor) increaseBudget(ctx context.Context, minExtra int64) error {
 	// NB: mm.mu Already locked by reserveBytes().
 	if mm.mu.curBudget.mon == nil {
-		return errors.Wrap(mm.resource.NewBudgetExceededError(
-			minExtra, mm.mu.curAllocated, mm.reserved.used), mm.name,
-		)
+		return mm.noPoolErrorLocked(minExtra, mm.mu.curAllocated)
 	}
-	minExtra = mm.roundSize(minExtra)
-	if log.V(2) {
-		log.Infof(ctx, "%s: requesting %d bytes from the pool", mm.name, minExtra)
+	minExtra = mm.roundBudgetRequest(minExtra)
+	if mm.log().V(2) {
+		mm.log().Infof(ctx, "%s: requesting %d bytes from the pool", mm.name, minExtra)
 	}
+	mm.notePoolRequestLocked()
+
+	return forwardedBy(mm.mu.curBudget.Grow(ctx, minExtra), mm)
+}
 
-	return mm.mu.curBudget.Grow(ctx, minExtra)
+// roundBudgetRequest rounds a request for budget to the pool with
+// roundSize, but by no more than the cap on unused bytes of the monitor, if
+// any.
+func (mm *BytesMonitor) roundBudgetRequest(sz int64) int64 {
+	rounded := mm.roundSize(sz)
+	if mm.maxUnusedBytes > 0 && rounded-sz > mm.maxUnusedBytes {
+		return sz + mm.maxUnusedBytes
+	}
+	return rounded
 }
 
 // roundSize rounds its argument to the smallest greater or equal
-// multiple of `poolAllocationSize`.
+// multiple of `poolAllocationSize`, as adjusted by the pressure mode (see
+// allocationSize).
 func (mm *BytesMonitor) roundSize(sz int64) int64 {
 	const maxRoundSize = 4 << 20 // 4 MB
 	if sz >= maxRoundSize {
@@ -636,35 +1610,68 @@ func (mm *BytesMonitor) roundSize(sz int64) int64 {
 		// edge cases in the math below if sz == math.MaxInt64.
 		return sz
 	}
-	chunks := (sz + mm.poolAllocationSize - 1) / mm.poolAllocationSize
-	return chunks * mm.poolAllocationSize
+	unit := mm.allocationSize()
+	chunks := (sz + unit - 1) / unit
+	return chunks * unit
 }
 
 // releaseBudget relinquishes all the monitor's allocated bytes back to the
 // pool.
 func (mm *BytesMonitor) releaseBudget(ctx context.Context) {
 	// NB: mm.mu need not be locked here, as this is only called from StopMonitor().
-	if log.V(2) {
-		log.Infof(ctx, "%s: releasing %d bytes to the pool", mm.name, mm.mu.curBudget.allocated())
+	if mm.log().V(2) {
+		mm.log().Infof(ctx, "%s: releasing %d bytes to the pool", mm.name, mm.mu.curBudget.allocated())
+	}
+	if n := mm.mu.curBudget.used; n > 0 {
+		mm.noteReturnLocked(n)
 	}
 	mm.mu.curBudget.Clear(ctx)
 }
 
 // adjustBudget ensures that the monitor does not keep many more bytes reserved
-// from the pool than it currently has allocated. Bytes are relinquished when
-// there are at least maxAllocatedButUnusedBlocks*poolAllocationSize bytes
-// reserved but unallocated.
+// from the pool than it currently has allocated, according to its release
+// policy, as adjusted by the pressure mode. With the default policy, bytes
+// are relinquished when there are at least
+// maxAllocatedButUnusedBlocks*poolAllocationSize bytes reserved but
+// unallocated.
 func (mm *BytesMonitor) adjustBudget(ctx context.Context) {
 	// NB: mm.mu Already locked by releaseBytes().
-	margin := mm.poolAllocationSize * int64(maxAllocatedButUnusedBlocks)
+	kind, blocks := mm.effectiveReleaseKind()
+	switch kind {
+	case releaseImmediately:
+		if unused := mm.unusedPoolBudgetLocked(); unused > 0 {
+			mm.returnBudgetLocked(ctx, unused)
+		}
+		return
+	case releaseDelayed:
+		// The budget is released by ReleaseIdleBudget.
+		mm.noteIdleBudgetLocked()
+	default:
+		margin := mm.allocationSize() * int64(blocks)
 
-	neededBytes := mm.mu.curAllocated
-	if neededBytes <= mm.reserved.used {
-		neededBytes = 0
-	} else {
-		neededBytes = mm.roundSize(neededBytes - mm.reserved.used)
+		neededBytes := mm.mu.curAllocated + mm.mu.emergencyHeld
+		if neededBytes <= mm.reserved.used {
+			neededBytes = 0
+		} else {
+			neededBytes = mm.roundSize(neededBytes - mm.reserved.used)
+		}
+		if neededBytes <= mm.mu.curBudget.used-margin {
+			mm.returnBudgetLocked(ctx, mm.mu.curBudget.used-neededBytes)
+		}
 	}
-	if neededBytes <= mm.mu.curBudget.used-margin {
-		mm.mu.curBudget.Shrink(ctx, mm.mu.curBudget.used-neededBytes)
+	if mm.maxUnusedBytes > 0 {
+		if unused := mm.unusedPoolBudgetLocked(); unused > mm.maxUnusedBytes {
+			mm.returnBudgetLocked(ctx, unused-mm.maxUnusedBytes)
+		}
+	}
+}
+
+// unusedPoolBudgetLocked returns the part of the budget obtained from the
+// pool that the monitor doesn't need for its allocations.
+func (mm *BytesMonitor) unusedPoolBudgetLocked() int64 {
+	needed := mm.mu.curAllocated + mm.mu.emergencyHeld - mm.reserved.used
+	if needed < 0 {
+		needed = 0
 	}
+	return mm.mu.curBudget.used - needed
 }
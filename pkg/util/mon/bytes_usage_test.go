@@ -18,214 +18,30 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
-	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 )
 
-// randomSize generates a size greater or equal to zero, with a random
-// distribution that is skewed towards zero and ensures that most
-// generated values are smaller than `mag`.
-func randomSize(rnd *rand.Rand, mag int64) int64 {
-	return int64(rnd.ExpFloat64() * float64(mag) * 0.3679)
-}
-
-func TestMemoryAllocations(t *testing.T) {
-	maxs := []int64{1, 9, 10, 11, 99, 100, 101, 0}
-	hysteresisFactors := []int{1, 2, 10, 10000}
-	poolAllocSizes := []int64{1, 2, 9, 10, 11, 100}
-	preBudgets := []int64{0, 1, 2, 9, 10, 11, 100}
-
-	rnd, seed := randutil.NewPseudoRand()
-	t.Logf("random seed: %v", seed)
-
-	ctx := context.Background()
-	st := cluster.MakeTestingClusterSettings()
-
-	var pool BytesMonitor
-	var m BytesMonitor
-	var paramHeader func()
-
-	accs := make([]BoundAccount, 4)
-	for i := range accs {
-		accs[i] = m.MakeBoundAccount()
-	}
-
-	// The following invariants will be checked at every step of the
-	// test underneath.
-	checkInvariants := func() {
-		t.Helper()
-
-		var sum int64
-		fail := false
-		for accI := range accs {
-			if accs[accI].used < 0 {
-				t.Errorf("account %d went negative: %d", accI, accs[accI].used)
-				fail = true
-			}
-			sum += accs[accI].allocated()
-		}
-		if m.mu.curAllocated < 0 {
-			t.Errorf("monitor current count went negative: %d", m.mu.curAllocated)
-			fail = true
-		}
-		if sum != m.mu.curAllocated {
-			t.Errorf("total account sum %d different from monitor count %d", sum, m.mu.curAllocated)
-			fail = true
-		}
-		if m.mu.curBudget.used < 0 {
-			t.Errorf("monitor current budget went negative: %d", m.mu.curBudget.used)
-			fail = true
-		}
-		avail := m.mu.curBudget.allocated() + m.reserved.used
-		if sum > avail {
-			t.Errorf("total account sum %d greater than total monitor budget %d", sum, avail)
-			fail = true
-		}
-		if pool.mu.curAllocated > pool.reserved.used {
-			t.Errorf("pool cur %d exceeds max %d", pool.mu.curAllocated, pool.reserved.used)
-			fail = true
-		}
-		if m.mu.curBudget.allocated() != pool.mu.curAllocated {
-			t.Errorf("monitor budget %d different from pool cur %d", m.mu.curBudget.used, pool.mu.curAllocated)
-			fail = true
-		}
-
-		if fail {
-			t.Fatal("invariants not preserved")
-		}
-	}
-
-	const numAccountOps = 200
-	var linesBetweenHeaderReminders int
-	var generateHeader func()
-	var reportAndCheck func(string, ...interface{})
-	if log.V(2) {
-		// Detailed output: report the intermediate values of the
-		// important variables at every stage of the test.
-		linesBetweenHeaderReminders = 5
-		generateHeader = func() {
-			fmt.Println("")
-			paramHeader()
-			fmt.Printf(" mcur  mbud  mpre  pool ")
-			for accI := range accs {
-				fmt.Printf("%5s ", fmt.Sprintf("a%d", accI))
-			}
-			fmt.Println("")
-		}
-		reportAndCheck = func(extraFmt string, extras ...interface{}) {
-			t.Helper()
-			fmt.Printf("%5d %5d %5d %5d ", m.mu.curAllocated, m.mu.curBudget.used, m.reserved.used, pool.mu.curAllocated)
-			for accI := range accs {
-				fmt.Printf("%5d ", accs[accI].used)
-			}
-			fmt.Print("\t")
-			fmt.Printf(extraFmt, extras...)
-			fmt.Println("")
-			checkInvariants()
-		}
-	} else {
-		// More compact output.
-		linesBetweenHeaderReminders = numAccountOps
-		if testing.Verbose() {
-			generateHeader = func() { paramHeader() }
-		} else {
-			generateHeader = func() {}
-		}
-		reportAndCheck = func(_ string, _ ...interface{}) {
-			t.Helper()
-			checkInvariants()
-		}
-	}
-
-	for _, max := range maxs {
-		pool = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
-		pool.Start(ctx, nil, MakeStandaloneBudget(max))
-
-		for _, hf := range hysteresisFactors {
-			maxAllocatedButUnusedBlocks = hf
-
-			for _, pb := range preBudgets {
-				mmax := pb + max
-
-				for _, pa := range poolAllocSizes {
-					paramHeader = func() { fmt.Printf("max %d, pb %d, as %d, hf %d\n", max, pb, pa, hf) }
-
-					// We start with a fresh monitor for every set of
-					// parameters.
-					m = MakeMonitor("test", MemoryResource, nil, nil, pa, 1000, st)
-					m.Start(ctx, &pool, MakeStandaloneBudget(pb))
-
-					for i := 0; i < numAccountOps; i++ {
-						if i%linesBetweenHeaderReminders == 0 {
-							generateHeader()
-						}
-
-						// The following implements a random operation generator.
-						// At every test iteration a random account is selected
-						// and then a random operation is performed for that
-						// account.
-
-						accI := rnd.Intn(len(accs))
-						switch rnd.Intn(3 /* number of states below */) {
-						case 0:
-							sz := randomSize(rnd, mmax)
-							reportAndCheck("G [%5d] %5d", accI, sz)
-							err := accs[accI].Grow(ctx, sz)
-							if err == nil {
-								reportAndCheck("G [%5d] ok", accI)
-							} else {
-								reportAndCheck("G [%5d] %s", accI, err)
-							}
-						case 1:
-							reportAndCheck("C [%5d]", accI)
-							accs[accI].Clear(ctx)
-							reportAndCheck("C [%5d]", accI)
-						case 2:
-							osz := rnd.Int63n(accs[accI].used + 1)
-							nsz := randomSize(rnd, mmax)
-							reportAndCheck("R [%5d] %5d %5d", accI, osz, nsz)
-							err := accs[accI].Resize(ctx, osz, nsz)
-							if err == nil {
-								reportAndCheck("R [%5d] ok", accI)
-							} else {
-								reportAndCheck("R [%5d] %s", accI, err)
-							}
-						}
-					}
-
-					// After all operations have been performed, ensure
-					// that closing everything comes back to the initial situation.
-					for accI := range accs {
-						reportAndCheck("CL[%5d]", accI)
-						accs[accI].Clear(ctx)
-						reportAndCheck("CL[%5d]", accI)
-					}
-
-					m.Stop(ctx)
-					if pool.mu.curAllocated != 0 {
-						t.Fatalf("pool not empty after monitor close: %d", pool.mu.curAllocated)
-					}
-				}
-			}
-		}
-		pool.Stop(ctx)
-	}
-}
-
 func TestBoundAccount(t *testing.T) {
 	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
 
-	ctx := context.Background()
+	ctx := TestingContextWithOwner(context.Background(), t)
 	st := cluster.MakeTestingClusterSettings()
 	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
 	m.Start(ctx, nil, MakeStandaloneBudget(100))
 	m.poolAllocationSize = 1
-	maxAllocatedButUnusedBlocks = 1
+	m.maxAllocatedButUnusedBlocks = 1
+	m.reservationPolicy = RetainQuantum
 
 	a1 := m.MakeBoundAccount()
 	a2 := m.MakeBoundAccount()
@@ -266,8 +82,8 @@ func TestBoundAccount(t *testing.T) {
 	a1.Close(ctx)
 	a2.Close(ctx)
 
-	if m.mu.curAllocated != 0 {
-		t.Fatal("closing spans leaves bytes in monitor")
+	if m.AllocBytes() != 0 {
+		t.Fatalf("closing spans leaves bytes in monitor: %s", m.DebugString())
 	}
 
 	if m2 := a1.Monitor(); m2 != &m {
@@ -277,14 +93,75 @@ func TestBoundAccount(t *testing.T) {
 	m.Stop(ctx)
 }
 
+// TestResizeInvalidOldSize checks that Resize rejects an old size that
+// isn't part of the usage of the account, which used to shrink the account
+// below the sizes of the items it holds, or grow it instead of shrinking.
+func TestResizeInvalidOldSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// resize returns the error of Resize, or its panic in race builds.
+	resize := func(oldSz, newSz int64) (err error) {
+		if util.RaceEnabled {
+			defer func() {
+				if r := recover(); r != nil {
+					err = r.(error)
+				}
+			}()
+		}
+		return acc.Resize(ctx, oldSz, newSz)
+	}
+	for _, tc := range []struct{ oldSz, newSz int64 }{
+		// A shrink of 5 bytes would leave 5 bytes for an item of 15 bytes.
+		{20, 15},
+		// A shrink larger than the account.
+		{100, 0},
+		// A growth of 10 bytes, for an item whose size didn't change.
+		{-10, 0},
+	} {
+		err := resize(tc.oldSz, tc.newSz)
+		if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeInternalError {
+			t.Fatalf("%d -> %d: expected an assertion error, got %v", tc.oldSz, tc.newSz, err)
+		}
+		expected := fmt.Sprintf("test: resizing an item of %d bytes in an account of 10 bytes", tc.oldSz)
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q, got %q", expected, err)
+		}
+		if acc.Used() != 10 || m.AllocBytes() != acc.Allocated() {
+			t.Fatalf("%d -> %d: expected the account to be unchanged, got %d bytes used, %d allocated",
+				tc.oldSz, tc.newSz, acc.Used(), m.AllocBytes())
+		}
+	}
+
+	if err := acc.Resize(ctx, 10, 4); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Used() != 4 {
+		t.Fatalf("expected 4 bytes used, got %d", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
 func TestBytesMonitor(t *testing.T) {
 	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
 
-	ctx := context.Background()
+	ctx := TestingContextWithOwner(context.Background(), t)
 	st := cluster.MakeTestingClusterSettings()
 	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
 	m.Start(ctx, nil, MakeStandaloneBudget(100))
-	maxAllocatedButUnusedBlocks = 1
+	m.maxAllocatedButUnusedBlocks = 1
 
 	if err := m.reserveBytes(ctx, 10); err != nil {
 		t.Fatalf("monitor refused small allocation: %v", err)
@@ -295,13 +172,13 @@ func TestBytesMonitor(t *testing.T) {
 	if err := m.reserveBytes(ctx, 90); err != nil {
 		t.Fatalf("monitor refused top allocation: %v", err)
 	}
-	if m.mu.curAllocated != 100 {
-		t.Fatalf("incorrect current allocation: got %d, expected %d", m.mu.curAllocated, 100)
+	if cur := m.AllocBytes(); cur != 100 {
+		t.Fatalf("incorrect current allocation: got %d, expected %d\n%s", cur, 100, m.DebugString())
 	}
 
 	m.releaseBytes(ctx, 90) // Should succeed without panic.
-	if m.mu.curAllocated != 10 {
-		t.Fatalf("incorrect current allocation: got %d, expected %d", m.mu.curAllocated, 10)
+	if cur := m.AllocBytes(); cur != 10 {
+		t.Fatalf("incorrect current allocation: got %d, expected %d\n%s", cur, 10, m.DebugString())
 	}
 	if m.mu.maxAllocated != 100 {
 		t.Fatalf("incorrect max allocation: got %d, expected %d", m.mu.maxAllocated, 100)
@@ -311,8 +188,8 @@ func TestBytesMonitor(t *testing.T) {
 	}
 
 	m.releaseBytes(ctx, 10) // Should succeed without panic.
-	if m.mu.curAllocated != 0 {
-		t.Fatalf("incorrect current allocation: got %d, expected %d", m.mu.curAllocated, 0)
+	if cur := m.AllocBytes(); cur != 0 {
+		t.Fatalf("incorrect current allocation: got %d, expected %d\n%s", cur, 0, m.DebugString())
 	}
 
 	limitedMonitor := MakeMonitorWithLimit(
@@ -333,8 +210,9 @@ func TestBytesMonitor(t *testing.T) {
 
 func TestMemoryAllocationEdgeCases(t *testing.T) {
 	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
 
-	ctx := context.Background()
+	ctx := TestingContextWithOwner(context.Background(), t)
 	st := cluster.MakeTestingClusterSettings()
 	m := MakeMonitor("test", MemoryResource,
 		nil /* curCount */, nil /* maxHist */, 1e9 /* increment */, 1e9 /* noteworthy */, st)
@@ -352,6 +230,318 @@ func TestMemoryAllocationEdgeCases(t *testing.T) {
 	m.Stop(ctx)
 }
 
+func TestMakeBoundAccountFor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 10, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	a1, err := m.MakeBoundAccountFor(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1.Used() != 42 || m.AllocBytes() < 42 {
+		t.Fatalf("expected 42 bytes charged, got %d in the account\n%s", a1.Used(), m.DebugString())
+	}
+	if err := a1.Grow(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refused account holds nothing and can be closed.
+	a2, err := m.MakeBoundAccountFor(ctx, 51)
+	if err == nil {
+		t.Fatal("expected the account to be refused")
+	}
+	if a2.Used() != 0 || a2.Monitor() != nil {
+		t.Fatalf("expected a zero account, got %d bytes used from %v", a2.Used(), a2.Monitor())
+	}
+	a2.Close(ctx)
+
+	a1.Close(ctx)
+	if m.AllocBytes() != 0 {
+		t.Fatalf("closing the account leaves bytes in the monitor: %s", m.DebugString())
+	}
+	m.Stop(ctx)
+}
+
+func TestReleaseReserved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	// The pre-reserved budget is granted by another monitor.
+	granter := MakeMonitor("granter", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	granter.Start(ctx, nil, MakeStandaloneBudget(1000))
+	reserved, err := granter.MakeBoundAccountFor(ctx, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, &pool, reserved)
+	acc, err := m.MakeBoundAccountFor(ctx, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The usage fits in the remaining reserved budget.
+	if err := m.ReleaseReserved(ctx, 200); err != nil {
+		t.Fatal(err)
+	}
+	if r, g := m.reserved.used, granter.AllocBytes(); r != 300 || g != 300 {
+		t.Fatalf("expected 300 bytes reserved and granted, got %d and %d", r, g)
+	}
+
+	// The usage spills over to the pool.
+	if err := m.ReleaseReserved(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if b := m.mu.curBudget.used; b != 50 {
+		t.Fatalf("expected 50 bytes of budget from the pool, got %d\n%s", b, m.DebugString())
+	}
+
+	// The pool can't take the usage over: nothing is released.
+	if err := m.ReleaseReserved(ctx, 100); !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if r := m.reserved.used; r != 250 {
+		t.Fatalf("expected 250 bytes reserved, got %d", r)
+	}
+	if err := m.ReleaseReserved(ctx, 251); err == nil {
+		t.Fatal("expected releasing more than the reserved budget to fail")
+	}
+
+	// Once the usage goes down, the rest of the budget can be released.
+	acc.Close(ctx)
+	if err := m.ReleaseReserved(ctx, 250); err != nil {
+		t.Fatal(err)
+	}
+	if g := granter.AllocBytes(); g != 0 {
+		t.Fatalf("expected the whole budget back in the granter, got %d", g)
+	}
+
+	m.Stop(ctx)
+	granter.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestGrowWithContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+	s := log.ScopeWithoutShowLogs(t)
+	defer s.Close(t)
+
+	const op = "building hash table for join"
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 10 /* noteworthy */, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	a := m.MakeBoundAccount()
+	if err := a.GrowWithContext(ctx, 50, op); err != nil {
+		t.Fatal(err)
+	}
+	log.Flush()
+	entries, err := log.FetchEntriesFromFiles(0, math.MaxInt64, 10,
+		regexp.MustCompile("test: bytes usage increases to .* while "+op))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("expected the description in the noteworthy usage log message")
+	}
+
+	err = a.GrowWithContext(ctx, 51, op)
+	if !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), op+": ") {
+		t.Fatalf("expected the description in the error, got %q", err)
+	}
+
+	a.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestGrowReturning(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	a := m.MakeBoundAccount()
+	for i, op := range []struct {
+		grow, shrink int64
+		expected     int64
+		ok           bool
+	}{
+		{grow: 30, expected: 30, ok: true},
+		{grow: 20, expected: 50, ok: true},
+		{shrink: 40, expected: 10},
+		{grow: 95, expected: 10, ok: false},
+		{grow: 80, expected: 90, ok: true},
+		{shrink: 90, expected: 0},
+		{grow: 0, expected: 0, ok: true},
+	} {
+		if op.shrink > 0 {
+			a.Shrink(ctx, op.shrink)
+			if a.Used() != op.expected {
+				t.Fatalf("%d: expected %d bytes used, got %d", i, op.expected, a.Used())
+			}
+			continue
+		}
+		used, err := a.GrowReturning(ctx, op.grow)
+		if op.ok != (err == nil) {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if err != nil && !isOutOfMemory(err) {
+			t.Fatalf("%d: expected out of memory error, got %v", i, err)
+		}
+		if used != op.expected || used != a.Used() {
+			t.Fatalf("%d: expected %d bytes used, got %d (account: %d)", i, op.expected, used, a.Used())
+		}
+	}
+
+	a.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestMergeInto(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(100))
+	m1 := MakeMonitor("m1", MemoryResource, nil, nil, 10, 1000, st)
+	m1.Start(ctx, &pool, MakeStandaloneBudget(0))
+	m2 := MakeMonitorWithLimit("m2", MemoryResource, 50, nil, nil, 1, 1000, st)
+	m2.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	// On the same monitor, the bytes change hands without the monitor or
+	// the pool noticing.
+	src, err := m1.MakeBoundAccountFor(ctx, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := m1.MakeBoundAccountFor(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := m1.Snapshot()
+	if err := src.MergeInto(ctx, &dst); err != nil {
+		t.Fatal(err)
+	}
+	if after := m1.Snapshot(); !reflect.DeepEqual(after, before) {
+		t.Fatalf("expected the monitor to be untouched, got %+v instead of %+v", after, before)
+	}
+	if dst.Used() != 30 || src.Used() != 0 {
+		t.Fatalf("expected 30 bytes merged, got %d and %d left", dst.Used(), src.Used())
+	}
+	src.Close(ctx)
+	if err := dst.MergeInto(ctx, &dst); err == nil {
+		t.Fatal("expected merging an account into itself to fail")
+	}
+
+	// Across monitors, the usage is transferred, unless the destination
+	// refuses it.
+	other, err := m2.MakeBoundAccountFor(ctx, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.MergeInto(ctx, &other); !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if dst.Used() != 30 || other.Used() != 25 {
+		t.Fatalf("expected the accounts to be untouched, got %d and %d", dst.Used(), other.Used())
+	}
+	if err := other.MergeInto(ctx, &dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Used() != 55 || m2.AllocBytes() != 0 {
+		t.Fatalf("expected 55 bytes merged, got %d\n%s", dst.Used(), m2.DebugString())
+	}
+	other.Close(ctx)
+
+	dst.Close(ctx)
+	m1.Stop(ctx)
+	m2.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestAccountQuantum(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, nil, MakeStandaloneBudget(16384))
+
+	a := m.MakeBoundAccount()
+	a.SetQuantum(4096)
+	before := atomic.LoadUint64(&m.activity)
+	for i := 0; i < 100; i++ {
+		if err := a.Grow(ctx, 8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The growths are served by a single 4KiB reservation.
+	if n := atomic.LoadUint64(&m.activity) - before; n != 1 {
+		t.Fatalf("expected 1 monitor allocation, got %d", n)
+	}
+	if a.Used() != 800 || a.Allocated() != 4096 || m.AllocBytes() != 4096 {
+		t.Fatalf("expected 800 bytes used out of 4096, got %d out of %d (%d in monitor)",
+			a.Used(), a.Allocated(), m.AllocBytes())
+	}
+
+	// Requests larger than the quantum are rounded up to it.
+	if err := a.Grow(ctx, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if a.Allocated() != 4096+8192 {
+		t.Fatalf("expected %d bytes allocated, got %d", 4096+8192, a.Allocated())
+	}
+
+	// Shrinking keeps up to a quantum of slack, despite the eager policy.
+	a.Shrink(ctx, 5800)
+	if a.Used() != 0 || a.Allocated() != 4096 {
+		t.Fatalf("expected 4096 bytes of slack, got %d used out of %d", a.Used(), a.Allocated())
+	}
+	// A growth denied by the monitor leaves the account unchanged.
+	if err := a.Grow(ctx, 20000); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	// Clear and Close return the slack.
+	a.Clear(ctx)
+	if m.AllocBytes() != 0 {
+		t.Fatalf("expected clear to return the slack, got %d", m.AllocBytes())
+	}
+	if err := a.Grow(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	a.Close(ctx)
+	if m.AllocBytes() != 0 {
+		t.Fatalf("expected close to return the slack, got %d", m.AllocBytes())
+	}
+	m.Stop(ctx)
+}
+
 func BenchmarkBoundAccountGrow(b *testing.B) {
 	ctx := context.Background()
 	m := MakeMonitor("test", MemoryResource,
@@ -364,3 +554,47 @@ func BenchmarkBoundAccountGrow(b *testing.B) {
 		_ = a.Grow(ctx, 1)
 	}
 }
+
+func BenchmarkBoundAccountGrowWithContext(b *testing.B) {
+	ctx := context.Background()
+	m := MakeMonitor("test", MemoryResource,
+		nil /* curCount */, nil /* maxHist */, 1e9 /* increment */, 1e9, /* noteworthy */
+		cluster.MakeTestingClusterSettings())
+	m.Start(ctx, nil, MakeStandaloneBudget(1e9))
+
+	a := m.MakeBoundAccount()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = a.GrowWithContext(ctx, 1, "benchmarking")
+	}
+}
+
+// BenchmarkBoundAccountQuantum grows and shrinks accounts by a handful of
+// bytes from concurrent goroutines, with and without a quantum, and reports
+// the number of monitor operations, each of which takes the monitor lock.
+func BenchmarkBoundAccountQuantum(b *testing.B) {
+	ctx := context.Background()
+	for _, quantum := range []int64{0, 4096} {
+		b.Run(fmt.Sprintf("quantum=%d", quantum), func(b *testing.B) {
+			m := MakeMonitor("test", MemoryResource,
+				nil /* curCount */, nil /* maxHist */, 1 /* increment */, 1e9, /* noteworthy */
+				cluster.MakeTestingClusterSettings())
+			m.Start(ctx, nil, MakeStandaloneBudget(1e9))
+			before := atomic.LoadUint64(&m.activity)
+
+			b.RunParallel(func(pb *testing.PB) {
+				a := m.MakeBoundAccount()
+				a.SetQuantum(quantum)
+				for pb.Next() {
+					_ = a.Grow(ctx, 8)
+					a.Shrink(ctx, 8)
+				}
+				a.Close(ctx)
+			})
+			b.StopTimer()
+			b.Logf("%d monitor operations for %d iterations",
+				atomic.LoadUint64(&m.activity)-before, b.N)
+			m.Stop(ctx)
+		})
+	}
+}
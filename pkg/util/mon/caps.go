@@ -0,0 +1,118 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+)
+
+// OpenAccount is like MakeBoundAccount, but the account counts towards the
+// cap on open accounts of the monitor (see WithMaxOpenAccounts) until it is
+// closed. An error is returned if the cap is reached.
+func (mm *BytesMonitor) OpenAccount() (BoundAccount, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.maxOpenAccounts > 0 && mm.mu.openAccounts >= mm.maxOpenAccounts {
+		return BoundAccount{}, errors.Errorf("%s: cannot open more than %d accounts",
+			mm.name, mm.maxOpenAccounts)
+	}
+	mm.mu.openAccounts++
+	return BoundAccount{mon: mm, opened: true, pageSize: mm.pageSize}, nil
+}
+
+// NumOpenAccounts returns the number of accounts made by OpenAccount that
+// haven't been closed yet.
+func (mm *BytesMonitor) NumOpenAccounts() int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.openAccounts
+}
+
+// closeAccount records that acc, made by OpenAccount, is closed.
+func (mm *BytesMonitor) closeAccount(acc *BoundAccount) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.openAccounts--
+	if mm.mu.accounts != nil {
+		delete(mm.mu.accounts, acc)
+	}
+}
+
+// addChild registers a monitor starting with mm as its pool, with reserved
+// bytes of pre-reserved budget. mm may be nil, for monitors without a pool.
+func (mm *BytesMonitor) addChild(child *BytesMonitor, reserved int64) error {
+	if mm == nil {
+		return nil
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.mu.stopped {
+		return errors.Wrapf(ErrMonitorStopped, "%s: cannot start %s", mm.name, child.name)
+	}
+	if mm.mu.draining {
+		return errors.Errorf("%s: cannot start %s while stopping the subtree", mm.name, child.name)
+	}
+	if mm.maxChildren > 0 && mm.mu.children >= mm.maxChildren {
+		return errors.Errorf("%s: cannot start more than %d child monitors",
+			mm.name, mm.maxChildren)
+	}
+	if mm.reservationCap > 0 {
+		if total := mm.mu.childReserved + reserved; total > mm.reservationCap {
+			return errors.Errorf("%s: cannot start %s with %s reserved: children of the pool "+
+				"already reserved %s, reservation cap %s",
+				mm.name, child.name, humanizeutil.IBytes(reserved),
+				humanizeutil.IBytes(mm.mu.childReserved), humanizeutil.IBytes(mm.reservationCap))
+		}
+		mm.mu.childReserved += reserved
+		child.poolReserved = reserved
+	}
+	mm.mu.children++
+	mm.childSet.Lock()
+	defer mm.childSet.Unlock()
+	if mm.childSet.monitors == nil {
+		mm.childSet.monitors = make(map[*BytesMonitor]struct{})
+	}
+	mm.childSet.monitors[child] = struct{}{}
+	return nil
+}
+
+// removeChild unregisters a child monitor when it stops.
+func (mm *BytesMonitor) removeChild(child *BytesMonitor) {
+	if mm == nil {
+		return
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.children--
+	mm.mu.childReserved -= child.poolReserved
+	child.poolReserved = 0
+	mm.childSet.Lock()
+	defer mm.childSet.Unlock()
+	delete(mm.childSet.monitors, child)
+}
+
+// childrenSnapshot returns the monitors currently started with mm as their
+// pool. It doesn't lock mm.mu, and can be called while mm is locked.
+func (mm *BytesMonitor) childrenSnapshot() []*BytesMonitor {
+	mm.childSet.Lock()
+	defer mm.childSet.Unlock()
+	children := make([]*BytesMonitor, 0, len(mm.childSet.monitors))
+	for c := range mm.childSet.monitors {
+		children = append(children, c)
+	}
+	return children
+}
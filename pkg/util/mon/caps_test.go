@@ -0,0 +1,165 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestMaxOpenAccounts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st, WithMaxOpenAccounts(2))
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	a1, err := m.OpenAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := m.OpenAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a2.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	// Accounts made by MakeBoundAccount don't count.
+	a3 := m.MakeBoundAccount()
+
+	if _, err := m.OpenAccount(); err == nil ||
+		!strings.Contains(err.Error(), "test: cannot open more than 2 accounts") {
+		t.Fatalf("expected the cap to be reached, got %v", err)
+	}
+
+	// Clearing an account keeps it open; closing it makes room for another
+	// one, once.
+	a1.Clear(ctx)
+	if _, err := m.OpenAccount(); err == nil {
+		t.Fatal("expected the cap to be reached")
+	}
+	a1.Close(ctx)
+	a1.Close(ctx)
+	a1, err = m.OpenAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := m.NumOpenAccounts(); n != 2 {
+		t.Fatalf("expected 2 open accounts, got %d", n)
+	}
+
+	a1.Close(ctx)
+	a2.Close(ctx)
+	a3.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestMaxChildren(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st, WithMaxChildren(1))
+	pool.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	c1 := MakeMonitor("c1", MemoryResource, nil, nil, 1, 1000, st)
+	if err := c1.TryStart(ctx, &pool, MakeStandaloneBudget(0)); err != nil {
+		t.Fatal(err)
+	}
+	c2 := MakeMonitor("c2", MemoryResource, nil, nil, 1, 1000, st)
+	if err := c2.TryStart(ctx, &pool, MakeStandaloneBudget(0)); err == nil ||
+		!strings.Contains(err.Error(), "pool: cannot start more than 1 child monitors") {
+		t.Fatalf("expected the cap to be reached, got %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected Start to panic")
+			}
+		}()
+		c2.Start(ctx, &pool, MakeStandaloneBudget(0))
+	}()
+
+	// Once the first child stops, the second one can start.
+	c1.Stop(ctx)
+	if err := c2.TryStart(ctx, &pool, MakeStandaloneBudget(0)); err != nil {
+		t.Fatal(err)
+	}
+	c2.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestReservationCap(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st, WithReservationCap(250))
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	children := make([]BytesMonitor, 4)
+	for i := range children {
+		children[i] = MakeMonitor(fmt.Sprintf("c%d", i), MemoryResource, nil, nil, 1, 1000, st)
+	}
+	// The children are started up to the cap.
+	for i := 0; i < 2; i++ {
+		if err := children[i].TryStart(ctx, &pool, MakeStandaloneBudget(100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := children[2].TryStart(ctx, &pool, MakeStandaloneBudget(100)); err == nil ||
+		!strings.Contains(err.Error(), "pool: cannot start c2 with 100 B reserved") ||
+		!strings.Contains(err.Error(), "reservation cap 250 B") {
+		t.Fatalf("expected the reservation cap to be reached, got %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected Start to panic")
+			}
+		}()
+		children[2].Start(ctx, &pool, MakeStandaloneBudget(100))
+	}()
+	// Children without a pre-reserved budget, or with a smaller one, can
+	// still start.
+	if err := children[2].TryStart(ctx, &pool, MakeStandaloneBudget(50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := children[3].TryStart(ctx, &pool, MakeStandaloneBudget(0)); err != nil {
+		t.Fatal(err)
+	}
+	children[3].Stop(ctx)
+
+	// Stopping a child returns its pre-reserved budget to the aggregate.
+	children[0].Stop(ctx)
+	if err := children[3].TryStart(ctx, &pool, MakeStandaloneBudget(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(children); i++ {
+		children[i].Stop(ctx)
+	}
+	pool.Stop(ctx)
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// CarveOut partitions off bytes of the budget of the monitor, typically a
+// root monitor, into a region with its own name, usage and limit, e.g. for
+// the SQL layer or the raft entry cache. The carve-out is a started monitor
+// pre-reserved with the bytes, and without a pool, so that the regions
+// can't take budget from each other once created. It is registered under
+// its name until it is stopped, which returns the bytes to the monitor.
+//
+// An error is returned if the monitor can't cover the carve-out, or if it
+// already has a carve-out with the same name.
+func (mm *BytesMonitor) CarveOut(
+	ctx context.Context, name string, bytes int64,
+) (*BytesMonitor, error) {
+	co := new(BytesMonitor)
+	*co = MakeMonitorWithLimit(name, mm.resource, math.MaxInt64, nil, nil,
+		mm.poolAllocationSize, mm.noteworthyUsageBytes, mm.settings,
+		WithTimeSource(mm.clock()), WithLabels(mm.Labels()...))
+	co.carveOutOf = mm
+
+	// The name is taken by a nil entry until the carve-out is started.
+	mm.carveOuts.Lock()
+	if _, ok := mm.carveOuts.byName[name]; ok {
+		mm.carveOuts.Unlock()
+		return nil, errors.Errorf("%s: carve-out %q already exists", mm.name, name)
+	}
+	if mm.carveOuts.byName == nil {
+		mm.carveOuts.byName = make(map[string]*BytesMonitor)
+	}
+	mm.carveOuts.byName[name] = nil
+	mm.carveOuts.Unlock()
+
+	reserved, err := mm.MakeBoundAccountFor(ctx, bytes)
+	if err == nil {
+		co.Start(ctx, nil, reserved)
+	}
+
+	mm.carveOuts.Lock()
+	defer mm.carveOuts.Unlock()
+	if err != nil {
+		delete(mm.carveOuts.byName, name)
+		return nil, errors.Wrapf(err, "cannot carve out %d bytes for %q", bytes, name)
+	}
+	mm.carveOuts.byName[name] = co
+	return co, nil
+}
+
+// removeCarveOut unregisters a carve-out of the monitor.
+func (mm *BytesMonitor) removeCarveOut(co *BytesMonitor) {
+	mm.carveOuts.Lock()
+	defer mm.carveOuts.Unlock()
+	if mm.carveOuts.byName[co.name] == co {
+		delete(mm.carveOuts.byName, co.name)
+	}
+}
+
+// Rebalance moves bytes of budget from the carve-out named from to the one
+// named to. The budget moves between the reservations of the carve-outs
+// without going through the monitor, whose usage doesn't change. An error is
+// returned, and both carve-outs are left unchanged, if either doesn't exist
+// or if the usage of from doesn't fit in its reduced budget.
+func (mm *BytesMonitor) Rebalance(ctx context.Context, from, to string, bytes int64) error {
+	if bytes < 0 {
+		return errors.Errorf("%s: cannot move %d bytes between carve-outs", mm.name, bytes)
+	}
+	// The carve-outs stay registered while the lock is held, and concurrent
+	// rebalances are serialized.
+	mm.carveOuts.Lock()
+	defer mm.carveOuts.Unlock()
+	src, dst := mm.carveOuts.byName[from], mm.carveOuts.byName[to]
+	if src == nil {
+		return errors.Errorf("%s: no carve-out %q", mm.name, from)
+	}
+	if dst == nil {
+		return errors.Errorf("%s: no carve-out %q", mm.name, to)
+	}
+	if src == dst {
+		return nil
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	remaining := src.reserved.used - bytes
+	if used := src.mu.curAllocated + src.mu.emergencyHeld; used > remaining {
+		return errors.Errorf("%s: cannot move %d bytes from carve-out %q, which uses %d of %d bytes",
+			mm.name, bytes, from, used, src.reserved.used)
+	}
+	src.reserved.used = remaining
+	dst.reserved.used += bytes
+	src.publishHeadroomLocked()
+	dst.publishHeadroomLocked()
+	src.updateUsageSplitLocked()
+	dst.updateUsageSplitLocked()
+	if mm.log().V(1) {
+		mm.log().Infof(ctx, "%s: moved %d bytes from carve-out %q to %q", mm.name, bytes, from, to)
+	}
+	return nil
+}
+
+// CarveOutUsage is the usage of a carve-out, as reported by ListCarveOuts.
+type CarveOutUsage struct {
+	Name         string
+	Budget       int64
+	Allocated    int64
+	MaxAllocated int64
+}
+
+// ListCarveOuts returns the usage of the carve-outs of the monitor, sorted
+// by name.
+func (mm *BytesMonitor) ListCarveOuts() []CarveOutUsage {
+	mm.carveOuts.Lock()
+	carveOuts := make([]*BytesMonitor, 0, len(mm.carveOuts.byName))
+	for _, co := range mm.carveOuts.byName {
+		if co != nil {
+			carveOuts = append(carveOuts, co)
+		}
+	}
+	mm.carveOuts.Unlock()
+
+	res := make([]CarveOutUsage, len(carveOuts))
+	for i, co := range carveOuts {
+		co.mu.Lock()
+		res[i] = CarveOutUsage{
+			Name:         co.name,
+			Budget:       co.reserved.used,
+			Allocated:    co.mu.curAllocated,
+			MaxAllocated: co.mu.maxAllocated,
+		}
+		co.mu.Unlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestCarveOut(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	root := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+
+	sql, err := root.CarveOut(ctx, "sql", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft, err := root.CarveOut(ctx, "kv-raft-entries", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.CarveOut(ctx, "sql", 100); err == nil ||
+		!strings.Contains(err.Error(), `root: carve-out "sql" already exists`) {
+		t.Fatalf("expected duplicate carve-out error, got %v", err)
+	}
+	// The root can't cover a third carve-out of 300 bytes.
+	if _, err := root.CarveOut(ctx, "timeseries", 300); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	ts, err := root.CarveOut(ctx, "timeseries", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exhaust the raft entries carve-out.
+	raftAcc := raft.MakeBoundAccount()
+	if err := raftAcc.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := raftAcc.Grow(ctx, 1); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	// The other carve-outs are unaffected.
+	sqlAcc := sql.MakeBoundAccount()
+	if err := sqlAcc.Grow(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	tsAcc := ts.MakeBoundAccount()
+	if err := tsAcc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []mon.CarveOutUsage{
+		{Name: "kv-raft-entries", Budget: 300, Allocated: 300, MaxAllocated: 300},
+		{Name: "sql", Budget: 500, Allocated: 500, MaxAllocated: 500},
+		{Name: "timeseries", Budget: 200, Allocated: 100, MaxAllocated: 100},
+	}
+	if u := root.ListCarveOuts(); !reflect.DeepEqual(u, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, u)
+	}
+
+	// Stopping a carve-out returns its budget to the root, and frees its
+	// name.
+	tsAcc.Close(ctx)
+	ts.Stop(ctx)
+	if u := root.ListCarveOuts(); len(u) != 2 {
+		t.Fatalf("expected 2 carve-outs, got %+v", u)
+	}
+	ts, err = root.CarveOut(ctx, "timeseries", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Stop(ctx)
+	raftAcc.Close(ctx)
+	raft.Stop(ctx)
+	sqlAcc.Close(ctx)
+	sql.Stop(ctx)
+	montest.AssertEmpty(t, &root)
+	root.Stop(ctx)
+}
+
+func TestCarveOutRebalance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	root := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+
+	sql, err := root.CarveOut(ctx, "sql", 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft, err := root.CarveOut(ctx, "kv-raft-entries", 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlAcc := sql.MakeBoundAccount()
+	if err := sqlAcc.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	raftAcc := raft.MakeBoundAccount()
+	if err := raftAcc.Grow(ctx, 400); err != nil {
+		t.Fatal(err)
+	}
+
+	before := root.ListCarveOuts()
+	// The usage of sql doesn't fit in 200 bytes.
+	if err := root.Rebalance(ctx, "sql", "kv-raft-entries", 400); err == nil ||
+		!strings.Contains(err.Error(), `cannot move 400 bytes from carve-out "sql", which uses 300 of 600 bytes`) {
+		t.Fatalf("expected usage error, got %v", err)
+	}
+	if err := root.Rebalance(ctx, "sql", "timeseries", 100); err == nil ||
+		!strings.Contains(err.Error(), `no carve-out "timeseries"`) {
+		t.Fatalf("expected missing carve-out error, got %v", err)
+	}
+	if after := root.ListCarveOuts(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("expected the carve-outs to be unchanged, got %+v instead of %+v", after, before)
+	}
+
+	if err := root.Rebalance(ctx, "sql", "kv-raft-entries", 300); err != nil {
+		t.Fatal(err)
+	}
+	expected := []mon.CarveOutUsage{
+		{Name: "kv-raft-entries", Budget: 700, Allocated: 400, MaxAllocated: 400},
+		{Name: "sql", Budget: 300, Allocated: 300, MaxAllocated: 300},
+	}
+	if u := root.ListCarveOuts(); !reflect.DeepEqual(u, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, u)
+	}
+	montest.AssertUsed(t, &root, 1000)
+	// The budget moved: raft can grow, and sql can't.
+	if err := raftAcc.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlAcc.Grow(ctx, 1); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	sqlAcc.Close(ctx)
+	sql.Stop(ctx)
+	raftAcc.Close(ctx)
+	raft.Stop(ctx)
+	montest.AssertEmpty(t, &root)
+	root.Stop(ctx)
+}
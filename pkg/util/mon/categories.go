@@ -0,0 +1,213 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+)
+
+// Category identifies a category of allocations, e.g. hash tables or sort
+// buffers, among the ones registered with WithCategories: category i is the
+// i-th name passed to WithCategories.
+type Category uint8
+
+// MaxCategories is the maximum number of categories of a monitor. The
+// usage of the categories is kept in an array, so that the bookkeeping stays
+// cheap.
+const MaxCategories = 8
+
+// WithCategories registers the categories of the allocations made through
+// the monitor with GrowCategory; see Category. It panics if there are more
+// than MaxCategories names.
+func WithCategories(names ...string) MonitorOption {
+	if len(names) > MaxCategories {
+		panic(fmt.Sprintf("%d categories registered, at most %d allowed", len(names), MaxCategories))
+	}
+	return optionFunc(func(o *monitorOptions) {
+		o.categories = names
+	})
+}
+
+// WithCategoryLimit caps the number of bytes used by the category cat of
+// allocations at limit: GrowCategory refuses to take the usage of the
+// category above limit, even if the monitor has room for it. The category
+// must be registered with WithCategories.
+func WithCategoryLimit(cat Category, limit int64) MonitorOption {
+	if cat >= MaxCategories {
+		panic(fmt.Sprintf("unknown category %d", cat))
+	}
+	return optionFunc(func(o *monitorOptions) {
+		o.categoryLimits[cat] = limit
+	})
+}
+
+// CategoryUsage is the usage of a category of allocations.
+type CategoryUsage struct {
+	Name string
+	// Current is the number of bytes currently used by the category, and
+	// Max the maximum over the monitoring region.
+	Current int64
+	Max     int64
+}
+
+// categoryCounters holds the usage of a category.
+type categoryCounters struct {
+	cur, max int64
+}
+
+// GrowCategory is like Grow, but the bytes are also counted as used by the
+// category cat of allocations, until they are released with ShrinkCategory
+// or the account is cleared or closed. The category must be registered with
+// the monitor; see WithCategories. The growth is refused if it takes the
+// usage of the category above its limit; see WithCategoryLimit. On a
+// standalone budget, which has no monitor, it is the same as Grow.
+func (b *BoundAccount) GrowCategory(ctx context.Context, cat Category, x int64) error {
+	if b.mon == nil {
+		return b.Grow(ctx, x)
+	}
+	b.mon.checkCategory(cat)
+	if b.mon.categoryLimits[cat] <= 0 {
+		if err := b.Grow(ctx, x); err != nil {
+			return err
+		}
+		b.mon.addCategoryUsage(cat, x)
+		b.addCategory(cat, x)
+		return nil
+	}
+	// The limited category is charged first, so that concurrent growths
+	// can't take it above its limit.
+	if err := b.mon.reserveCategory(cat, x); err != nil {
+		return err
+	}
+	if err := b.Grow(ctx, x); err != nil {
+		b.mon.addCategoryUsage(cat, -x)
+		return err
+	}
+	b.mon.addCategoryUsage(cat, 0 /* delta */)
+	b.addCategory(cat, x)
+	return nil
+}
+
+// ShrinkCategory is like Shrink, for bytes used by the category cat; see
+// GrowCategory.
+func (b *BoundAccount) ShrinkCategory(ctx context.Context, cat Category, delta int64) {
+	if b.mon == nil {
+		b.Shrink(ctx, delta)
+		return
+	}
+	b.mon.checkCategory(cat)
+	if b.categories == nil || b.categories[cat] < delta {
+		var cur int64
+		if b.categories != nil {
+			cur = b.categories[cat]
+		}
+		panic(fmt.Sprintf("%s: no bytes in account to release in category %s, current %d, free %d",
+			b.mon.name, b.mon.categories[cat], cur, delta))
+	}
+	b.mon.addCategoryUsage(cat, -delta)
+	b.addCategory(cat, -delta)
+	b.Shrink(ctx, delta)
+}
+
+// addCategory adds delta to the bytes of the account counted in the
+// category cat.
+func (b *BoundAccount) addCategory(cat Category, delta int64) {
+	if b.categories == nil {
+		b.categories = new([MaxCategories]int64)
+	}
+	b.categories[cat] += delta
+}
+
+// mergeCategories moves the bytes of src counted in the categories to the
+// account, which is bound to the same monitor.
+func (b *BoundAccount) mergeCategories(src *BoundAccount) {
+	if src.categories == nil {
+		return
+	}
+	for cat, n := range src.categories {
+		if n != 0 {
+			b.addCategory(Category(cat), n)
+		}
+	}
+	src.categories = nil
+}
+
+// releaseCategories releases the bytes of the account still counted in the
+// categories of its monitor, when the account is cleared or closed.
+func (b *BoundAccount) releaseCategories() {
+	if b.categories == nil {
+		return
+	}
+	b.mon.mu.Lock()
+	for cat, n := range b.categories {
+		b.mon.mu.categories[cat].cur -= n
+	}
+	b.mon.mu.Unlock()
+	b.categories = nil
+}
+
+func (mm *BytesMonitor) checkCategory(cat Category) {
+	if int(cat) >= len(mm.categories) {
+		panic(fmt.Sprintf("%s: unknown category %d", mm.name, cat))
+	}
+}
+
+// reserveCategory adds x bytes to the usage of the category cat, unless it
+// takes the usage above the limit of the category. The maximum usage of the
+// category is only updated by the next addCategoryUsage, once the growth is
+// granted.
+func (mm *BytesMonitor) reserveCategory(cat Category, x int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	c := &mm.mu.categories[cat]
+	if limit := mm.categoryLimits[cat]; limit > 0 && c.cur+x > limit {
+		err := mm.newBudgetExceededError(LocalLimit, x, c.cur, limit)
+		err.reason = fmt.Sprintf("%s category limit exceeded", mm.categories[cat])
+		mm.denialCounts.count(err)
+		return err
+	}
+	c.cur += x
+	return nil
+}
+
+// addCategoryUsage adds delta to the usage of the category cat.
+func (mm *BytesMonitor) addCategoryUsage(cat Category, delta int64) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	c := &mm.mu.categories[cat]
+	if c.cur+delta < 0 {
+		panic(fmt.Sprintf("%s: no bytes to release in category %s, current %d, free %d",
+			mm.name, mm.categories[cat], c.cur, -delta))
+	}
+	c.cur += delta
+	if c.cur > c.max {
+		c.max = c.cur
+	}
+}
+
+// categoryUsageLocked returns the usage of the categories of the monitor, in
+// the order they were registered.
+func (mm *BytesMonitor) categoryUsageLocked() []CategoryUsage {
+	if len(mm.categories) == 0 {
+		return nil
+	}
+	usage := make([]CategoryUsage, len(mm.categories))
+	for i, name := range mm.categories {
+		c := mm.mu.categories[i]
+		usage[i] = CategoryUsage{Name: name, Current: c.cur, Max: c.max}
+	}
+	return usage
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestCategories(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	const (
+		hashTable Category = iota
+		sortBuffer
+		resultBuffer
+	)
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("session", MemoryResource, nil, nil, 1, 1000, st,
+		WithCategories("hash table", "sort buffer", "result buffer"))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	a1, a2 := m.MakeBoundAccount(), m.MakeBoundAccount()
+
+	grow := func(acc *BoundAccount, cat Category, n int64) {
+		t.Helper()
+		if err := acc.GrowCategory(ctx, cat, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(expected []CategoryUsage) {
+		t.Helper()
+		if usage := m.Snapshot().Categories; !reflect.DeepEqual(usage, expected) {
+			t.Fatalf("expected %+v, got %+v", expected, usage)
+		}
+	}
+
+	grow(&a1, hashTable, 100)
+	grow(&a2, sortBuffer, 50)
+	grow(&a1, hashTable, 200)
+	a1.ShrinkCategory(ctx, hashTable, 250)
+	grow(&a2, resultBuffer, 30)
+	grow(&a2, sortBuffer, 20)
+	expect([]CategoryUsage{
+		{Name: "hash table", Current: 50, Max: 300},
+		{Name: "sort buffer", Current: 70, Max: 70},
+		{Name: "result buffer", Current: 30, Max: 30},
+	})
+
+	// Refused growths are not counted.
+	if err := a1.GrowCategory(ctx, hashTable, 1000); !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	expect([]CategoryUsage{
+		{Name: "hash table", Current: 50, Max: 300},
+		{Name: "sort buffer", Current: 70, Max: 70},
+		{Name: "result buffer", Current: 30, Max: 30},
+	})
+
+	// Inherited monitors share the categories.
+	child := MakeMonitorInheritWithLimit("child", 100, &m)
+	if !reflect.DeepEqual(child.categories, m.categories) {
+		t.Errorf("expected the categories to be inherited, got %q", child.categories)
+	}
+
+	// Clearing or closing an account releases its bytes from the
+	// categories.
+	a1.Clear(ctx)
+	expect([]CategoryUsage{
+		{Name: "hash table", Current: 0, Max: 300},
+		{Name: "sort buffer", Current: 70, Max: 70},
+		{Name: "result buffer", Current: 30, Max: 30},
+	})
+	a2.Close(ctx)
+	a1.Close(ctx)
+	stats := m.StopAndGetStats(ctx)
+	if expected := []CategoryUsage{
+		{Name: "hash table", Current: 0, Max: 300},
+		{Name: "sort buffer", Current: 0, Max: 70},
+		{Name: "result buffer", Current: 0, Max: 30},
+	}; !reflect.DeepEqual(stats.Categories, expected) {
+		t.Errorf("expected %+v, got %+v", expected, stats.Categories)
+	}
+}
+
+func TestCategoryLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	const (
+		hashTable Category = iota
+		resultBuffer
+	)
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("session", MemoryResource, nil, nil, 1, 1000, st,
+		WithCategories("hash table", "result buffer"), WithCategoryLimit(resultBuffer, 64))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	if err := acc.GrowCategory(ctx, resultBuffer, 60); err != nil {
+		t.Fatal(err)
+	}
+	// The category hits its limit while the monitor has plenty of room.
+	err := acc.GrowCategory(ctx, resultBuffer, 10)
+	if !isOutOfMemory(err) || !strings.Contains(err.Error(), "result buffer category limit exceeded") {
+		t.Fatalf("expected the category limit to be exceeded, got %v", err)
+	}
+	if used := acc.Used(); used != 60 {
+		t.Fatalf("expected the account to be left alone, got %d bytes used", used)
+	}
+	// Other categories are not limited.
+	if err := acc.GrowCategory(ctx, hashTable, 500); err != nil {
+		t.Fatal(err)
+	}
+	// Shrinks make room in the category again.
+	acc.ShrinkCategory(ctx, resultBuffer, 20)
+	if err := acc.GrowCategory(ctx, resultBuffer, 24); err != nil {
+		t.Fatal(err)
+	}
+	// A growth refused by the monitor doesn't count against the category.
+	acc.ShrinkCategory(ctx, resultBuffer, 64)
+	if err := acc.GrowCategory(ctx, hashTable, 600); !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if c := m.Snapshot().Categories[hashTable]; c.Current != 500 {
+		t.Fatalf("expected 500 bytes in the hash table category, got %+v", c)
+	}
+
+	// Closing an account without shrinking its categories makes room in
+	// them.
+	if err := acc.GrowCategory(ctx, resultBuffer, 64); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+	acc = m.MakeBoundAccount()
+	if err := acc.GrowCategory(ctx, resultBuffer, 64); err != nil {
+		t.Fatalf("expected the closed account to release its category usage, got %v", err)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestCategoriesStandaloneBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	acc := MakeStandaloneBudget(0)
+	if err := acc.GrowCategory(ctx, 3, 100); err != nil {
+		t.Fatal(err)
+	}
+	acc.ShrinkCategory(ctx, 3, 40)
+	if used := acc.Used(); used != 60 {
+		t.Fatalf("expected 60 bytes used, got %d", used)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// Checkpoint records the usage of an account, so that the growth that
+// follows can be unwound with RollbackTo.
+type Checkpoint struct {
+	acc  *BoundAccount
+	used int64
+}
+
+// Checkpoint returns a checkpoint of the current usage of the account.
+func (b *BoundAccount) Checkpoint() Checkpoint {
+	return Checkpoint{acc: b, used: b.used}
+}
+
+// RollbackTo shrinks the account back to its usage at the checkpoint, e.g.
+// to unwind the growth performed for a row that couldn't be completed.
+// Checkpoints can be nested: rolling back to a checkpoint also rolls back
+// the checkpoints taken after it. If the account already shrank below the
+// checkpoint, nothing is done.
+//
+// RollbackTo panics if the checkpoint was taken on another account.
+func (b *BoundAccount) RollbackTo(ctx context.Context, cp Checkpoint) {
+	if cp.acc != b {
+		panic("rolling back to a checkpoint of another account")
+	}
+	if b.used > cp.used {
+		b.Shrink(ctx, b.used-cp.used)
+	}
+}
+
+// GrowScope runs fn, and rolls back the growth of the account performed
+// while it runs if it returns an error, which is then returned. Scopes can
+// be nested.
+func (b *BoundAccount) GrowScope(ctx context.Context, fn func() error) error {
+	cp := b.Checkpoint()
+	if err := fn(); err != nil {
+		b.RollbackTo(ctx, cp)
+		return err
+	}
+	return nil
+}
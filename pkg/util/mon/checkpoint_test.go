@@ -0,0 +1,106 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestCheckpoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	grow := func(n int64) {
+		t.Helper()
+		if err := acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(used int64) {
+		t.Helper()
+		montest.AssertAccountUsed(t, &acc, used)
+		montest.AssertUsed(t, &m, used)
+	}
+
+	grow(100)
+	outer := acc.Checkpoint()
+	grow(50)
+	inner := acc.Checkpoint()
+	grow(25)
+	acc.RollbackTo(ctx, inner)
+	expect(150)
+	grow(30)
+	// Rolling back to the outer checkpoint also unwinds the inner one.
+	acc.RollbackTo(ctx, outer)
+	expect(100)
+	// Nothing is done if the account already shrank below the checkpoint.
+	cp := acc.Checkpoint()
+	acc.Shrink(ctx, 60)
+	acc.RollbackTo(ctx, cp)
+	expect(40)
+
+	errRow := errors.New("bad row")
+	err := acc.GrowScope(ctx, func() error {
+		grow(100)
+		// The inner scope succeeds, so its growth is kept until the outer
+		// scope fails.
+		if err := acc.GrowScope(ctx, func() error {
+			grow(200)
+			return nil
+		}); err != nil {
+			return err
+		}
+		expect(340)
+		if err := acc.GrowScope(ctx, func() error {
+			grow(300)
+			return errRow
+		}); err != errRow {
+			t.Fatalf("expected %v, got %v", errRow, err)
+		}
+		expect(340)
+		return errRow
+	})
+	if err != errRow {
+		t.Fatalf("expected %v, got %v", errRow, err)
+	}
+	expect(40)
+
+	if err := acc.GrowScope(ctx, func() error {
+		grow(10)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect(50)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// DefaultChunkSize is the chunk size used by a ChunkAllocator when none is
+// specified.
+const DefaultChunkSize = 64 << 10
+
+// ChunkAllocator is an arena allocator for many small byte slices. It grows
+// its BoundAccount one fixed-size chunk at a time and hands out sub-slices of
+// the current chunk, so that the account is charged for the chunks and not
+// for each individual allocation. Allocations larger than the chunk size get
+// a dedicated chunk of their own.
+//
+// A ChunkAllocator is not safe for concurrent use.
+type ChunkAllocator struct {
+	acc       *BoundAccount
+	chunkSize int
+
+	// chunks are the fixed-size chunks obtained so far. chunks[cur] is the
+	// one currently being carved up, at offset off; the chunks after it are
+	// free for reuse after a Reset. cur is -1 before the first allocation.
+	chunks [][]byte
+	cur    int
+	off    int
+
+	// large are the dedicated chunks for oversized allocations, and
+	// largeBytes is the sum of their sizes.
+	large      [][]byte
+	largeBytes int64
+}
+
+// NewChunkAllocator creates a ChunkAllocator charging acc in increments of
+// chunkSize bytes. If chunkSize is 0 or lower, DefaultChunkSize is used.
+func NewChunkAllocator(acc *BoundAccount, chunkSize int) *ChunkAllocator {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &ChunkAllocator{acc: acc, chunkSize: chunkSize, cur: -1}
+}
+
+// Alloc returns a zeroed byte slice of length and capacity n. An error is
+// returned if the account denies the chunk needed to satisfy the request.
+func (a *ChunkAllocator) Alloc(ctx context.Context, n int) ([]byte, error) {
+	if n > a.chunkSize {
+		if err := a.acc.Grow(ctx, int64(n)); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		a.large = append(a.large, buf)
+		a.largeBytes += int64(n)
+		return buf, nil
+	}
+	if a.cur < 0 || a.off+n > a.chunkSize {
+		if err := a.nextChunk(ctx); err != nil {
+			return nil, err
+		}
+	}
+	buf := a.chunks[a.cur][a.off : a.off+n : a.off+n]
+	a.off += n
+	return buf, nil
+}
+
+// nextChunk advances to the next chunk, reusing a chunk retained by a
+// previous Reset if there is one.
+func (a *ChunkAllocator) nextChunk(ctx context.Context) error {
+	if a.cur+1 < len(a.chunks) {
+		a.cur++
+		a.off = 0
+		chunk := a.chunks[a.cur]
+		for i := range chunk {
+			chunk[i] = 0
+		}
+		return nil
+	}
+	if err := a.acc.Grow(ctx, int64(a.chunkSize)); err != nil {
+		return err
+	}
+	a.chunks = append(a.chunks, make([]byte, a.chunkSize))
+	a.cur = len(a.chunks) - 1
+	a.off = 0
+	return nil
+}
+
+// Allocated returns the number of bytes charged to the account by the
+// allocator.
+func (a *ChunkAllocator) Allocated() int64 {
+	return int64(len(a.chunks)*a.chunkSize) + a.largeBytes
+}
+
+// Reset makes all the fixed-size chunks available for reuse and releases the
+// dedicated chunks. The fixed-size chunks remain charged to the account. The
+// slices returned by Alloc before the Reset must not be used afterwards.
+func (a *ChunkAllocator) Reset(ctx context.Context) {
+	if a.largeBytes > 0 {
+		a.acc.Shrink(ctx, a.largeBytes)
+	}
+	a.large = nil
+	a.largeBytes = 0
+	// The next Alloc starts over at chunks[0], which nextChunk clears.
+	a.cur = -1
+	a.off = 0
+}
+
+// Close releases all the chunks and their accounting.
+func (a *ChunkAllocator) Close(ctx context.Context) {
+	if sz := a.Allocated(); sz > 0 {
+		a.acc.Shrink(ctx, sz)
+	}
+	*a = ChunkAllocator{acc: a.acc, chunkSize: a.chunkSize, cur: -1}
+}
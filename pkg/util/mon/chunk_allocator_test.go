@@ -0,0 +1,132 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestChunkAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	a := NewChunkAllocator(&acc, 100)
+	checkCharged := func(expected int64) {
+		t.Helper()
+		if acc.Used() != expected || a.Allocated() != expected {
+			t.Fatalf("expected %d bytes charged, got %d (allocator reports %d)",
+				expected, acc.Used(), a.Allocated())
+		}
+	}
+
+	// Ten 30-byte allocations fit three per chunk and need four chunks,
+	// although only 300 bytes are requested.
+	for i := 0; i < 10; i++ {
+		b, err := a.Alloc(ctx, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 30 || cap(b) != 30 {
+			t.Fatalf("expected len and cap 30, got %d and %d", len(b), cap(b))
+		}
+		b[0] = 1
+	}
+	checkCharged(400)
+
+	// Oversized allocations get a dedicated chunk.
+	if _, err := a.Alloc(ctx, 250); err != nil {
+		t.Fatal(err)
+	}
+	checkCharged(650)
+
+	// Reset keeps the fixed-size chunks and drops the dedicated one.
+	a.Reset(ctx)
+	checkCharged(400)
+	for i := 0; i < 12; i++ {
+		b, err := a.Alloc(ctx, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != 0 {
+			t.Fatal("expected recycled chunk to be cleared")
+		}
+	}
+	checkCharged(400)
+
+	// A chunk that doesn't fit in the budget is denied.
+	if _, err := a.Alloc(ctx, 700); err == nil {
+		t.Fatal("expected budget error")
+	}
+	checkCharged(400)
+
+	a.Close(ctx)
+	checkCharged(0)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+// makeBenchmarkMonitor returns the started monitor of the benchmarks
+// comparing ChunkAllocator to per-object accounting, which must use the same
+// monitor configuration to be comparable.
+func makeBenchmarkMonitor(ctx context.Context) *BytesMonitor {
+	m := MakeMonitor("test", MemoryResource,
+		nil /* curCount */, nil /* maxHist */, 1 /* increment */, 1e9, /* noteworthy */
+		cluster.MakeTestingClusterSettings())
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	return &m
+}
+
+func BenchmarkChunkAllocator(b *testing.B) {
+	ctx := context.Background()
+	m := makeBenchmarkMonitor(ctx)
+	defer m.Stop(ctx)
+	acc := m.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	a := NewChunkAllocator(&acc, DefaultChunkSize)
+	defer a.Close(ctx)
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Alloc(ctx, 16); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPerObjectGrow(b *testing.B) {
+	ctx := context.Background()
+	m := makeBenchmarkMonitor(ctx)
+	defer m.Stop(ctx)
+	acc := m.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	for i := 0; i < b.N; i++ {
+		if err := acc.Grow(ctx, 16); err != nil {
+			b.Fatal(err)
+		}
+		_ = make([]byte, 16)
+	}
+}
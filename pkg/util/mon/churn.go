@@ -0,0 +1,62 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// The churn of a monitor measures how much it thrashes its pool: the bytes
+// of budget it returned to its pool, and the number of round-trips to the
+// pool, i.e. its requests for budget and its returns of budget. Monitors
+// with the same peak usage can have very different churns, depending on
+// their usage patterns and release policies. A return of budget counts as
+// one round-trip whatever the number of releases it batches, e.g. with
+// ReleaseAfter.
+
+// WithChurnCounters sets counters incremented by the bytes of budget the
+// monitor returns to its pool and by its round-trips to the pool, in
+// addition to the counts in MonitorSnapshot and MonitorStats. Either counter
+// can be nil.
+func WithChurnCounters(releasedBytes, roundTrips Counter) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.releasedToPoolCount = counterOrNil(releasedBytes)
+		o.poolRoundTripCount = counterOrNil(roundTrips)
+	})
+}
+
+// notePoolRequestLocked counts a request for budget to the pool.
+func (mm *BytesMonitor) notePoolRequestLocked() {
+	mm.mu.poolRoundTrips++
+	if mm.poolRoundTripCount != nil {
+		mm.poolRoundTripCount.Inc(1)
+	}
+}
+
+// returnBudgetLocked returns n bytes of the budget obtained from the pool.
+func (mm *BytesMonitor) returnBudgetLocked(ctx context.Context, n int64) {
+	mm.mu.curBudget.Shrink(ctx, n)
+	mm.noteReturnLocked(n)
+}
+
+// noteReturnLocked counts a return of n bytes of budget to the pool.
+func (mm *BytesMonitor) noteReturnLocked(n int64) {
+	mm.mu.releasedToPool += n
+	mm.mu.poolRoundTrips++
+	if mm.releasedToPoolCount != nil {
+		mm.releasedToPoolCount.Inc(n)
+	}
+	if mm.poolRoundTripCount != nil {
+		mm.poolRoundTripCount.Inc(1)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestChurnCounters(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	policies := []struct {
+		name   string
+		policy mon.ReleasePolicy
+	}{
+		{"immediate", mon.ReleaseImmediately()},
+		{"delayed", mon.ReleaseAfter(10 * time.Second)},
+	}
+	// The monitor under test has an allocation size of 100 bytes. Each step
+	// is followed by a call to ReleaseIdleBudget on the pool, and lists the
+	// bytes released to the pool and the round-trips to the pool expected
+	// with each policy. With ReleaseAfter, a flush of the idle budget counts
+	// as one round-trip.
+	type churn struct{ released, trips int64 }
+	steps := []struct {
+		advance  time.Duration
+		grow     int64
+		expected [2]churn
+	}{
+		{grow: 250, expected: [2]churn{{0, 1}, {0, 1}}},
+		{grow: -200, expected: [2]churn{{250, 2}, {0, 1}}},
+		{grow: 100, expected: [2]churn{{250, 3}, {0, 1}}},
+		{advance: 11 * time.Second, expected: [2]churn{{250, 3}, {150, 2}}},
+		{grow: -100, expected: [2]churn{{350, 4}, {150, 2}}},
+		{advance: 10 * time.Second, expected: [2]churn{{350, 4}, {250, 3}}},
+	}
+	// The final return of the budget by Stop counts too.
+	final := [2]churn{{400, 5}, {300, 4}}
+
+	for i, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+			released := metric.NewCounter(metric.Metadata{Name: "test.released"})
+			trips := metric.NewCounter(metric.Metadata{Name: "test.round_trips"})
+			pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+				mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+			pool.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+			m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 100, math.MaxInt64, st,
+				mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+				mon.WithReleasePolicy(p.policy), mon.WithChurnCounters(released, trips))
+			m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+			acc := m.MakeBoundAccount()
+
+			check := func(step string, exp churn, r, n int64) {
+				t.Helper()
+				if r != exp.released || n != exp.trips {
+					t.Fatalf("%s: expected %d bytes released in %d round-trips, got %d bytes in %d",
+						step, exp.released, exp.trips, r, n)
+				}
+				if c := released.Count(); c != r {
+					t.Fatalf("%s: expected %d bytes counted in the metric, got %d", step, r, c)
+				}
+				if c := trips.Count(); c != n {
+					t.Fatalf("%s: expected %d round-trips counted in the metric, got %d", step, n, c)
+				}
+			}
+
+			for j, s := range steps {
+				clock.Advance(s.advance)
+				if s.grow > 0 {
+					if err := acc.Grow(ctx, s.grow); err != nil {
+						t.Fatal(err)
+					}
+				} else if s.grow < 0 {
+					acc.Shrink(ctx, -s.grow)
+				}
+				pool.ReleaseIdleBudget(ctx)
+				state := m.Snapshot()
+				check(fmt.Sprintf("step %d", j), s.expected[i], state.ReleasedToPool, state.PoolRoundTrips)
+			}
+
+			acc.Close(ctx)
+			stats := m.StopAndGetStats(ctx)
+			check("stop", final[i], stats.ReleasedToPool, stats.PoolRoundTrips)
+			pool.Stop(ctx)
+		})
+	}
+}
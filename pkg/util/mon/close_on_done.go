@@ -0,0 +1,258 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// CloseOnDone makes the account close itself when ctx is done, unless it
+// was closed before, for accounts owned by request-scoped goroutines that
+// may die before their deferred Close runs, e.g. by runtime.Goexit. Once
+// ctx is done, the growths of the account fail and its other operations
+// are no-ops; closing it still makes it reusable. The account must not be
+// copied or moved while it is watched. The contexts of all the watched
+// accounts of a monitor are watched by a single goroutine, which exits when
+// none is left or the monitor is stopped.
+func (b *BoundAccount) CloseOnDone(ctx context.Context) {
+	if b.mon == nil || ctx.Done() == nil || b.watch != nil {
+		// Standalone budgets need not be closed, ctx is never done, or the
+		// account is already watched.
+		return
+	}
+	w := &accountWatch{
+		unwatched: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	b.watch = w
+	b.mon.doneWatch.watch(ctx, b, w)
+}
+
+// watchClosed is the state of an accountWatch whose account is closed.
+const watchClosed = -1
+
+// accountWatch hands a watched account over between its owner and the
+// goroutine watching its context, so that only one of them closes it, and
+// never while the other is using it.
+type accountWatch struct {
+	// state is the number of operations of the owner in progress on the
+	// account, or watchClosed once the account was claimed to be closed.
+	// The owner increments it for the duration of its operations; the
+	// account is claimed by swapping it from 0 to watchClosed.
+	state int32
+	// closeRequested is set by the watcher when the context is done. If the
+	// owner is operating on the account at the time, it closes the account
+	// once its operation is over.
+	closeRequested int32
+	// unwatched is closed when the owner closes the account itself, to stop
+	// the watcher.
+	unwatched chan struct{}
+	// closed is closed once the account was closed because its context was
+	// done, by the watcher or by its owner.
+	closed chan struct{}
+}
+
+// enter marks the start of an operation of the owner on the account. It
+// returns false if the account was closed because its context was done.
+func (w *accountWatch) enter() bool {
+	for {
+		s := atomic.LoadInt32(&w.state)
+		if s == watchClosed {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&w.state, s, s+1) {
+			return true
+		}
+	}
+}
+
+// exit marks the end of an operation of the owner on b, started by enter,
+// and closes b if its context was done in the meantime.
+func (w *accountWatch) exit(ctx context.Context, b *BoundAccount) {
+	for {
+		s := atomic.LoadInt32(&w.state)
+		if s == watchClosed {
+			// The owner closed the account during the operation.
+			return
+		}
+		if atomic.CompareAndSwapInt32(&w.state, s, s-1) {
+			if s == 1 && atomic.LoadInt32(&w.closeRequested) == 1 && w.claim() {
+				b.closeUnwatched(ctx)
+				close(w.closed)
+			}
+			return
+		}
+	}
+}
+
+// claim claims the account to close it, once no operation of the owner is
+// in progress. It returns false if the account was already claimed.
+func (w *accountWatch) claim() bool {
+	return atomic.CompareAndSwapInt32(&w.state, 0, watchClosed)
+}
+
+// claimByOwner claims the account for the owner to close it, from within
+// its operations if need be, and stops the watcher. It returns false if the
+// account was already closed because its context was done, once that close
+// is complete.
+func (w *accountWatch) claimByOwner() bool {
+	for {
+		s := atomic.LoadInt32(&w.state)
+		if s == watchClosed {
+			<-w.closed
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&w.state, s, watchClosed) {
+			close(w.unwatched)
+			return true
+		}
+	}
+}
+
+// errClosedOnDone returns the error of the growths of an account closed
+// because its context was done.
+func (b *BoundAccount) errClosedOnDone() error {
+	return errors.Errorf("%s: account closed because its context is done", b.monitorName())
+}
+
+// doneWatcher runs the goroutine watching the contexts of the accounts of a
+// monitor registered by CloseOnDone. A single goroutine multiplexes the
+// contexts of all the watched accounts; it is started by the first
+// registration and exits once no account is watched any more, or when the
+// monitor is stopped.
+type doneWatcher struct {
+	mu struct {
+		// Mutex is never held while closing an account.
+		syncutil.Mutex
+		// pending are the accounts registered since the goroutine last
+		// looked.
+		pending []watchedAccount
+		// stop, if the goroutine is running, is closed to stop it; done is
+		// closed once it exited.
+		stop, done chan struct{}
+		// notify wakes the goroutine up when accounts are registered.
+		notify chan struct{}
+	}
+}
+
+// watchedAccount is an account registered with a doneWatcher.
+type watchedAccount struct {
+	ctx context.Context
+	b   *BoundAccount
+	w   *accountWatch
+}
+
+func (dw *doneWatcher) watch(ctx context.Context, b *BoundAccount, w *accountWatch) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	dw.mu.pending = append(dw.mu.pending, watchedAccount{ctx: ctx, b: b, w: w})
+	if dw.mu.stop == nil {
+		dw.mu.stop, dw.mu.done = make(chan struct{}), make(chan struct{})
+		dw.mu.notify = make(chan struct{}, 1)
+		go dw.run(dw.mu.stop, dw.mu.done, dw.mu.notify)
+		return
+	}
+	select {
+	case dw.mu.notify <- struct{}{}:
+	default:
+		// The goroutine was already notified.
+	}
+}
+
+// run is the goroutine of the watcher. It waits for the context of any of
+// the watched accounts to be done, for the owner of any of them to close it,
+// for new registrations, or for stop to be closed.
+func (dw *doneWatcher) run(stop, done, notify chan struct{}) {
+	defer close(done)
+	// The first two cases are stop and notify, followed by the Done channel
+	// of the context and the unwatched channel of each watched account.
+	const fixedCases = 2
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(notify)},
+	}
+	var watched []watchedAccount
+	for {
+		dw.mu.Lock()
+		if dw.mu.stop != stop {
+			// The watcher was stopped.
+			dw.mu.Unlock()
+			return
+		}
+		for _, a := range dw.mu.pending {
+			watched = append(watched, a)
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(a.ctx.Done())},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(a.w.unwatched)})
+		}
+		dw.mu.pending = nil
+		if len(watched) == 0 {
+			dw.mu.stop, dw.mu.done, dw.mu.notify = nil, nil, nil
+			dw.mu.Unlock()
+			return
+		}
+		dw.mu.Unlock()
+
+		i, _, _ := reflect.Select(cases)
+		if i < fixedCases {
+			// Either stop was closed, which the next iteration notices, or
+			// accounts were registered.
+			continue
+		}
+		k := (i - fixedCases) / 2
+		a := watched[k]
+		// Remove the account, moving the last one in its place.
+		last := len(watched) - 1
+		watched[k] = watched[last]
+		watched[last] = watchedAccount{}
+		watched = watched[:last]
+		copy(cases[fixedCases+2*k:], cases[fixedCases+2*last:])
+		cases[fixedCases+2*last], cases[fixedCases+2*last+1] = reflect.SelectCase{}, reflect.SelectCase{}
+		cases = cases[:fixedCases+2*last]
+		if (i-fixedCases)%2 == 1 {
+			// The owner closed the account.
+			continue
+		}
+		atomic.StoreInt32(&a.w.closeRequested, 1)
+		if a.w.claim() {
+			a.b.closeUnwatched(a.ctx)
+			close(a.w.closed)
+		}
+		// Otherwise the owner is operating on the account, and closes it
+		// once done, or closed it already.
+	}
+}
+
+// stop stops the goroutine watching accounts, and waits for it to exit. It
+// is called when the monitor is stopped; the accounts still watched by then
+// are reported as leaked.
+func (dw *doneWatcher) stop() {
+	dw.mu.Lock()
+	stop, done := dw.mu.stop, dw.mu.done
+	dw.mu.stop, dw.mu.done, dw.mu.notify = nil, nil, nil
+	dw.mu.pending = nil
+	dw.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestCloseOnDone(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+
+	waitForEmpty := func() {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); m.AllocBytes() != 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the monitor to be empty, got %d bytes", m.AllocBytes())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Goroutines exit without closing their accounts; their contexts are
+	// canceled afterwards.
+	const n = 50
+	var cancels []context.CancelFunc
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		reqCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			acc := m.MakeBoundAccount()
+			acc.CloseOnDone(reqCtx)
+			if err := acc.Grow(reqCtx, int64(10*(i+1))); err != nil {
+				t.Error(err)
+			}
+			runtime.Goexit()
+			acc.Close(ctx)
+		}(i)
+	}
+	wg.Wait()
+	if m.AllocBytes() == 0 {
+		t.Fatal("expected the accounts to hold bytes")
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	waitForEmpty()
+
+	// Accounts closed by their owners, before or after their context is
+	// done, are only closed once.
+	accs := make([]mon.BoundAccount, n)
+	cancels = cancels[:0]
+	for i := range accs {
+		reqCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		accs[i] = m.MakeBoundAccount()
+		accs[i].CloseOnDone(reqCtx)
+		if err := accs[i].Grow(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range accs {
+		if i%2 == 0 {
+			accs[i].Close(ctx)
+		}
+		cancels[i]()
+	}
+	waitForEmpty()
+	for i := range accs {
+		accs[i].Close(ctx)
+	}
+	montest.AssertEmpty(t, &m)
+
+	// A closed account can be reused without watching.
+	if err := accs[0].Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	accs[0].Close(ctx)
+}
+
+func TestCloseOnDoneConcurrentUse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+
+	// The contexts of the accounts are canceled while their owners use
+	// them. Once the context is done, growths fail and the other operations
+	// are no-ops, without the bytes being released twice.
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		reqCtx, cancel := context.WithCancel(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acc := m.MakeBoundAccount()
+			acc.CloseOnDone(reqCtx)
+			for reqCtx.Err() == nil {
+				if err := acc.Grow(ctx, 100); err != nil {
+					break
+				}
+				acc.Shrink(ctx, 50)
+			}
+			<-reqCtx.Done()
+			// Let the close by the watcher happen, if it didn't already.
+			for deadline := time.Now().Add(10 * time.Second); ; {
+				if err := acc.Grow(ctx, 10); err != nil {
+					break
+				}
+				acc.Shrink(ctx, 10)
+				if time.Now().After(deadline) {
+					t.Error("expected growths to fail once the context is done")
+					break
+				}
+				runtime.Gosched()
+			}
+			acc.Shrink(ctx, 50)
+			acc.Clear(ctx)
+			acc.Close(ctx)
+		}()
+		go func() {
+			time.Sleep(time.Millisecond)
+			cancel()
+		}()
+	}
+	wg.Wait()
+	montest.AssertEmpty(t, &m)
+}
+
+func TestCloseOnDoneStop(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithLeakReaction(mon.LeakLogAndRelease))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	before := runtime.NumGoroutine()
+	waitForGoroutines := func() {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); runtime.NumGoroutine() > before; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the watching goroutine to exit, got %d more", runtime.NumGoroutine()-before)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	accs := make([]mon.BoundAccount, 10)
+	watch := func() {
+		t.Helper()
+		for i := range accs {
+			accs[i] = m.MakeBoundAccount()
+			accs[i].CloseOnDone(reqCtx)
+		}
+		if g := runtime.NumGoroutine(); g != before+1 {
+			t.Fatalf("expected a single goroutine for all the watched accounts, got %d more", g-before)
+		}
+	}
+
+	// The goroutine watching the accounts exits once they are all closed.
+	watch()
+	for i := range accs {
+		accs[i].Close(ctx)
+	}
+	waitForGoroutines()
+
+	// It also exits when the monitor is stopped, even though the contexts
+	// of the accounts are never done.
+	watch()
+	if err := accs[0].Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop(ctx)
+	waitForGoroutines()
+}
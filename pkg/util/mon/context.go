@@ -0,0 +1,64 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// The helpers below carry an account or a monitor in a context, for deep
+// call stacks that carry a context but can't thread them as parameters,
+// e.g. the evaluation of expressions and builtins. By convention, a context
+// without an account or a monitor attached means that the work it carries
+// is not monitored: the lookups return nil and GrowFromContext is a no-op.
+// The lookups don't allocate.
+
+type accountContextKey struct{}
+type monitorContextKey struct{}
+
+// ContextWithAccount returns a context carrying acc, which overrides any
+// account carried by ctx. The account must not be used concurrently by the
+// users of the context, like any other account.
+func ContextWithAccount(ctx context.Context, acc *BoundAccount) context.Context {
+	return context.WithValue(ctx, accountContextKey{}, acc)
+}
+
+// AccountFromContext returns the account carried by ctx, or nil if there is
+// none.
+func AccountFromContext(ctx context.Context) *BoundAccount {
+	acc, _ := ctx.Value(accountContextKey{}).(*BoundAccount)
+	return acc
+}
+
+// ContextWithMonitor returns a context carrying mm, which overrides any
+// monitor carried by ctx.
+func ContextWithMonitor(ctx context.Context, mm *BytesMonitor) context.Context {
+	return context.WithValue(ctx, monitorContextKey{}, mm)
+}
+
+// MonitorFromContext returns the monitor carried by ctx, or nil if there is
+// none.
+func MonitorFromContext(ctx context.Context) *BytesMonitor {
+	mm, _ := ctx.Value(monitorContextKey{}).(*BytesMonitor)
+	return mm
+}
+
+// GrowFromContext grows the account carried by ctx by n bytes. It is a no-op
+// if ctx doesn't carry an account.
+func GrowFromContext(ctx context.Context, n int64) error {
+	acc := AccountFromContext(ctx)
+	if acc == nil {
+		return nil
+	}
+	return acc.Grow(ctx, n)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestContextAccount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("eval", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	outer, inner := m.MakeBoundAccount(), m.MakeBoundAccount()
+
+	// Unattached: nothing is found and growing is a no-op.
+	if acc := mon.AccountFromContext(ctx); acc != nil {
+		t.Fatalf("expected no account, got %v", acc)
+	}
+	if mm := mon.MonitorFromContext(ctx); mm != nil {
+		t.Fatal("expected no monitor")
+	}
+	if err := mon.GrowFromContext(ctx, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attached.
+	outerCtx := mon.ContextWithMonitor(mon.ContextWithAccount(ctx, &outer), &m)
+	if acc := mon.AccountFromContext(outerCtx); acc != &outer {
+		t.Fatalf("expected the outer account, got %v", acc)
+	}
+	if mm := mon.MonitorFromContext(outerCtx); mm != &m {
+		t.Fatal("expected the monitor to be attached")
+	}
+	if err := mon.GrowFromContext(outerCtx, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nested: the inner account overrides the outer one, and the monitor is
+	// still visible.
+	innerCtx := mon.ContextWithAccount(outerCtx, &inner)
+	if acc := mon.AccountFromContext(innerCtx); acc != &inner {
+		t.Fatalf("expected the inner account, got %v", acc)
+	}
+	if mm := mon.MonitorFromContext(innerCtx); mm != &m {
+		t.Fatal("expected the monitor to be visible from the inner context")
+	}
+	if err := mon.GrowFromContext(innerCtx, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.GrowFromContext(innerCtx, 2000); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if outer.Used() != 100 || inner.Used() != 10 {
+		t.Fatalf("expected 100 and 10 bytes used, got %d and %d", outer.Used(), inner.Used())
+	}
+
+	// The lookups don't allocate.
+	if n := testing.AllocsPerRun(100, func() {
+		_ = mon.AccountFromContext(innerCtx)
+		_ = mon.MonitorFromContext(innerCtx)
+		_ = mon.AccountFromContext(ctx)
+		_ = mon.GrowFromContext(ctx, 1)
+	}); n != 0 {
+		t.Fatalf("expected the lookups not to allocate, got %.1f allocations", n)
+	}
+
+	outer.Close(ctx)
+	inner.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// copyChunkSize is the size of the buffer used by Copy.
+const copyChunkSize = 32 << 10
+
+// Copy is like io.Copy, for destinations that keep the copied bytes in
+// memory: every chunk read from src is charged to acc before it is written
+// to dst, so that a copy that doesn't fit in the budget fails as soon as it
+// exceeds it. The charge is not released; it belongs to whoever owns dst. On
+// a budget error, the number of bytes copied so far is returned along with
+// the error.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, acc *BoundAccount) (int64, error) {
+	buf := make([]byte, copyChunkSize)
+	var written int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if err := acc.Grow(ctx, int64(n)); err != nil {
+				return written, errors.Wrapf(err, "copy aborted after %d bytes", written)
+			}
+			nw, werr := dst.Write(buf[:n])
+			written += int64(nw)
+			if nw < n {
+				acc.Shrink(ctx, int64(n-nw))
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nw < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// CopyN is like io.CopyN, for copies whose size is known upfront: the n bytes
+// are charged to acc before anything is copied, so that the copy fails
+// without doing any work if it doesn't fit in the budget. If fewer than n
+// bytes are copied, the charge for the missing bytes is released; the charge
+// for the copied bytes belongs to whoever owns dst.
+func CopyN(
+	ctx context.Context, dst io.Writer, src io.Reader, n int64, acc *BoundAccount,
+) (int64, error) {
+	if err := acc.Grow(ctx, n); err != nil {
+		return 0, errors.Wrapf(err, "reserving %d bytes for copy", n)
+	}
+	written, err := io.CopyN(dst, src, n)
+	if written < n {
+		acc.Shrink(ctx, n-written)
+	}
+	return written, err
+}
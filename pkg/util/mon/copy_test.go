@@ -0,0 +1,113 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestCopy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(90<<10))
+	acc := m.MakeBoundAccount()
+
+	// A copy that fits keeps its charge.
+	var dst bytes.Buffer
+	src := bytes.Repeat([]byte("x"), 50<<10)
+	n, err := Copy(ctx, &dst, bytes.NewReader(src), &acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(src)) || dst.Len() != len(src) || acc.Used() != n {
+		t.Fatalf("expected %d bytes copied and charged, got %d copied, %d written, %d charged",
+			len(src), n, dst.Len(), acc.Used())
+	}
+
+	// A copy that doesn't fit is aborted once the budget is exhausted. The
+	// copied bytes stay charged.
+	dst.Reset()
+	n, err = Copy(ctx, &dst, bytes.NewReader(src), &acc)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "copy aborted after 32768 bytes") {
+		t.Fatalf("expected error to mention the bytes copied, got %v", err)
+	}
+	if n != copyChunkSize || dst.Len() != copyChunkSize || acc.Used() != 50<<10+n {
+		t.Fatalf("expected one chunk copied and charged, got %d copied, %d written, %d charged",
+			n, dst.Len(), acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestCopyN(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	var dst bytes.Buffer
+	src := strings.Repeat("x", 600)
+	n, err := CopyN(ctx, &dst, strings.NewReader(src), 600, &acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 600 || acc.Used() != 600 {
+		t.Fatalf("expected 600 bytes copied and charged, got %d and %d", n, acc.Used())
+	}
+
+	// A copy that doesn't fit fails without copying anything.
+	dst.Reset()
+	n, err = CopyN(ctx, &dst, strings.NewReader(src), 600, &acc)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if n != 0 || dst.Len() != 0 || acc.Used() != 600 {
+		t.Fatalf("expected nothing copied, got %d copied, %d written, %d charged",
+			n, dst.Len(), acc.Used())
+	}
+
+	// A short copy only keeps the charge for the bytes copied.
+	acc.Clear(ctx)
+	n, err = CopyN(ctx, &dst, strings.NewReader(src[:100]), 200, &acc)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if n != 100 || acc.Used() != 100 {
+		t.Fatalf("expected 100 bytes copied and charged, got %d and %d", n, acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
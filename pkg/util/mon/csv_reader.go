@@ -0,0 +1,222 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// CSVReader reads CSV records while charging the bytes of the record being
+// read to an account. The raw bytes of a record are accumulated line by line
+// (a quoted field may span several lines) in a buffer whose capacity is
+// charged as it grows, so that a huge record is refused while it is being
+// read rather than after it has been buffered entirely. Complete records are
+// then split into fields with encoding/csv, and the fields are charged too.
+//
+// The buffer is reused from one record to the next, and stays charged until
+// Close, or until the end of the input; a buffer grown beyond
+// csvMaxRetainedBuffer by a huge record is dropped, along with its charge,
+// at the next call to Read. The charge for the fields of a record is held
+// until the next call to Read or Close, which release it, unless the caller
+// takes over the charge with Retain.
+//
+// A CSVReader is not safe for concurrent use.
+type CSVReader struct {
+	// Comma is the field delimiter. It is set to ',' by NewCSVReader.
+	Comma rune
+
+	ctx           context.Context
+	r             *bufio.Reader
+	acc           *BoundAccount
+	maxRecordSize int64
+
+	// line is the number of lines consumed so far.
+	line int
+	// buf accumulates the raw bytes of the current record. Its capacity is
+	// charged to acc as bufCharged.
+	buf        []byte
+	bufCharged int64
+	// charged is the number of bytes charged to acc for the fields of the
+	// current record.
+	charged int64
+}
+
+// csvMaxRetainedBuffer is the capacity beyond which the buffer of a
+// CSVReader is not reused for the next record.
+const csvMaxRetainedBuffer = 64 << 10
+
+// NewCSVReader creates a CSVReader reading from r and charging acc. Records
+// larger than maxRecordSize bytes are refused; if maxRecordSize is 0 or
+// lower, records are only limited by the account's budget.
+func NewCSVReader(
+	ctx context.Context, r io.Reader, acc *BoundAccount, maxRecordSize int64,
+) *CSVReader {
+	return &CSVReader{
+		Comma:         ',',
+		ctx:           ctx,
+		r:             bufio.NewReader(r),
+		acc:           acc,
+		maxRecordSize: maxRecordSize,
+	}
+}
+
+// Read returns the next record, or io.EOF if there are no more records. The
+// returned fields remain charged to the account until the next call to Read
+// or Close.
+func (c *CSVReader) Read() ([]string, error) {
+	c.release()
+	if c.bufCharged > csvMaxRetainedBuffer {
+		c.dropBuffer()
+	}
+	for {
+		record, err := c.readRecord()
+		if err == io.EOF {
+			c.dropBuffer()
+		}
+		if err != nil || record != nil {
+			return record, err
+		}
+		// Skip empty lines, like encoding/csv does.
+	}
+}
+
+// readRecord reads the raw bytes of the next record and parses them. It
+// returns a nil record without an error for empty lines.
+func (c *CSVReader) readRecord() ([]string, error) {
+	startLine := c.line + 1
+	c.buf = c.buf[:0]
+	quotes := 0
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if err := c.growBuffer(startLine, len(chunk)); err != nil {
+				return nil, err
+			}
+			c.buf = append(c.buf, chunk...)
+			quotes += bytes.Count(chunk, []byte{'"'})
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == nil {
+			c.line++
+			if quotes%2 != 0 {
+				// The newline is part of a quoted field.
+				continue
+			}
+		}
+		if len(bytes.TrimRight(c.buf, "\r\n")) == 0 {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, nil
+		}
+		return c.parse(startLine)
+	}
+}
+
+// growBuffer makes room for n more bytes in the buffer of the record
+// starting at startLine, charging the capacity it adds.
+func (c *CSVReader) growBuffer(startLine int, n int) error {
+	need := int64(len(c.buf) + n)
+	if c.maxRecordSize > 0 && need > c.maxRecordSize {
+		return errors.Errorf("record on line %d exceeds maximum record size of %d bytes",
+			startLine, c.maxRecordSize)
+	}
+	if need <= int64(cap(c.buf)) {
+		return nil
+	}
+	newCap := 2 * int64(cap(c.buf))
+	if newCap < need {
+		newCap = need
+	}
+	if c.maxRecordSize > 0 && newCap > c.maxRecordSize {
+		newCap = c.maxRecordSize
+	}
+	if err := c.acc.Grow(c.ctx, newCap-c.bufCharged); err != nil {
+		return errors.Wrapf(err, "reading record on line %d", startLine)
+	}
+	c.bufCharged = newCap
+	buf := make([]byte, len(c.buf), newCap)
+	copy(buf, c.buf)
+	c.buf = buf
+	return nil
+}
+
+func (c *CSVReader) parse(startLine int) ([]string, error) {
+	cr := csv.NewReader(bytes.NewReader(c.buf))
+	cr.Comma = c.Comma
+	cr.FieldsPerRecord = -1
+	record, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing record on line %d", startLine)
+	}
+	// The headers of the fields are in the backing array of the record.
+	sz := SliceSize(int64(len(record)), int64(cap(record)), SizeOfString)
+	for _, f := range record {
+		sz += StringSize(f) - SizeOfString
+	}
+	if err := c.acc.Grow(c.ctx, sz); err != nil {
+		return nil, errors.Wrapf(err, "parsing record on line %d", startLine)
+	}
+	c.charged = sz
+	return record, nil
+}
+
+// Retain transfers the charge for the fields of the record last returned by
+// Read to dst, for callers that hold on to the fields beyond the next call
+// to Read.
+func (c *CSVReader) Retain(dst *BoundAccount) error {
+	if c.charged == 0 {
+		return nil
+	}
+	if err := dst.Grow(c.ctx, c.charged); err != nil {
+		return err
+	}
+	c.release()
+	return nil
+}
+
+// Close releases the charge for the current record and the buffer.
+func (c *CSVReader) Close() {
+	c.release()
+	c.dropBuffer()
+}
+
+// release releases the charge for the fields of the current record.
+func (c *CSVReader) release() {
+	if c.charged > 0 {
+		c.acc.Shrink(c.ctx, c.charged)
+		c.charged = 0
+	}
+}
+
+// dropBuffer drops the buffer and releases its charge.
+func (c *CSVReader) dropBuffer() {
+	c.buf = nil
+	if c.bufCharged > 0 {
+		c.acc.Shrink(c.ctx, c.bufCharged)
+		c.bufCharged = 0
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestCSVReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1<<20))
+	acc := m.MakeBoundAccount()
+	retained := m.MakeBoundAccount()
+
+	input := "a,b,c\n\n\"multi\nline\",\"with \"\"quotes\"\"\",3\r\nlast,row"
+	r := NewCSVReader(ctx, strings.NewReader(input), &acc, 0 /* maxRecordSize */)
+
+	expected := [][]string{
+		{"a", "b", "c"},
+		{"multi\nline", `with "quotes"`, "3"},
+		{"last", "row"},
+	}
+	var bufCap int
+	for i, exp := range expected {
+		record, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(record, exp) {
+			t.Fatalf("%d: expected %q, got %q", i, exp, record)
+		}
+		// The buffer and the fields are charged.
+		fields := SliceSize(int64(len(record)), int64(cap(record)), SizeOfString)
+		for _, f := range record {
+			fields += int64(len(f))
+		}
+		if expected := int64(cap(r.buf)) + fields; acc.Used() != expected {
+			t.Fatalf("%d: expected %d bytes charged, got %d", i, expected, acc.Used())
+		}
+		// The last record fits in the buffer of the previous one, which is
+		// reused.
+		if i == 2 && cap(r.buf) != bufCap {
+			t.Fatalf("expected the buffer of capacity %d to be reused, got %d", bufCap, cap(r.buf))
+		}
+		bufCap = cap(r.buf)
+		if i == 1 {
+			if err := r.Retain(&retained); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Used() != int64(cap(r.buf)) || retained.Used() != fields {
+				t.Fatalf("expected charge of %d to move to the retaining account, got %d and %d",
+					fields, acc.Used(), retained.Used())
+			}
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected reader to release its charge, got %d", acc.Used())
+	}
+	// The buffer of the records isn't kept once the input is consumed.
+	if c := cap(r.buf); c != 0 {
+		t.Fatalf("expected the buffer to be dropped, got a capacity of %d", c)
+	}
+	r.Close()
+
+	retained.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestCSVReaderLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// The third record has a quoted field that spans several lines and keeps
+	// growing past the limits.
+	input := "a,b\nc,d\n\"" + strings.Repeat(strings.Repeat("x", 99)+"\n", 200) + "\",e\n"
+
+	t.Run("budget", func(t *testing.T) {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(10000))
+		acc := m.MakeBoundAccount()
+
+		r := NewCSVReader(ctx, strings.NewReader(input), &acc, 0 /* maxRecordSize */)
+		for i := 0; i < 2; i++ {
+			if _, err := r.Read(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := r.Read()
+		if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+			t.Fatalf("expected out of memory error, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "line 3") {
+			t.Fatalf("expected error to mention the line number, got %v", err)
+		}
+		r.Close()
+		if acc.Used() != 0 {
+			t.Fatalf("expected account to be empty, got %d", acc.Used())
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+
+	t.Run("max-record-size", func(t *testing.T) {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(1<<20))
+		acc := m.MakeBoundAccount()
+
+		r := NewCSVReader(ctx, strings.NewReader(input), &acc, 5000 /* maxRecordSize */)
+		for i := 0; i < 2; i++ {
+			if _, err := r.Read(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := r.Read()
+		if err == nil || !strings.Contains(err.Error(),
+			"record on line 3 exceeds maximum record size of 5000 bytes") {
+			t.Fatalf("expected record size error, got %v", err)
+		}
+		if acc.Used() > 5000 {
+			t.Fatalf("expected at most 5000 bytes charged, got %d", acc.Used())
+		}
+		r.Close()
+		if acc.Used() != 0 {
+			t.Fatalf("expected account to be empty, got %d", acc.Used())
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+)
+
+// limitedDecompressReader is the io.ReadCloser returned by
+// LimitedDecompressReader.
+type limitedDecompressReader struct {
+	ctx   context.Context
+	r     io.Reader
+	acc   *BoundAccount
+	chunk int64
+
+	// charged is the number of bytes this reader has grown acc by so far.
+	charged int64
+	// produced is the number of bytes handed out to the caller so far. It
+	// never exceeds charged.
+	produced int64
+	// err is the sticky error returned once the account denied a chunk.
+	err error
+	// peek holds a byte read ahead from r, if peeked is set, to check that
+	// the stream goes on before charging the next chunk.
+	peek   [1]byte
+	peeked bool
+}
+
+// LimitedDecompressReader wraps r, typically the output of a decompressor
+// (gzip, snappy, etc), so that the bytes it produces are charged to acc. The
+// account is grown in increments of chunk bytes ahead of the data being
+// returned to the caller; once the account denies an increment, the read
+// stops and the budget error is returned from that point on, so the output is
+// truncated at the last granted chunk.
+//
+// The bytes charged by the reader are released from acc when the returned
+// reader is closed. Close also closes r if it implements io.Closer.
+func LimitedDecompressReader(
+	ctx context.Context, r io.Reader, acc *BoundAccount, chunk int64,
+) io.ReadCloser {
+	if chunk <= 0 {
+		chunk = DefaultPoolAllocationSize
+	}
+	return &limitedDecompressReader{ctx: ctx, r: r, acc: acc, chunk: chunk}
+}
+
+// Read implements the io.Reader interface.
+func (l *limitedDecompressReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.produced == l.charged {
+		// Only charge the next chunk if the stream goes on, so that a stream
+		// ending exactly at the budget isn't refused.
+		if !l.peeked {
+			n, err := l.r.Read(l.peek[:])
+			for n == 0 && err == nil {
+				n, err = l.r.Read(l.peek[:])
+			}
+			if n == 0 {
+				return 0, err
+			}
+			l.peeked = true
+		}
+		if err := l.acc.Grow(l.ctx, l.chunk); err != nil {
+			l.err = err
+			return 0, err
+		}
+		l.charged += l.chunk
+	}
+	if avail := l.charged - l.produced; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	if !l.peeked {
+		n, err := l.r.Read(p)
+		l.produced += int64(n)
+		return n, err
+	}
+	p[0] = l.peek[0]
+	l.peeked = false
+	n, err := l.r.Read(p[1:])
+	n++
+	l.produced += int64(n)
+	return n, err
+}
+
+// Close releases the bytes charged by the reader and closes the underlying
+// reader if it implements io.Closer.
+func (l *limitedDecompressReader) Close() error {
+	if l.charged > 0 {
+		l.acc.Shrink(l.ctx, l.charged)
+		l.charged = 0
+		l.produced = 0
+	}
+	if c, ok := l.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
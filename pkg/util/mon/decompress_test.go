@@ -0,0 +1,145 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestLimitedDecompressReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// 1MiB of zeros compresses down to about 1KiB.
+	const uncompressedSize = 1 << 20
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(make([]byte, uncompressedSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const budget = 64 << 10
+	const chunk = 4 << 10
+	if compressed.Len() >= budget {
+		t.Fatalf("expected compressed input smaller than budget, got %d bytes", compressed.Len())
+	}
+
+	t.Run("denied", func(t *testing.T) {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(budget))
+		acc := m.MakeBoundAccount()
+
+		gr, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := LimitedDecompressReader(ctx, gr, &acc, chunk)
+		out, err := ioutil.ReadAll(r)
+		if err == nil {
+			t.Fatal("expected budget error, got none")
+		}
+		if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+			t.Fatalf("expected out of memory error, got %v", err)
+		}
+		if len(out) != budget {
+			t.Fatalf("expected output truncated at %d bytes, got %d", budget, len(out))
+		}
+		if acc.Used() != budget {
+			t.Fatalf("expected %d bytes charged, got %d", budget, acc.Used())
+		}
+		// The error is sticky.
+		if _, err := r.Read(make([]byte, 1)); err == nil {
+			t.Fatal("expected error on subsequent read")
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if acc.Used() != 0 {
+			t.Fatalf("expected account empty after Close, got %d", acc.Used())
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+
+	t.Run("exact", func(t *testing.T) {
+		// The stream ends exactly at the budget.
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(uncompressedSize))
+		acc := m.MakeBoundAccount()
+
+		gr, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := LimitedDecompressReader(ctx, gr, &acc, chunk)
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != uncompressedSize {
+			t.Fatalf("expected %d bytes, got %d", uncompressedSize, len(out))
+		}
+		if acc.Used() != uncompressedSize {
+			t.Fatalf("expected %d bytes charged, got %d", uncompressedSize, acc.Used())
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+
+	t.Run("fits", func(t *testing.T) {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(2*uncompressedSize))
+		acc := m.MakeBoundAccount()
+
+		gr, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := LimitedDecompressReader(ctx, gr, &acc, chunk)
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != uncompressedSize {
+			t.Fatalf("expected %d bytes, got %d", uncompressedSize, len(out))
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if acc.Used() != 0 {
+			t.Fatalf("expected account empty after Close, got %d", acc.Used())
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+}
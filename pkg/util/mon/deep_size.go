@@ -0,0 +1,190 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+)
+
+// DefaultDeepSizeMaxDepth is the default number of indirections followed by
+// DeepSize; see WithMaxDepth.
+const DefaultDeepSizeMaxDepth = 100
+
+// mapEntryOverhead estimates the per-entry overhead of a map on top of the
+// size of its keys and values: the tophash byte and the share of the bucket
+// pointers and of the unused slots of a bucket.
+const mapEntryOverhead = 8
+
+// DeepSizeOption is an option that can be passed to DeepSize and DeepGrow.
+type DeepSizeOption interface {
+	apply(*deepSizer)
+}
+
+type deepSizeOptionFunc func(*deepSizer)
+
+func (f deepSizeOptionFunc) apply(s *deepSizer) {
+	f(s)
+}
+
+// WithMaxDepth caps the number of pointers, slices, maps, channels and
+// interfaces followed from the value being measured. The values beyond the
+// cap are not counted, so a low cap underestimates deep structures, like
+// long linked lists, in exchange for a bounded traversal.
+func WithMaxDepth(depth int) DeepSizeOption {
+	return deepSizeOptionFunc(func(s *deepSizer) {
+		s.maxDepth = depth
+	})
+}
+
+// DeepSize estimates the memory footprint of v by walking it with
+// reflection: the value itself and everything reachable from it, including
+// through unexported fields. Values reachable through several pointers, and
+// cycles, are counted once. If v is a pointer, the pointer itself is not
+// counted, only what it points to.
+//
+// The estimate ignores allocator rounding and approximates the layout of
+// maps, and is much slower than manual accounting: it is meant for rarely
+// executed paths where exact accounting isn't worth the code.
+func DeepSize(v interface{}, opts ...DeepSizeOption) int64 {
+	if v == nil {
+		return 0
+	}
+	s := deepSizer{
+		maxDepth: DefaultDeepSizeMaxDepth,
+		seen:     make(map[seenKey]struct{}),
+	}
+	for _, opt := range opts {
+		opt.apply(&s)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		return s.indirect(rv, 0)
+	}
+	return int64(rv.Type().Size()) + s.indirect(rv, 0)
+}
+
+// DeepGrow charges the account with the DeepSize of v, and returns the
+// number of bytes charged so that the caller can later release them with
+// Shrink. Nothing is charged, and 0 is returned, if the growth is refused.
+func DeepGrow(
+	ctx context.Context, acc *BoundAccount, v interface{}, opts ...DeepSizeOption,
+) (int64, error) {
+	size := DeepSize(v, opts...)
+	if err := acc.Grow(ctx, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// seenKey identifies an out-of-line value reached by DeepSize. The type is
+// part of the key, as a struct and its first field share their address.
+type seenKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+type deepSizer struct {
+	maxDepth int
+	seen     map[seenKey]struct{}
+}
+
+// visit returns whether the value of type typ at ptr is reached for the
+// first time, and records it.
+func (s *deepSizer) visit(ptr uintptr, typ reflect.Type) bool {
+	k := seenKey{ptr: ptr, typ: typ}
+	if _, ok := s.seen[k]; ok {
+		return false
+	}
+	s.seen[k] = struct{}{}
+	return true
+}
+
+// indirect returns the size of the memory reachable from v, excluding v
+// itself, depth being the number of indirections followed to reach v.
+func (s *deepSizer) indirect(v reflect.Value, depth int) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || depth >= s.maxDepth || !s.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		elem := v.Elem()
+		return int64(elem.Type().Size()) + s.indirect(elem, depth+1)
+
+	case reflect.Slice:
+		if v.IsNil() || depth >= s.maxDepth || !s.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += s.indirect(v.Index(i), depth+1)
+		}
+		return size
+
+	case reflect.String:
+		return int64(v.Len())
+
+	case reflect.Map:
+		if v.IsNil() || depth >= s.maxDepth || !s.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		t := v.Type()
+		entry := int64(t.Key().Size()+t.Elem().Size()) + mapEntryOverhead
+		size := int64(v.Len()) * entry
+		for _, k := range v.MapKeys() {
+			size += s.indirect(k, depth+1) + s.indirect(v.MapIndex(k), depth+1)
+		}
+		return size
+
+	case reflect.Chan:
+		if v.IsNil() || depth >= s.maxDepth || !s.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		return int64(v.Cap()) * int64(v.Type().Elem().Size())
+
+	case reflect.Interface:
+		if v.IsNil() || depth >= s.maxDepth {
+			return 0
+		}
+		elem := v.Elem()
+		switch elem.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			// Pointer-shaped values are stored in the interface itself.
+			return s.indirect(elem, depth)
+		}
+		// Other values are boxed. The boxes can't be told apart, so they are
+		// counted every time.
+		return int64(elem.Type().Size()) + s.indirect(elem, depth+1)
+
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += s.indirect(v.Field(i), depth)
+		}
+		return size
+
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += s.indirect(v.Index(i), depth)
+		}
+		return size
+
+	default:
+		// Scalars have no out-of-line memory, and functions and unsafe
+		// pointers are not followed.
+		return 0
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+type deepSizeLeaf struct {
+	id   int64
+	name string
+}
+
+// deepSizeNode has a known layout of 8+24+16+8+8 = 64 bytes on 64-bit
+// platforms.
+type deepSizeNode struct {
+	val    int64
+	ints   []int64
+	desc   string
+	leaf   *deepSizeLeaf
+	shared *deepSizeLeaf
+}
+
+type deepSizeList struct {
+	val  int64
+	next *deepSizeList
+}
+
+func TestDeepSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const leafSize = SizeOfInt64 + SizeOfString
+	const nodeSize = SizeOfInt64 + SizeOfSliceHeader + SizeOfString + 2*SizeOfPtr
+	leaf := &deepSizeLeaf{id: 1, name: "leaf"}
+	node := &deepSizeNode{
+		val:    1,
+		ints:   make([]int64, 3, 10),
+		desc:   "hello",
+		leaf:   leaf,
+		shared: leaf,
+	}
+	list := &deepSizeList{val: 1, next: &deepSizeList{val: 2, next: &deepSizeList{val: 3}}}
+	ring := &deepSizeList{val: 1}
+	ring.next = &deepSizeList{val: 2, next: ring}
+
+	testCases := []struct {
+		name     string
+		v        interface{}
+		opts     []DeepSizeOption
+		expected int64
+	}{
+		{"nil", nil, nil, 0},
+		{"int", int64(1), nil, SizeOfInt64},
+		{"string", "hello", nil, StringSize("hello")},
+		{"slice", make([]int64, 3, 10), nil, SliceSize(3, 10, SizeOfInt64)},
+		{"leaf", leaf, nil, leafSize + 4},
+		// The leaf is shared by two fields, but only counted once.
+		{"node", node, nil, nodeSize + 10*SizeOfInt64 + 5 + leafSize + 4},
+		{"node by value", *node, nil, nodeSize + 10*SizeOfInt64 + 5 + leafSize + 4},
+		{"list", list, nil, 3 * 16},
+		{"cycle", ring, nil, 2 * 16},
+		{"max depth", list, []DeepSizeOption{WithMaxDepth(2)}, 2 * 16},
+		{"interfaces", []interface{}{leaf, leaf}, nil, SliceSize(2, 2, SizeOfInterface) + leafSize + 4},
+		{"map", map[int64]int64{1: 1, 2: 2}, nil, SizeOfMap + 2*(2*SizeOfInt64+mapEntryOverhead)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The estimates must be within 10% of the expected size.
+			size := DeepSize(tc.v, tc.opts...)
+			if diff := size - tc.expected; diff*10 > tc.expected || -diff*10 > tc.expected {
+				t.Errorf("expected about %d bytes, got %d", tc.expected, size)
+			}
+		})
+	}
+}
+
+func TestDeepGrow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+
+	acc := m.MakeBoundAccount()
+	v := &deepSizeLeaf{id: 1, name: "leaf"}
+	size, err := DeepGrow(ctx, &acc, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != DeepSize(v) || acc.Used() != size {
+		t.Fatalf("expected %d bytes to be charged, got %d (account: %d)", DeepSize(v), size, acc.Used())
+	}
+
+	// Nothing is charged if the growth is refused.
+	big := make([]byte, 100)
+	if n, err := DeepGrow(ctx, &acc, big); !isOutOfMemory(err) || n != 0 {
+		t.Fatalf("expected out of memory error, got %d, %v", n, err)
+	}
+	if acc.Used() != size {
+		t.Fatalf("expected %d bytes used, got %d", size, acc.Used())
+	}
+
+	acc.Shrink(ctx, size)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
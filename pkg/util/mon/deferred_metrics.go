@@ -0,0 +1,71 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+// WithDeferredMetrics makes the monitor accumulate the changes of its usage
+// locally, and apply them to its current usage gauge only once they add up
+// to threshold bytes, in either direction, or when FlushMetrics is called.
+// This avoids contention on the gauge, which is typically shared by many
+// monitors, when the monitor is hot; in exchange, the gauge lags behind the
+// usage of the monitor by less than threshold bytes. The maximum usage
+// histogram is unaffected, as it is recorded from the true maximum when the
+// monitor stops. 0 disables the mode.
+func WithDeferredMetrics(threshold int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.metricsFlushThreshold = threshold
+	})
+}
+
+// FlushMetrics applies the changes of usage accumulated in deferred metrics
+// mode to the current usage gauge, e.g. from a periodic logger. It is a no-op
+// otherwise.
+func (mm *BytesMonitor) FlushMetrics() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.flushMetricsLocked()
+}
+
+// updateCurBytesLocked reflects a change of delta bytes of the usage in the
+// current usage gauge, possibly deferring it.
+func (mm *BytesMonitor) updateCurBytesLocked(delta int64) {
+	if mm.curBytesCount == nil {
+		return
+	}
+	if mm.metricsFlushThreshold <= 0 {
+		updateGauge(mm.curBytesCount, delta)
+		return
+	}
+	mm.mu.unflushedDelta += delta
+	if d := mm.mu.unflushedDelta; d >= mm.metricsFlushThreshold || -d >= mm.metricsFlushThreshold {
+		mm.flushMetricsLocked()
+	}
+}
+
+func (mm *BytesMonitor) flushMetricsLocked() {
+	if mm.mu.unflushedDelta == 0 {
+		return
+	}
+	updateGauge(mm.curBytesCount, mm.mu.unflushedDelta)
+	mm.mu.unflushedDelta = 0
+}
+
+// updateGauge increments or decrements g by delta depending on its sign.
+func updateGauge(g BytesGauge, delta int64) {
+	if delta < 0 {
+		g.Dec(-delta)
+	} else {
+		g.Inc(delta)
+	}
+}
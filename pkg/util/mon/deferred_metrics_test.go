@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestDeferredMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+
+	const threshold = 1000
+	curBytes := metric.NewGauge(metric.Metadata{Name: "test.cur_bytes"})
+	maxBytes := metric.NewHistogram(metric.Metadata{Name: "test.max_bytes"}, time.Minute, 1e10, 1)
+	m := mon.MakeMonitor("hot", mon.MemoryResource, curBytes, maxBytes, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly), mon.WithDeferredMetrics(threshold))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	acc := m.MakeBoundAccount()
+
+	// The gauge lags behind the usage by less than the threshold.
+	for i := 0; i < 1000; i++ {
+		if n := rnd.Int63n(300); rnd.Intn(2) == 0 || n > acc.Used() {
+			if err := acc.Grow(ctx, n); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			acc.Shrink(ctx, n)
+		}
+		if lag := m.AllocBytes() - curBytes.Value(); lag >= threshold || -lag >= threshold {
+			t.Fatalf("gauge at %d for a usage of %d", curBytes.Value(), m.AllocBytes())
+		}
+	}
+
+	m.FlushMetrics()
+	if curBytes.Value() != m.AllocBytes() {
+		t.Fatalf("expected the gauge at %d after a flush, got %d", m.AllocBytes(), curBytes.Value())
+	}
+
+	if err := acc.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+	if v := curBytes.Value(); v != 0 {
+		t.Fatalf("expected the gauge to be flushed when the monitor stops, got %d", v)
+	}
+	if n := maxBytes.TotalCount(); n != 1 {
+		t.Fatalf("expected the maximum usage to be recorded, got %d records", n)
+	}
+}
+
+// BenchmarkDeferredMetrics grows and shrinks accounts of monitors sharing a
+// gauge from concurrent goroutines, with and without deferred metrics.
+func BenchmarkDeferredMetrics(b *testing.B) {
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	for _, threshold := range []int64{0, 64 << 10} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			curBytes := metric.NewGauge(metric.Metadata{Name: "test.cur_bytes"})
+			b.RunParallel(func(pb *testing.PB) {
+				m := mon.MakeMonitor("hot", mon.MemoryResource, curBytes, nil, 1, math.MaxInt64, st,
+					mon.WithReservationPolicy(mon.ReleaseEagerly), mon.WithDeferredMetrics(threshold))
+				m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+				acc := m.MakeBoundAccount()
+				for pb.Next() {
+					_ = acc.Grow(ctx, 1024)
+					acc.Shrink(ctx, 1024)
+				}
+				acc.Close(ctx)
+				m.Stop(ctx)
+			})
+		})
+	}
+}
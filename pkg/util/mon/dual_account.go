@@ -0,0 +1,104 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// DualAccount charges a memory monitor and a disk monitor in lockstep, for
+// hybrid data structures such as a disk-backed row container with an
+// in-memory index. Grow charges both resources at once: if the second one
+// denies the request, the first charge is rolled back, so that a failure
+// leaves the account as it was. Close releases both.
+//
+// Errors returned by DualAccount are prefixed with the resource that was
+// exhausted.
+//
+// A DualAccount is not safe for concurrent use.
+type DualAccount struct {
+	mem  BoundAccount
+	disk BoundAccount
+}
+
+// MakeDualAccount creates a DualAccount charging memMon for memory and
+// diskMon for disk.
+func MakeDualAccount(memMon, diskMon *BytesMonitor) DualAccount {
+	return DualAccount{mem: memMon.MakeBoundAccount(), disk: diskMon.MakeBoundAccount()}
+}
+
+// MemoryUsed returns the number of bytes of memory charged to the account.
+func (d *DualAccount) MemoryUsed() int64 {
+	return d.mem.Used()
+}
+
+// DiskUsed returns the number of bytes of disk charged to the account.
+func (d *DualAccount) DiskUsed() int64 {
+	return d.disk.Used()
+}
+
+// GrowMemory charges n more bytes of memory.
+func (d *DualAccount) GrowMemory(ctx context.Context, n int64) error {
+	return errors.Wrap(d.mem.Grow(ctx, n), "memory")
+}
+
+// GrowDisk charges n more bytes of disk.
+func (d *DualAccount) GrowDisk(ctx context.Context, n int64) error {
+	return errors.Wrap(d.disk.Grow(ctx, n), "disk")
+}
+
+// Grow charges memBytes of memory and diskBytes of disk. Either both charges
+// succeed or neither does.
+func (d *DualAccount) Grow(ctx context.Context, memBytes, diskBytes int64) error {
+	if err := d.GrowMemory(ctx, memBytes); err != nil {
+		return err
+	}
+	if err := d.GrowDisk(ctx, diskBytes); err != nil {
+		d.mem.Shrink(ctx, memBytes)
+		return err
+	}
+	return nil
+}
+
+// ShrinkMemory releases n bytes of memory.
+func (d *DualAccount) ShrinkMemory(ctx context.Context, n int64) {
+	d.mem.Shrink(ctx, n)
+}
+
+// ShrinkDisk releases n bytes of disk.
+func (d *DualAccount) ShrinkDisk(ctx context.Context, n int64) {
+	d.disk.Shrink(ctx, n)
+}
+
+// Shrink releases memBytes of memory and diskBytes of disk.
+func (d *DualAccount) Shrink(ctx context.Context, memBytes, diskBytes int64) {
+	d.mem.Shrink(ctx, memBytes)
+	d.disk.Shrink(ctx, diskBytes)
+}
+
+// Clear releases all the bytes charged to the account, which remains
+// usable.
+func (d *DualAccount) Clear(ctx context.Context) {
+	d.mem.Clear(ctx)
+	d.disk.Clear(ctx)
+}
+
+// Close releases both resources.
+func (d *DualAccount) Close(ctx context.Context) {
+	d.mem.Close(ctx)
+	d.disk.Close(ctx)
+}
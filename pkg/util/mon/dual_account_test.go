@@ -0,0 +1,103 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestDualAccount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	memMon := mon.MakeMonitor("test-mem", mon.MemoryResource, nil, nil, 1, 1000, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	memMon.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	diskMon := mon.MakeMonitor("test-disk", mon.DiskResource, nil, nil, 1, 1000, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	diskMon.Start(ctx, nil, mon.MakeStandaloneBudget(500))
+
+	d := mon.MakeDualAccount(&memMon, &diskMon)
+	check := func(mem, disk int64) {
+		t.Helper()
+		if d.MemoryUsed() != mem || d.DiskUsed() != disk {
+			t.Fatalf("expected memory %d and disk %d, got %d and %d",
+				mem, disk, d.MemoryUsed(), d.DiskUsed())
+		}
+		montest.AssertUsed(t, &memMon, mem)
+		montest.AssertUsed(t, &diskMon, disk)
+	}
+	checkErr := func(err error, resource string, code string) {
+		t.Helper()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !strings.HasPrefix(err.Error(), resource+":") {
+			t.Fatalf("expected the error to name the %s, got %v", resource, err)
+		}
+		if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != code {
+			t.Fatalf("expected code %s, got %v", code, err)
+		}
+	}
+
+	if err := d.Grow(ctx, 40, 200); err != nil {
+		t.Fatal(err)
+	}
+	check(40, 200)
+	if err := d.GrowMemory(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.GrowDisk(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	check(50, 250)
+
+	// Disk runs out: the memory charged first is rolled back.
+	checkErr(d.Grow(ctx, 30, 300), "disk", pgerror.CodeDiskFullError)
+	check(50, 250)
+	// Memory runs out: disk isn't charged at all.
+	checkErr(d.Grow(ctx, 60, 10), "memory", pgerror.CodeOutOfMemoryError)
+	check(50, 250)
+	checkErr(d.GrowMemory(ctx, 51), "memory", pgerror.CodeOutOfMemoryError)
+	checkErr(d.GrowDisk(ctx, 251), "disk", pgerror.CodeDiskFullError)
+	check(50, 250)
+
+	d.Shrink(ctx, 20, 100)
+	d.ShrinkMemory(ctx, 10)
+	d.ShrinkDisk(ctx, 50)
+	check(20, 100)
+	d.Clear(ctx)
+	check(0, 0)
+
+	if err := d.Grow(ctx, 100, 500); err != nil {
+		t.Fatal(err)
+	}
+	d.Close(ctx)
+	montest.AssertEmpty(t, &memMon)
+	montest.AssertEmpty(t, &diskMon)
+
+	memMon.Stop(ctx)
+	diskMon.Stop(ctx)
+}
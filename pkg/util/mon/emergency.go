@@ -0,0 +1,115 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// WithEmergencyReserve sets aside bytes of the capacity of the monitor for
+// GrowEmergency, so that the error and cleanup paths of an operation that
+// ran out of memory can still allocate. The reserve is taken from the
+// monitor's budget when it is started and counts against its limit: regular
+// allocations can't use it. It is replenished from the bytes released by
+// regular allocations.
+func WithEmergencyReserve(bytes int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.emergencyReserve = bytes
+	})
+}
+
+// GrowEmergency is like Grow, but if the monitor denies the request, the
+// bytes are taken from the emergency reserve of the monitor instead (see
+// WithEmergencyReserve). It is meant for the allocations of error and
+// cleanup paths only; an error is returned if the reserve doesn't hold n
+// bytes either.
+func (b *BoundAccount) GrowEmergency(ctx context.Context, n int64) error {
+	if w := b.watch; w != nil {
+		// The growth and the emergency allocation are a single operation on
+		// the account.
+		if !w.enter() {
+			return b.errClosedOnDone()
+		}
+		defer w.exit(ctx, b)
+	}
+	err := b.Grow(ctx, n)
+	if err == nil || b.mon == nil {
+		return err
+	}
+	overhead := b.overheadCost(n)
+	if emErr := b.mon.reserveEmergencyBytes(ctx, n+overhead); emErr != nil {
+		return errors.Wrap(err, emErr.Error())
+	}
+	b.used += n
+	b.overhead += overhead
+	return nil
+}
+
+// reserveEmergencyBytes declares an allocation of x bytes taken from the
+// emergency reserve.
+func (mm *BytesMonitor) reserveEmergencyBytes(ctx context.Context, x int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if x > mm.mu.emergencyHeld {
+		return errors.Errorf("%s: %d bytes left in emergency reserve", mm.name, mm.mu.emergencyHeld)
+	}
+	// The held bytes are already part of the budget of the monitor, so the
+	// allocation doesn't need to consult the pool.
+	mm.mu.emergencyHeld -= x
+	mm.allocateLocked(x)
+	mm.log().Warningf(ctx, "%s: %d bytes allocated from the emergency reserve, %d bytes left",
+		mm.name, x, mm.mu.emergencyHeld)
+	return nil
+}
+
+// fillEmergencyReserve sets aside the emergency reserve of a monitor being
+// started, requesting the bytes from the pool if needed. The reserve is left
+// partially filled if the pool refuses them.
+func (mm *BytesMonitor) fillEmergencyReserve(ctx context.Context) {
+	// NB: mm.mu need not be locked here, as this is only called from Start().
+	if missing := mm.emergencyReserve - mm.freeBudgetLocked(); missing > 0 &&
+		mm.mu.curBudget.mon != nil {
+		if err := mm.increaseBudget(ctx, missing); err != nil {
+			mm.log().Warningf(ctx, "%s: cannot set aside emergency reserve: %v", mm.name, err)
+		}
+	}
+	mm.refillEmergencyReserveLocked()
+}
+
+// refillEmergencyReserveLocked tops up the emergency reserve from the unused
+// budget of the monitor, within its limit.
+func (mm *BytesMonitor) refillEmergencyReserveLocked() {
+	missing := mm.emergencyReserve - mm.mu.emergencyHeld
+	if missing <= 0 {
+		return
+	}
+	if free := mm.freeBudgetLocked(); missing > free {
+		missing = free
+	}
+	if headroom := mm.limit - mm.mu.curAllocated - mm.mu.emergencyHeld; missing > headroom {
+		missing = headroom
+	}
+	if missing > 0 {
+		mm.mu.emergencyHeld += missing
+	}
+}
+
+// freeBudgetLocked returns the part of the budget of the monitor that is
+// neither allocated nor held in the emergency reserve.
+func (mm *BytesMonitor) freeBudgetLocked() int64 {
+	return mm.mu.curBudget.used + mm.reserved.used - mm.mu.curAllocated - mm.mu.emergencyHeld
+}
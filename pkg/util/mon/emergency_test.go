@@ -0,0 +1,114 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestGrowEmergency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		name string
+		// limit is the limit of the monitor, and budget the budget of its
+		// pool; whichever is lower is the capacity of the monitor.
+		limit, budget int64
+	}{
+		{"pool", 0, 1000},
+		{"limit", 1000, 10000},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st,
+				WithReservationPolicy(ReleaseEagerly))
+			pool.Start(ctx, nil, MakeStandaloneBudget(tc.budget))
+			m := MakeMonitorWithLimit("test", MemoryResource, tc.limit, nil, nil, 1, 1e9, st,
+				WithReservationPolicy(ReleaseEagerly), WithEmergencyReserve(100))
+			m.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+			checkReserve := func(expected int64) {
+				t.Helper()
+				if r := m.Snapshot().EmergencyReserve; r != expected {
+					t.Fatalf("expected %d bytes in emergency reserve, got %d\n%s",
+						expected, r, m.DebugString())
+				}
+			}
+			checkReserve(100)
+
+			// Regular allocations can't use the reserve.
+			acc := m.MakeBoundAccount()
+			if err := acc.Grow(ctx, 900); err != nil {
+				t.Fatal(err)
+			}
+			if err := acc.Grow(ctx, 1); !isOutOfMemory(err) {
+				t.Fatalf("expected out of memory error, got %v", err)
+			}
+
+			// Emergency allocations can, up to the reserve.
+			cleanup := m.MakeBoundAccount()
+			if err := cleanup.GrowEmergency(ctx, 60); err != nil {
+				t.Fatal(err)
+			}
+			checkReserve(40)
+			if err := cleanup.GrowEmergency(ctx, 41); !isOutOfMemory(err) {
+				t.Fatalf("expected out of memory error, got %v", err)
+			}
+			if err := cleanup.GrowEmergency(ctx, 40); err != nil {
+				t.Fatal(err)
+			}
+			checkReserve(0)
+			if used := m.AllocBytes(); used != 1000 {
+				t.Fatalf("expected 1000 bytes allocated, got %d", used)
+			}
+
+			// The reserve is replenished as regular usage drops, before the
+			// bytes become available to regular allocations again.
+			acc.Shrink(ctx, 70)
+			checkReserve(70)
+			if err := acc.Grow(ctx, 1); !isOutOfMemory(err) {
+				t.Fatalf("expected out of memory error, got %v", err)
+			}
+			cleanup.Clear(ctx)
+			checkReserve(100)
+			if err := acc.Grow(ctx, 70); err != nil {
+				t.Fatal(err)
+			}
+
+			// Emergency allocations only use the reserve when needed.
+			acc.Shrink(ctx, 100)
+			if err := cleanup.GrowEmergency(ctx, 30); err != nil {
+				t.Fatal(err)
+			}
+			checkReserve(100)
+
+			cleanup.Close(ctx)
+			acc.Close(ctx)
+			m.Stop(ctx)
+			if used := pool.AllocBytes(); used != 0 {
+				t.Fatalf("expected the reserve to be released to the pool, got\n%s", pool.DebugString())
+			}
+			pool.Stop(ctx)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+)
+
+// Enforcement determines whether a monitor enforces its limit.
+type Enforcement int
+
+const (
+	// Enforced denies the allocations that would take the usage above the
+	// limit. This is the default.
+	Enforced Enforcement = iota
+	// ReportOnly grants the allocations that would take the usage above the
+	// limit, but counts and logs them. It is used to measure how often a new
+	// limit would fire before enforcing it.
+	ReportOnly
+)
+
+// wouldDenyLogInterval is the minimum interval between two log messages
+// about allocations granted in spite of the limit by a monitor in ReportOnly
+// mode.
+const wouldDenyLogInterval = 10 * time.Second
+
+// WithWouldDenyCounter sets a counter incremented every time the monitor
+// grants an allocation in ReportOnly mode that it would have denied if the
+// limit was enforced.
+func WithWouldDenyCounter(c Counter) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.wouldDenyCount = counterOrNil(c)
+	})
+}
+
+// SetEnforcement changes the enforcement mode of the monitor's limit. It
+// only applies to the limit of the monitor; the budget obtained from its
+// pool is always enforced.
+func (mm *BytesMonitor) SetEnforcement(e Enforcement) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.enforcement = e
+}
+
+// noteWouldDenyLocked records an allocation granted in ReportOnly mode in
+// spite of err, the error it would have been denied with.
+func (mm *BytesMonitor) noteWouldDenyLocked(ctx context.Context, err error) {
+	mm.mu.wouldDeny++
+	if mm.wouldDenyCount != nil {
+		mm.wouldDenyCount.Inc(1)
+	}
+	now := mm.clock().Now()
+	if now.Sub(mm.mu.lastWouldDenyLog) >= wouldDenyLogInterval {
+		mm.mu.lastWouldDenyLog = now
+		mm.log().Warningf(ctx, "%v (not enforced, %d allocations would have been denied so far)",
+			err, mm.mu.wouldDeny)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestReportOnlyEnforcement(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	rnd, _ := randutil.NewPseudoRand()
+
+	const limit = 1000
+	counter := metric.NewCounter(metric.Metadata{Name: "test.would_deny"})
+	enforced := MakeMonitorWithLimit("enforced", MemoryResource, limit, nil, nil, 1, 1e9, st,
+		WithReservationPolicy(ReleaseEagerly))
+	enforced.Start(ctx, nil, MakeStandaloneBudget(10*limit))
+	reportOnly := MakeMonitorWithLimit("report-only", MemoryResource, limit, nil, nil, 1, 1e9, st,
+		WithReservationPolicy(ReleaseEagerly), WithWouldDenyCounter(counter))
+	reportOnly.Start(ctx, nil, MakeStandaloneBudget(10*limit))
+	reportOnly.SetEnforcement(ReportOnly)
+
+	// The same operations are applied to both monitors. The allocations that
+	// the enforced monitor denies are granted by the report-only one, which
+	// counts them; they are released right away so that both monitors keep
+	// the same usage.
+	enfAcc := enforced.MakeBoundAccount()
+	repAcc := reportOnly.MakeBoundAccount()
+	var denied int64
+	for i := 0; i < 1000; i++ {
+		if n := enfAcc.Used(); n > 0 && rnd.Intn(3) == 0 {
+			x := 1 + rnd.Int63n(n)
+			enfAcc.Shrink(ctx, x)
+			repAcc.Shrink(ctx, x)
+		} else {
+			x := 1 + rnd.Int63n(limit/4)
+			errEnf := enfAcc.Grow(ctx, x)
+			if err := repAcc.Grow(ctx, x); err != nil {
+				t.Fatalf("expected the report-only monitor to grant the allocation, got %v", err)
+			}
+			if errEnf != nil {
+				if !isOutOfMemory(errEnf) {
+					t.Fatal(errEnf)
+				}
+				denied++
+				repAcc.Shrink(ctx, x)
+			}
+		}
+		enfState, repState := enforced.Snapshot(), reportOnly.Snapshot()
+		if repState.WouldDeny != denied {
+			t.Fatalf("expected %d allocations to be reported, got %d", denied, repState.WouldDeny)
+		}
+		if enfState.WouldDeny != 0 {
+			t.Fatalf("expected no reports from the enforced monitor, got %d", enfState.WouldDeny)
+		}
+		if enfState.Allocated != repState.Allocated || enfAcc.Used() != repAcc.Used() {
+			t.Fatalf("expected identical accounting, got %+v and %+v", enfState, repState)
+		}
+	}
+	if denied == 0 {
+		t.Fatal("expected some allocations to be denied")
+	}
+	if c := counter.Count(); c != denied {
+		t.Fatalf("expected the counter at %d, got %d", denied, c)
+	}
+
+	// Switching back to enforcement takes effect right away.
+	reportOnly.SetEnforcement(Enforced)
+	if err := repAcc.Grow(ctx, limit+1); !isOutOfMemory(err) {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if s := reportOnly.Snapshot(); s.WouldDeny != denied {
+		t.Fatalf("expected %d allocations to be reported, got %d", denied, s.WouldDeny)
+	}
+
+	enfAcc.Close(ctx)
+	repAcc.Close(ctx)
+	enforced.Stop(ctx)
+	reportOnly.Stop(ctx)
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sort"
+)
+
+// EvictableCache is implemented by in-memory caches whose memory is charged
+// to an account on a monitor and which can give some of it back on demand.
+// Once registered with RegisterEvictableCache, the monitor asks its caches,
+// and those of its pools, to evict entries when a reservation is denied,
+// largest caches first, and retries the reservation if anything was freed.
+// Only the denials by a limit or for lack of budget trigger eviction:
+// injected failures and the errors of stopped or frozen monitors don't. The
+// monitor also asks its caches to evict when its usage crosses its soft
+// limit, if it has one; see WithEvictionSoftLimit.
+type EvictableCache interface {
+	// CachedBytes returns the number of bytes currently charged by the cache.
+	// It is used to evict from the largest caches first and must be safe for
+	// concurrent use.
+	CachedBytes() int64
+
+	// Evict drops entries totaling at least targetBytes if possible, shrinking
+	// the cache's account accordingly, and returns the number of bytes
+	// released. It must be safe for concurrent use. It is invoked
+	// synchronously from the Grow call that was denied, so it must not grow
+	// any account itself. It is never invoked from a Grow call on the cache's
+	// own account.
+	//
+	// That Grow call may come from another cache of the monitor, which may
+	// in turn be asked to evict by a Grow of this cache: a cache must not
+	// hold a lock that Evict or CachedBytes wait for across a Grow of its
+	// account, or else Evict must give up instead of waiting for it (see
+	// BytePool).
+	Evict(ctx context.Context, targetBytes int64) int64
+}
+
+// WithEvictionSoftLimit makes the monitor ask its caches to evict entries
+// whenever a reservation brings its usage above bytes, down to bytes if
+// possible, so that the caches shrink under pressure before reservations
+// are denied. The reservation itself is not denied by the soft limit.
+func WithEvictionSoftLimit(bytes int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.evictionSoftLimit = bytes
+	})
+}
+
+// evictableCache is a cache registered with a monitor.
+type evictableCache struct {
+	acc   *BoundAccount
+	cache EvictableCache
+}
+
+// RegisterEvictableCache registers a cache whose memory is charged to acc, an
+// account on this monitor. The returned function unregisters the cache; it
+// must be called before acc is closed.
+func (mm *BytesMonitor) RegisterEvictableCache(
+	acc *BoundAccount, cache EvictableCache,
+) (unregister func()) {
+	e := &evictableCache{acc: acc, cache: cache}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.evictable = append(mm.mu.evictable, e)
+	return func() {
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+		for i := range mm.mu.evictable {
+			if mm.mu.evictable[i] == e {
+				mm.mu.evictable = append(mm.mu.evictable[:i], mm.mu.evictable[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// evictionMayHelp reports whether err is a denial that evicting from caches
+// may turn into a grant: the local limit of the monitor, or the exhaustion
+// of its budget or of one of its pools, as opposed to an injected failure, a
+// burst that lasted too long or the error of a stopped or frozen monitor.
+func evictionMayHelp(err error) bool {
+	e, ok := GetBudgetExceededError(err)
+	if !ok || e.reason != "" {
+		return false
+	}
+	switch e.DenialCause {
+	case LocalLimit, ReservedExhausted, PoolExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// evictCaches asks the caches registered with the monitor and its pools, up
+// to the root monitor, except the one charged to the account requesting the
+// bytes, to release targetBytes in total, largest caches first: the denial
+// may come from any of the pools, and the bytes freed in a pool are
+// available to its children. It returns the number of bytes released. It
+// must be called without holding mm.mu.
+func (mm *BytesMonitor) evictCaches(
+	ctx context.Context, requester *BoundAccount, targetBytes int64,
+) int64 {
+	var caches []EvictableCache
+	for m := mm; m != nil; {
+		m.mu.Lock()
+		if m.mu.stopped {
+			// The pool of a stopped monitor is cleared without the lock.
+			m.mu.Unlock()
+			break
+		}
+		for _, e := range m.mu.evictable {
+			if e.acc != requester {
+				caches = append(caches, e.cache)
+			}
+		}
+		pool := m.mu.curBudget.mon
+		m.mu.Unlock()
+		m = pool
+	}
+	return evictFrom(ctx, caches, targetBytes)
+}
+
+// evictAboveSoftLimit asks the caches registered with the monitor, except
+// the one charged to the account that requested bytes, to bring the usage
+// of the monitor back to its soft limit, if it is above. It must be called
+// without holding mm.mu.
+func (mm *BytesMonitor) evictAboveSoftLimit(ctx context.Context, requester *BoundAccount) {
+	if mm.evictionSoftLimit <= 0 {
+		return
+	}
+	mm.mu.Lock()
+	excess := mm.mu.curAllocated - mm.evictionSoftLimit
+	var caches []EvictableCache
+	if excess > 0 {
+		for _, e := range mm.mu.evictable {
+			if e.acc != requester {
+				caches = append(caches, e.cache)
+			}
+		}
+	}
+	mm.mu.Unlock()
+	evictFrom(ctx, caches, excess)
+}
+
+// evictFrom asks caches to release targetBytes in total, largest caches
+// first, and returns the number of bytes released.
+func evictFrom(ctx context.Context, caches []EvictableCache, targetBytes int64) int64 {
+	if len(caches) == 0 {
+		return 0
+	}
+	sizes := make([]int64, len(caches))
+	for i := range caches {
+		sizes[i] = caches[i].CachedBytes()
+	}
+	sort.Sort(cachesBySize{caches: caches, sizes: sizes})
+
+	var freed int64
+	for _, c := range caches {
+		if freed >= targetBytes {
+			break
+		}
+		freed += c.Evict(ctx, targetBytes-freed)
+	}
+	return freed
+}
+
+// cachesBySize sorts caches by decreasing size.
+type cachesBySize struct {
+	caches []EvictableCache
+	sizes  []int64
+}
+
+func (c cachesBySize) Len() int           { return len(c.caches) }
+func (c cachesBySize) Less(i, j int) bool { return c.sizes[i] > c.sizes[j] }
+func (c cachesBySize) Swap(i, j int) {
+	c.caches[i], c.caches[j] = c.caches[j], c.caches[i]
+	c.sizes[i], c.sizes[j] = c.sizes[j], c.sizes[i]
+}
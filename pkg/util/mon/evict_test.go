@@ -0,0 +1,327 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"container/list"
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// testLRU is a minimal LRU cache of fixed-size entries charged to an account,
+// wired to its monitor through the EvictableCache interface. As required by
+// the interface, it doesn't hold its lock across the Grow of its account,
+// which may ask it to evict; it gives up evicting during that Grow instead.
+type testLRU struct {
+	mu struct {
+		syncutil.Mutex
+		acc   BoundAccount
+		order *list.List // of string keys, most recently used at the front
+		sizes map[string]int64
+		// cached is the sum of sizes.
+		cached int64
+		// growing is set while add grows acc without holding the lock.
+		growing bool
+	}
+}
+
+var _ EvictableCache = &testLRU{}
+
+func newTestLRU(m *BytesMonitor) *testLRU {
+	c := &testLRU{}
+	c.mu.acc = m.MakeBoundAccount()
+	c.mu.order = list.New()
+	c.mu.sizes = make(map[string]int64)
+	return c
+}
+
+func (c *testLRU) add(ctx context.Context, key string, sz int64) error {
+	c.mu.Lock()
+	if c.mu.growing {
+		c.mu.Unlock()
+		panic("concurrent add")
+	}
+	c.mu.growing = true
+	acc := &c.mu.acc
+	c.mu.Unlock()
+
+	err := acc.Grow(ctx, sz)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.growing = false
+	if err != nil {
+		return err
+	}
+	c.mu.order.PushFront(key)
+	c.mu.sizes[key] = sz
+	c.mu.cached += sz
+	return nil
+}
+
+func (c *testLRU) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.mu.sizes[key]
+	return ok
+}
+
+func (c *testLRU) CachedBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.cached
+}
+
+func (c *testLRU) Evict(ctx context.Context, targetBytes int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.growing {
+		// The account is being grown without the lock.
+		return 0
+	}
+	var freed int64
+	for freed < targetBytes && c.mu.order.Len() > 0 {
+		key := c.mu.order.Remove(c.mu.order.Back()).(string)
+		sz := c.mu.sizes[key]
+		delete(c.mu.sizes, key)
+		c.mu.acc.Shrink(ctx, sz)
+		c.mu.cached -= sz
+		freed += sz
+	}
+	return freed
+}
+
+func (c *testLRU) close(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.acc.Close(ctx)
+}
+
+func TestEvictableCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	small := newTestLRU(&m)
+	large := newTestLRU(&m)
+	unregisterSmall := m.RegisterEvictableCache(&small.mu.acc, small)
+	unregisterLarge := m.RegisterEvictableCache(&large.mu.acc, large)
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := large.add(ctx, key, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := small.add(ctx, "x", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.add(ctx, "y", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// The monitor is at 800 out of 1000 bytes. A 350 byte request would be
+	// denied, but succeeds after the largest cache evicts its four least
+	// recently used entries.
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 350); err != nil {
+		t.Fatalf("expected grow to succeed after eviction, got %v", err)
+	}
+	if large.CachedBytes() != 200 || small.CachedBytes() != 200 {
+		t.Fatalf("expected eviction from the large cache only, got large %d, small %d",
+			large.CachedBytes(), small.CachedBytes())
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if large.contains(key) {
+			t.Fatalf("expected %q to be evicted", key)
+		}
+	}
+
+	// A cache is never asked to evict on behalf of its own account: the
+	// large cache's grow is served by evicting from the small one.
+	if err := large.add(ctx, "g", 300); err != nil {
+		t.Fatalf("expected grow to succeed after eviction, got %v", err)
+	}
+	if large.CachedBytes() != 500 || small.CachedBytes() != 0 {
+		t.Fatalf("expected eviction from the small cache only, got large %d, small %d",
+			large.CachedBytes(), small.CachedBytes())
+	}
+
+	// Unregistered caches are left alone.
+	unregisterLarge()
+	if err := acc.Grow(ctx, 200); err == nil {
+		t.Fatal("expected grow to be denied without evictable caches")
+	}
+	if large.CachedBytes() != 500 {
+		t.Fatalf("expected unregistered cache to be left alone, got %d", large.CachedBytes())
+	}
+
+	unregisterSmall()
+	small.close(ctx)
+	large.close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestEvictableCachePools(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	root := MakeMonitor("root", MemoryResource, nil, nil, 1, 1000, st)
+	root.Start(ctx, nil, MakeStandaloneBudget(1000))
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, &root, MakeStandaloneBudget(0))
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st, WithHysteresis(0))
+	m.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	// The caches of the pools of the monitor are evicted from when the
+	// budget of the root is exhausted.
+	rootCache := newTestLRU(&root)
+	defer root.RegisterEvictableCache(&rootCache.mu.acc, rootCache)()
+	poolCache := newTestLRU(&pool)
+	defer pool.RegisterEvictableCache(&poolCache.mu.acc, poolCache)()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := rootCache.add(ctx, key, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"e", "f", "g"} {
+		if err := poolCache.add(ctx, key, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 600); err != nil {
+		t.Fatalf("expected grow to succeed after eviction, got %v", err)
+	}
+	if c := rootCache.CachedBytes() + poolCache.CachedBytes(); c > 400 {
+		t.Fatalf("expected at least 300 bytes evicted, got %d bytes cached", c)
+	}
+
+	rootCache.close(ctx)
+	poolCache.close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+	pool.Stop(ctx)
+	root.Stop(ctx)
+}
+
+func TestEvictionSoftLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st, WithEvictionSoftLimit(500))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	cache := newTestLRU(&m)
+	defer m.RegisterEvictableCache(&cache.mu.acc, cache)()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := cache.add(ctx, key, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The cache may grow past the soft limit on its own.
+	if err := cache.add(ctx, "e", 200); err != nil {
+		t.Fatal(err)
+	}
+	if c := cache.CachedBytes(); c != 600 {
+		t.Fatalf("expected the cache not to evict for its own growth, got %d bytes", c)
+	}
+
+	// Other reservations beyond the soft limit make the cache evict, though
+	// the budget could cover them.
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if c := cache.CachedBytes(); c != 400 {
+		t.Fatalf("expected the usage to be brought back to the soft limit, got %d bytes cached", c)
+	}
+	if cache.contains("a") || cache.contains("b") || !cache.contains("e") {
+		t.Fatal("expected the least recently used entries to be evicted")
+	}
+
+	// Reservations that stay below the soft limit don't.
+	acc.Shrink(ctx, 100)
+	if err := acc.Grow(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if c := cache.CachedBytes(); c != 400 {
+		t.Fatalf("expected the cache not to evict below the soft limit, got %d bytes", c)
+	}
+
+	cache.close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+// TestEvictionDenialCauses verifies that the denials by the local limit of
+// the monitor make the caches evict, and that the denials eviction can't
+// turn into grants don't.
+func TestEvictionDenialCauses(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitorWithLimit("test", MemoryResource, 500, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	cache := newTestLRU(&m)
+	defer m.RegisterEvictableCache(&cache.mu.acc, cache)()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := cache.add(ctx, key, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The budget covers the request, but the limit doesn't.
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 200); err != nil {
+		t.Fatalf("expected grow to succeed after eviction, got %v", err)
+	}
+	if c := cache.CachedBytes(); c != 200 {
+		t.Fatalf("expected the cache to evict on a local limit, got %d bytes", c)
+	}
+	if cache.contains("a") || cache.contains("b") || !cache.contains("c") {
+		t.Fatal("expected the least recently used entries to be evicted")
+	}
+
+	fi := DenyLargerThan(0)
+	m.TestingSetFailureInjector(fi)
+	if err := acc.Grow(ctx, 50); err == nil {
+		t.Fatal("expected grow to be denied by the failure injector")
+	}
+	fi.AssertDenials(t, 1)
+	m.TestingSetFailureInjector(nil)
+	if c := cache.CachedBytes(); c != 200 {
+		t.Fatalf("expected the cache not to evict on an injected failure, got %d bytes", c)
+	}
+
+	cache.close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ExhaustionDumpConfig configures the dumps written by a monitor when it
+// refuses an allocation; see WithExhaustionDumps.
+type ExhaustionDumpConfig struct {
+	// Dir is the directory the dumps are written to. It is created if
+	// needed.
+	Dir string
+	// MinInterval is the minimum time between two dumps.
+	MinInterval time.Duration
+	// MaxFiles and MaxTotalSize cap the number of dumps of the monitor kept
+	// in Dir, and their total size; the oldest dumps are removed first. The
+	// dump just written is always kept. 0 means no cap.
+	MaxFiles     int
+	MaxTotalSize int64
+	// TopChildren is the number of children of the monitor, the ones using
+	// the most memory, whose recent operations are included in the dump, if
+	// they are recorded (see TestingSetRecorder).
+	TopChildren int
+}
+
+// maxDumpedOps is the number of recent operations of a child included in
+// an exhaustion dump.
+const maxDumpedOps = 100
+
+// exhaustionDumpPrefix starts the names of the dump files.
+const exhaustionDumpPrefix = "memdump."
+
+// WithExhaustionDumps makes the monitor write a dump of its state and of
+// the tree of its children to a file when it refuses an allocation, so that
+// the state of the monitors at the time can be investigated after the fact.
+// It is meant for root monitors, whose denials mean that a node ran out of
+// memory budget. The time is measured with the TimeSource of the monitor.
+func WithExhaustionDumps(cfg ExhaustionDumpConfig) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.exhaustionDumps = cfg
+	})
+}
+
+// exhaustionDump is the content of a dump file, written as JSON.
+type exhaustionDump struct {
+	Time      time.Time      `json:"time"`
+	Requested int64          `json:"requested"`
+	Error     string         `json:"error"`
+	Monitor   expvarState    `json:"monitor"`
+	Children  []dumpedChild  `json:"children,omitempty"`
+	RecentOps []dumpedRecent `json:"recent_ops,omitempty"`
+}
+
+// dumpedChild is the usage of a monitor in the tree of an exhaustion dump.
+type dumpedChild struct {
+	Name      string        `json:"name"`
+	Allocated int64         `json:"allocated"`
+	Children  []dumpedChild `json:"children,omitempty"`
+}
+
+// dumpedRecent holds the recent operations of a child in an exhaustion
+// dump.
+type dumpedRecent struct {
+	Monitor string   `json:"monitor"`
+	Ops     []string `json:"ops"`
+}
+
+// shouldDumpExhaustionLocked returns whether the monitor, which just refused
+// an allocation, is due for an exhaustion dump. If so, the dump is accounted
+// for in the rate limit, and it is up to the caller to call dumpExhaustion
+// once the monitor is unlocked.
+func (mm *BytesMonitor) shouldDumpExhaustionLocked() bool {
+	if mm.exhaustionDumps.Dir == "" {
+		return false
+	}
+	now := mm.clock().Now()
+	if last := mm.mu.lastExhaustionDump; !last.IsZero() &&
+		now.Sub(last) < mm.exhaustionDumps.MinInterval {
+		return false
+	}
+	mm.mu.lastExhaustionDump = now
+	return true
+}
+
+// dumpExhaustion writes an exhaustion dump after the monitor refused an
+// allocation of x bytes with err. The monitor must not be locked; like
+// logTopConsumers, it reads the usage of the children without locking them.
+func (mm *BytesMonitor) dumpExhaustion(ctx context.Context, x int64, err error) {
+	now := mm.clock().Now()
+	dump := exhaustionDump{
+		Time:      now,
+		Requested: x,
+		Error:     err.Error(),
+		Monitor:   mm.expvarState(),
+		Children:  dumpChildren(mm),
+	}
+	children := mm.childrenSnapshot()
+	sort.Slice(children, func(i, j int) bool {
+		return atomic.LoadInt64(&children[i].approxAllocated) >
+			atomic.LoadInt64(&children[j].approxAllocated)
+	})
+	if len(children) > mm.exhaustionDumps.TopChildren {
+		children = children[:mm.exhaustionDumps.TopChildren]
+	}
+	for _, c := range children {
+		if r := c.testingRecorder; r != nil {
+			dump.RecentOps = append(dump.RecentOps, dumpedRecent{
+				Monitor: c.name,
+				Ops:     r.lastOps(maxDumpedOps),
+			})
+		}
+	}
+
+	if err := mm.writeExhaustionDump(dump); err != nil {
+		mm.log().Warningf(ctx, "%s: could not write exhaustion dump: %v", mm.name, err)
+	}
+}
+
+// dumpChildren returns the tree of the children of mm, by decreasing usage.
+func dumpChildren(mm *BytesMonitor) []dumpedChild {
+	children := mm.childrenSnapshot()
+	if len(children) == 0 {
+		return nil
+	}
+	res := make([]dumpedChild, len(children))
+	for i, c := range children {
+		res[i] = dumpedChild{
+			Name:      c.name,
+			Allocated: atomic.LoadInt64(&c.approxAllocated),
+			Children:  dumpChildren(c),
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Allocated > res[j].Allocated
+	})
+	return res
+}
+
+// exhaustionDumpName returns the name of the files holding the dumps of the
+// monitor written at t. The names of the dumps of a monitor sort in the
+// order they were written.
+func (mm *BytesMonitor) exhaustionDumpName(t time.Time) string {
+	return fmt.Sprintf("%s%s.json", mm.exhaustionDumpFilePrefix(),
+		t.UTC().Format("2006-01-02T15_04_05.000000000"))
+}
+
+func (mm *BytesMonitor) exhaustionDumpFilePrefix() string {
+	name := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, mm.name)
+	return exhaustionDumpPrefix + name + "."
+}
+
+// writeExhaustionDump writes the dump to a new file, and removes the oldest
+// dumps of the monitor beyond the caps of the configuration.
+func (mm *BytesMonitor) writeExhaustionDump(dump exhaustionDump) error {
+	cfg := mm.exhaustionDumps
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := mm.exhaustionDumpName(dump.Time)
+	if err := ioutil.WriteFile(filepath.Join(cfg.Dir, name), buf, 0644); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	prefix := mm.exhaustionDumpFilePrefix()
+	var dumps []os.FileInfo
+	var total int64
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix) && !f.IsDir() {
+			dumps = append(dumps, f)
+			total += f.Size()
+		}
+	}
+	// ReadDir sorts the files by name, so the oldest dumps come first.
+	for len(dumps) > 1 && ((cfg.MaxFiles > 0 && len(dumps) > cfg.MaxFiles) ||
+		(cfg.MaxTotalSize > 0 && total > cfg.MaxTotalSize)) {
+		if dumps[0].Name() == name {
+			break
+		}
+		if err := os.Remove(filepath.Join(cfg.Dir, dumps[0].Name())); err != nil {
+			return err
+		}
+		total -= dumps[0].Size()
+		dumps = dumps[1:]
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestExhaustionDumps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	dir, err := ioutil.TempDir("", "exhaustion-dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	root := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithExhaustionDumps(mon.ExhaustionDumpConfig{
+			Dir:         dir,
+			MinInterval: time.Minute,
+			MaxFiles:    2,
+			TopChildren: 1,
+		}))
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(500))
+
+	var sessions []*mon.BytesMonitor
+	var accounts []*mon.BoundAccount
+	for _, name := range []string{"session1", "session2"} {
+		m := mon.MakeMonitor(name, mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		m.TestingSetRecorder(mon.NewRecorder(false /* bucketSizes */))
+		m.Start(ctx, &root, mon.MakeStandaloneBudget(0))
+		acc := m.MakeBoundAccount()
+		sessions = append(sessions, &m)
+		accounts = append(accounts, &acc)
+	}
+	grow := func(acc *mon.BoundAccount, n int64, ok bool) {
+		t.Helper()
+		err := acc.Grow(ctx, n)
+		if ok && err != nil {
+			t.Fatal(err)
+		}
+		if !ok && !mon.IsBudgetExceededError(err) {
+			t.Fatalf("expected budget error, got %v", err)
+		}
+	}
+	dumps := func() []string {
+		t.Helper()
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+
+	grow(accounts[0], 300, true)
+	grow(accounts[1], 100, true)
+	if files := dumps(); len(files) != 0 {
+		t.Fatalf("expected no dumps, got %q", files)
+	}
+
+	// A denial by the root writes a dump.
+	grow(accounts[1], 200, false)
+	files := dumps()
+	if len(files) != 1 || !strings.HasPrefix(files[0], "memdump.root.") {
+		t.Fatalf("expected one dump, got %q", files)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Time      time.Time
+		Requested int64
+		Error     string
+		Monitor   map[string]interface{}
+		Children  []struct {
+			Name      string
+			Allocated int64
+		}
+		RecentOps []struct {
+			Monitor string
+			Ops     []string
+		} `json:"recent_ops"`
+	}
+	if err := json.Unmarshal(buf, &dump); err != nil {
+		t.Fatalf("expected JSON, got %s: %v", buf, err)
+	}
+	if !dump.Time.Equal(clock.Now()) || dump.Requested != 200 ||
+		!strings.Contains(dump.Error, "budget exceeded") {
+		t.Errorf("unexpected dump header in %s", buf)
+	}
+	if dump.Monitor["name"] != "root" || dump.Monitor["allocated"] != float64(400) {
+		t.Errorf("expected the state of the root in %s", buf)
+	}
+	if len(dump.Children) != 2 ||
+		dump.Children[0].Name != "session1" || dump.Children[0].Allocated != 300 ||
+		dump.Children[1].Name != "session2" || dump.Children[1].Allocated != 100 {
+		t.Errorf("expected the children by decreasing usage in %s", buf)
+	}
+	if len(dump.RecentOps) != 1 || dump.RecentOps[0].Monitor != "session1" ||
+		len(dump.RecentOps[0].Ops) != 1 || dump.RecentOps[0].Ops[0] != "session1/acc1: grow 300" {
+		t.Errorf("expected the recent operations of session1 in %s", buf)
+	}
+
+	// Dumps are rate limited.
+	grow(accounts[1], 200, false)
+	if files := dumps(); len(files) != 1 {
+		t.Fatalf("expected the dumps to be rate limited, got %q", files)
+	}
+	clock.Advance(time.Minute)
+	grow(accounts[1], 200, false)
+	if files := dumps(); len(files) != 2 {
+		t.Fatalf("expected a second dump, got %q", files)
+	}
+
+	// Only the last two dumps are kept.
+	clock.Advance(time.Minute)
+	grow(accounts[1], 200, false)
+	if newFiles := dumps(); len(newFiles) != 2 || newFiles[0] == files[0] {
+		t.Fatalf("expected the oldest dump to be removed, got %q", newFiles)
+	}
+
+	for i, acc := range accounts {
+		acc.Close(ctx)
+		sessions[i].Stop(ctx)
+	}
+	root.Stop(ctx)
+}
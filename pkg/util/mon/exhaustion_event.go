@@ -0,0 +1,125 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultExhaustionEventInterval is the minimum interval between two
+// BudgetExhaustedEvents of a monitor without a pool, unless set otherwise
+// with WithExhaustionEvents.
+const DefaultExhaustionEventInterval = 10 * time.Second
+
+// WithExhaustionEvents makes the monitor log a BudgetExhaustedEvent when it
+// denies a request, at most once every interval. The monitors without a
+// pool log them every DefaultExhaustionEventInterval without this option.
+func WithExhaustionEvents(interval time.Duration) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.exhaustionEventInterval = interval
+	})
+}
+
+// BudgetExhaustedEvent is logged, as a warning, when a monitor denies a
+// request; see WithExhaustionEvents. Its rendering is a list of key=value
+// pairs, for log-based alerting.
+type BudgetExhaustedEvent struct {
+	// Monitor is the name of the monitor that denied the request, and
+	// Resource the name of its resource, e.g. "memory".
+	Monitor  string
+	Resource string
+	// Requested is the number of bytes requested from the monitor, and Used
+	// and Limit its usage and budget or limit at the time of the denial.
+	Requested int64
+	Used      int64
+	Limit     int64
+	// Cause is the cause of the denial.
+	Cause DenialCause
+	// TopConsumer is the child of the monitor using the most bytes, if the
+	// monitor has children.
+	TopConsumer *MonitorUsage
+}
+
+func (ev BudgetExhaustedEvent) String() string {
+	s := fmt.Sprintf("budget exhausted: monitor=%q resource=%s requested=%d used=%d limit=%d cause=%s",
+		ev.Monitor, ev.Resource, ev.Requested, ev.Used, ev.Limit, ev.Cause)
+	if ev.TopConsumer != nil {
+		s += fmt.Sprintf(" top_consumer=%q top_consumer_used=%d",
+			ev.TopConsumer.Name, ev.TopConsumer.Allocated)
+	}
+	return s
+}
+
+// resourceName returns the name of a resource in BudgetExhaustedEvents.
+func resourceName(res Resource) string {
+	switch res {
+	case MemoryResource:
+		return "memory"
+	case DiskResource:
+		return "disk"
+	case CountResource:
+		return "count"
+	}
+	return fmt.Sprintf("%T", res)
+}
+
+// exhaustionEventLocked returns the BudgetExhaustedEvent of the denial of a
+// request by mm with err, if mm logs such events and is due for one. The
+// event is accounted for in the rate limit, and it is up to the caller to
+// call logExhaustionEvent once the monitor is unlocked. The denials of the
+// requests forwarded to the pool of mm are left to the pool.
+func (mm *BytesMonitor) exhaustionEventLocked(err error) *BudgetExhaustedEvent {
+	interval := mm.exhaustionEventInterval
+	if interval == 0 {
+		if mm.mu.curBudget.mon != nil {
+			return nil
+		}
+		interval = DefaultExhaustionEventInterval
+	}
+	e, ok := err.(*BudgetExceededError)
+	if !ok || e.DenialCause == PoolExhausted {
+		return nil
+	}
+	now := mm.clock().Now()
+	if last := mm.mu.lastExhaustionEvent; !last.IsZero() && now.Sub(last) < interval {
+		return nil
+	}
+	mm.mu.lastExhaustionEvent = now
+	return &BudgetExhaustedEvent{
+		Monitor:   mm.name,
+		Resource:  resourceName(mm.resource),
+		Requested: e.Requested,
+		Used:      e.Allocated,
+		Limit:     e.Budget,
+		Cause:     e.DenialCause,
+	}
+}
+
+// logExhaustionEvent completes ev with the top consumer of the monitor and
+// logs it. The monitor must not be locked; like logTopConsumers, it reads
+// the usage of the children without locking them.
+func (mm *BytesMonitor) logExhaustionEvent(ctx context.Context, ev *BudgetExhaustedEvent) {
+	for _, c := range mm.childrenSnapshot() {
+		u := MonitorUsage{Name: c.name, Allocated: atomic.LoadInt64(&c.approxAllocated)}
+		if top := ev.TopConsumer; top == nil || u.Allocated > top.Allocated ||
+			(u.Allocated == top.Allocated && u.Name < top.Name) {
+			ev.TopConsumer = &u
+		}
+	}
+	mm.log().Warningf(ctx, "%s", *ev)
+}
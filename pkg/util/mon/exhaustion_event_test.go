@@ -0,0 +1,131 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// steppedTimeSource is a TimeSource whose time only changes when the test
+// sets it.
+type steppedTimeSource struct {
+	systemTimeSource
+	now *time.Time
+}
+
+func (ts steppedTimeSource) Now() time.Time {
+	return *ts.now
+}
+
+func TestExhaustionEvents(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	now := time.Unix(0, 0)
+	ts := steppedTimeSource{now: &now}
+	l := &capturingLogger{}
+	root := MakeMonitor("root", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		WithLogger(l), WithTimeSource(ts))
+	root.Start(ctx, nil, MakeStandaloneBudget(1000))
+	session := MakeMonitorWithLimit("session", MemoryResource, 300, nil, nil, 1, math.MaxInt64, st,
+		WithLogger(l), WithTimeSource(ts), WithExhaustionEvents(time.Minute))
+	session.Start(ctx, &root, BoundAccount{})
+
+	rootAcc := root.MakeBoundAccount()
+	sessionAcc := session.MakeBoundAccount()
+	if err := rootAcc.Grow(ctx, 800); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionAcc.Grow(ctx, 150); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(expected ...BudgetExhaustedEvent) {
+		t.Helper()
+		var events []BudgetExhaustedEvent
+		for _, args := range l.takeArgs() {
+			if len(args) == 1 {
+				if ev, ok := args[0].(BudgetExhaustedEvent); ok {
+					events = append(events, ev)
+				}
+			}
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Fatalf("expected %v, got %v", expected, events)
+		}
+	}
+	rootEvent := BudgetExhaustedEvent{
+		Monitor:     "root",
+		Resource:    "memory",
+		Requested:   100,
+		Used:        950,
+		Limit:       1000,
+		Cause:       ReservedExhausted,
+		TopConsumer: &MonitorUsage{Name: "session", Allocated: 150},
+	}
+
+	// The root denies the request forwarded by the session. The session
+	// leaves the event to the root, even though it logs its own denials.
+	if err := sessionAcc.Grow(ctx, 100); err == nil {
+		t.Fatal("expected the growth to be denied")
+	}
+	expect(rootEvent)
+
+	// The events of the root are rate limited.
+	if err := sessionAcc.Grow(ctx, 100); err == nil {
+		t.Fatal("expected the growth to be denied")
+	}
+	expect()
+	now = now.Add(DefaultExhaustionEventInterval)
+	if err := sessionAcc.Grow(ctx, 100); err == nil {
+		t.Fatal("expected the growth to be denied")
+	}
+	expect(rootEvent)
+
+	// The session logs the denials at its own limit, at its own rate.
+	for i := 0; i < 2; i++ {
+		if err := sessionAcc.Grow(ctx, 200); err == nil {
+			t.Fatal("expected the growth to be denied")
+		}
+	}
+	expect(BudgetExhaustedEvent{
+		Monitor:   "session",
+		Resource:  "memory",
+		Requested: 200,
+		Used:      150,
+		Limit:     300,
+		Cause:     LocalLimit,
+	})
+
+	const expectedString = `budget exhausted: monitor="root" resource=memory requested=100 used=950 ` +
+		`limit=1000 cause=reserved-exhausted top_consumer="session" top_consumer_used=150`
+	if s := rootEvent.String(); s != expectedString {
+		t.Fatalf("expected %q, got %q", expectedString, s)
+	}
+
+	sessionAcc.Close(ctx)
+	rootAcc.Close(ctx)
+	session.Stop(ctx)
+	root.Stop(ctx)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+)
+
+var _ fmt.Stringer = &BytesMonitor{}
+
+// String returns a short description of the usage of the monitor, e.g.
+// "sql: 12 MiB used / 64 MiB budget (max 40 MiB)", where the budget is the
+// budget obtained from the pool plus the pre-reserved budget. The usage
+// reported by the sources registered with RegisterExternalUsage, if any, is
+// added after the usage, e.g. "12 MiB used (+8 MiB external)". Unlike
+// DebugString, it only looks at the monitor itself, not at its pool.
+func (mm *BytesMonitor) String() string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	budget := "unlimited budget"
+	if b := saturatingAdd(mm.mu.curBudget.allocated(), mm.reserved.used); b != math.MaxInt64 {
+		budget = humanizeutil.IBytes(b) + " budget"
+	}
+	used := humanizeutil.IBytes(mm.mu.curAllocated) + " used"
+	if ext := mm.externalUsageLocked(); ext != 0 {
+		used = fmt.Sprintf("%s (+%s external)", used, humanizeutil.IBytes(ext))
+	}
+	return fmt.Sprintf("%s: %s / %s (max %s)", mm.name,
+		used, budget, humanizeutil.IBytes(mm.mu.maxAllocated))
+}
+
+// expvarState is the JSON rendering of the state of a monitor published
+// with PublishExpvar. Limit is omitted if the monitor has no limit, External
+// if it has no external usage, and Frozen unless it is frozen.
+type expvarState struct {
+	Name         string            `json:"name"`
+	ID           uint64            `json:"id"`
+	Allocated    int64             `json:"allocated"`
+	MaxAllocated int64             `json:"max_allocated"`
+	PoolBudget   int64             `json:"pool_budget"`
+	Reserved     int64             `json:"reserved"`
+	External     int64             `json:"external,omitempty"`
+	Limit        *int64            `json:"limit,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Frozen       bool              `json:"frozen,omitempty"`
+}
+
+// PublishExpvar publishes the state of the monitor under the given name
+// with package expvar, as a JSON object, for generic tooling to scrape. It
+// is meant for long-lived root monitors: expvar variables can't be
+// unpublished, and like expvar.Publish, PublishExpvar panics if the name is
+// already in use.
+func (mm *BytesMonitor) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return mm.expvarState()
+	}))
+}
+
+func (mm *BytesMonitor) expvarState() expvarState {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	s := expvarState{
+		Name:         mm.name,
+		ID:           mm.mu.id,
+		Allocated:    mm.mu.curAllocated,
+		MaxAllocated: mm.mu.maxAllocated,
+		PoolBudget:   mm.mu.curBudget.allocated(),
+		Reserved:     mm.reserved.used,
+		External:     mm.externalUsageLocked(),
+		Frozen:       mm.mu.frozen,
+	}
+	if mm.limit != math.MaxInt64 {
+		limit := mm.limit
+		s.Limit = &limit
+	}
+	if len(mm.mu.labels) > 0 {
+		s.Labels = make(map[string]string, len(mm.mu.labels))
+		for _, l := range mm.mu.labels {
+			s.Labels[l.Key] = l.Value
+		}
+	}
+	return s
+}
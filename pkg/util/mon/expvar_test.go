@@ -0,0 +1,119 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestMonitorString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m := MakeMonitor("test", MemoryResource, nil, nil, 10, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, &pool, MakeStandaloneBudget(50))
+
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 120); err != nil {
+		t.Fatal(err)
+	}
+	acc.Shrink(ctx, 100)
+	state := m.Snapshot()
+	expected := fmt.Sprintf("test: %s used / %s budget (max %s)", humanizeutil.IBytes(20),
+		humanizeutil.IBytes(state.PoolBudget+state.Reserved), humanizeutil.IBytes(120))
+	if s := m.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	if s := fmt.Sprint(&m); s != expected {
+		t.Errorf("expected %q to be printed, got %q", expected, s)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+
+	unlimited := MakeUnlimitedMonitor(ctx, "unlimited", MemoryResource, nil, nil, 1000, st)
+	expected = fmt.Sprintf("unlimited: %s used / unlimited budget (max %s)",
+		humanizeutil.IBytes(0), humanizeutil.IBytes(0))
+	if s := unlimited.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	// The external usage is reported next to the usage.
+	unlimited.RegisterExternalUsage("cache", func() int64 { return 100 })
+	expected = fmt.Sprintf("unlimited: %s used (+%s external) / unlimited budget (max %s)",
+		humanizeutil.IBytes(0), humanizeutil.IBytes(100), humanizeutil.IBytes(0))
+	if s := unlimited.String(); s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+	unlimited.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestPublishExpvar(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitorWithLimit("root", MemoryResource, 500, nil, nil, 1, 1000, st,
+		WithLabels(Label{Key: "tenant", Value: "1"}))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m.RegisterExternalUsage("cache", func() int64 { return 200 })
+	// expvar variables can't be unpublished: make the name unique to this
+	// run of the test, with the process-unique ID of the monitor.
+	name := fmt.Sprintf("mon_test_root_%d", m.ID())
+	m.PublishExpvar(name)
+
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	var state map[string]interface{}
+	out := expvar.Get(name).String()
+	if err := json.Unmarshal([]byte(out), &state); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", out, err)
+	}
+	for key, expected := range map[string]interface{}{
+		"name":          "root",
+		"id":            float64(m.ID()),
+		"allocated":     float64(100),
+		"max_allocated": float64(100),
+		"reserved":      float64(1000),
+		"limit":         float64(500),
+		"external":      float64(200),
+		"labels":        map[string]interface{}{"tenant": "1"},
+	} {
+		if v, ok := state[key]; !ok || fmt.Sprint(v) != fmt.Sprint(expected) {
+			t.Errorf("expected %s=%v, got %v in %s", key, expected, v, out)
+		}
+	}
+	if _, ok := state["pool_budget"]; !ok {
+		t.Errorf("expected pool_budget in %s", out)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+// externalUsage is a source of usage registered via RegisterExternalUsage.
+type externalUsage struct {
+	name string
+	fn   func() int64
+}
+
+// ExternalUsageSource is the usage reported by one of the sources registered
+// via RegisterExternalUsage, as listed in MonitorSnapshot.
+type ExternalUsageSource struct {
+	Name  string
+	Bytes int64
+}
+
+// RegisterExternalUsage folds usage that is managed outside of the monitor
+// (for example the storage engine's block cache) into the monitor's
+// availability calculations: the value reported by fn counts against the
+// monitor's local limit and, if the monitor has no pool, against its reserved
+// budget. The monitor does not own these bytes and never releases them. The
+// source is listed under name in the snapshot and the DebugString of the
+// monitor. The returned function unregisters the source.
+//
+// fn is invoked with the monitor's lock held on every reservation; it must be
+// cheap, must not block, and must not call into the monitor.
+func (mm *BytesMonitor) RegisterExternalUsage(
+	name string, fn func() int64,
+) (unregister func()) {
+	e := &externalUsage{name: name, fn: fn}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.external = append(mm.mu.external, e)
+	return func() {
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+		for i := range mm.mu.external {
+			if mm.mu.external[i] == e {
+				mm.mu.external = append(mm.mu.external[:i], mm.mu.external[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// ExternalUsage returns the total usage currently reported by the sources
+// registered via RegisterExternalUsage.
+func (mm *BytesMonitor) ExternalUsage() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.externalUsageLocked()
+}
+
+func (mm *BytesMonitor) externalUsageLocked() int64 {
+	var total int64
+	for _, e := range mm.mu.external {
+		if v := e.fn(); v > 0 {
+			total += v
+		}
+	}
+	return total
+}
+
+// externalSourcesLocked lists the usage reported by each of the sources
+// registered via RegisterExternalUsage, in the order they were registered.
+func (mm *BytesMonitor) externalSourcesLocked() []ExternalUsageSource {
+	if len(mm.mu.external) == 0 {
+		return nil
+	}
+	sources := make([]ExternalUsageSource, len(mm.mu.external))
+	for i, e := range mm.mu.external {
+		sources[i] = ExternalUsageSource{Name: e.name, Bytes: e.fn()}
+	}
+	return sources
+}
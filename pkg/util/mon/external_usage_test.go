@@ -0,0 +1,108 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestExternalUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		name  string
+		start func(m *BytesMonitor)
+	}{
+		{"reserved", func(m *BytesMonitor) {
+			*m = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+			m.Start(ctx, nil, MakeStandaloneBudget(1000))
+		}},
+		{"limit", func(m *BytesMonitor) {
+			*m = MakeMonitorWithLimit("test", MemoryResource, 1000, nil, nil, 1, 1000, st)
+			m.Start(ctx, nil, MakeStandaloneBudget(1<<30))
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var m BytesMonitor
+			tc.start(&m)
+
+			var blockCache int64
+			unregister := m.RegisterExternalUsage("block-cache", func() int64 {
+				return atomic.LoadInt64(&blockCache)
+			})
+
+			acc := m.MakeBoundAccount()
+			if err := acc.Grow(ctx, 600); err != nil {
+				t.Fatal(err)
+			}
+			acc.Clear(ctx)
+
+			// As the external usage grows, the same reservation is denied.
+			atomic.StoreInt64(&blockCache, 500)
+			if m.ExternalUsage() != 500 {
+				t.Fatalf("expected external usage 500, got %d", m.ExternalUsage())
+			}
+			if err := acc.Grow(ctx, 600); err == nil {
+				t.Fatal("expected reservation to be denied")
+			}
+			if err := acc.Grow(ctx, 500); err != nil {
+				t.Fatal(err)
+			}
+			if err := acc.Grow(ctx, 1); err == nil {
+				t.Fatal("expected reservation to be denied")
+			}
+
+			// And allowed again once the external usage shrinks.
+			atomic.StoreInt64(&blockCache, 100)
+			if err := acc.Grow(ctx, 400); err != nil {
+				t.Fatal(err)
+			}
+
+			// The source is listed by name.
+			if s := m.Snapshot().External; !reflect.DeepEqual(s,
+				[]ExternalUsageSource{{Name: "block-cache", Bytes: 100}}) {
+				t.Fatalf("expected the block cache in the snapshot, got %+v", s)
+			}
+			if s := m.DebugString(); !strings.Contains(s, "100 bytes of external usage from block-cache") {
+				t.Fatalf("expected the block cache in the debug string, got %s", s)
+			}
+
+			// Once unregistered, it no longer counts.
+			unregister()
+			if m.ExternalUsage() != 0 || m.Snapshot().External != nil {
+				t.Fatalf("expected no external usage, got %d", m.ExternalUsage())
+			}
+			if err := acc.Grow(ctx, 100); err != nil {
+				t.Fatal(err)
+			}
+
+			acc.Close(ctx)
+			m.Stop(ctx)
+		})
+	}
+}
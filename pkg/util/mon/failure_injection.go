@@ -0,0 +1,99 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "github.com/cockroachdb/cockroach/pkg/util/syncutil"
+
+// FailureInjector makes a monitor deny reservations deterministically, to
+// exercise the error paths of its clients without tuning budgets until a
+// failure happens at the right moment. Reservations that are not denied are
+// handled by the monitor as usual, so accounting stays correct.
+//
+// A reservation is a request from an account to its monitor for more bytes;
+// an account only makes one when its own unused reservation is exhausted.
+// Using a pool allocation size of 1 makes every Grow a reservation.
+type FailureInjector struct {
+	// deny is called with the 1-based index of the reservation and its size.
+	deny func(op int64, size int64) bool
+
+	mu struct {
+		syncutil.Mutex
+		ops     int64
+		denials int64
+	}
+}
+
+// NewFailureInjector creates a FailureInjector denying the reservations for
+// which deny returns true. deny is called with the 1-based count of
+// reservations seen by the injector and the size of the reservation, with
+// the monitor's lock held.
+func NewFailureInjector(deny func(op int64, size int64) bool) *FailureInjector {
+	return &FailureInjector{deny: deny}
+}
+
+// DenyNth creates a FailureInjector denying the nth reservation only.
+func DenyNth(n int64) *FailureInjector {
+	return NewFailureInjector(func(op, _ int64) bool { return op == n })
+}
+
+// DenyLargerThan creates a FailureInjector denying every reservation larger
+// than size bytes.
+func DenyLargerThan(size int64) *FailureInjector {
+	return NewFailureInjector(func(_, sz int64) bool { return sz > size })
+}
+
+// shouldDeny records a reservation and returns whether to deny it.
+func (fi *FailureInjector) shouldDeny(size int64) bool {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.mu.ops++
+	if fi.deny(fi.mu.ops, size) {
+		fi.mu.denials++
+		return true
+	}
+	return false
+}
+
+// Ops returns the number of reservations seen so far.
+func (fi *FailureInjector) Ops() int64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.mu.ops
+}
+
+// Denials returns the number of reservations denied so far.
+func (fi *FailureInjector) Denials() int64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.mu.denials
+}
+
+// AssertDenials fails the test if the number of reservations denied so far
+// differs from expected.
+func (fi *FailureInjector) AssertDenials(t testingT, expected int64) {
+	t.Helper()
+	if denials := fi.Denials(); denials != expected {
+		t.Errorf("expected %d injected denial(s), got %d (out of %d reservations)",
+			expected, denials, fi.Ops())
+	}
+}
+
+// TestingSetFailureInjector makes the monitor consult fi on every
+// reservation. It must be called before the monitor is shared; a nil fi
+// disables injection. Denied reservations return the monitor's usual budget
+// error, annotated as injected.
+func (mm *BytesMonitor) TestingSetFailureInjector(fi *FailureInjector) {
+	mm.testingFailureInjector = fi
+}
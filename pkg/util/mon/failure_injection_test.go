@@ -0,0 +1,146 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func isOutOfMemory(err error) bool {
+	pgErr, ok := pgerror.GetPGCause(err)
+	return ok && pgErr.Code == pgerror.CodeOutOfMemoryError
+}
+
+func TestFailureInjector(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		name string
+		fi   *FailureInjector
+		// denied lists the indexes of the grows below that are expected to fail.
+		denied map[int]bool
+	}{
+		{"nth", DenyNth(3), map[int]bool{2: true}},
+		{"larger-than", DenyLargerThan(25), map[int]bool{3: true, 4: true}},
+		{"predicate", NewFailureInjector(func(op, size int64) bool {
+			return op%2 == 0 && size > 10
+		}), map[int]bool{1: true, 3: true}},
+	}
+	sizes := []int64{10, 20, 20, 30, 40}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+			m.TestingSetFailureInjector(tc.fi)
+			m.Start(ctx, nil, MakeStandaloneBudget(1000))
+			acc := m.MakeBoundAccount()
+
+			for i, sz := range sizes {
+				err := acc.Grow(ctx, sz)
+				if tc.denied[i] {
+					if !isOutOfMemory(err) {
+						t.Fatalf("%d: expected injected out of memory error, got %v", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%d: %v", i, err)
+				}
+			}
+			tc.fi.AssertDenials(t, int64(len(tc.denied)))
+			if tc.fi.Ops() != int64(len(sizes)) {
+				t.Fatalf("expected %d reservations, got %d", len(sizes), tc.fi.Ops())
+			}
+
+			// The accounting only reflects the grows that were allowed.
+			var used int64
+			for i, sz := range sizes {
+				if !tc.denied[i] {
+					used += sz
+				}
+			}
+			if acc.Used() != used || m.AllocBytes() != used {
+				t.Fatalf("expected %d bytes used, got %d in the account\n%s",
+					used, acc.Used(), m.DebugString())
+			}
+
+			acc.Close(ctx)
+			m.Stop(ctx)
+		})
+	}
+}
+
+// TestFailureInjectorBlockingGrow exercises the failure paths of
+// ByteChannel.SendCtx, which waits for the consumer when a grow is denied
+// while items are queued and fails when nothing is.
+func TestFailureInjectorBlockingGrow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	fi := DenyNth(2)
+	m.TestingSetFailureInjector(fi)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+	c := NewByteChannel(&acc, 0 /* limit */)
+
+	if err := c.SendCtx(ctx, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	// The second send is denied while an item is queued, so it waits for the
+	// consumer and then succeeds.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendCtx(ctx, 1, 10)
+	}()
+	for fi.Denials() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Recv(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	fi.AssertDenials(t, 1)
+
+	// A denial while the channel is empty is returned to the sender.
+	if _, err := c.Recv(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m.TestingSetFailureInjector(DenyLargerThan(0))
+	if err := c.SendCtx(ctx, 2, 10); !isOutOfMemory(err) {
+		t.Fatalf("expected injected out of memory error, got %v", err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected account to be empty, got %d", acc.Used())
+	}
+
+	c.Close(ctx)
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
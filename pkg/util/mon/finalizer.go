@@ -0,0 +1,111 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// finalizedCharge is a charge made by GrowWithFinalizer.
+type finalizedCharge struct {
+	acc *BoundAccount
+	n   int64
+}
+
+// finalized holds the charges made by GrowWithFinalizer that were not
+// released yet, by address of their object. The addresses don't keep the
+// objects alive. mu also serializes the uses of the accounts of the charges,
+// since finalizers run on their own goroutine.
+var finalized struct {
+	syncutil.Mutex
+	charges map[uintptr]finalizedCharge
+}
+
+// GrowWithFinalizer grows acc by n bytes on behalf of obj, which must be a
+// pointer to a heap object, and sets a finalizer on obj which releases the
+// bytes, and logs that their owner forgot to, if obj is garbage collected
+// before the bytes are released with ReleaseWithFinalizer.
+//
+// This is a safety net for the few long-lived allocations handed to code we
+// don't control, and a debugging aid; it is not meant for the hot path:
+// finalizers are expensive, delay the collection of obj and may never run.
+// acc must only be used through GrowWithFinalizer and ReleaseWithFinalizer,
+// and must not be closed while it holds charges.
+func GrowWithFinalizer(ctx context.Context, acc *BoundAccount, obj interface{}, n int64) error {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.Errorf("cannot set a finalizer on %T", obj)
+	}
+	finalized.Lock()
+	defer finalized.Unlock()
+	if _, ok := finalized.charges[v.Pointer()]; ok {
+		return errors.Errorf("%s: %T already charged with a finalizer", acc.monitorName(), obj)
+	}
+	if err := acc.Grow(ctx, n); err != nil {
+		return err
+	}
+	if finalized.charges == nil {
+		finalized.charges = make(map[uintptr]finalizedCharge)
+	}
+	finalized.charges[v.Pointer()] = finalizedCharge{acc: acc, n: n}
+	runtime.SetFinalizer(obj, releaseFinalized)
+	return nil
+}
+
+// ReleaseWithFinalizer releases the bytes charged for obj by
+// GrowWithFinalizer, and clears its finalizer. It is a no-op if obj holds no
+// charge.
+func ReleaseWithFinalizer(ctx context.Context, obj interface{}) {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return
+	}
+	finalized.Lock()
+	defer finalized.Unlock()
+	c, ok := finalized.charges[v.Pointer()]
+	if !ok {
+		return
+	}
+	delete(finalized.charges, v.Pointer())
+	runtime.SetFinalizer(obj, nil)
+	c.acc.Shrink(ctx, c.n)
+}
+
+// releaseFinalized is the finalizer of the objects charged by
+// GrowWithFinalizer.
+func releaseFinalized(obj interface{}) {
+	ctx := context.Background()
+	finalized.Lock()
+	defer finalized.Unlock()
+	p := reflect.ValueOf(obj).Pointer()
+	c, ok := finalized.charges[p]
+	if !ok {
+		return
+	}
+	delete(finalized.charges, p)
+	c.acc.Shrink(ctx, c.n)
+	l := DefaultLogger
+	if c.acc.mon != nil {
+		l = c.acc.mon.log()
+	}
+	l.Warningf(ctx, "%s: assertion failed: %T collected with %d bytes still charged; releasing them",
+		c.acc.monitorName(), obj, c.n)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+type finalizedObject struct {
+	buf [64]byte
+}
+
+func TestGrowWithFinalizer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	l := &capturingLogger{}
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, math.MaxInt64, st, WithLogger(l))
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+	acc := m.MakeBoundAccount()
+	// assertions returns the assertion failures logged since the last call,
+	// leaving out the other messages of the monitor, e.g. those of the
+	// metamorphic parameters.
+	assertions := func() []string {
+		var res []string
+		for _, msg := range l.take() {
+			if strings.Contains(msg, "assertion failed") {
+				res = append(res, msg)
+			}
+		}
+		return res
+	}
+
+	if err := GrowWithFinalizer(ctx, &acc, finalizedObject{}, 10); err == nil {
+		t.Fatal("expected an error for a non-pointer object")
+	}
+
+	t.Run("released", func(t *testing.T) {
+		obj := &finalizedObject{}
+		if err := GrowWithFinalizer(ctx, &acc, obj, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := GrowWithFinalizer(ctx, &acc, obj, 100); err == nil {
+			t.Fatal("expected an error when charging an object twice")
+		}
+		if u := acc.Used(); u != 100 {
+			t.Fatalf("expected 100 bytes used, got %d", u)
+		}
+		ReleaseWithFinalizer(ctx, obj)
+		if u := acc.Used(); u != 0 {
+			t.Fatalf("expected no bytes used, got %d", u)
+		}
+		// A second release is a no-op.
+		ReleaseWithFinalizer(ctx, obj)
+		obj = nil
+		for i := 0; i < 5; i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		if msgs := assertions(); len(msgs) != 0 {
+			t.Fatalf("expected no assertion failure, got %q", msgs)
+		}
+	})
+
+	t.Run("collected", func(t *testing.T) {
+		obj := &finalizedObject{}
+		if err := GrowWithFinalizer(ctx, &acc, obj, 100); err != nil {
+			t.Fatal(err)
+		}
+		obj = nil
+		var msgs []string
+		for deadline := time.Now().Add(10 * time.Second); len(msgs) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("the object was not finalized")
+			}
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+			msgs = assertions()
+		}
+		if len(msgs) != 1 || !strings.Contains(msgs[0], "100 bytes still charged") {
+			t.Fatalf("unexpected messages: %q", msgs)
+		}
+		if u := acc.Used(); u != 0 {
+			t.Fatalf("expected the finalizer to release the bytes, got %d bytes used", u)
+		}
+	})
+
+	acc.Close(ctx)
+}
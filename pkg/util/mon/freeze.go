@@ -0,0 +1,52 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "github.com/pkg/errors"
+
+// ErrMonitorFrozen is the cause of the errors returned by the reservations
+// of a frozen monitor, or of a monitor whose frozen pool refused it budget;
+// see SetFrozen.
+var ErrMonitorFrozen = errors.New("monitor frozen")
+
+// SetFrozen freezes or unfreezes the monitor. While frozen, the monitor
+// denies all new reservations with an error whose cause is
+// ErrMonitorFrozen, and which names the monitor, while releases still work.
+// Since the monitor also denies budget to its children, they can't grow
+// beyond the budget they already obtained from it either. It is meant for
+// chaos testing and for operators to stop a node about to run out of
+// memory from admitting more memory growth.
+//
+// Accounts can still grow within the bytes they already reserved, and
+// GrowEmergency still draws from the emergency reserve, so that cleanup
+// paths complete. The monitor stays frozen across restarts, until
+// SetFrozen(false).
+func (mm *BytesMonitor) SetFrozen(frozen bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.frozen = frozen
+}
+
+// Frozen returns whether the monitor is frozen; see SetFrozen.
+func (mm *BytesMonitor) Frozen() bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.frozen
+}
+
+// errFrozen returns the error of the reservations of a frozen monitor.
+func (mm *BytesMonitor) errFrozen() error {
+	return errors.Wrapf(ErrMonitorFrozen, "%s", mm.name)
+}
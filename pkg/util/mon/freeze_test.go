@@ -0,0 +1,121 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestSetFrozen(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	m := mon.MakeMonitor("child", mon.MemoryResource, nil, nil, 100, math.MaxInt64, st,
+		mon.WithReleasePolicy(mon.ReleaseImmediately()))
+	m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+
+	accs := make([]mon.BoundAccount, 4)
+	for i := range accs {
+		accs[i] = m.MakeBoundAccount()
+	}
+	poolAcc := pool.MakeBoundAccount()
+
+	// workload grows every account by 1000 bytes and shrinks them by 500,
+	// and returns the first error.
+	workload := func() error {
+		for i := range accs {
+			if err := accs[i].Grow(ctx, 1000); err != nil {
+				return err
+			}
+			accs[i].Shrink(ctx, 500)
+		}
+		return nil
+	}
+	expectFrozen := func(err error, name string) {
+		t.Helper()
+		if errors.Cause(err) != mon.ErrMonitorFrozen {
+			t.Fatalf("expected a frozen error, got %v", err)
+		}
+		if !strings.HasPrefix(err.Error(), name+":") {
+			t.Fatalf("expected the error to name %s, got %q", name, err)
+		}
+	}
+
+	if err := workload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mid-workload, freeze the pool: the child can't obtain more budget,
+	// and the error names the pool.
+	pool.SetFrozen(true)
+	if !pool.Frozen() || !pool.Snapshot().Frozen || m.Snapshot().Frozen {
+		t.Fatal("expected only the pool to be frozen")
+	}
+	if s := pool.DebugString(); !strings.HasSuffix(s, ", frozen") {
+		t.Fatalf("expected the frozen pool to be reported, got %q", s)
+	}
+	expectFrozen(workload(), "pool")
+	expectFrozen(poolAcc.Grow(ctx, 1), "pool")
+	// GrowUpTo is limited to the budget that the child already obtained.
+	allocated := pool.AllocBytes()
+	if granted, err := accs[0].GrowUpTo(ctx, 1<<20); err != nil || granted >= 1<<20 {
+		t.Fatalf("expected a partial grant, got %d, %v", granted, err)
+	}
+	montest.AssertUsed(t, &pool, allocated)
+	// Releases still work.
+	for i := range accs {
+		accs[i].Clear(ctx)
+	}
+	if a := pool.AllocBytes(); a >= allocated {
+		t.Fatalf("expected releases to reach the frozen pool, got %d bytes, had %d", a, allocated)
+	}
+
+	// Freezing the child itself names it.
+	pool.SetFrozen(false)
+	m.SetFrozen(true)
+	expectFrozen(accs[0].Grow(ctx, 1), "child")
+
+	// The workload recovers once unfrozen.
+	m.SetFrozen(false)
+	for i := 0; i < 3; i++ {
+		if err := workload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := poolAcc.Grow(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	poolAcc.Close(ctx)
+	for i := range accs {
+		accs[i].Close(ctx)
+	}
+	m.Stop(ctx)
+	pool.Stop(ctx)
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryOptions configures the backoff of GrowWithRetry.
+type RetryOptions struct {
+	// InitialBackoff is the wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries, if set.
+	MaxBackoff time.Duration
+	// Multiplier is the factor applied to the wait after every retry, if
+	// set.
+	Multiplier float64
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+}
+
+// GrowWithRetry is like acc.Grow, but retries with exponential backoff when
+// the growth is refused for lack of budget, for callers that can afford to
+// wait for concurrent users of the budget to release memory. Other errors
+// are returned right away. If the growth is still refused after
+// opts.MaxRetries retries, the last budget error is returned, annotated with
+// the number of retries. The waits are measured with the TimeSource of the
+// monitor of the account, and cut short by the cancellation of ctx.
+func GrowWithRetry(ctx context.Context, acc *BoundAccount, n int64, opts RetryOptions) error {
+	backoff := opts.InitialBackoff
+	for retries := 0; ; retries++ {
+		err := acc.Grow(ctx, n)
+		if err == nil || !IsBudgetExceededError(err) {
+			return err
+		}
+		if retries >= opts.MaxRetries {
+			return errors.Wrapf(err, "after %d retries", retries)
+		}
+
+		t := acc.mon.clock().NewTimer(backoff)
+		select {
+		case <-t.C():
+		case <-ctx.Done():
+			t.Stop()
+			return errors.Wrapf(ctx.Err(), "giving up after %d retries (%v)", retries, err)
+		}
+
+		if opts.Multiplier > 0 {
+			backoff = time.Duration(float64(backoff) * opts.Multiplier)
+		}
+		if opts.MaxBackoff > 0 && backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
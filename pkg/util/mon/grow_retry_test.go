@@ -0,0 +1,134 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestGrowWithRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	opts := mon.RetryOptions{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     4 * time.Millisecond,
+		Multiplier:     2,
+		MaxRetries:     3,
+	}
+
+	// setup returns a monitor with a budget of 100 bytes, of which 80 are
+	// held by the returned account.
+	setup := func(
+		t *testing.T, fi *mon.FailureInjector,
+	) (*mon.BytesMonitor, *mon.BoundAccount, *montest.ManualTimeSource) {
+		clock := montest.NewManualTimeSource(time.Unix(0, 0))
+		m := &mon.BytesMonitor{}
+		*m = mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, 1000, st,
+			mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+		m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+		other := &mon.BoundAccount{}
+		*other = m.MakeBoundAccount()
+		if err := other.Grow(ctx, 80); err != nil {
+			t.Fatal(err)
+		}
+		m.TestingSetFailureInjector(fi)
+		return m, other, clock
+	}
+
+	// growAsync runs GrowWithRetry in the background and returns the
+	// channel on which its result is delivered.
+	growAsync := func(ctx context.Context, acc *mon.BoundAccount) chan error {
+		errCh := make(chan error, 1)
+		go func() { errCh <- mon.GrowWithRetry(ctx, acc, 50, opts) }()
+		return errCh
+	}
+
+	// waitForBackoff waits for GrowWithRetry to wait for a retry.
+	waitForBackoff := func(clock *montest.ManualTimeSource) {
+		for clock.NumTimers() == 0 {
+			runtime.Gosched()
+		}
+	}
+
+	t.Run("release", func(t *testing.T) {
+		// The injector lets every attempt through, so that the attempts only
+		// fail for lack of budget.
+		fi := mon.NewFailureInjector(func(op, size int64) bool { return false })
+		m, other, clock := setup(t, fi)
+		acc := m.MakeBoundAccount()
+		errCh := growAsync(ctx, &acc)
+
+		waitForBackoff(clock)
+		clock.Advance(opts.InitialBackoff)
+		waitForBackoff(clock)
+		// Another user releases the budget between two attempts.
+		other.Close(ctx)
+		clock.Advance(2 * opts.InitialBackoff)
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		montest.AssertAccountUsed(t, &acc, 50)
+		fi.AssertDenials(t, 0)
+		if ops := fi.Ops(); ops != 3 {
+			t.Fatalf("expected 3 attempts, got %d", ops)
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		// All the attempts are denied: the account budget doesn't matter.
+		m, other, clock := setup(t, mon.NewFailureInjector(func(op, size int64) bool { return true }))
+		other.Close(ctx)
+		acc := m.MakeBoundAccount()
+		errCh := growAsync(ctx, &acc)
+		for _, backoff := range []time.Duration{1, 2, 4} {
+			waitForBackoff(clock)
+			clock.Advance(backoff * time.Millisecond)
+		}
+		err := <-errCh
+		if !mon.IsBudgetExceededError(err) || !strings.Contains(err.Error(), "after 3 retries") {
+			t.Fatalf("expected a budget error after 3 retries, got %v", err)
+		}
+		montest.AssertEmpty(t, m)
+		m.Stop(ctx)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		m, other, clock := setup(t, nil)
+		acc := m.MakeBoundAccount()
+		ctx, cancel := context.WithCancel(ctx)
+		errCh := growAsync(ctx, &acc)
+		waitForBackoff(clock)
+		cancel()
+		if err := <-errCh; err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("expected the retries to be cancelled, got %v", err)
+		}
+		other.Close(ctx)
+		m.Stop(ctx)
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// GrowUpTo grows the account by as many bytes as are available, up to max,
+// for components that can make use of however much memory they get, e.g. a
+// sort buffer. It returns the number of bytes granted, which is 0 if
+// nothing is available. Both the limit of the monitor and the budget of its
+// pools are respected; the burst allowance of the monitor is not used.
+//
+// An error is only returned if max is negative, or if the account is not
+// bound to a started monitor.
+func (b *BoundAccount) GrowUpTo(ctx context.Context, max int64) (granted int64, _ error) {
+	if w := b.watch; w != nil {
+		if !w.enter() {
+			return 0, b.errClosedOnDone()
+		}
+		defer w.exit(ctx, b)
+	}
+	b.canary.touch()
+	if max < 0 {
+		return 0, errors.Errorf("cannot grow by up to %d bytes", max)
+	}
+	if b.mon == nil {
+		return 0, errors.New("cannot grow a standalone budget")
+	}
+	if b.mon.stoppedAtomic() {
+		return 0, b.mon.errStopped()
+	}
+	granted = b.growUpTo(ctx, max)
+	if b.mon.testingRecorder != nil && granted > 0 {
+		b.mon.testingRecorder.record(b, "grow", granted, nil)
+	}
+	return granted, nil
+}
+
+// growUpTo grows the account by up to max bytes, taking them from its
+// unused reservation first.
+func (b *BoundAccount) growUpTo(ctx context.Context, max int64) int64 {
+	if b.reserved < max {
+		want := b.mon.roundSize(max - b.reserved)
+		if b.pageSize > 0 {
+			want = b.pageExtra(max)
+		}
+		overhead := b.overheadCost(want)
+		request := saturatingAdd(want, overhead)
+		charged := b.mon.reserveBytesUpTo(ctx, request)
+		if charged < request {
+			// Only part of the request was granted: keep the largest
+			// reservation whose overhead fits in it, and give the rest back.
+			want = charged
+			if m := b.overheadMultiplier(); m != 1 {
+				want = int64(float64(charged) / m)
+			}
+			for want > 0 && want+b.overheadCost(want) > charged {
+				want--
+			}
+			if b.pageSize > 0 {
+				// Only reserve whole pages.
+				want = b.pageFloor(b.used+b.reserved+want) - b.used - b.reserved
+				if want < 0 {
+					want = 0
+				}
+			}
+			overhead = b.overheadCost(want)
+			if rest := charged - want - overhead; rest > 0 {
+				b.mon.releaseBytes(ctx, rest)
+			}
+		}
+		b.reserved += want
+		b.overhead += overhead
+	}
+	granted := max
+	if b.reserved < granted {
+		granted = b.reserved
+	}
+	b.reserved -= granted
+	b.used += granted
+	return granted
+}
+
+// reserveBytesUpTo declares an allocation of as many bytes as the monitor
+// can admit, up to max. It returns the number of bytes allocated.
+func (mm *BytesMonitor) reserveBytesUpTo(ctx context.Context, max int64) int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.mu.stopped || mm.mu.frozen {
+		return 0
+	}
+	if fi := mm.testingFailureInjector; fi != nil && fi.shouldDeny(max) {
+		return 0
+	}
+	mm.refreshLimitLocked()
+	used := mm.mu.curAllocated + mm.externalUsageLocked()
+	n := max
+	if mm.mu.enforcement == Enforced {
+		if headroom := mm.limit - mm.mu.emergencyHeld - used; headroom < n {
+			n = headroom
+		}
+	}
+	if mm.mu.curBudget.mon == nil && used != mm.mu.curAllocated {
+		// Without a pool, the external usage also competes for the reserved
+		// budget.
+		if headroom := mm.reserved.used - used; headroom < n {
+			n = headroom
+		}
+	}
+	if n <= 0 {
+		return 0
+	}
+	if free := mm.freeBudgetLocked(); free < n {
+		if mm.mu.curBudget.mon != nil {
+			free += mm.mu.curBudget.growUpTo(ctx, mm.roundBudgetRequest(n-free))
+		}
+		if free < n {
+			n = free
+		}
+	}
+	if n <= 0 {
+		return 0
+	}
+	mm.allocateLocked(n)
+	return n
+}
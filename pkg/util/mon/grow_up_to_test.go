@@ -0,0 +1,129 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestGrowUpTo(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m := MakeMonitorWithLimit("test", MemoryResource, 600, nil, nil, 10, 1e9, st,
+		WithReservationPolicy(ReleaseEagerly), WithHysteresis(0))
+	m.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	growUpTo := func(acc *BoundAccount, max, expected int64) {
+		t.Helper()
+		granted, err := acc.GrowUpTo(ctx, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if granted != expected {
+			t.Fatalf("expected %d bytes granted out of %d, got %d\n%s\n%s",
+				expected, max, granted, m.DebugString(), pool.DebugString())
+		}
+	}
+
+	acc := m.MakeBoundAccount()
+	growUpTo(&acc, 105, 105)
+	// The limit caps the grant.
+	growUpTo(&acc, 1000, 495)
+	growUpTo(&acc, 1, 0)
+	if used := acc.Used(); used != 600 {
+		t.Fatalf("expected 600 bytes used, got %d", used)
+	}
+	acc.Clear(ctx)
+
+	// So does the budget of the pool.
+	other := pool.MakeBoundAccount()
+	if err := other.Grow(ctx, 750); err != nil {
+		t.Fatal(err)
+	}
+	growUpTo(&acc, 1000, 250)
+	growUpTo(&acc, 1000, 0)
+	other.Shrink(ctx, 100)
+	growUpTo(&acc, 40, 40)
+	growUpTo(&acc, 1000, 60)
+	acc.Clear(ctx)
+	other.Clear(ctx)
+
+	if _, err := acc.GrowUpTo(ctx, -1); err == nil {
+		t.Fatal("expected an error for a negative size")
+	}
+
+	// Concurrent competitors share the whole capacity without overshooting.
+	const workers = 8
+	granted := make([]int64, workers)
+	accs := make([]BoundAccount, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			a := &accs[w]
+			*a = m.MakeBoundAccount()
+			for i := 0; i < 100; i++ {
+				n, err := a.GrowUpTo(ctx, int64(1+w+i%7))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				granted[w] += n
+			}
+			if a.Used() != granted[w] {
+				t.Errorf("expected %d bytes used, got %d", granted[w], a.Used())
+			}
+		}(w)
+	}
+	wg.Wait()
+	var total int64
+	for _, n := range granted {
+		total += n
+	}
+	if total != 600 {
+		t.Fatalf("expected the competitors to get 600 bytes in total, got %d\n%s", total, m.DebugString())
+	}
+	if used := m.AllocBytes(); used != 600 {
+		t.Fatalf("expected 600 bytes allocated, got\n%s", m.DebugString())
+	}
+	if err := m.TestReserve(ctx, 1); err == nil {
+		t.Fatal("expected the monitor to be full")
+	}
+
+	for i := range accs {
+		accs[i].Close(ctx)
+	}
+	acc.Close(ctx)
+	other.Close(ctx)
+	m.Stop(ctx)
+	if _, err := acc.GrowUpTo(ctx, 1); errors.Cause(err) != ErrMonitorStopped {
+		t.Fatalf("expected ErrMonitorStopped, got %v", err)
+	}
+	pool.Stop(ctx)
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// ApproxHeadroom returns an estimate of the number of bytes that could be
+// allocated through the monitor, considering its limit, its pre-reserved
+// budget and the availability of its pool. It is meant for planning
+// decisions, e.g. choosing between algorithms with different memory
+// requirements.
+//
+// The estimate is non-binding: nothing is reserved, and a subsequent
+// allocation may be denied. The availability of the pool is the headroom it
+// published after its last change, which doesn't take the lock of the pool
+// but may be stale when monitors further up the chain changed since.
+func (mm *BytesMonitor) ApproxHeadroom() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.refreshLimitLocked()
+	return mm.headroomLocked(mm.externalUsageLocked())
+}
+
+// publishHeadroomLocked updates the headroom of the monitor as seen by its
+// children. It is called whenever the usage or the budget of the monitor
+// changes. It disregards the external usage, to keep it cheap.
+func (mm *BytesMonitor) publishHeadroomLocked() {
+	atomic.StoreInt64(&mm.approxHeadroom, mm.headroomLocked(0 /* external */))
+}
+
+// headroomLocked computes the headroom of the monitor, given its external
+// usage.
+func (mm *BytesMonitor) headroomLocked(external int64) int64 {
+	used := mm.mu.curAllocated + external + mm.mu.emergencyHeld
+	headroom := int64(math.MaxInt64)
+	if mm.limit != math.MaxInt64 {
+		headroom = mm.limit - used
+	}
+	free := mm.freeBudgetLocked() - external
+	if pool := mm.mu.curBudget.mon; pool != nil {
+		free = saturatingAdd(free, atomic.LoadInt64(&pool.approxHeadroom))
+	}
+	if free < headroom {
+		headroom = free
+	}
+	if headroom < 0 {
+		return 0
+	}
+	return headroom
+}
+
+// saturatingAdd returns a+b, or math.MaxInt64 if the sum overflows. b must
+// not be negative.
+func saturatingAdd(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestApproxHeadroom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m1 := MakeMonitor("m1", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly), WithHysteresis(0))
+	m1.Start(ctx, &pool, MakeStandaloneBudget(100))
+	m2 := MakeMonitorWithLimit("m2", MemoryResource, 500, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly), WithHysteresis(0))
+	m2.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	expect := func(m *BytesMonitor, expected int64) {
+		t.Helper()
+		if h := m.ApproxHeadroom(); h != expected {
+			t.Fatalf("expected a headroom of %d, got %d\n%s", expected, h, m.DebugString())
+		}
+	}
+
+	// m1 has its pre-reserved budget on top of the pool's; m2 is capped by
+	// its limit.
+	expect(&pool, 1000)
+	expect(&m1, 1100)
+	expect(&m2, 500)
+
+	// As the pool fills, the headroom of its children goes down. The
+	// budget that a monitor obtained from the pool but doesn't use only
+	// counts towards its own headroom.
+	acc1 := m1.MakeBoundAccount()
+	if err := acc1.Grow(ctx, 400); err != nil {
+		t.Fatal(err)
+	}
+	expect(&pool, 600)
+	expect(&m1, 700)
+	expect(&m2, 500)
+	if err := acc1.Grow(ctx, 400); err != nil {
+		t.Fatal(err)
+	}
+	expect(&pool, 200)
+	expect(&m1, 300)
+	expect(&m2, 200)
+
+	acc2 := m2.MakeBoundAccount()
+	if err := acc2.Grow(ctx, 200); err != nil {
+		t.Fatal(err)
+	}
+	expect(&pool, 0)
+	expect(&m1, 100)
+	expect(&m2, 0)
+
+	// The estimate is good enough to plan with: an allocation of the
+	// estimated size succeeds.
+	acc1.Shrink(ctx, 250)
+	expect(&m2, 300)
+	if err := acc2.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	expect(&m2, 0)
+
+	// The headroom comes back when the pool empties.
+	acc2.Close(ctx)
+	acc1.Close(ctx)
+	expect(&m1, 1100)
+	expect(&m2, 500)
+
+	m2.Stop(ctx)
+	m1.Stop(ctx)
+	pool.Stop(ctx)
+
+	unlimited := MakeUnlimitedMonitor(ctx, "unlimited", MemoryResource, nil, nil, math.MaxInt64, st)
+	expect(&unlimited, math.MaxInt64)
+	unlimited.Stop(ctx)
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+)
+
+type heapProfileConfig struct {
+	fraction   float64
+	hysteresis float64
+	cooldown   time.Duration
+	capture    func(context.Context)
+}
+
+// WithHeapProfileHook makes the monitor call capture when its pressure (see
+// Pressure) crosses fraction, so that the caller can take a heap profile
+// while the usage is high, and compare the actual heap to the accounted
+// usage. capture is called once per crossing: the hook is only rearmed once
+// the pressure goes back below fraction-hysteresis. Besides, it is called at
+// most once every cooldown, measured with the TimeSource of the monitor; a
+// crossing during the cooldown fires the hook on the first allocation after
+// the cooldown, if the pressure is still above fraction by then.
+//
+// capture is called without the monitor being locked, but the monitor
+// asking for budget may be locked, so capture must not use the monitors.
+func WithHeapProfileHook(
+	fraction, hysteresis float64, cooldown time.Duration, capture func(context.Context),
+) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.heapProfile = heapProfileConfig{
+			fraction:   fraction,
+			hysteresis: hysteresis,
+			cooldown:   cooldown,
+			capture:    capture,
+		}
+	})
+}
+
+// shouldCaptureHeapProfileLocked returns whether the heap profile hook must
+// fire after an allocation. If so, the hook is disarmed, and it is up to the
+// caller to call it once the monitor is unlocked.
+func (mm *BytesMonitor) shouldCaptureHeapProfileLocked() bool {
+	if mm.heapProfile.capture == nil || mm.mu.heapProfileDisarmed ||
+		mm.localPressureLocked() < mm.heapProfile.fraction*softThresholdFactor() {
+		return false
+	}
+	now := mm.clock().Now()
+	if last := mm.mu.lastHeapProfile; !last.IsZero() && now.Sub(last) < mm.heapProfile.cooldown {
+		return false
+	}
+	mm.mu.heapProfileDisarmed = true
+	mm.mu.lastHeapProfile = now
+	return true
+}
+
+// maybeRearmHeapProfileLocked rearms the heap profile hook once the pressure
+// went back below the hysteresis band.
+func (mm *BytesMonitor) maybeRearmHeapProfileLocked() {
+	if !mm.mu.heapProfileDisarmed {
+		return
+	}
+	fraction := mm.heapProfile.fraction * softThresholdFactor()
+	if mm.localPressureLocked() < fraction-mm.heapProfile.hysteresis {
+		mm.mu.heapProfileDisarmed = false
+	}
+}
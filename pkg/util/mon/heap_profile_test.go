@@ -0,0 +1,86 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestHeapProfileHook(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	var captures int
+	m := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+		mon.WithHeapProfileHook(0.8, 0.1, time.Minute, func(context.Context) { captures++ }))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	grow := func(n int64) {
+		t.Helper()
+		if err := acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(expected int) {
+		t.Helper()
+		if captures != expected {
+			t.Fatalf("expected %d captures, got %d", expected, captures)
+		}
+	}
+
+	grow(700)
+	expect(0)
+	// Crossing 80% fires the hook, once.
+	grow(150)
+	expect(1)
+	grow(50)
+	expect(1)
+
+	// Going back down within the hysteresis band doesn't rearm the hook.
+	acc.Shrink(ctx, 150)
+	grow(100)
+	expect(1)
+
+	// Going below 70% rearms it, but the next crossing is within the
+	// cooldown.
+	acc.Shrink(ctx, 200)
+	grow(150)
+	expect(1)
+	clock.Advance(time.Minute)
+	grow(10)
+	expect(2)
+
+	// After the cooldown, a new crossing fires the hook right away.
+	acc.Shrink(ctx, 300)
+	clock.Advance(time.Minute)
+	grow(300)
+	expect(3)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// InternPool deduplicates strings whose memory is charged to a BoundAccount,
+// for workloads with highly repetitive strings, e.g. enum-like column values
+// or user names in audit events: each distinct string is copied and charged
+// once, whatever the number of its occurrences. The strings are released
+// all at once by Reset, e.g. at the end of each epoch of the workload.
+//
+// An InternPool is safe for concurrent use; the account it is configured
+// with must not be used by anything else concurrently.
+type InternPool struct {
+	mu struct {
+		syncutil.Mutex
+		acc *BoundAccount
+		// strings maps the interned strings to their canonical copy.
+		strings map[string]string
+		// size is the number of bytes charged for the interned strings.
+		size int64
+	}
+
+	// maxSize is the maximum number of bytes charged for the interned
+	// strings, or 0 for no maximum.
+	maxSize int64
+}
+
+// NewInternPool creates an InternPool charging acc, which charges at most
+// maxSize bytes for its strings if maxSize is positive.
+func NewInternPool(acc *BoundAccount, maxSize int64) *InternPool {
+	p := &InternPool{maxSize: maxSize}
+	p.mu.acc = acc
+	return p
+}
+
+// internedSize is the number of bytes charged for an interned string: its
+// contents, and the headers of the key and the value of its map entry.
+func internedSize(s string) int64 {
+	return StringSize(s) + SizeOfString
+}
+
+// Intern returns the canonical copy of s, which shares its memory with all
+// the strings equal to s interned since the last Reset. Once the maximum
+// size of the pool is reached, or if the account denies the allocation, s is
+// returned as is, and isn't charged to the account.
+func (p *InternPool) Intern(ctx context.Context, s string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.mu.strings[s]; ok {
+		return c
+	}
+	sz := internedSize(s)
+	if p.maxSize > 0 && p.mu.size+sz > p.maxSize {
+		return s
+	}
+	if err := p.mu.acc.Grow(ctx, sz); err != nil {
+		return s
+	}
+	if p.mu.strings == nil {
+		p.mu.strings = make(map[string]string)
+	}
+	// The copy keeps s from pinning a larger string it may be a substring
+	// of.
+	c := string([]byte(s))
+	p.mu.strings[c] = c
+	p.mu.size += sz
+	return c
+}
+
+// Len returns the number of strings interned since the last Reset.
+func (p *InternPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.mu.strings)
+}
+
+// Size returns the number of bytes charged for the strings interned since
+// the last Reset.
+func (p *InternPool) Size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mu.size
+}
+
+// Reset drops all the interned strings and releases their bytes from the
+// account. The strings already returned by Intern remain valid, but are no
+// longer accounted for.
+func (p *InternPool) Reset(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.size > 0 {
+		p.mu.acc.Shrink(ctx, p.mu.size)
+	}
+	p.mu.strings = nil
+	p.mu.size = 0
+}
+
+// Close releases the interned strings.
+func (p *InternPool) Close(ctx context.Context) {
+	p.Reset(ctx)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// stringData returns the address of the contents of s.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestInternPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+	acc := m.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	// Each distinct string is charged its contents and two string headers.
+	values := []string{"active", "suspended", "deleted"}
+	var unique int64
+	for _, v := range values {
+		unique += int64(len(v)) + 2*mon.SizeOfString
+	}
+
+	p := mon.NewInternPool(&acc, 0 /* maxSize */)
+	canonical := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		// Build a new string each time, as a decoder would.
+		s := string([]byte(values[i%len(values)]))
+		c := p.Intern(ctx, s)
+		if c != s {
+			t.Fatalf("expected %q, got %q", s, c)
+		}
+		if prev, ok := canonical[s]; ok && stringData(prev) != stringData(c) {
+			t.Fatalf("expected the canonical copy of %q to be returned", s)
+		}
+		canonical[s] = c
+	}
+	if n := p.Len(); n != len(values) {
+		t.Fatalf("expected %d strings, got %d", len(values), n)
+	}
+	if u := acc.Used(); u != unique || p.Size() != unique {
+		t.Fatalf("expected %d bytes charged, got %d (size %d)", unique, u, p.Size())
+	}
+
+	p.Reset(ctx)
+	if u := acc.Used(); u != 0 {
+		t.Fatalf("expected Reset to release all the bytes, got %d", u)
+	}
+	if n := p.Len(); n != 0 {
+		t.Fatalf("expected no strings after Reset, got %d", n)
+	}
+
+	// Past its maximum size, the pool passes the strings through.
+	p = mon.NewInternPool(&acc, unique)
+	for _, v := range values {
+		p.Intern(ctx, v)
+	}
+	s := "archived"
+	if c := p.Intern(ctx, s); stringData(c) != stringData(s) {
+		t.Fatal("expected the string to be passed through")
+	}
+	if n := p.Len(); n != len(values) {
+		t.Fatalf("expected %d strings, got %d", len(values), n)
+	}
+	if u := acc.Used(); u != unique {
+		t.Fatalf("expected %d bytes charged, got %d", unique, u)
+	}
+	p.Close(ctx)
+	if u := acc.Used(); u != 0 {
+		t.Fatalf("expected Close to release all the bytes, got %d", u)
+	}
+}
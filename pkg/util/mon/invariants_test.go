@@ -0,0 +1,120 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestMemoryAllocations(t *testing.T) {
+	maxs := []int64{1, 9, 10, 11, 99, 100, 101, 0}
+	hysteresisFactors := []int{1, 2, 10, 10000}
+	// Every run also picks a random cap on unused bytes, 0 meaning none.
+	maxUnusedBytes := []int64{0, 0, 1, 5, 15}
+	// Every run also gives every account a random quantum, 0 meaning none.
+	quanta := []int64{0, 0, 1, 7, 64}
+	// Every run also puts some accounts in page mode, with a random page
+	// size, 0 meaning byte mode.
+	pageSizes := []int64{0, 0, 0, 8, 32}
+	// Every run also picks a random overhead multiplier, 0 meaning none.
+	overheads := []float64{0, 0, 1.15, 1.5, 3}
+	poolAllocSizes := []int64{1, 2, 9, 10, 11, 100}
+	preBudgets := []int64{0, 1, 2, 9, 10, 11, 100}
+
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+
+	var pool mon.BytesMonitor
+	var m mon.BytesMonitor
+
+	accs := make([]mon.BoundAccount, 4)
+	accPtrs := make([]*mon.BoundAccount, len(accs))
+	for i := range accs {
+		accs[i] = m.MakeBoundAccount()
+		accPtrs[i] = &accs[i]
+	}
+
+	// The invariants are checked at every step of the test underneath.
+	checker := montest.NewInvariantChecker(t)
+	checker.AddMonitor("pool", &pool)
+	checker.AddMonitor("monitor", &m, accPtrs...)
+
+	const numAccountOps = 200
+	driver := montest.Driver{Checker: checker}
+	if log.V(2) {
+		// Detailed output: report every operation.
+		driver.Logf = t.Logf
+	}
+
+	for _, max := range maxs {
+		pool = mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, 1000, st)
+		pool.Start(ctx, nil, mon.MakeStandaloneBudget(max))
+
+		for _, hf := range hysteresisFactors {
+			for _, pb := range preBudgets {
+				mmax := pb + max
+
+				for _, pa := range poolAllocSizes {
+					if testing.Verbose() {
+						fmt.Printf("max %d, pb %d, as %d, hf %d\n", max, pb, pa, hf)
+					}
+
+					// We start with a fresh monitor for every set of
+					// parameters.
+					mu := maxUnusedBytes[rnd.Intn(len(maxUnusedBytes))]
+					om := overheads[rnd.Intn(len(overheads))]
+					m = mon.MakeMonitor("test", mon.MemoryResource, nil, nil, pa, 1000, st,
+						mon.WithHysteresis(hf), mon.WithMaxUnusedBytes(mu),
+						mon.WithOverheadMultiplier(om))
+					m.Start(ctx, &pool, mon.MakeStandaloneBudget(pb))
+					for i := range accs {
+						accs[i].SetQuantum(quanta[rnd.Intn(len(quanta))])
+						accs[i].SetPageSize(pageSizes[rnd.Intn(len(pageSizes))])
+					}
+
+					// At every iteration a random account is selected and
+					// then a random operation is performed for that account;
+					// parts of the pre-reserved budget are released along the
+					// way.
+					driver.Operations = append(montest.AccountOperations(accPtrs, mmax),
+						montest.ReleaseReservedOperation(&m))
+					driver.Run(ctx, rnd, numAccountOps)
+
+					// After all operations have been performed, ensure
+					// that closing everything comes back to the initial situation.
+					for accI := range accs {
+						accs[accI].Clear(ctx)
+						checker.Check()
+					}
+
+					m.Stop(ctx)
+					montest.AssertEmpty(t, &pool)
+				}
+			}
+		}
+		pool.Stop(ctx)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// DecodeJSON estimates the in-memory footprint of a JSON document decoded
+// into the generic representation used by encoding/json
+// (map[string]interface{}, []interface{}, string, float64, bool, nil) on a
+// 64-bit platform, using the sizes in sizes.go. The model is intentionally
+// simple:
+//
+// - every value occupies an interface slot (SizeOfInterface) in its parent
+//   object, array, or in the caller's target;
+// - strings additionally cost a boxed string (StringSize);
+// - numbers cost a boxed float64 (or a boxed json.Number string when the
+//   decoder uses UseNumber);
+// - booleans and nulls cost nothing beyond their interface slot;
+// - objects cost a map header plus, per entry, the key (StringSize) and the
+//   amortized per-entry overhead of the map's buckets;
+// - arrays cost a boxed slice header plus the slots of their elements; the
+//   spare capacity left by append is accounted for by jsonArraySpareCapacity.
+//
+// The estimates are checked against heap measurements in the tests and are
+// expected to be within a factor of two of the real footprint.
+const (
+	// jsonMapOverhead is the size of the internal structure of a map.
+	jsonMapOverhead = 48
+	// jsonMapEntryOverhead is the amortized overhead of a map entry in the
+	// map's buckets, beyond the key and value.
+	jsonMapEntryOverhead = 16
+	// jsonArraySpareCapacity is the amortized spare capacity per element of
+	// an array grown by append.
+	jsonArraySpareCapacity = 8
+	// jsonMaxNumberLen is the maximum length of a float64 marshaled by
+	// encoding/json.
+	jsonMaxNumberLen = 24
+)
+
+// DecodeJSON decodes the next JSON value from dec into the value pointed to
+// by into, charging acc for an estimate of the decoded structure as tokens
+// are consumed (see the constants above for the estimation model). If the
+// account denies an allocation, decoding stops and the budget error is
+// returned.
+//
+// On success the estimated bytes remain charged to acc; the caller is
+// responsible for shrinking the account (by the difference in acc.Used()
+// across the call) once the decoded value is dropped. On error, everything
+// charged by DecodeJSON is released before returning.
+//
+// The document is decoded token by token into the generic representation. If
+// into is not a *interface{}, the generic value is then converted into the
+// target type via an additional marshaling round-trip. An estimate of the
+// marshaled document is charged before marshaling it, and the buffer stays
+// charged until the conversion is done. Once converted, the charge for the
+// generic value is replaced by the size of the target (see typedSize).
+func DecodeJSON(
+	ctx context.Context, dec *json.Decoder, acc *BoundAccount, into interface{},
+) error {
+	d := jsonDecoder{ctx: ctx, dec: dec, acc: acc}
+	v, err := d.decodeValue()
+	if err == nil {
+		err = d.grow(SizeOfInterface)
+	}
+	if err == nil {
+		if p, ok := into.(*interface{}); ok {
+			*p = v
+		} else {
+			err = d.convert(v, into)
+		}
+	}
+	if err != nil {
+		if d.charged > 0 {
+			acc.Shrink(ctx, d.charged)
+		}
+		return err
+	}
+	return nil
+}
+
+// jsonDecoder holds the state of a single DecodeJSON call.
+type jsonDecoder struct {
+	ctx     context.Context
+	dec     *json.Decoder
+	acc     *BoundAccount
+	charged int64
+	// encoded is an estimate of the length of the decoded value once
+	// marshaled again.
+	encoded int64
+}
+
+func (d *jsonDecoder) grow(n int64) error {
+	if err := d.acc.Grow(d.ctx, n); err != nil {
+		return err
+	}
+	d.charged += n
+	return nil
+}
+
+func (d *jsonDecoder) shrink(n int64) {
+	d.acc.Shrink(d.ctx, n)
+	d.charged -= n
+}
+
+// resize adjusts the charge for part of the decoding from old to new bytes.
+func (d *jsonDecoder) resize(old, new int64) error {
+	if new > old {
+		return d.grow(new - old)
+	}
+	d.shrink(old - new)
+	return nil
+}
+
+// convert converts the generic value v into the value pointed to by into,
+// charging the marshaled form of v while it is alive, and then replaces the
+// charge for v by the size of the converted value.
+func (d *jsonDecoder) convert(v interface{}, into interface{}) error {
+	if err := d.grow(d.encoded); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// The buffer may have been grown beyond the estimate.
+	n := int64(cap(buf))
+	if err := d.resize(d.encoded, n); err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf, into)
+	d.shrink(n)
+	if err != nil {
+		return err
+	}
+	return d.resize(d.charged, typedSize(reflect.ValueOf(into).Elem()))
+}
+
+// decodeValue reads the next value from the token stream. The interface slot
+// that holds the value is charged by the caller.
+func (d *jsonDecoder) decodeValue() (interface{}, error) {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			return d.decodeObject()
+		case '[':
+			return d.decodeArray()
+		default:
+			return nil, errors.Errorf("unexpected delimiter %q", t)
+		}
+	case string:
+		d.encoded += jsonQuotedLen(t)
+		return t, d.grow(StringSize(t))
+	case json.Number:
+		d.encoded += int64(len(t))
+		return t, d.grow(StringSize(string(t)))
+	case float64:
+		d.encoded += jsonMaxNumberLen
+		return t, d.grow(SizeOfFloat64)
+	case bool:
+		if t {
+			d.encoded += int64(len("true"))
+		} else {
+			d.encoded += int64(len("false"))
+		}
+		return t, nil
+	default:
+		// nil.
+		d.encoded += int64(len("null"))
+		return t, nil
+	}
+}
+
+func (d *jsonDecoder) decodeObject() (interface{}, error) {
+	if err := d.grow(jsonMapOverhead); err != nil {
+		return nil, err
+	}
+	// The braces, and a colon and a comma per entry.
+	d.encoded += 2
+	m := make(map[string]interface{})
+	for d.dec.More() {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.Errorf("unexpected object key %v", tok)
+		}
+		if err := d.grow(jsonMapEntryOverhead + StringSize(key) + SizeOfInterface); err != nil {
+			return nil, err
+		}
+		d.encoded += jsonQuotedLen(key) + 2
+		v, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	// Consume the closing delimiter.
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *jsonDecoder) decodeArray() (interface{}, error) {
+	if err := d.grow(SizeOfSliceHeader); err != nil {
+		return nil, err
+	}
+	// The brackets, and a comma per element.
+	d.encoded += 2
+	a := []interface{}{}
+	for d.dec.More() {
+		if err := d.grow(SizeOfInterface + jsonArraySpareCapacity); err != nil {
+			return nil, err
+		}
+		d.encoded++
+		v, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	// Consume the closing delimiter.
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// jsonQuotedLen returns the length of s once quoted and escaped by
+// encoding/json, which escapes HTML characters by default. Invalid UTF-8 is
+// counted as escaped replacement characters, which is an upper bound across
+// Go versions.
+func jsonQuotedLen(s string) int64 {
+	n := int64(2)
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			switch {
+			case b == '"' || b == '\\' || b == '\n' || b == '\r' || b == '\t':
+				n += 2
+			case b < 0x20 || b == '<' || b == '>' || b == '&':
+				n += int64(len(`\u0000`))
+			default:
+				n++
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' || r == '\u2029' {
+			n += int64(len(`\ufffd`))
+		} else {
+			n += int64(size)
+		}
+		i += size
+	}
+	return n
+}
+
+// typedSize returns the number of bytes to account for v, a value decoded
+// into a typed target: its own size plus that of the values it references.
+func typedSize(v reflect.Value) int64 {
+	return int64(v.Type().Size()) + referencedSize(v)
+}
+
+// referencedSize returns the size of the values referenced by v, excluding
+// v itself. Maps are estimated like the objects of the generic
+// representation.
+func referencedSize(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return typedSize(v.Elem())
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		elemSize := int64(v.Type().Elem().Size())
+		sz := SliceSize(int64(v.Len()), int64(v.Cap()), elemSize) - SizeOfSliceHeader
+		for i := 0; i < v.Len(); i++ {
+			sz += referencedSize(v.Index(i))
+		}
+		return sz
+	case reflect.Array:
+		var sz int64
+		for i := 0; i < v.Len(); i++ {
+			sz += referencedSize(v.Index(i))
+		}
+		return sz
+	case reflect.Struct:
+		var sz int64
+		for i := 0; i < v.NumField(); i++ {
+			sz += referencedSize(v.Field(i))
+		}
+		return sz
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+		entrySize := int64(v.Type().Key().Size()+v.Type().Elem().Size()) + jsonMapEntryOverhead
+		sz := jsonMapOverhead + int64(v.Len())*entrySize
+		for _, k := range v.MapKeys() {
+			sz += referencedSize(k) + referencedSize(v.MapIndex(k))
+		}
+		return sz
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// makeNestedJSONDoc generates a document of n records, each of which
+// contains nested objects, arrays, strings, numbers, booleans and nulls.
+func makeNestedJSONDoc(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"records": [`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf,
+			`{"id": %d, "name": "record-%d-%s", "ok": true, "missing": null, `+
+				`"tags": ["a", "bb", "ccc"], "nested": {"x": %d.5, "y": [1, 2, {"z": "zz"}]}}`,
+			i, i, strings.Repeat("x", i%20), i)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+func TestDecodeJSON(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	doc := makeNestedJSONDoc(100)
+
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	acc := m.MakeBoundAccount()
+
+	var v interface{}
+	if err := DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &v); err != nil {
+		t.Fatal(err)
+	}
+	var expected interface{}
+	if err := json.Unmarshal(doc, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("decoded value differs from json.Unmarshal")
+	}
+	if acc.Used() <= int64(len(doc))/2 {
+		t.Fatalf("estimate %d implausibly small for a %d byte document", acc.Used(), len(doc))
+	}
+
+	// Decoding into a typed target only leaves the size of the target
+	// charged.
+	var typed struct {
+		Records []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"records"`
+	}
+	before := acc.Used()
+	if err := DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &typed); err != nil {
+		t.Fatal(err)
+	}
+	if len(typed.Records) != 100 || typed.Records[42].ID != 42 {
+		t.Fatalf("unexpected typed decoding: %+v", typed.Records)
+	}
+	targetSize := int64(reflect.TypeOf(typed).Size()) +
+		SliceSize(int64(len(typed.Records)), int64(cap(typed.Records)),
+			int64(reflect.TypeOf(typed.Records).Elem().Size())) - SizeOfSliceHeader
+	for _, r := range typed.Records {
+		targetSize += int64(len(r.Name))
+	}
+	if charged := acc.Used() - before; charged != targetSize {
+		t.Fatalf("expected %d bytes charged for the typed target, got %d", targetSize, charged)
+	}
+	if targetSize >= before {
+		t.Fatalf("expected the typed target (%d bytes) to be smaller than the generic value (%d bytes)",
+			targetSize, before)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestDecodeJSONDenied(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	doc := makeNestedJSONDoc(100)
+
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(int64(len(doc))/4))
+	acc := m.MakeBoundAccount()
+	// Pre-existing usage on the account must survive the failed decode.
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	var v interface{}
+	err := DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &v)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if v != nil {
+		t.Fatalf("expected no value on error, got %v", v)
+	}
+	if acc.Used() != 100 {
+		t.Fatalf("expected partial decode to be released, got %d bytes used", acc.Used())
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+
+	// The conversion into a typed target is denied if the budget only
+	// covers the generic representation, and not the marshaled document.
+	m = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	acc = m.MakeBoundAccount()
+	if err := DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &v); err != nil {
+		t.Fatal(err)
+	}
+	generic := acc.Used()
+	acc.Close(ctx)
+	m.Stop(ctx)
+
+	m = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(generic+100))
+	acc = m.MakeBoundAccount()
+	var typed struct {
+		Records []struct {
+			ID int `json:"id"`
+		} `json:"records"`
+	}
+	err = DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &typed)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if len(typed.Records) != 0 {
+		t.Fatalf("expected no value on error, got %+v", typed.Records)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected the decode to be released, got %d bytes used", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestJSONQuotedLen(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, s := range []string{
+		"", "abc", `"quoted" \ back`, "tab\tnew\nline\r", "\x00\x1f", "<a href=\"x\">&</a>",
+		"héllo wörld", "\u2028\u2029",
+	} {
+		buf, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := jsonQuotedLen(s); n != int64(len(buf)) {
+			t.Errorf("%q: expected %d, got %d", s, len(buf), n)
+		}
+	}
+}
+
+// TestDecodeJSONEstimate compares the estimate model against the heap
+// footprint actually retained by a decoded document.
+func TestDecodeJSONEstimate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	for _, n := range []int{1000, 5000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			doc := makeNestedJSONDoc(n)
+
+			m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+			m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+			acc := m.MakeBoundAccount()
+			var v interface{}
+			if err := DecodeJSON(ctx, json.NewDecoder(bytes.NewReader(doc)), &acc, &v); err != nil {
+				t.Fatal(err)
+			}
+			estimate := acc.Used()
+			acc.Close(ctx)
+			m.Stop(ctx)
+
+			var ms runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&ms)
+			start := ms.HeapAlloc
+			var measured interface{}
+			if err := json.Unmarshal(doc, &measured); err != nil {
+				t.Fatal(err)
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&ms)
+			actual := int64(ms.HeapAlloc) - int64(start)
+			runtime.KeepAlive(measured)
+
+			t.Logf("estimate %d, measured %d", estimate, actual)
+			if estimate < actual/2 || estimate > actual*2 {
+				t.Errorf("estimate %d not within 2x of measured size %d", estimate, actual)
+			}
+		})
+	}
+}
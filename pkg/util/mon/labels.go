@@ -0,0 +1,88 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"sort"
+	"strings"
+)
+
+// Label is a key/value pair attached to a monitor, e.g. to break down the
+// usage by tenant or application name.
+type Label struct {
+	Key, Value string
+}
+
+// WithLabels attaches labels to the monitor. The monitor also carries the
+// labels of its pool, as of when it is started, except for the keys it
+// overrides. Labels can't be changed once the monitor is built.
+//
+// The metrics of the monitor are not labeled, as the metric types don't
+// support labels.
+func WithLabels(labels ...Label) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.labels = mergeLabels(o.labels, labels)
+	})
+}
+
+// Labels returns the labels of the monitor, including the ones inherited
+// from its pool, ordered by key.
+func (mm *BytesMonitor) Labels() []Label {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]Label(nil), mm.mu.labels...)
+}
+
+// mergeLabels returns the union of base and overrides, ordered by key, with
+// the values of overrides taking precedence. The arguments are not modified.
+func mergeLabels(base, overrides []Label) []Label {
+	if len(overrides) == 0 {
+		return base
+	}
+	merged := make([]Label, 0, len(base)+len(overrides))
+	for _, l := range base {
+		if _, ok := findLabel(overrides, l.Key); !ok {
+			merged = append(merged, l)
+		}
+	}
+	for _, l := range overrides {
+		if i, ok := findLabel(merged, l.Key); ok {
+			// The last of duplicate overrides wins.
+			merged[i] = l
+			continue
+		}
+		merged = append(merged, l)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+	return merged
+}
+
+func findLabel(labels []Label, key string) (int, bool) {
+	for i := range labels {
+		if labels[i].Key == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// formatLabels formats labels as "k1=v1,k2=v2".
+func formatLabels(labels []Label) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.Key + "=" + l.Value
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestMonitorLabels(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	root := MakeMonitor("root", MemoryResource, nil, nil, 1, 1000, st,
+		WithLabels(Label{"tenant", "1"}, Label{"region", "us"}))
+	root.Start(ctx, nil, MakeStandaloneBudget(1000))
+	sql := MakeMonitor("sql", MemoryResource, nil, nil, 1, 1000, st)
+	sql.Start(ctx, &root, MakeStandaloneBudget(0))
+	session := MakeMonitor("session", MemoryResource, nil, nil, 1, 1000, st,
+		WithLabels(Label{"app", "psql"}, Label{"tenant", "2"}))
+	session.Start(ctx, &sql, MakeStandaloneBudget(0))
+	txn := MakeMonitorInheritWithLimit("txn", 100, &session)
+	txn.Start(ctx, &session, MakeStandaloneBudget(0))
+	unlabeled := MakeMonitor("unlabeled", MemoryResource, nil, nil, 1, 1000, st)
+	unlabeled.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	testCases := []struct {
+		m        *BytesMonitor
+		expected []Label
+	}{
+		{&root, []Label{{"region", "us"}, {"tenant", "1"}}},
+		{&sql, []Label{{"region", "us"}, {"tenant", "1"}}},
+		{&session, []Label{{"app", "psql"}, {"region", "us"}, {"tenant", "2"}}},
+		{&txn, []Label{{"app", "psql"}, {"region", "us"}, {"tenant", "2"}}},
+		{&unlabeled, nil},
+	}
+	for _, tc := range testCases {
+		if labels := tc.m.Snapshot().Labels; !reflect.DeepEqual(labels, tc.expected) {
+			t.Errorf("%s: expected labels %v, got %v", tc.m.name, tc.expected, labels)
+		}
+		if labels := tc.m.Labels(); !reflect.DeepEqual(labels, tc.expected) {
+			t.Errorf("%s: expected labels %v, got %v", tc.m.name, tc.expected, labels)
+		}
+	}
+	if s := session.DebugString(); !strings.HasPrefix(s, "session [app=psql,region=us,tenant=2]: ") {
+		t.Errorf("expected the labels in the debug string, got %q", s)
+	}
+	if s := unlabeled.DebugString(); !strings.HasPrefix(s, "unlabeled: ") {
+		t.Errorf("expected no labels in the debug string, got %q", s)
+	}
+
+	// The labels returned are copies.
+	session.Labels()[0].Value = "foo"
+	if v := session.Labels()[0].Value; v != "psql" {
+		t.Errorf("expected the labels to be immutable, got %q", v)
+	}
+
+	unlabeled.Stop(ctx)
+	txn.Stop(ctx)
+	session.Stop(ctx)
+	sql.Stop(ctx)
+	root.Stop(ctx)
+}
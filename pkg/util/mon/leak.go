@@ -0,0 +1,130 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/build"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// LeakReaction determines what Stop does when it finds bytes still
+// allocated through the monitor. In all cases where the process survives,
+// the bytes are then released, so that the pool is left consistent.
+type LeakReaction int
+
+const (
+	// LeakPanic panics, except in release builds where the leak is logged
+	// and reported (see log.ReportOrPanic). This is the default.
+	LeakPanic LeakReaction = iota
+	// LeakLogAndRelease logs the leak and counts the leaked bytes in the
+	// counter set with WithLeakedBytesCounter, if any.
+	LeakLogAndRelease
+	// LeakCrashWithDump logs the state of the monitor and the operations
+	// recorded on its accounts, if it has a Recorder, and then crashes the
+	// process.
+	LeakCrashWithDump
+)
+
+// WithLeakReaction sets the reaction of the monitor to bytes leaked when it
+// is stopped.
+func WithLeakReaction(r LeakReaction) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.leakReaction = r
+	})
+}
+
+// WithLeakedBytesCounter sets a counter incremented by the number of bytes
+// leaked when the monitor is stopped with the LeakLogAndRelease reaction.
+func WithLeakedBytesCounter(c Counter) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.leakedBytesCount = counterOrNil(c)
+	})
+}
+
+// maxLeakedAccountsReported is the number of accounts listed by the report
+// of a leak.
+const maxLeakedAccountsReported = 10
+
+// leakedAccountsSummary describes the accounts that are still open when mm
+// is stopped with bytes allocated, for the report of the leak: their number,
+// and if mm has an account registry (see WithAccountRegistry), the names,
+// usage and creation stacks of the largest ones.
+func (mm *BytesMonitor) leakedAccountsSummary() string {
+	if mm.mu.openAccounts == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, ", %d accounts open", mm.mu.openAccounts)
+	infos := mm.OpenAccounts()
+	if len(infos) == 0 {
+		return buf.String()
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Used > infos[j].Used })
+	buf.WriteString(":")
+	for i, info := range infos {
+		if i == maxLeakedAccountsReported {
+			fmt.Fprintf(&buf, "\n  ... and %d more", len(infos)-i)
+			break
+		}
+		name := info.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		fmt.Fprintf(&buf, "\n  %s: %d bytes, opened at:\n%s",
+			name, info.Used, bytes.TrimRight(info.Stack, "\n"))
+	}
+	return buf.String()
+}
+
+// reactToLeak carries out the leak reaction of the monitor, which is being
+// stopped with bytes still allocated.
+func (mm *BytesMonitor) reactToLeak(ctx context.Context) {
+	// NB: mm.mu need not be locked here, as this is only called from doStop().
+	msg := fmt.Sprintf("%s: unexpected %d leftover bytes", mm.name, mm.mu.curAllocated)
+	msg += mm.leakedAccountsSummary()
+	if mm.mu.startStack != nil {
+		msg = fmt.Sprintf("%s, started at:\n%s", msg, mm.mu.startStack)
+	}
+	switch mm.leakReaction {
+	case LeakLogAndRelease:
+		mm.log().Warningf(ctx, "%s, releasing them", msg)
+		if mm.leakedBytesCount != nil {
+			mm.leakedBytesCount.Inc(mm.mu.curAllocated)
+		}
+	case LeakCrashWithDump:
+		mm.log().Errorf(ctx, "%s\n%s", msg, mm.DebugString())
+		if r := mm.testingRecorder; r != nil {
+			mm.log().Errorf(ctx, "%s: recorded operations:\n%s", mm.name, r.String())
+		}
+		mm.log().Fatalf(ctx, "%s", msg)
+	default:
+		mm.reportOrPanic(ctx, msg)
+	}
+}
+
+// reportOrPanic is log.ReportOrPanic, logging through the Logger of the
+// monitor.
+func (mm *BytesMonitor) reportOrPanic(ctx context.Context, msg string) {
+	if !build.IsRelease() || log.PanicOnAssertions.Get(&mm.settings.SV) {
+		panic(msg)
+	}
+	mm.log().Warningf(ctx, "%s", msg)
+	log.SendCrashReport(ctx, &mm.settings.SV, 1 /* depth */, "%s", []interface{}{msg})
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+func TestLeakReaction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	t.Run("log-and-release", func(t *testing.T) {
+		leaked := metric.NewCounter(metric.Metadata{Name: "test.leaked"})
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+			WithReservationPolicy(ReleaseEagerly), WithLeakReaction(LeakLogAndRelease), WithLeakedBytesCounter(leaked))
+		m.Start(ctx, &pool, MakeStandaloneBudget(0))
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 123); err != nil {
+			t.Fatal(err)
+		}
+		m.Stop(ctx)
+		if c := leaked.Count(); c != 123 {
+			t.Errorf("expected 123 leaked bytes counted, got %d", c)
+		}
+		if used := pool.AllocBytes(); used != 0 {
+			t.Fatalf("expected the pool to get its budget back, got\n%s", pool.DebugString())
+		}
+
+		// The pool is usable to its full capacity.
+		other := pool.MakeBoundAccount()
+		if err := other.Grow(ctx, 1000); err != nil {
+			t.Fatal(err)
+		}
+		other.Close(ctx)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 10, 1000, st)
+		m.Start(ctx, &pool, MakeStandaloneBudget(0))
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			m.Stop(ctx)
+		}()
+		m.EmergencyStop(ctx)
+		if used := pool.AllocBytes(); used != 0 {
+			t.Fatalf("expected the pool to get its budget back, got\n%s", pool.DebugString())
+		}
+	})
+
+	pool.Stop(ctx)
+}
+
+func TestLeakedAccountsReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	// stop stops m, and returns the report of its leak. Other messages, e.g.
+	// about metamorphic parameters, are ignored.
+	stop := func(t *testing.T, m *BytesMonitor, l *capturingLogger) string {
+		t.Helper()
+		m.mu.Lock()
+		startStack := m.mu.startStack
+		m.mu.Unlock()
+		m.Stop(ctx)
+		var reports []string
+		for _, msg := range l.take() {
+			if strings.HasPrefix(msg, "W ") && strings.Contains(msg, "leftover bytes") {
+				reports = append(reports, msg)
+			}
+		}
+		if len(reports) != 1 {
+			t.Fatalf("expected one leak report, got %q", reports)
+		}
+		msg := strings.TrimPrefix(reports[0], "W ")
+		if startStack != nil {
+			msg = strings.Replace(msg, fmt.Sprintf(", started at:\n%s", startStack), "", 1)
+		}
+		return strings.TrimSuffix(msg, ", releasing them")
+	}
+
+	t.Run("counter", func(t *testing.T) {
+		l := &capturingLogger{}
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+			WithLeakReaction(LeakLogAndRelease), WithLogger(l))
+		m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+		for i := 0; i < 2; i++ {
+			acc, err := m.OpenAccount()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := acc.Grow(ctx, 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Accounts made by value are not counted.
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+		const expected = "test: unexpected 300 leftover bytes, 2 accounts open"
+		if msg := stop(t, &m, l); msg != expected {
+			t.Fatalf("expected %q, got %q", expected, msg)
+		}
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		l := &capturingLogger{}
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+			WithLeakReaction(LeakLogAndRelease), WithLogger(l), WithAccountRegistry())
+		m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+		accs := make([]BoundAccount, 12)
+		for i := range accs {
+			if err := m.OpenAccountAt(&accs[i], WithAccountName(fmt.Sprintf("acc%d", i))); err != nil {
+				t.Fatal(err)
+			}
+			if err := accs[i].Grow(ctx, int64(10*(i+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := stop(t, &m, l)
+
+		const header = "test: unexpected 780 leftover bytes, 12 accounts open:"
+		if !strings.HasPrefix(msg, header) {
+			t.Fatalf("expected %q, got %q", header, msg)
+		}
+		// The ten largest accounts are listed, largest first, with their
+		// stacks.
+		var listed []string
+		for _, line := range strings.Split(msg, "\n") {
+			if strings.HasPrefix(line, "  ") {
+				listed = append(listed, strings.TrimSpace(line))
+			}
+		}
+		var expected []string
+		for i := 11; i >= 2; i-- {
+			expected = append(expected, fmt.Sprintf("acc%d: %d bytes, opened at:", i, 10*(i+1)))
+		}
+		expected = append(expected, "... and 2 more")
+		if !reflect.DeepEqual(listed, expected) {
+			t.Fatalf("expected the accounts\n%s\ngot\n%s",
+				strings.Join(expected, "\n"), strings.Join(listed, "\n"))
+		}
+		if n := strings.Count(msg, "TestLeakedAccountsReport"); n != 10 {
+			t.Fatalf("expected the stacks of the ten accounts, got %d in:\n%s", n, msg)
+		}
+	})
+}
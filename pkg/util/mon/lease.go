@@ -0,0 +1,208 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// ErrLeaseExpired is returned by the operations of a Lease that expired.
+var ErrLeaseExpired = errors.New("budget lease expired")
+
+// WithExpiredLeaseCounter sets a counter incremented every time a lease of
+// the monitor is released because it expired.
+func WithExpiredLeaseCounter(c Counter) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.expiredLeaseCount = counterOrNil(c)
+	})
+}
+
+// Lease holds a chunk of budget of a monitor for a limited time, e.g. for
+// the duration of a phase of a job. The bytes are allocated from the monitor
+// when the lease is taken, and the holder charges its usage against them
+// with Grow and Shrink. The lease must be renewed with Extend before it
+// expires, and returned with Release; otherwise, it is released by the next
+// call to ExpireLeases after it expired, so that the budget is returned even
+// if the cleanup of the holder is buggy.
+//
+// Expiry is measured with the TimeSource of the monitor. A Lease is safe for
+// concurrent use.
+type Lease struct {
+	mon  *BytesMonitor
+	size int64
+
+	mu struct {
+		syncutil.Mutex
+		acc     BoundAccount
+		used    int64
+		expiry  time.Time
+		expired bool
+		// released is set once the lease is released, explicitly or
+		// because it expired.
+		released bool
+	}
+}
+
+// Lease allocates n bytes from the monitor and returns a lease holding them
+// for d.
+func (mm *BytesMonitor) Lease(ctx context.Context, n int64, d time.Duration) (*Lease, error) {
+	acc, err := mm.MakeBoundAccountFor(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lease{mon: mm, size: n}
+	l.mu.acc = acc
+	l.mu.expiry = mm.clock().Now().Add(d)
+
+	mm.leases.Lock()
+	defer mm.leases.Unlock()
+	if mm.leases.set == nil {
+		mm.leases.set = make(map[*Lease]struct{})
+	}
+	mm.leases.set[l] = struct{}{}
+	return l, nil
+}
+
+// Size returns the number of bytes held by the lease.
+func (l *Lease) Size() int64 {
+	return l.size
+}
+
+// Used returns the number of bytes of the lease charged by Grow.
+func (l *Lease) Used() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mu.used
+}
+
+// Grow charges x bytes to the lease. An error is returned if the lease
+// doesn't have x bytes left, or if it expired or was released.
+func (l *Lease) Grow(ctx context.Context, x int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkLocked(); err != nil {
+		return err
+	}
+	if l.mu.used+x > l.size {
+		return errors.Wrapf(l.mon.resource.NewBudgetExceededError(x, l.mu.used, l.size),
+			"%s: lease", l.mon.name)
+	}
+	l.mu.used += x
+	return nil
+}
+
+// Shrink releases x bytes previously charged with Grow. Releasing more bytes
+// than were charged is reported (see log.ReportOrPanic), and then releases
+// all of them.
+func (l *Lease) Shrink(ctx context.Context, x int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mu.used < x {
+		l.mon.reportOrPanic(ctx, fmt.Sprintf("%s: no bytes in lease to release, current %d, free %d",
+			l.mon.name, l.mu.used, x))
+		x = l.mu.used
+	}
+	l.mu.used -= x
+}
+
+// Extend renews the lease until d from now. An error is returned if the
+// lease already expired or was released.
+func (l *Lease) Extend(d time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkLocked(); err != nil {
+		return err
+	}
+	l.mu.expiry = l.mon.clock().Now().Add(d)
+	return nil
+}
+
+// Release returns the bytes of the lease to the monitor. It is a no-op if
+// the lease was already released or expired.
+func (l *Lease) Release(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(ctx)
+}
+
+// checkLocked returns an error if the lease can't be used any more.
+func (l *Lease) checkLocked() error {
+	if l.mu.expired {
+		return errors.Wrapf(ErrLeaseExpired, "%s", l.mon.name)
+	}
+	if l.mu.released {
+		return errors.Errorf("%s: budget lease released", l.mon.name)
+	}
+	return nil
+}
+
+func (l *Lease) releaseLocked(ctx context.Context) {
+	if l.mu.released {
+		return
+	}
+	l.mu.released = true
+	l.mu.acc.Close(ctx)
+	l.mon.leases.Lock()
+	delete(l.mon.leases.set, l)
+	l.mon.leases.Unlock()
+}
+
+// ExpireLeases releases the leases of the monitor and its descendants that
+// expired, and returns their number. It is meant to be called periodically,
+// e.g. by a server-wide maintenance loop, on a root monitor.
+func (mm *BytesMonitor) ExpireLeases(ctx context.Context) int {
+	mm.leases.Lock()
+	leases := make([]*Lease, 0, len(mm.leases.set))
+	for l := range mm.leases.set {
+		leases = append(leases, l)
+	}
+	mm.leases.Unlock()
+
+	now := mm.clock().Now()
+	var expired int
+	for _, l := range leases {
+		if l.expireIfDue(ctx, now) {
+			expired++
+		}
+	}
+	for _, c := range mm.childrenSnapshot() {
+		expired += c.ExpireLeases(ctx)
+	}
+	return expired
+}
+
+// expireIfDue releases the lease if it expired as of now, and returns
+// whether it did.
+func (l *Lease) expireIfDue(ctx context.Context, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mu.released || now.Before(l.mu.expiry) {
+		return false
+	}
+	l.mon.log().Warningf(ctx, "%s: budget lease of %d bytes (%d used) expired at %s, releasing it",
+		l.mon.name, l.size, l.mu.used, l.mu.expiry)
+	l.mu.expired = true
+	l.releaseLocked(ctx)
+	if c := l.mon.expiredLeaseCount; c != nil {
+		c.Inc(1)
+	}
+	return true
+}
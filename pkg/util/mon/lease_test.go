@@ -0,0 +1,134 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestLease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	expiredLeases := metric.NewCounter(metric.Metadata{Name: "test.expired_leases"})
+	root := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	m := mon.MakeMonitor("job", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+		mon.WithHysteresis(0), mon.WithExpiredLeaseCounter(expiredLeases))
+	m.Start(ctx, &root, mon.MakeStandaloneBudget(0))
+
+	// The budget is held for the lease.
+	if _, err := m.Lease(ctx, 2000, time.Minute); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	expiring, err := m.Lease(ctx, 400, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extended, err := m.Lease(ctx, 300, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := m.Lease(ctx, 200, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	montest.AssertUsed(t, &root, 900)
+
+	// The usage is charged against the lease.
+	if err := expiring.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := expiring.Grow(ctx, 200); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	// Explicit release.
+	released.Release(ctx)
+	released.Release(ctx)
+	if err := released.Grow(ctx, 1); err == nil {
+		t.Fatal("expected an error growing a released lease")
+	}
+	montest.AssertUsed(t, &root, 700)
+
+	// Extension.
+	clock.Advance(50 * time.Second)
+	if err := extended.Extend(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := root.ExpireLeases(ctx); n != 0 {
+		t.Fatalf("expected no lease to expire, got %d", n)
+	}
+
+	// Expiry.
+	clock.Advance(10 * time.Second)
+	if n := root.ExpireLeases(ctx); n != 1 {
+		t.Fatalf("expected 1 lease to expire, got %d", n)
+	}
+	if err := expiring.Grow(ctx, 1); errors.Cause(err) != mon.ErrLeaseExpired {
+		t.Fatalf("expected expired lease error, got %v", err)
+	}
+	if err := expiring.Extend(time.Minute); errors.Cause(err) != mon.ErrLeaseExpired {
+		t.Fatalf("expected expired lease error, got %v", err)
+	}
+	if c := expiredLeases.Count(); c != 1 {
+		t.Fatalf("expected 1 expired lease counted, got %d", c)
+	}
+	montest.AssertUsed(t, &root, 300)
+	if err := extended.Grow(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing more than was charged is reported.
+	extended.Shrink(ctx, 100)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected the over-release to be reported")
+			}
+		}()
+		extended.Shrink(ctx, 300)
+	}()
+	if u := extended.Used(); u != 200 {
+		t.Fatalf("expected 200 bytes used, got %d", u)
+	}
+
+	clock.Advance(time.Minute)
+	if n := root.ExpireLeases(ctx); n != 1 {
+		t.Fatalf("expected 1 lease to expire, got %d", n)
+	}
+	// Releasing an expired lease is a no-op.
+	extended.Release(ctx)
+	montest.AssertEmpty(t, &root)
+
+	m.Stop(ctx)
+	root.Stop(ctx)
+}
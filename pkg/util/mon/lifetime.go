@@ -0,0 +1,67 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"time"
+)
+
+// WithLifetimeHistograms makes the monitor record, when it is stopped, how
+// long it ran in lifetime, in nanoseconds, and the maximum number of bytes
+// allocated through it in peak. Unlike the max histogram passed to the
+// constructors, which records the logarithm of the peak for the UI, peak
+// records the number of bytes. Either histogram can be nil. The lifetime is
+// measured with the TimeSource of the monitor.
+func WithLifetimeHistograms(lifetime, peak BytesHistogram) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.lifetimeHist = histogramOrNil(lifetime)
+		o.peakHist = histogramOrNil(peak)
+	})
+}
+
+// MonitorStats summarizes the usage of a monitor over a monitoring region.
+type MonitorStats struct {
+	// Lifetime is the time elapsed between Start and Stop.
+	Lifetime time.Duration
+	// MaxAllocated is the maximum number of bytes allocated through the
+	// monitor at one time.
+	MaxAllocated int64
+	// Categories is the usage of the categories of allocations of the
+	// monitor (see WithCategories).
+	Categories []CategoryUsage
+	// ReleasedToPool and PoolRoundTrips are the churn of the monitor (see
+	// WithChurnCounters). They include the return of the whole budget by
+	// Stop.
+	ReleasedToPool int64
+	PoolRoundTrips int64
+}
+
+// StopAndGetStats is like Stop, but also returns the stats of the
+// monitoring region that ends.
+func (mm *BytesMonitor) StopAndGetStats(ctx context.Context) MonitorStats {
+	return mm.doStop(ctx, true)
+}
+
+// recordLifetime records the stats of a stopped monitor in its lifetime
+// histograms.
+func (mm *BytesMonitor) recordLifetime(stats MonitorStats) {
+	if mm.lifetimeHist != nil {
+		mm.lifetimeHist.RecordValue(stats.Lifetime.Nanoseconds())
+	}
+	if mm.peakHist != nil {
+		mm.peakHist.RecordValue(stats.MaxAllocated)
+	}
+}
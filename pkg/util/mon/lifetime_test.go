@@ -0,0 +1,82 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestLifetimeHistograms(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	lifetime := metric.NewLatency(metric.Metadata{Name: "lifetime"}, time.Minute)
+	peak := metric.NewHistogram(metric.Metadata{Name: "peak"}, time.Minute, 1e9, 1)
+
+	// Run several short-lived monitors, as for transactions.
+	for i := int64(1); i <= 5; i++ {
+		m := mon.MakeMonitor("txn", mon.MemoryResource, nil, nil, 1, 1e9, st,
+			mon.WithTimeSource(clock), mon.WithLifetimeHistograms(lifetime, peak))
+		m.Start(ctx, nil, mon.MakeStandaloneBudget(1e6))
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 100*i); err != nil {
+			t.Fatal(err)
+		}
+		acc.Shrink(ctx, 50)
+		clock.Advance(time.Duration(i) * time.Second)
+		acc.Close(ctx)
+
+		stats := m.StopAndGetStats(ctx)
+		if stats.Lifetime != time.Duration(i)*time.Second || stats.MaxAllocated != 100*i {
+			t.Errorf("%d: unexpected stats %+v", i, stats)
+		}
+		if n := lifetime.TotalCount(); n != i {
+			t.Errorf("%d: expected %d lifetimes recorded, got %d", i, i, n)
+		}
+		if n := peak.TotalCount(); n != i {
+			t.Errorf("%d: expected %d peaks recorded, got %d", i, i, n)
+		}
+		// Stopping again is a no-op, which returns the same stats.
+		if again := m.StopAndGetStats(ctx); again.Lifetime != stats.Lifetime ||
+			again.MaxAllocated != stats.MaxAllocated {
+			t.Errorf("%d: expected the stats of the first stop, got %+v", i, again)
+		}
+		if n := lifetime.TotalCount(); n != i {
+			t.Errorf("%d: expected the lifetime to be recorded once, got %d recordings", i, n)
+		}
+	}
+
+	// The histograms are not inherited, and monitors without them work as
+	// before.
+	m := mon.MakeMonitor("txn", mon.MemoryResource, nil, nil, 1, 1e9, st,
+		mon.WithLifetimeHistograms(lifetime, peak))
+	child := mon.MakeMonitorInheritWithLimit("child", 100, &m)
+	child.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	child.Stop(ctx)
+	if n := lifetime.TotalCount(); n != 5 {
+		t.Errorf("expected no lifetime to be recorded, got %d recordings", n)
+	}
+}
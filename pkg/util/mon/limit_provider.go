@@ -0,0 +1,81 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"math"
+	"time"
+)
+
+// limitRefreshInterval is the maximum time for which a monitor uses the
+// limit returned by its limit provider before consulting it again.
+const limitRefreshInterval = time.Second
+
+// WithLimitProvider makes the limit of the monitor track the value returned
+// by fn, e.g. a session setting, instead of the limit it was created with.
+// fn is consulted lazily by the operations that need the limit, at most once
+// per second unless InvalidateLimit is called, so it must be cheap and must
+// not use the monitor. A value of 0 or less means no limit.
+//
+// Lowering the limit below the current usage doesn't affect the existing
+// allocations: only the allocations made while the usage is above the new
+// limit are denied.
+func WithLimitProvider(fn func() int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.limitProvider = fn
+	})
+}
+
+// SetLimit changes the limit of the monitor. A limit of 0 or less means no
+// limit. Like with a limit provider, lowering the limit below the current
+// usage only denies new allocations. The limit provider of the monitor, if
+// any, takes precedence the next time it is consulted.
+func (mm *BytesMonitor) SetLimit(limit int64) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.limit = normalizeLimit(limit)
+	mm.publishHeadroomLocked()
+}
+
+// InvalidateLimit makes the monitor consult its limit provider the next
+// time it needs its limit, e.g. when the setting the provider reads from
+// changes.
+func (mm *BytesMonitor) InvalidateLimit() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.limitFetched = time.Time{}
+}
+
+// refreshLimitLocked consults the limit provider of the monitor, if any and
+// if the cached limit is stale.
+func (mm *BytesMonitor) refreshLimitLocked() {
+	if mm.limitProvider == nil {
+		return
+	}
+	now := mm.clock().Now()
+	if !mm.mu.limitFetched.IsZero() && now.Sub(mm.mu.limitFetched) < limitRefreshInterval {
+		return
+	}
+	mm.limit = normalizeLimit(mm.limitProvider())
+	mm.mu.limitFetched = now
+	mm.publishHeadroomLocked()
+}
+
+func normalizeLimit(limit int64) int64 {
+	if limit <= 0 {
+		return math.MaxInt64
+	}
+	return limit
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestLimitProvider(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+
+	// setting stands for a session setting changed by the user.
+	setting := int64(1000)
+	var calls int32
+	provider := func() int64 {
+		atomic.AddInt32(&calls, 1)
+		return atomic.LoadInt64(&setting)
+	}
+	m := mon.MakeMonitor("session", mon.MemoryResource, nil, nil, 1, 1e9, st,
+		mon.WithTimeSource(clock), mon.WithLimitProvider(provider),
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1e6))
+	acc := m.MakeBoundAccount()
+
+	grow := func(n int64, ok bool) {
+		t.Helper()
+		err := acc.Grow(ctx, n)
+		if ok && err != nil {
+			t.Fatal(err)
+		}
+		if !ok && !mon.IsBudgetExceededError(err) {
+			t.Fatalf("expected budget error, got %v", err)
+		}
+	}
+
+	grow(1000, true)
+	grow(1, false)
+
+	// Raising the setting takes effect once the cached limit is stale.
+	atomic.StoreInt64(&setting, 2000)
+	grow(1, false)
+	clock.Advance(time.Second)
+	grow(1000, true)
+	grow(1, false)
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("expected the provider to be consulted twice, got %d", c)
+	}
+
+	// Lowering the setting below the current usage only denies new grows,
+	// and the existing allocations can still be released. InvalidateLimit
+	// makes the change effective right away.
+	atomic.StoreInt64(&setting, 500)
+	m.InvalidateLimit()
+	grow(1, false)
+	montest.AssertUsed(t, &m, 2000)
+	acc.Shrink(ctx, 1000)
+	grow(1, false)
+	montest.AssertUsed(t, &m, 1000)
+	acc.Shrink(ctx, 600)
+	grow(100, true)
+	grow(1, false)
+	montest.AssertAccountUsed(t, &acc, 500)
+
+	// A value of 0 removes the limit.
+	atomic.StoreInt64(&setting, 0)
+	m.InvalidateLimit()
+	grow(1e5, true)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestSetLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitorWithLimit("test", mon.MemoryResource, 100, nil, nil, 1, 1e9, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	m.SetLimit(50)
+	if err := acc.Grow(ctx, 1); !mon.IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	m.SetLimit(0)
+	if err := acc.Grow(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
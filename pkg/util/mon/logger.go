@@ -0,0 +1,81 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// Logger is the sink of the log messages of the package. Monitors never call
+// util/log directly, so that tests can capture their messages and noisy
+// monitors can be redirected (see WithLogger). The only exception is the
+// crash report of LeakPanic in release builds, which goes to telemetry
+// rather than to a log.
+type Logger interface {
+	// V returns whether messages of the given verbosity are logged.
+	V(level int32) bool
+	Infof(ctx context.Context, format string, args ...interface{})
+	Warningf(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	// Fatalf logs a message and terminates the process.
+	Fatalf(ctx context.Context, format string, args ...interface{})
+}
+
+// DefaultLogger is the Logger of monitors that don't specify one, and of
+// the other facilities of the package. It logs through util/log.
+var DefaultLogger Logger = utilLogger{}
+
+type utilLogger struct{}
+
+func (utilLogger) V(level int32) bool {
+	return log.VDepth(level, 2)
+}
+
+func (utilLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	log.InfofDepth(ctx, 1, format, args...)
+}
+
+func (utilLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	log.WarningfDepth(ctx, 1, format, args...)
+}
+
+func (utilLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	log.ErrorfDepth(ctx, 1, format, args...)
+}
+
+func (utilLogger) Fatalf(ctx context.Context, format string, args ...interface{}) {
+	log.FatalfDepth(ctx, 1, format, args...)
+}
+
+// WithLogger sets the Logger of the monitor. It defaults to DefaultLogger.
+func WithLogger(l Logger) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.logger = l
+	})
+}
+
+// log returns the Logger of the monitor.
+func (mm *BytesMonitor) log() Logger {
+	return loggerOrDefault(mm.logger)
+}
+
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return DefaultLogger
+	}
+	return l
+}
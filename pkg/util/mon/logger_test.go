@@ -0,0 +1,199 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// capturingLogger records the messages logged through it, and their
+// arguments.
+type capturingLogger struct {
+	verbosity int32
+
+	mu struct {
+		syncutil.Mutex
+		msgs []string
+		args [][]interface{}
+	}
+}
+
+func (l *capturingLogger) V(level int32) bool {
+	return level <= l.verbosity
+}
+
+func (l *capturingLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.record("I "+fmt.Sprintf(format, args...), args)
+}
+
+func (l *capturingLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	l.record("W "+fmt.Sprintf(format, args...), args)
+}
+
+func (l *capturingLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.record("E "+fmt.Sprintf(format, args...), args)
+}
+
+// Fatalf records the message and panics instead of terminating the process.
+func (l *capturingLogger) Fatalf(ctx context.Context, format string, args ...interface{}) {
+	msg := "F " + fmt.Sprintf(format, args...)
+	l.record(msg, args)
+	panic(msg)
+}
+
+func (l *capturingLogger) record(msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.msgs = append(l.mu.msgs, msg)
+	l.mu.args = append(l.mu.args, args)
+}
+
+// take returns the messages logged since the last call to take or
+// takeArgs.
+func (l *capturingLogger) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	msgs := l.mu.msgs
+	l.mu.msgs, l.mu.args = nil, nil
+	return msgs
+}
+
+// takeArgs is like take, but returns the arguments of the messages.
+func (l *capturingLogger) takeArgs() [][]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	args := l.mu.args
+	l.mu.msgs, l.mu.args = nil, nil
+	return args
+}
+
+func TestLogger(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	l := &capturingLogger{}
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000 /* noteworthy */, st,
+		WithLogger(l), WithLeakReaction(LeakLogAndRelease))
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	acc := m.MakeBoundAccount()
+
+	// expect checks the messages containing substr logged since the last
+	// call, ignoring the others.
+	expect := func(substr string, expected ...string) {
+		t.Helper()
+		var msgs []string
+		for _, msg := range l.take() {
+			if strings.Contains(msg, substr) {
+				msgs = append(msgs, msg)
+			}
+		}
+		if !reflect.DeepEqual(msgs, expected) {
+			t.Fatalf("expected %q, got %q", expected, msgs)
+		}
+	}
+	const increases = "bytes usage increases"
+
+	// Only the usage above the noteworthy threshold is logged, when it
+	// doubles.
+	for _, n := range []int64{600, 600, 200, 700, 1000} {
+		if err := acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(increases,
+		"I test: bytes usage increases to "+humanizeutil.IBytes(1200)+" (+600)",
+		"I test: bytes usage increases to "+humanizeutil.IBytes(2100)+" (+700)",
+	)
+	if err := acc.GrowWithContext(ctx, 1000, "sorting"); err != nil {
+		t.Fatal(err)
+	}
+	expect(increases, "I test: bytes usage increases to "+humanizeutil.IBytes(4100)+" (+1000) while sorting")
+
+	// Nothing is logged below the verbosity of the logger.
+	const released = "I test: now at"
+	acc.Shrink(ctx, 100)
+	expect(released)
+	l.verbosity = 2
+	acc.Shrink(ctx, 100)
+	var msgs []string
+	for _, msg := range l.take() {
+		if strings.HasPrefix(msg, released) {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected a message at verbosity 2, got %q", msgs)
+	}
+	l.verbosity = 0
+
+	// The bytes leaked when the monitor stops are reported to the logger.
+	leftover := m.AllocBytes()
+	expected := fmt.Sprintf("W test: unexpected %d leftover bytes", leftover)
+	m.mu.Lock()
+	if m.mu.startStack != nil {
+		expected = fmt.Sprintf("%s, started at:\n%s", expected, m.mu.startStack)
+	}
+	m.mu.Unlock()
+	m.Stop(ctx)
+	expect("leftover bytes", expected+", releasing them")
+}
+
+// TestLoggerLeakCrash checks that the dump of LeakCrashWithDump, and the
+// crash that follows it, go through the logger.
+func TestLoggerLeakCrash(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	l := &capturingLogger{}
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+		WithLogger(l), WithLeakReaction(LeakCrashWithDump))
+	m.Start(ctx, nil, MakeStandaloneBudget(math.MaxInt64))
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected the logger to be asked to crash")
+			}
+		}()
+		m.reactToLeak(ctx)
+	}()
+	msgs := l.take()
+	if len(msgs) != 2 ||
+		!strings.HasPrefix(msgs[0], "E test: unexpected 100 leftover bytes") ||
+		!strings.HasPrefix(msgs[1], "F test: unexpected 100 leftover bytes") {
+		t.Fatalf("expected the dump and the crash to be logged, got %q", msgs)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// metamorphicParams, when set, makes the monitor constructors pick the
+// allocation block size, hysteresis and reservation policy of every monitor
+// at random, to shake out bugs that hide behind the defaults. Parameters set
+// explicitly by the caller are kept. The choices derive from a seed that can
+// be set with COCKROACH_MON_METAMORPHIC_SEED to reproduce a run; it is
+// reported by TestingVerifyAllStopped when a test fails, and logged with the
+// choices when a monitor starts, at verbosity 1.
+var metamorphicParams = envutil.EnvOrDefaultBool("COCKROACH_MON_METAMORPHIC_TESTING", false)
+
+var metamorphic struct {
+	syncutil.Mutex
+	seed int64
+	rnd  *rand.Rand
+}
+
+func init() {
+	if !metamorphicParams {
+		return
+	}
+	metamorphic.seed = envutil.EnvOrDefaultInt64("COCKROACH_MON_METAMORPHIC_SEED", randutil.NewPseudoSeed())
+	metamorphic.rnd = rand.New(rand.NewSource(metamorphic.seed))
+}
+
+var (
+	metamorphicAllocationSizes = []int64{1, 2, 9, 10, 11, 100, 1024}
+	metamorphicHysteresis      = []int{1, 2, 10, 10000}
+)
+
+// randomize overrides the tuning parameters that weren't set explicitly if
+// metamorphic testing is enabled.
+func (o *monitorOptions) randomize() {
+	if !metamorphicParams {
+		return
+	}
+	metamorphic.Lock()
+	defer metamorphic.Unlock()
+	rnd := metamorphic.rnd
+	if !o.poolAllocationSizeSet {
+		o.poolAllocationSize = metamorphicAllocationSizes[rnd.Intn(len(metamorphicAllocationSizes))]
+	}
+	if !o.hysteresisSet {
+		o.maxAllocatedButUnusedBlocks = metamorphicHysteresis[rnd.Intn(len(metamorphicHysteresis))]
+	}
+	if !o.reservationPolicySet {
+		o.reservationPolicy = ReservationPolicy(rnd.Intn(2))
+	}
+	o.metamorphic = true
+}
+
+// logMetamorphicParams logs the parameters of a monitor being started, if
+// they were randomized.
+func (mm *BytesMonitor) logMetamorphicParams(ctx context.Context) {
+	if !mm.metamorphic || !mm.log().V(1) {
+		return
+	}
+	mm.log().Infof(ctx, "%s: metamorphic monitor parameters (COCKROACH_MON_METAMORPHIC_SEED=%d): "+
+		"increment %d, hysteresis %d, policy %d", mm.name, metamorphic.seed,
+		mm.poolAllocationSize, mm.maxAllocatedButUnusedBlocks, mm.reservationPolicy)
+}
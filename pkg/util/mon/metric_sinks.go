@@ -0,0 +1,88 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "reflect"
+
+// BytesGauge is the sink of the current usage of a monitor. *metric.Gauge
+// implements it; other implementations let the package be used with
+// alternate metric sinks.
+type BytesGauge interface {
+	Inc(int64)
+	Dec(int64)
+}
+
+// BytesHistogram is the sink of the usage statistics of a monitor recorded
+// as a distribution, e.g. its maximum usage. *metric.Histogram implements
+// it.
+type BytesHistogram interface {
+	RecordValue(int64)
+}
+
+// LatencyHistogram is the sink of durations recorded as a distribution, in
+// nanoseconds, e.g. the time spent waiting for budget. A *metric.Histogram
+// created with metric.NewLatency implements it.
+type LatencyHistogram interface {
+	RecordValue(nanos int64)
+}
+
+// Counter is the sink of the counts kept by a monitor, e.g. of its denials
+// or of the bytes it leaked. *metric.Counter implements it.
+type Counter interface {
+	Inc(int64)
+}
+
+// gaugeOrNil returns nil if g is nil or a nil pointer, e.g. a nil
+// *metric.Gauge, so that callers passing a nil metric of a concrete type
+// keep disabling the metric.
+func gaugeOrNil(g BytesGauge) BytesGauge {
+	if isNilSink(g) {
+		return nil
+	}
+	return g
+}
+
+// histogramOrNil is like gaugeOrNil, for histograms.
+func histogramOrNil(h BytesHistogram) BytesHistogram {
+	if isNilSink(h) {
+		return nil
+	}
+	return h
+}
+
+// latencyHistogramOrNil is like gaugeOrNil, for latency histograms.
+func latencyHistogramOrNil(h LatencyHistogram) LatencyHistogram {
+	if isNilSink(h) {
+		return nil
+	}
+	return h
+}
+
+// counterOrNil is like gaugeOrNil, for counters.
+func counterOrNil(c Counter) Counter {
+	if isNilSink(c) {
+		return nil
+	}
+	return c
+}
+
+// isNilSink returns whether the metric sink s is nil or a nil pointer.
+func isNilSink(s interface{}) bool {
+	if s == nil {
+		return true
+	}
+	v := reflect.ValueOf(s)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
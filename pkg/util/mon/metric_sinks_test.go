@@ -0,0 +1,124 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+var _ BytesGauge = (*metric.Gauge)(nil)
+var _ BytesHistogram = (*metric.Histogram)(nil)
+var _ Counter = (*metric.Counter)(nil)
+
+// fakeGauge and fakeHistogram record the updates they receive.
+type fakeGauge struct{ ops []string }
+
+func (g *fakeGauge) Inc(v int64) { g.ops = append(g.ops, fmt.Sprintf("inc %d", v)) }
+func (g *fakeGauge) Dec(v int64) { g.ops = append(g.ops, fmt.Sprintf("dec %d", v)) }
+
+type fakeHistogram struct{ values []int64 }
+
+func (h *fakeHistogram) RecordValue(v int64) { h.values = append(h.values, v) }
+
+func TestMetricSinks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	t.Run("updates", func(t *testing.T) {
+		var g fakeGauge
+		var h fakeHistogram
+		// The account keeps a block of its reservation when it shrinks.
+		m := MakeMonitor("test", MemoryResource, &g, &h, 10, math.MaxInt64, st,
+			WithReservationPolicy(RetainQuantum))
+		m.Start(ctx, nil, MakeStandaloneBudget(1000))
+		acc := m.MakeBoundAccount()
+
+		// The gauge follows the reservations of the accounts from the
+		// monitor, not their usage.
+		if err := acc.Grow(ctx, 15); err != nil {
+			t.Fatal(err)
+		}
+		if err := acc.Grow(ctx, 5); err != nil {
+			t.Fatal(err)
+		}
+		acc.Shrink(ctx, 20)
+		acc.Close(ctx)
+		if expected := []string{"inc 20", "dec 10", "dec 10"}; !reflect.DeepEqual(g.ops, expected) {
+			t.Fatalf("expected gauge updates %v, got %v", expected, g.ops)
+		}
+
+		// The histogram is only updated when the monitor stops, with the
+		// logarithm of the maximum usage.
+		if len(h.values) != 0 {
+			t.Fatalf("expected no histogram update before Stop, got %v", h.values)
+		}
+		m.Stop(ctx)
+		if expected := []int64{1301}; !reflect.DeepEqual(h.values, expected) {
+			t.Fatalf("expected histogram values %v, got %v", expected, h.values)
+		}
+	})
+
+	t.Run("deferred", func(t *testing.T) {
+		var g fakeGauge
+		m := MakeMonitor("test", MemoryResource, &g, nil, 1, math.MaxInt64, st,
+			WithReservationPolicy(ReleaseEagerly), WithDeferredMetrics(100))
+		m.Start(ctx, nil, MakeStandaloneBudget(1000))
+		acc := m.MakeBoundAccount()
+		for i := 0; i < 3; i++ {
+			if err := acc.Grow(ctx, 40); err != nil {
+				t.Fatal(err)
+			}
+		}
+		acc.Shrink(ctx, 50)
+		m.FlushMetrics()
+		acc.Close(ctx)
+		m.Stop(ctx)
+		if expected := []string{"inc 120", "dec 50", "dec 70"}; !reflect.DeepEqual(g.ops, expected) {
+			t.Fatalf("expected gauge updates %v, got %v", expected, g.ops)
+		}
+	})
+
+	t.Run("nil metrics", func(t *testing.T) {
+		// Nil metrics of the concrete types disable the metrics, as before
+		// the interfaces.
+		var g *metric.Gauge
+		var h *metric.Histogram
+		var c *metric.Counter
+		m := MakeMonitor("test", MemoryResource, g, h, 1, math.MaxInt64, st,
+			WithLifetimeHistograms(h, h), WithChurnCounters(c, c),
+			WithDenialCounters(DenialCounters{ReservedExhausted: c}))
+		m.Start(ctx, nil, MakeStandaloneBudget(1000))
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := acc.Grow(ctx, 1000); err == nil {
+			t.Fatal("expected grow to be denied")
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// AssertEmpty fails the test if any bytes are allocated through m.
+func AssertEmpty(t testing.TB, m *mon.BytesMonitor) {
+	t.Helper()
+	if used := m.AllocBytes(); used != 0 {
+		t.Fatalf("expected monitor to be empty, got %d bytes allocated\n%s", used, m.DebugString())
+	}
+}
+
+// AssertUsed fails the test if the number of bytes allocated through m is
+// not n.
+func AssertUsed(t testing.TB, m *mon.BytesMonitor, n int64) {
+	t.Helper()
+	if used := m.AllocBytes(); used != n {
+		t.Fatalf("expected %d bytes allocated, got %d\n%s", n, used, m.DebugString())
+	}
+}
+
+// AssertAccountUsed fails the test if the number of bytes used by acc is not
+// n.
+func AssertAccountUsed(t testing.TB, acc *mon.BoundAccount, n int64) {
+	t.Helper()
+	if used := acc.Used(); used != n {
+		desc := "standalone budget"
+		if m := acc.Monitor(); m != nil {
+			desc = m.DebugString()
+		}
+		t.Fatalf("expected %d bytes used by the account, got %d\n%s", n, used, desc)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// fatalRecorder records the failures reported through it instead of
+// failing the test.
+type fatalRecorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *fatalRecorder) Helper() {}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestAssertions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("assert", mon.MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+
+	var r fatalRecorder
+	AssertEmpty(&r, &m)
+	AssertUsed(&r, &m, 0)
+	AssertAccountUsed(&r, &acc, 0)
+	if len(r.failures) != 0 {
+		t.Fatalf("unexpected failures: %q", r.failures)
+	}
+
+	if err := acc.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	AssertUsed(&r, &m, 10)
+	AssertAccountUsed(&r, &acc, 10)
+	if len(r.failures) != 0 {
+		t.Fatalf("unexpected failures: %q", r.failures)
+	}
+
+	AssertEmpty(&r, &m)
+	AssertUsed(&r, &m, 5)
+	AssertAccountUsed(&r, &acc, 5)
+	if len(r.failures) != 3 {
+		t.Fatalf("expected 3 failures, got %q", r.failures)
+	}
+	for _, f := range r.failures {
+		// The failures describe the monitor.
+		if !strings.Contains(f, "assert: 10 bytes allocated") {
+			t.Errorf("expected the monitor state in %q", f)
+		}
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
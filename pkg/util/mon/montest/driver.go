@@ -0,0 +1,157 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// Operation is an operation performed by a Driver.
+type Operation interface {
+	// Run performs the operation with parameters drawn from rnd and returns a
+	// description of what it did.
+	Run(ctx context.Context, rnd *rand.Rand) string
+}
+
+// OperationFunc adapts a function to the Operation interface.
+type OperationFunc func(ctx context.Context, rnd *rand.Rand) string
+
+// Run implements the Operation interface.
+func (f OperationFunc) Run(ctx context.Context, rnd *rand.Rand) string {
+	return f(ctx, rnd)
+}
+
+// Driver performs random operations and checks the invariants after each of
+// them. Callers plug in their own operations (transferring bytes between
+// accounts, splitting accounts, spilling to disk...) alongside the basic
+// account operations from AccountOperations.
+type Driver struct {
+	Checker    *InvariantChecker
+	Operations []Operation
+	// Logf, if set, is called with the description of every operation.
+	Logf func(format string, args ...interface{})
+}
+
+// Run performs numOps operations chosen uniformly at random.
+func (d *Driver) Run(ctx context.Context, rnd *rand.Rand, numOps int) {
+	d.Checker.t.Helper()
+	d.Checker.Check()
+	for i := 0; i < numOps; i++ {
+		op := d.Operations[rnd.Intn(len(d.Operations))]
+		desc := op.Run(ctx, rnd)
+		if d.Logf != nil {
+			d.Logf("%s", desc)
+		}
+		d.Checker.Check()
+	}
+}
+
+// RandomSize generates a size greater or equal to zero, with a random
+// distribution that is skewed towards zero and ensures that most
+// generated values are smaller than `mag`.
+func RandomSize(rnd *rand.Rand, mag int64) int64 {
+	return int64(rnd.ExpFloat64() * float64(mag) * 0.3679)
+}
+
+// AccountOperations returns operations that grow, clear, resize and merge
+// random accounts among accounts, with sizes generated by
+// RandomSize(rnd, maxSize).
+// Budget errors are expected and reported in the descriptions. Some resizes
+// use an invalid old size, and panic if Resize doesn't reject it.
+func AccountOperations(accounts []*mon.BoundAccount, maxSize int64) []Operation {
+	result := func(err error) string {
+		if err != nil {
+			return err.Error()
+		}
+		return "ok"
+	}
+	return []Operation{
+		OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+			accI := rnd.Intn(len(accounts))
+			sz := RandomSize(rnd, maxSize)
+			err := accounts[accI].Grow(ctx, sz)
+			return fmt.Sprintf("G [%5d] %5d: %s", accI, sz, result(err))
+		}),
+		OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+			accI := rnd.Intn(len(accounts))
+			accounts[accI].Clear(ctx)
+			return fmt.Sprintf("C [%5d]", accI)
+		}),
+		OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+			accI := rnd.Intn(len(accounts))
+			nsz := RandomSize(rnd, maxSize)
+			if rnd.Intn(8) == 0 {
+				osz := accounts[accI].Used() + 1 + RandomSize(rnd, maxSize)
+				if rnd.Intn(2) == 0 {
+					osz = -1 - RandomSize(rnd, maxSize)
+				}
+				if err := resizeInvalid(ctx, accounts[accI], osz, nsz); err == nil {
+					panic(fmt.Sprintf("resize of an item of %d bytes in an account of %d bytes accepted",
+						osz, accounts[accI].Used()))
+				}
+				return fmt.Sprintf("R [%5d] %5d %5d: rejected", accI, osz, nsz)
+			}
+			osz := rnd.Int63n(accounts[accI].Used() + 1)
+			err := accounts[accI].Resize(ctx, osz, nsz)
+			return fmt.Sprintf("R [%5d] %5d %5d: %s", accI, osz, nsz, result(err))
+		}),
+		OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+			if len(accounts) < 2 {
+				return "M: no account to merge into"
+			}
+			srcI := rnd.Intn(len(accounts))
+			dstI := (srcI + 1 + rnd.Intn(len(accounts)-1)) % len(accounts)
+			src := accounts[srcI]
+			m := src.Monitor()
+			err := src.MergeInto(ctx, accounts[dstI])
+			if err == nil {
+				// Replace the merged account with a fresh one.
+				*src = m.MakeBoundAccount()
+			}
+			return fmt.Sprintf("M [%5d] [%5d]: %s", srcI, dstI, result(err))
+		}),
+	}
+}
+
+// ReleaseReservedOperation returns an operation that releases a random part
+// of the pre-reserved budget of m. Refusals from the pool are expected and
+// reported in the description.
+func ReleaseReservedOperation(m *mon.BytesMonitor) Operation {
+	return OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+		sz := rnd.Int63n(m.Snapshot().Reserved + 1)
+		if err := m.ReleaseReserved(ctx, sz); err != nil {
+			return fmt.Sprintf("RR %5d: %s", sz, err)
+		}
+		return fmt.Sprintf("RR %5d: ok", sz)
+	})
+}
+
+// resizeInvalid resizes an item with an invalid old size in acc, and
+// returns the error of Resize, or its panic in race builds.
+func resizeInvalid(ctx context.Context, acc *mon.BoundAccount, oldSz, newSz int64) (err error) {
+	if util.RaceEnabled {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(error)
+			}
+		}()
+	}
+	return acc.Resize(ctx, oldSz, newSz)
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build gofuzz
+
+package montest
+
+// Fuzz is the go-fuzz entry point exploring sequences of accounting
+// operations; see RunSequence for the input format. Invariant violations
+// and panics are crashes. The seed corpus is in testdata/corpus:
+//
+//   go-fuzz-build github.com/cockroachdb/cockroach/pkg/util/mon/montest
+//   mkdir -p workdir && cp -r testdata/corpus workdir/
+//   go-fuzz -bin=montest-fuzz.zip -workdir=workdir
+func Fuzz(data []byte) int {
+	ops, err := RunSequence(data)
+	if err != nil {
+		panic(err)
+	}
+	if ops == 0 {
+		return 0
+	}
+	return 1
+}
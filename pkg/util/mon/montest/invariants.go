@@ -0,0 +1,142 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package montest provides utilities to test code that performs accounting
+// through the mon package: an invariant checker for monitors and accounts,
+// and a driver performing random operations against them.
+package montest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// InvariantChecker verifies that a set of monitors and their accounts are
+// consistent with each other:
+// - no account, monitor, budget or reserved budget goes negative;
+// - a monitor's allocation is the sum of the allocations of its accounts,
+//   including the slack they reserve (see mon.BoundAccount.SetQuantum), and
+//   of the budgets of its child monitors;
+// - a monitor's allocation doesn't exceed the budget it obtained from its
+//   pool plus its pre-reserved budget;
+// - a monitor with a cap on unused budget (see mon.WithMaxUnusedBytes)
+//   doesn't keep more unused budget from its pool than the cap.
+//
+// The second invariant only holds if all the accounts of a registered
+// monitor are registered along with it, and all the monitors using it as a
+// pool are registered too. Accounts passed as the pre-reserved budget of a
+// child monitor count as accounts of the monitor they were made from.
+type InvariantChecker struct {
+	t        testing.TB
+	monitors []*monitorEntry
+}
+
+type monitorEntry struct {
+	name     string
+	mon      *mon.BytesMonitor
+	accounts []*mon.BoundAccount
+}
+
+// NewInvariantChecker creates an InvariantChecker reporting violations to t.
+// t may be nil if only Violations is used.
+func NewInvariantChecker(t testing.TB) *InvariantChecker {
+	return &InvariantChecker{t: t}
+}
+
+// AddMonitor registers a monitor and its accounts with the checker. It can
+// be called several times for the same monitor to register more accounts.
+// The name is used in reports. The monitor and accounts are referenced by
+// pointer, so they can be reinitialized in place between checks.
+func (c *InvariantChecker) AddMonitor(
+	name string, m *mon.BytesMonitor, accounts ...*mon.BoundAccount,
+) {
+	for _, e := range c.monitors {
+		if e.mon == m {
+			e.accounts = append(e.accounts, accounts...)
+			return
+		}
+	}
+	c.monitors = append(c.monitors, &monitorEntry{name: name, mon: m, accounts: accounts})
+}
+
+// Violations returns a description of every invariant that doesn't hold.
+func (c *InvariantChecker) Violations() []string {
+	var violations []string
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	states := make(map[*mon.BytesMonitor]mon.MonitorSnapshot, len(c.monitors))
+	for _, e := range c.monitors {
+		states[e.mon] = e.mon.Snapshot()
+	}
+	for _, e := range c.monitors {
+		st := states[e.mon]
+		var sum int64
+		for i, acc := range e.accounts {
+			if acc.Used() < 0 {
+				fail("%s: account %d went negative: %d", e.name, i, acc.Used())
+			}
+			sum += acc.Allocated()
+		}
+		for _, child := range c.monitors {
+			if childSt := states[child.mon]; childSt.Pool == e.mon {
+				sum += childSt.PoolBudget
+			}
+		}
+		if st.Allocated < 0 {
+			fail("%s: monitor current count went negative: %d", e.name, st.Allocated)
+		}
+		if sum != st.Allocated {
+			fail("%s: total account sum %d different from monitor count %d",
+				e.name, sum, st.Allocated)
+		}
+		if st.PoolBudgetUsed < 0 {
+			fail("%s: monitor current budget went negative: %d", e.name, st.PoolBudgetUsed)
+		}
+		if st.Reserved < 0 {
+			fail("%s: monitor reserved budget went negative: %d", e.name, st.Reserved)
+		}
+		if avail := st.PoolBudget + st.Reserved; st.Allocated > avail {
+			fail("%s: monitor count %d greater than total monitor budget %d",
+				e.name, st.Allocated, avail)
+		}
+		if st.MaxUnusedBytes > 0 {
+			needed := st.Allocated + st.EmergencyReserve - st.Reserved
+			if needed < 0 {
+				needed = 0
+			}
+			if unused := st.PoolBudgetUsed - needed; unused > st.MaxUnusedBytes {
+				fail("%s: monitor keeps %d bytes of unused budget, more than its cap of %d",
+					e.name, unused, st.MaxUnusedBytes)
+			}
+		}
+	}
+	return violations
+}
+
+// Check fails the test if any invariant doesn't hold.
+func (c *InvariantChecker) Check() {
+	c.t.Helper()
+	violations := c.Violations()
+	if len(violations) == 0 {
+		return
+	}
+	for _, v := range violations {
+		c.t.Error(v)
+	}
+	c.t.Fatal("invariants not preserved")
+}
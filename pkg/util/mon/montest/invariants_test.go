@@ -0,0 +1,130 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestInvariantChecker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	m := mon.MakeMonitor("monitor", mon.MemoryResource, nil, nil, 10, 1000, st)
+	m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+	a1 := m.MakeBoundAccount()
+	a2 := m.MakeBoundAccount()
+
+	c := NewInvariantChecker(t)
+	c.AddMonitor("pool", &pool)
+	c.AddMonitor("monitor", &m, &a1)
+
+	if err := a1.Grow(ctx, 15); err != nil {
+		t.Fatal(err)
+	}
+	AssertAccountUsed(t, &a1, 15)
+	c.Check()
+
+	// An account that the checker doesn't know about breaks the sums.
+	if err := a2.Grow(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	violations := c.Violations()
+	if len(violations) != 1 || !strings.Contains(violations[0], "monitor: total account sum") {
+		t.Fatalf("expected a sum violation on the monitor, got %q", violations)
+	}
+	c.AddMonitor("monitor", &m, &a2)
+	c.Check()
+
+	a1.Clear(ctx)
+	a2.Clear(ctx)
+	c.Check()
+	AssertEmpty(t, &m)
+	m.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestDriver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+
+	for _, overhead := range []float64{0, 1.15} {
+		t.Run(fmt.Sprintf("overhead=%g", overhead), func(t *testing.T) {
+			testDriver(t, rnd, overhead)
+		})
+	}
+}
+
+func testDriver(t *testing.T, rnd *rand.Rand, overhead float64) {
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("monitor", mon.MemoryResource, nil, nil, 1, 1000, st,
+		mon.WithOverheadMultiplier(overhead))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	accs := []*mon.BoundAccount{new(mon.BoundAccount), new(mon.BoundAccount)}
+	for _, acc := range accs {
+		*acc = m.MakeBoundAccount()
+	}
+
+	c := NewInvariantChecker(t)
+	c.AddMonitor("monitor", &m, accs...)
+
+	// A custom operation moving bytes from one account to the other.
+	var transfers int
+	transfer := OperationFunc(func(ctx context.Context, rnd *rand.Rand) string {
+		from, to := accs[0], accs[1]
+		if rnd.Intn(2) == 0 {
+			from, to = to, from
+		}
+		sz := rnd.Int63n(from.Used() + 1)
+		if err := to.Grow(ctx, sz); err != nil {
+			return fmt.Sprintf("T %d: %s", sz, err)
+		}
+		from.Shrink(ctx, sz)
+		transfers++
+		return fmt.Sprintf("T %d: ok", sz)
+	})
+
+	d := Driver{
+		Checker:    c,
+		Operations: append(AccountOperations(accs, 100), transfer),
+	}
+	d.Run(ctx, rnd, 1000)
+	if transfers == 0 {
+		t.Fatal("expected the custom operation to be performed")
+	}
+
+	for _, acc := range accs {
+		acc.Close(ctx)
+	}
+	AssertEmpty(t, &m)
+	m.Stop(ctx)
+}
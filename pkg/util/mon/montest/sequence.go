@@ -0,0 +1,142 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+const (
+	// sequenceHeaderLen is the number of bytes describing the monitor tree.
+	sequenceHeaderLen = 5
+	// sequenceOpLen is the number of bytes describing one operation.
+	sequenceOpLen = 4
+	// sequenceAccountsPerMonitor is the number of accounts on each child
+	// monitor.
+	sequenceAccountsPerMonitor = 3
+)
+
+// RunSequence decodes data into a tree of monitors and accounts and a
+// sequence of operations on the accounts, performs them, and checks the
+// invariants after every step. It returns the number of operations performed
+// and an error describing the first violation, if any. Panics raised by the
+// monitors are not recovered.
+//
+// The tree consists of a pool and two child monitors with three accounts
+// each. The first byte of data is the budget of the pool; the next two pairs
+// of bytes are the pool allocation size (plus one) and pre-reserved budget of
+// the children. Every following group of four bytes is an operation: an
+// opcode, an account index and a big-endian 16-bit size, where 0xffff stands
+// for math.MaxInt64. The opcodes, modulo 6, are:
+// - 0: grow the account by the size;
+// - 1: shrink the account by the size, modulo its usage plus one;
+// - 2: resize the whole usage of the account to the size;
+// - 3: clear the account;
+// - 4: close the account and replace it with a new one;
+// - 5: transfer the size, modulo the usage plus one, to the next account.
+func RunSequence(data []byte) (int, error) {
+	if len(data) < sequenceHeaderLen {
+		return 0, nil
+	}
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(int64(data[0])))
+	children := make([]mon.BytesMonitor, 2)
+	accs := make([]*mon.BoundAccount, len(children)*sequenceAccountsPerMonitor)
+	checker := NewInvariantChecker(nil)
+	checker.AddMonitor("pool", &pool)
+	for i := range children {
+		name := fmt.Sprintf("child%d", i)
+		allocSize := int64(data[1+2*i]) + 1
+		children[i] = mon.MakeMonitor(name, mon.MemoryResource, nil, nil, allocSize, math.MaxInt64, st)
+		children[i].Start(ctx, &pool, mon.MakeStandaloneBudget(int64(data[2+2*i])))
+		for j := 0; j < sequenceAccountsPerMonitor; j++ {
+			acc := children[i].MakeBoundAccount()
+			accs[i*sequenceAccountsPerMonitor+j] = &acc
+		}
+		checker.AddMonitor(name, &children[i], accs[i*sequenceAccountsPerMonitor:(i+1)*sequenceAccountsPerMonitor]...)
+	}
+
+	check := func(desc string) error {
+		if violations := checker.Violations(); len(violations) > 0 {
+			return fmt.Errorf("after %s:\n%s", desc, strings.Join(violations, "\n"))
+		}
+		return nil
+	}
+
+	ops := 0
+	for data = data[sequenceHeaderLen:]; len(data) >= sequenceOpLen; data = data[sequenceOpLen:] {
+		accI := int(data[1]) % len(accs)
+		acc := accs[accI]
+		sz := int64(data[2])<<8 | int64(data[3])
+		if sz == 0xffff {
+			sz = math.MaxInt64
+		}
+		var desc string
+		switch data[0] % 6 {
+		case 0:
+			desc = fmt.Sprintf("grow %d by %d", accI, sz)
+			_ = acc.Grow(ctx, sz)
+		case 1:
+			sz %= acc.Used() + 1
+			desc = fmt.Sprintf("shrink %d by %d", accI, sz)
+			acc.Shrink(ctx, sz)
+		case 2:
+			desc = fmt.Sprintf("resize %d from %d to %d", accI, acc.Used(), sz)
+			_ = acc.Resize(ctx, acc.Used(), sz)
+		case 3:
+			desc = fmt.Sprintf("clear %d", accI)
+			acc.Clear(ctx)
+		case 4:
+			desc = fmt.Sprintf("close %d", accI)
+			acc.Close(ctx)
+			*acc = acc.Monitor().MakeBoundAccount()
+		case 5:
+			dstI := (accI + 1) % len(accs)
+			sz %= acc.Used() + 1
+			desc = fmt.Sprintf("transfer %d from %d to %d", sz, accI, dstI)
+			if err := accs[dstI].Grow(ctx, sz); err == nil {
+				acc.Shrink(ctx, sz)
+			}
+		}
+		ops++
+		if err := check(desc); err != nil {
+			return ops, err
+		}
+	}
+
+	for _, acc := range accs {
+		acc.Clear(ctx)
+	}
+	if err := check("clearing all accounts"); err != nil {
+		return ops, err
+	}
+	for i := range children {
+		children[i].Stop(ctx)
+	}
+	if cur := pool.Snapshot().Allocated; cur != 0 {
+		return ops, fmt.Errorf("pool not empty after stopping its children: %d", cur)
+	}
+	pool.Stop(ctx)
+	return ops, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+// TestSequenceCorpus runs the fuzzing seed corpus, and random inputs, through
+// RunSequence.
+func TestSequenceCorpus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no seed corpus found")
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops, err := RunSequence(data)
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		if ops == 0 {
+			t.Fatalf("%s: expected operations to be performed", f)
+		}
+	}
+
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+	for i := 0; i < 200; i++ {
+		data := randutil.RandBytes(rnd, sequenceHeaderLen+sequenceOpLen*rnd.Intn(100))
+		if _, err := RunSequence(data); err != nil {
+			t.Fatalf("%x: %v", data, err)
+		}
+	}
+}
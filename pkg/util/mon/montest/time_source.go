@@ -0,0 +1,114 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// ManualTimeSource is a mon.TimeSource whose time only moves when told to.
+// Timers fire when the time is advanced past their deadline. It is safe for
+// concurrent use.
+type ManualTimeSource struct {
+	mu struct {
+		syncutil.Mutex
+		now    time.Time
+		timers []*manualTimer
+	}
+}
+
+var _ mon.TimeSource = &ManualTimeSource{}
+
+// NewManualTimeSource creates a ManualTimeSource starting at the given time.
+func NewManualTimeSource(start time.Time) *ManualTimeSource {
+	ts := &ManualTimeSource{}
+	ts.mu.now = start
+	return ts
+}
+
+// Now implements the mon.TimeSource interface.
+func (ts *ManualTimeSource) Now() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.mu.now
+}
+
+// NewTimer implements the mon.TimeSource interface.
+func (ts *ManualTimeSource) NewTimer(d time.Duration) mon.Timer {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := &manualTimer{ts: ts, at: ts.mu.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- ts.mu.now
+		return t
+	}
+	ts.mu.timers = append(ts.mu.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d and fires the timers whose deadline
+// has passed.
+func (ts *ManualTimeSource) Advance(d time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.mu.now = ts.mu.now.Add(d)
+	pending := ts.mu.timers[:0]
+	for _, t := range ts.mu.timers {
+		if t.at.After(ts.mu.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- ts.mu.now
+	}
+	for i := len(pending); i < len(ts.mu.timers); i++ {
+		ts.mu.timers[i] = nil
+	}
+	ts.mu.timers = pending
+}
+
+// NumTimers returns the number of timers that haven't fired or been stopped
+// yet. Tests use it to wait for the code under test to set up a timer before
+// advancing the time.
+func (ts *ManualTimeSource) NumTimers() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.mu.timers)
+}
+
+type manualTimer struct {
+	ts *ManualTimeSource
+	at time.Time
+	// ch is buffered so that firing never blocks Advance.
+	ch chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *manualTimer) Stop() bool {
+	t.ts.mu.Lock()
+	defer t.ts.mu.Unlock()
+	for i, other := range t.ts.mu.timers {
+		if other == t {
+			t.ts.mu.timers = append(t.ts.mu.timers[:i], t.ts.mu.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
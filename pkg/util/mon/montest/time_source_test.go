@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestManualTimeSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	start := time.Unix(1000, 0)
+	ts := NewManualTimeSource(start)
+	if now := ts.Now(); !now.Equal(start) {
+		t.Fatalf("expected %s, got %s", start, now)
+	}
+
+	fired := func(timer interface{ C() <-chan time.Time }) bool {
+		select {
+		case <-timer.C():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t1 := ts.NewTimer(time.Second)
+	t2 := ts.NewTimer(2 * time.Second)
+	t3 := ts.NewTimer(3 * time.Second)
+	if n := ts.NumTimers(); n != 3 {
+		t.Fatalf("expected 3 timers, got %d", n)
+	}
+
+	ts.Advance(999 * time.Millisecond)
+	if fired(t1) {
+		t.Fatal("timer fired early")
+	}
+	ts.Advance(time.Millisecond)
+	if !fired(t1) || fired(t2) {
+		t.Fatal("expected only the first timer to fire")
+	}
+	if t1.Stop() {
+		t.Fatal("expected Stop to report that the timer fired")
+	}
+	if !t2.Stop() {
+		t.Fatal("expected Stop to stop a pending timer")
+	}
+
+	ts.Advance(time.Hour)
+	if fired(t2) || !fired(t3) {
+		t.Fatal("expected only the third timer to fire")
+	}
+	if n := ts.NumTimers(); n != 0 {
+		t.Fatalf("expected no timers, got %d", n)
+	}
+	if now, expected := ts.Now(), start.Add(time.Second+time.Hour); !now.Equal(expected) {
+		t.Fatalf("expected %s, got %s", expected, now)
+	}
+
+	// Timers with no duration fire right away.
+	if !fired(ts.NewTimer(0)) {
+		t.Fatal("expected a zero timer to fire immediately")
+	}
+}
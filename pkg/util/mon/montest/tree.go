@@ -0,0 +1,143 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// TreeConfig describes the shape of a random tree of monitors built by
+// MakeRandomTree.
+type TreeConfig struct {
+	// Depth is the number of levels of monitors, including the root.
+	Depth int
+	// MaxFanout is the maximum number of children of every monitor that
+	// isn't a leaf.
+	MaxFanout int
+	// AccountsPerLeaf is the number of accounts opened on every leaf monitor.
+	AccountsPerLeaf int
+	// RootBudget is the standalone budget of the root monitor.
+	RootBudget int64
+	// Policy is the reservation policy of all the monitors.
+	Policy mon.ReservationPolicy
+}
+
+// Tree is a tree of monitors mirroring the ones found in production (root,
+// SQL, session, transaction, operator...), with accounts opened on the
+// leaves. All the monitors and accounts are registered with Checker, which
+// then verifies at every level that the allocation of a monitor is the sum
+// of the budgets of its children and of its accounts.
+type Tree struct {
+	// Monitors lists the monitors of the tree, parents before their
+	// children. The root comes first.
+	Monitors []*mon.BytesMonitor
+	// Accounts lists the accounts opened on the leaf monitors.
+	Accounts []*mon.BoundAccount
+	Checker  *InvariantChecker
+
+	t testing.TB
+}
+
+// MakeRandomTree builds and starts a tree of monitors of the given shape.
+// The number of children of every monitor and the allocation size, limit,
+// hysteresis and pre-reserved budget of every monitor below the root are
+// drawn from rnd.
+func MakeRandomTree(
+	ctx context.Context, t testing.TB, rnd *rand.Rand, st *cluster.Settings, cfg TreeConfig,
+) *Tree {
+	tr := &Tree{Checker: NewInvariantChecker(t), t: t}
+
+	root := &mon.BytesMonitor{}
+	*root = mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, 1000, st,
+		mon.WithReservationPolicy(cfg.Policy))
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(cfg.RootBudget))
+	tr.Monitors = append(tr.Monitors, root)
+	tr.Checker.AddMonitor("root", root)
+
+	openAccounts := func(m *mon.BytesMonitor, name string) {
+		for i := 0; i < cfg.AccountsPerLeaf; i++ {
+			acc := &mon.BoundAccount{}
+			*acc = m.MakeBoundAccount()
+			tr.Accounts = append(tr.Accounts, acc)
+			tr.Checker.AddMonitor(name, m, acc)
+		}
+	}
+
+	var build func(parent *mon.BytesMonitor, name string, depth int)
+	build = func(parent *mon.BytesMonitor, name string, depth int) {
+		m := &mon.BytesMonitor{}
+		var limit int64
+		if rnd.Intn(2) == 0 {
+			// Limits are in the same range as the root budget, so that some
+			// of them kick in before the budget runs out.
+			limit = 1 + rnd.Int63n(cfg.RootBudget+1)
+		}
+		increment := []int64{1, 2, 9, 10, 11, 100}[rnd.Intn(6)]
+		hysteresis := []int{1, 2, 10, 10000}[rnd.Intn(4)]
+		*m = mon.MakeMonitorWithLimit(name, mon.MemoryResource, limit, nil, nil, increment, 1000, st,
+			mon.WithHysteresis(hysteresis), mon.WithReservationPolicy(cfg.Policy))
+		var reserved int64
+		if rnd.Intn(4) == 0 {
+			reserved = RandomSize(rnd, cfg.RootBudget/10)
+		}
+		m.Start(ctx, parent, mon.MakeStandaloneBudget(reserved))
+		tr.Monitors = append(tr.Monitors, m)
+		tr.Checker.AddMonitor(name, m)
+
+		if depth == cfg.Depth {
+			openAccounts(m, name)
+			return
+		}
+		for i, n := 0, 1+rnd.Intn(cfg.MaxFanout); i < n; i++ {
+			build(m, fmt.Sprintf("%s.%d", name, i), depth+1)
+		}
+	}
+	if cfg.Depth <= 1 {
+		// The root is the only monitor.
+		openAccounts(root, "root")
+		return tr
+	}
+	for i, n := 0, 1+rnd.Intn(cfg.MaxFanout); i < n; i++ {
+		build(root, fmt.Sprintf("m%d", i), 2)
+	}
+	return tr
+}
+
+// Operations returns the operations of AccountOperations on the accounts of
+// the tree.
+func (tr *Tree) Operations(maxSize int64) []Operation {
+	return AccountOperations(tr.Accounts, maxSize)
+}
+
+// Stop clears all the accounts and stops the monitors from the leaves up,
+// checking the invariants along the way and verifying that every monitor is
+// empty when it is stopped.
+func (tr *Tree) Stop(ctx context.Context) {
+	tr.t.Helper()
+	for _, acc := range tr.Accounts {
+		acc.Clear(ctx)
+		tr.Checker.Check()
+	}
+	for i := len(tr.Monitors) - 1; i >= 0; i-- {
+		AssertEmpty(tr.t, tr.Monitors[i])
+		tr.Monitors[i].Stop(ctx)
+	}
+}
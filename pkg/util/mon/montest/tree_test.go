@@ -0,0 +1,64 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package montest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestMonitorTree(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	for _, policy := range []mon.ReservationPolicy{mon.RetainQuantum, mon.ReleaseEagerly} {
+		for depth := 3; depth <= 5; depth++ {
+			t.Run(fmt.Sprintf("policy=%d/depth=%d", policy, depth), func(t *testing.T) {
+				for i := 0; i < 10; i++ {
+					tr := MakeRandomTree(ctx, t, rnd, st, TreeConfig{
+						Depth:           depth,
+						MaxFanout:       3,
+						AccountsPerLeaf: 2,
+						RootBudget:      1000,
+						Policy:          policy,
+					})
+					ops := tr.Operations(100)
+					for _, m := range tr.Monitors[1:] {
+						ops = append(ops, ReleaseReservedOperation(m))
+					}
+					d := Driver{Checker: tr.Checker, Operations: ops}
+					if log.V(2) {
+						d.Logf = t.Logf
+					}
+					d.Run(ctx, rnd, 200)
+					tr.Stop(ctx)
+				}
+			})
+		}
+	}
+}
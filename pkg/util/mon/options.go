@@ -0,0 +1,312 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "time"
+
+// MonitorOption is an option that can be passed to the monitor
+// constructors.
+type MonitorOption interface {
+	apply(*monitorOptions)
+}
+
+// monitorOptions holds the tuning parameters set by MonitorOption. They are
+// collected separately from the monitor, which can't be copied once built,
+// and embedded in it by its constructors.
+type monitorOptions struct {
+	// poolAllocationSize specifies the allocation unit for requests to the
+	// pool.
+	poolAllocationSize int64
+
+	// maxAllocatedButUnusedBlocks is the hysteresis applied when releasing
+	// bytes to the pool; see the global of the same name for the default.
+	maxAllocatedButUnusedBlocks int
+
+	// maxUnusedBytes, if set, caps the budget that the monitor keeps from
+	// its pool without using it; see WithMaxUnusedBytes.
+	maxUnusedBytes int64
+
+	// releaseKind and releaseDelay are the release policy of the monitor;
+	// see WithReleasePolicy.
+	releaseKind  releaseKind
+	releaseDelay time.Duration
+
+	// reservationPolicy determines how much unused reservation the accounts
+	// keep when they shrink.
+	reservationPolicy ReservationPolicy
+
+	// timeSource provides the time to the time-based features of the
+	// monitor. Use clock() rather than accessing it directly, as it is nil in
+	// monitors that weren't made by a constructor.
+	timeSource TimeSource
+
+	// maxOpenAccounts and maxChildren cap the number of simultaneously open
+	// accounts and children of the monitor; 0 means no cap. See
+	// WithMaxOpenAccounts and WithMaxChildren.
+	maxOpenAccounts int
+	maxChildren     int
+
+	// reservationCap caps the sum of the pre-reserved budgets of the
+	// children of the monitor; 0 means no cap. See WithReservationCap.
+	reservationCap int64
+
+	// verifyBudget, if set, makes Start reserve a standalone pre-reserved
+	// budget from the pool; see WithVerifiedBudget.
+	verifyBudget bool
+
+	// limitProvider, if set, provides the limit; see WithLimitProvider.
+	limitProvider func() int64
+
+	// burst is the allowance above the limit; see WithBurst.
+	burst burstConfig
+
+	// peakInterval is the granularity of the windowed maximum, if enabled;
+	// see WithPeakWindow.
+	peakInterval time.Duration
+
+	// smoothingHalfLife is the half-life of the moving average of the usage,
+	// if enabled; see WithSmoothingHalfLife.
+	smoothingHalfLife time.Duration
+
+	// reservationRateHalfLife is the half-life of the moving average of the
+	// rate of reservations; see WithReservationRateHalfLife.
+	reservationRateHalfLife time.Duration
+
+	// emergencyReserve is the number of bytes set aside for GrowEmergency;
+	// see WithEmergencyReserve.
+	emergencyReserve int64
+
+	// evictionSoftLimit, if positive, is the usage beyond which the monitor
+	// asks its caches to evict; see WithEvictionSoftLimit.
+	evictionSoftLimit int64
+
+	// overheadMultiplier is the factor applied to the bytes requested by the
+	// accounts; see WithOverheadMultiplier.
+	overheadMultiplier float64
+
+	// unmarshalExpansionFactor is the ratio between the size charged by
+	// Unmarshal and the size of the serialized message; see
+	// WithUnmarshalExpansionFactor.
+	unmarshalExpansionFactor float64
+
+	// pageSize, if positive, puts the accounts of the monitor in page mode;
+	// see WithPageSize.
+	pageSize int64
+
+	// categories are the names of the categories of allocations, and
+	// categoryLimits their limits, 0 meaning no limit; see WithCategories
+	// and WithCategoryLimit.
+	categories     []string
+	categoryLimits [MaxCategories]int64
+
+	// labels are the labels attached to the monitor itself; see WithLabels.
+	labels []Label
+
+	// logger is the sink of the log messages of the monitor; see WithLogger.
+	logger Logger
+
+	// errorVerbosity determines how the budget errors of the monitor
+	// render; see WithErrorVerbosity.
+	errorVerbosity ErrorVerbosity
+
+	// denialCounts counts the denials of the requests made to the monitor;
+	// see WithDenialCounters.
+	denialCounts DenialCounters
+
+	// metricsFlushThreshold, if positive, defers the updates of
+	// curBytesCount until they add up to that many bytes; see
+	// WithDeferredMetrics.
+	metricsFlushThreshold int64
+
+	// wouldDenyCount, if set, counts the allocations granted in ReportOnly
+	// mode that the limit would have denied; see WithWouldDenyCounter.
+	wouldDenyCount Counter
+
+	// expiredLeaseCount, if set, counts the leases released because they
+	// expired; see WithExpiredLeaseCounter.
+	expiredLeaseCount Counter
+
+	// leakReaction determines what Stop does with leaked bytes; see
+	// WithLeakReaction.
+	leakReaction LeakReaction
+
+	// leakedBytesCount, if set, counts the bytes leaked by the monitor; see
+	// WithLeakedBytesCounter.
+	leakedBytesCount Counter
+
+	// accountRegistry is set if the monitor keeps a registry of its
+	// accounts; see WithAccountRegistry.
+	accountRegistry bool
+
+	// lifetimeHist and peakHist, if set, record the lifetime and the peak
+	// usage of the monitor when it is stopped; see WithLifetimeHistograms.
+	lifetimeHist BytesHistogram
+	peakHist     BytesHistogram
+
+	// topConsumers configures the logging of the top consumers of the
+	// monitor; see WithTopConsumersLog.
+	topConsumers topConsumersConfig
+
+	// exhaustionDumps configures the dumps written when the monitor refuses
+	// an allocation; see WithExhaustionDumps.
+	exhaustionDumps ExhaustionDumpConfig
+
+	// exhaustionEventInterval is the minimum interval between two
+	// BudgetExhaustedEvents; see WithExhaustionEvents.
+	exhaustionEventInterval time.Duration
+
+	// releasedToPoolCount and poolRoundTripCount, if set, count the churn of
+	// the monitor; see WithChurnCounters.
+	releasedToPoolCount Counter
+	poolRoundTripCount  Counter
+
+	// reservedUsageGauge and poolUsageGauge, if set, track the split of the
+	// usage; see WithUsageSplitGauges.
+	reservedUsageGauge BytesGauge
+	poolUsageGauge     BytesGauge
+
+	// heapProfile configures the heap profile hook; see
+	// WithHeapProfileHook.
+	heapProfile heapProfileConfig
+
+	// metamorphic is set if the tuning parameters of the monitor were
+	// randomized; see metamorphicParams.
+	metamorphic bool
+
+	// The following indicate which parameters were set explicitly, as
+	// opposed to left to their defaults.
+	poolAllocationSizeSet bool
+	hysteresisSet         bool
+	reservationPolicySet  bool
+}
+
+// makeMonitorOptions collects the tuning parameters of a monitor from the
+// increment passed to its constructor, 0 or lower meaning the default, and
+// its options.
+func makeMonitorOptions(increment int64, opts []MonitorOption) monitorOptions {
+	o := monitorOptions{
+		poolAllocationSize:          increment,
+		poolAllocationSizeSet:       increment > 0,
+		maxAllocatedButUnusedBlocks: maxAllocatedButUnusedBlocks,
+		timeSource:                  DefaultTimeSource,
+	}
+	if !o.poolAllocationSizeSet {
+		o.poolAllocationSize = DefaultPoolAllocationSize
+	}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	o.randomize()
+	return o
+}
+
+type optionFunc func(*monitorOptions)
+
+func (f optionFunc) apply(o *monitorOptions) {
+	f(o)
+}
+
+// WithHysteresis sets the number of allocation blocks a monitor may keep
+// reserved from its pool without using them before it releases the excess
+// (see maxAllocatedButUnusedBlocks, which provides the default).
+func WithHysteresis(blocks int) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.maxAllocatedButUnusedBlocks = blocks
+		o.hysteresisSet = true
+	})
+}
+
+// WithMaxUnusedBytes caps the number of bytes a monitor keeps reserved from
+// its pool without using them, regardless of its allocation size: the
+// monitor only asks its pool for what it misses, rounded up to the
+// allocation size by at most bytes, and releases the excess as soon as it
+// has more than bytes of unused budget. Unlike WithHysteresis, the cap
+// doesn't depend on the allocation size; when both are set, the stricter
+// applies. 0 means no cap.
+func WithMaxUnusedBytes(bytes int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.maxUnusedBytes = bytes
+	})
+}
+
+// ReservationPolicy determines how much unused reservation the accounts of
+// a monitor keep when they shrink.
+type ReservationPolicy int
+
+const (
+	// RetainQuantum keeps up to one allocation block reserved in the
+	// account, so that an account shrinking and growing around the same size
+	// doesn't hit the monitor every time. This is the default.
+	RetainQuantum ReservationPolicy = iota
+	// ReleaseEagerly returns all unused bytes to the monitor right away.
+	ReleaseEagerly
+)
+
+// WithReservationPolicy sets the reservation policy of the monitor's
+// accounts.
+func WithReservationPolicy(p ReservationPolicy) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.reservationPolicy = p
+		o.reservationPolicySet = true
+	})
+}
+
+// WithTimeSource sets the source of time of the monitor, which defaults to
+// DefaultTimeSource. Tests use it to control time-based features.
+func WithTimeSource(ts TimeSource) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.timeSource = ts
+	})
+}
+
+// WithMaxOpenAccounts caps the number of accounts made by OpenAccount that
+// can be open at the same time, so that code leaking accounts fails instead
+// of creeping. The default is no cap.
+func WithMaxOpenAccounts(n int) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.maxOpenAccounts = n
+	})
+}
+
+// WithMaxChildren caps the number of monitors that can be started with the
+// monitor as their pool at the same time. The default is no cap.
+func WithMaxChildren(n int) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.maxChildren = n
+	})
+}
+
+// WithVerifiedBudget makes Start verify that the pool can back a standalone
+// pre-reserved budget (see MakeStandaloneBudget): the budget is reserved from
+// the pool, and starting fails if the pool can't cover it, so that a
+// misconfigured budget fails at setup time rather than as confusing denials
+// later. The budget is returned to the pool when the monitor stops. By
+// default, a standalone budget is taken at face value.
+func WithVerifiedBudget() MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.verifyBudget = true
+	})
+}
+
+// WithReservationCap caps the sum of the pre-reserved budgets that the
+// monitors started with the monitor as their pool are given at Start, e.g.
+// to a fraction of the budget of a root monitor, so that budget reserved
+// but unused can't oversubscribe the node. Starting a child that would
+// exceed the cap fails (see TryStart). The default is no cap.
+func WithReservationCap(bytes int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.reservationCap = bytes
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestMonitorOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		policy ReservationPolicy
+		// reserved is the unused reservation expected in the account after
+		// shrinking.
+		reserved int64
+	}{
+		{RetainQuantum, 10},
+		{ReleaseEagerly, 0},
+	}
+	for _, tc := range testCases {
+		pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+		pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+		m := MakeMonitor("test", MemoryResource, nil, nil, 10, 1000, st,
+			WithHysteresis(2), WithReservationPolicy(tc.policy))
+		if m.maxAllocatedButUnusedBlocks != 2 || m.reservationPolicy != tc.policy {
+			t.Fatalf("expected options to apply, got hysteresis %d, policy %d",
+				m.maxAllocatedButUnusedBlocks, m.reservationPolicy)
+		}
+		m.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 95); err != nil {
+			t.Fatal(err)
+		}
+		acc.Shrink(ctx, 90)
+		if r := acc.reserved; r != tc.reserved {
+			t.Errorf("%d: expected %d bytes reserved in the account, got %d", tc.policy, tc.reserved, r)
+		}
+		// The monitor keeps at most two blocks more than it needs from the
+		// pool.
+		if excess := m.mu.curBudget.used - m.roundSize(m.mu.curAllocated); excess > 20 {
+			t.Errorf("%d: expected at most 20 bytes of excess budget, got %d", tc.policy, excess)
+		}
+
+		// Inherited monitors keep the options.
+		child := MakeMonitorInheritWithLimit("child", 100, &m)
+		if child.maxAllocatedButUnusedBlocks != 2 || child.reservationPolicy != tc.policy {
+			t.Errorf("%d: expected options to be inherited, got hysteresis %d, policy %d",
+				tc.policy, child.maxAllocatedButUnusedBlocks, child.reservationPolicy)
+		}
+
+		acc.Close(ctx)
+		m.Stop(ctx)
+		pool.Stop(ctx)
+	}
+}
+
+func TestMaxUnusedBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(100000))
+	// With a large allocation size, a single block would leave the monitor
+	// with thousands of unused bytes.
+	m := MakeMonitor("test", MemoryResource, nil, nil, 4096, 1000, st,
+		WithMaxUnusedBytes(100), WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, &pool, MakeStandaloneBudget(0))
+	if child := MakeMonitorInheritWithLimit("child", 100, &m); child.maxUnusedBytes != 100 {
+		t.Errorf("expected the cap to be inherited, got %d", child.maxUnusedBytes)
+	}
+
+	unused := func() int64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.unusedPoolBudgetLocked()
+	}
+	acc := m.MakeBoundAccount()
+	for _, sz := range []int64{10, 1000, 5000, 3} {
+		if err := acc.Grow(ctx, sz); err != nil {
+			t.Fatal(err)
+		}
+		if u := unused(); u > 100 {
+			t.Fatalf("after growing by %d: expected at most 100 unused bytes, got %d", sz, u)
+		}
+	}
+	acc.Shrink(ctx, 5000)
+	if u := unused(); u > 100 {
+		t.Fatalf("after shrinking: expected at most 100 unused bytes, got %d", u)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+	pool.Stop(ctx)
+}
+
+func TestMetamorphicParams(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(enabled bool, seed int64, rnd *rand.Rand) {
+		metamorphicParams, metamorphic.seed, metamorphic.rnd = enabled, seed, rnd
+	}(metamorphicParams, metamorphic.seed, metamorphic.rnd)
+	metamorphicParams = true
+	metamorphic.seed = 42
+	metamorphic.rnd = rand.New(rand.NewSource(metamorphic.seed))
+
+	contains := func(values []int64, v int64) bool {
+		for _, x := range values {
+			if x == v {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 100; i++ {
+		o := makeMonitorOptions(0 /* increment */, nil)
+		if !contains(metamorphicAllocationSizes, o.poolAllocationSize) {
+			t.Fatalf("unexpected random increment %d", o.poolAllocationSize)
+		}
+		if o.reservationPolicy != RetainQuantum && o.reservationPolicy != ReleaseEagerly {
+			t.Fatalf("unexpected random policy %d", o.reservationPolicy)
+		}
+
+		// Explicit parameters are kept.
+		o = makeMonitorOptions(7, []MonitorOption{WithHysteresis(3), WithReservationPolicy(ReleaseEagerly)})
+		if o.poolAllocationSize != 7 || o.maxAllocatedButUnusedBlocks != 3 ||
+			o.reservationPolicy != ReleaseEagerly {
+			t.Fatalf("expected explicit parameters to be kept, got %+v", o)
+		}
+	}
+
+	// The seed is reported by failed tests only.
+	var rt recordingT
+	TestingVerifyAllStopped(&rt)()
+	if len(rt.logs) != 0 {
+		t.Fatalf("expected no message from a passing test, got %q", rt.logs)
+	}
+	rt.errors = []string{"failure"}
+	TestingVerifyAllStopped(&rt)()
+	if len(rt.logs) != 1 || !strings.Contains(rt.logs[0], "COCKROACH_MON_METAMORPHIC_SEED=42") {
+		t.Fatalf("expected the seed to be reported, got %q", rt.logs)
+	}
+}
+
+func TestWithTimeSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	st := cluster.MakeTestingClusterSettings()
+	type testTimeSource struct {
+		systemTimeSource
+		id int
+	}
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	if m.clock() != DefaultTimeSource {
+		t.Errorf("expected the default time source, got %v", m.clock())
+	}
+	var zero BytesMonitor
+	if zero.clock() != DefaultTimeSource {
+		t.Errorf("expected the default time source, got %v", zero.clock())
+	}
+
+	ts := testTimeSource{id: 1}
+	m = MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st, WithTimeSource(ts))
+	if m.clock() != ts {
+		t.Errorf("expected the time source to apply, got %v", m.clock())
+	}
+	child := MakeMonitorInheritWithLimit("child", 100, &m)
+	if child.clock() != ts {
+		t.Errorf("expected the time source to be inherited, got %v", child.clock())
+	}
+}
+
+func TestWithVerifiedBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+
+	// By default, a standalone budget is taken at face value, even if the
+	// pool could never supply it.
+	legacy := MakeMonitor("legacy", MemoryResource, nil, nil, 1, 1000, st)
+	if err := legacy.TryStart(ctx, &pool, MakeStandaloneBudget(5000)); err != nil {
+		t.Fatal(err)
+	}
+	if a := pool.AllocBytes(); a != 0 {
+		t.Fatalf("expected the legacy budget not to be reserved from the pool, got %d", a)
+	}
+	legacy.Stop(ctx)
+
+	verified := MakeMonitor("verified", MemoryResource, nil, nil, 1, 1000, st, WithVerifiedBudget())
+	if err := verified.TryStart(ctx, &pool, MakeStandaloneBudget(5000)); !IsBudgetExceededError(err) ||
+		!strings.Contains(err.Error(), "verified: pool pool can't back a budget of 5000 B") {
+		t.Fatalf("expected the budget to be refused, got %v", err)
+	}
+	if a := pool.AllocBytes(); a != 0 {
+		t.Fatalf("expected nothing reserved from the pool after a failed start, got %d", a)
+	}
+
+	// A budget the pool can cover is reserved from it for the lifetime of
+	// the monitor.
+	if err := verified.TryStart(ctx, &pool, MakeStandaloneBudget(400)); err != nil {
+		t.Fatal(err)
+	}
+	if a := pool.AllocBytes(); a != 400 {
+		t.Fatalf("expected 400 bytes reserved from the pool, got %d", a)
+	}
+	acc := verified.MakeBoundAccount()
+	if err := acc.Grow(ctx, 400); err != nil {
+		t.Fatal(err)
+	}
+	if a := pool.AllocBytes(); a != 400 {
+		t.Fatalf("expected the monitor to use its budget, got %d bytes from the pool", a)
+	}
+	acc.Close(ctx)
+	verified.Stop(ctx)
+	if a := pool.AllocBytes(); a != 0 {
+		t.Fatalf("expected the budget to be returned to the pool, got %d", a)
+	}
+	pool.Stop(ctx)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "math"
+
+// WithOverheadMultiplier makes the monitor charge multiplier times the bytes
+// requested by its accounts against its limit and its pool, e.g. 1.15, to
+// make up for the overhead of the allocator, the headroom of the GC and
+// fragmentation, which the logical sizes accounted for by the clients
+// don't include. The accounts keep reporting the logical sizes to their
+// owners (see BoundAccount.Used); the overhead shows in
+// BoundAccount.Allocated and in the usage of the monitor. The budgets of
+// the child monitors of the monitor are charged without overhead, since
+// they already include the overhead of the child monitors.
+//
+// Each account tracks the overhead it was charged, and releases it as it
+// shrinks, so that the rounding of the overhead doesn't leak bytes. A
+// multiplier of 1 or less disables the overhead.
+func WithOverheadMultiplier(multiplier float64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.overheadMultiplier = multiplier
+	})
+}
+
+// makeBudgetAccount creates an account holding the budget of a child monitor,
+// which is charged without overhead.
+func (mm *BytesMonitor) makeBudgetAccount() BoundAccount {
+	return BoundAccount{mon: mm, noOverhead: true}
+}
+
+// overheadMultiplier returns the multiplier applied to the bytes requested
+// through the account.
+func (b *BoundAccount) overheadMultiplier() float64 {
+	if b.noOverhead || b.mon == nil || b.mon.overheadMultiplier <= 1 {
+		return 1
+	}
+	return b.mon.overheadMultiplier
+}
+
+// overheadFor returns the overhead charged for a logical allocation of n
+// bytes through the account.
+func (b *BoundAccount) overheadFor(n int64) int64 {
+	m := b.overheadMultiplier()
+	if m == 1 {
+		return 0
+	}
+	charged := math.Ceil(float64(n) * m)
+	if charged >= math.MaxInt64 {
+		return math.MaxInt64 - n
+	}
+	return int64(charged) - n
+}
+
+// overheadCost returns the overhead to charge on top of n bytes when the
+// logical allocation of the account grows by n bytes.
+func (b *BoundAccount) overheadCost(n int64) int64 {
+	if cost := b.overheadFor(saturatingAdd(b.used+b.reserved, n)) - b.overhead; cost > 0 {
+		return cost
+	}
+	return 0
+}
+
+// shedOverhead drops the overhead charged to the account beyond what its
+// logical allocation needs, e.g. after it shrank, and returns the number of
+// bytes dropped, which the caller must release.
+func (b *BoundAccount) shedOverhead() int64 {
+	excess := b.overhead - b.overheadFor(b.used+b.reserved)
+	if excess <= 0 {
+		return 0
+	}
+	b.overhead -= excess
+	return excess
+}
+
+// moveUsedTo moves n bytes of usage from the account to dst, which must be
+// bound to the same monitor, along with the overhead they were charged.
+func (b *BoundAccount) moveUsedTo(dst *BoundAccount, n int64) {
+	b.used -= n
+	dst.used += n
+	if need := dst.overheadCost(0); need > 0 {
+		moved := b.overhead - b.overheadFor(b.used+b.reserved)
+		if moved > need {
+			moved = need
+		}
+		if moved > 0 {
+			b.overhead -= moved
+			dst.overhead += moved
+		}
+	}
+}
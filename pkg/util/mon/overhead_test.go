@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestOverheadMultiplier(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	rnd, seed := randutil.NewPseudoRand()
+	t.Logf("random seed: %v", seed)
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	const multiplier = 1.15
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithOverheadMultiplier(2))
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithOverheadMultiplier(multiplier), mon.WithReservationPolicy(mon.ReleaseEagerly),
+		mon.WithReleasePolicy(mon.ReleaseImmediately()))
+	m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+	acc := m.MakeBoundAccount()
+
+	// The account reports logical bytes, and the monitor is charged the
+	// overhead on top.
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if u, a := acc.Used(), acc.Allocated(); u != 100 || a != 115 {
+		t.Fatalf("expected 100 bytes used and 115 allocated, got %d and %d", u, a)
+	}
+	montest.AssertUsed(t, &m, 115)
+	// The budget of the monitor is charged to the pool without the overhead
+	// of the pool.
+	montest.AssertUsed(t, &pool, 115)
+
+	// The rounding of the overhead doesn't leak over many cycles.
+	for i := 0; i < 1000; i++ {
+		if rnd.Intn(2) == 0 {
+			if err := acc.Grow(ctx, rnd.Int63n(50)); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			acc.Shrink(ctx, rnd.Int63n(acc.Used()+1))
+		}
+		expected := int64(math.Ceil(float64(acc.Used()) * multiplier))
+		montest.AssertUsed(t, &m, expected)
+	}
+
+	acc.Close(ctx)
+	montest.AssertEmpty(t, &m)
+	m.Stop(ctx)
+	montest.AssertEmpty(t, &pool)
+	pool.Stop(ctx)
+}
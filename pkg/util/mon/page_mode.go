@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "math"
+
+// DefaultPageSize is the usual size of the pages of the OS, for the
+// accounts of mmap-backed components and I/O buffers.
+const DefaultPageSize = 4 << 10 // 4 KiB
+
+// WithPageSize puts the accounts made by the monitor in page mode, with the
+// given page size; see BoundAccount.SetPageSize. The budgets of the child
+// monitors of the monitor are not affected.
+func WithPageSize(pageSize int64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.pageSize = pageSize
+	})
+}
+
+// SetPageSize puts the account in page mode, for components that consume
+// memory in whole pages regardless of the logical size of their data, e.g.
+// mmap-backed ones: the account then reserves whole pages from the monitor,
+// so that its allocation always covers the pages spanned by the bytes it
+// uses, and only calls into the monitor when its usage crosses a page
+// boundary. The account and the monitor keep reporting bytes. The quantum
+// of the account (see SetQuantum) and the allocation size of the monitor
+// are ignored in page mode. Accounts in page mode and in byte mode can
+// share a monitor. 0 restores byte mode.
+func (b *BoundAccount) SetPageSize(pageSize int64) {
+	b.pageSize = pageSize
+}
+
+// PageSize returns the page size of the account, or 0 if it is in byte
+// mode.
+func (b BoundAccount) PageSize() int64 {
+	return b.pageSize
+}
+
+// pageCeil returns the size of the pages spanned by n bytes in page mode.
+func (b *BoundAccount) pageCeil(n int64) int64 {
+	p := b.pageSize
+	if n > math.MaxInt64-p {
+		return math.MaxInt64
+	}
+	return (n + p - 1) / p * p
+}
+
+// pageFloor returns the size of the whole pages within n bytes in page
+// mode.
+func (b *BoundAccount) pageFloor(n int64) int64 {
+	return n / b.pageSize * b.pageSize
+}
+
+// pageExtra returns the number of bytes that the account must reserve, in
+// page mode, for its usage to grow by x bytes.
+func (b *BoundAccount) pageExtra(x int64) int64 {
+	if extra := b.pageCeil(saturatingAdd(b.used, x)) - b.used - b.reserved; extra > 0 {
+		return extra
+	}
+	return 0
+}
+
+// pageRetain returns the number of bytes that the account keeps reserved,
+// in page mode, once it shrank: the rest of its last page.
+func (b *BoundAccount) pageRetain() int64 {
+	return b.pageCeil(b.used) - b.used
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestPageMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	// The account in byte mode keeps a block of its allocation in reserve
+	// when it shrinks.
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 10, math.MaxInt64, st,
+		mon.WithPageSize(mon.DefaultPageSize), mon.WithReservationPolicy(mon.RetainQuantum))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+
+	pages := m.MakeBoundAccount()
+	bytes := m.MakeBoundAccount()
+	bytes.SetPageSize(0)
+	if p := pages.PageSize(); p != mon.DefaultPageSize {
+		t.Fatalf("expected the account to inherit the page size, got %d", p)
+	}
+
+	steps := []struct {
+		acc       *mon.BoundAccount
+		grow      int64
+		used      int64
+		allocated int64
+	}{
+		// The charges of the account in page mode are rounded up to whole
+		// pages, and only grow when the usage crosses a page boundary.
+		{acc: &pages, grow: 1, used: 1, allocated: 4096},
+		{acc: &pages, grow: 4095, used: 4096, allocated: 4096},
+		{acc: &pages, grow: 1, used: 4097, allocated: 8192},
+		{acc: &pages, grow: 10000, used: 14097, allocated: 16384},
+		// The account in byte mode rounds to the allocation size of the
+		// monitor.
+		{acc: &bytes, grow: 15, used: 15, allocated: 20},
+		// Shrinking keeps the rest of the last page only.
+		{acc: &pages, grow: -10000, used: 4097, allocated: 8192},
+		{acc: &pages, grow: -1, used: 4096, allocated: 4096},
+		{acc: &bytes, grow: -5, used: 10, allocated: 20},
+	}
+	for i, s := range steps {
+		if s.grow >= 0 {
+			if err := s.acc.Grow(ctx, s.grow); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			s.acc.Shrink(ctx, -s.grow)
+		}
+		if u, a := s.acc.Used(), s.acc.Allocated(); u != s.used || a != s.allocated {
+			t.Fatalf("%d: expected %d bytes used and %d allocated, got %d and %d",
+				i, s.used, s.allocated, u, a)
+		}
+		// The monitor reports the sum of the accounts, in bytes.
+		if a, e := m.AllocBytes(), pages.Allocated()+bytes.Allocated(); a != e {
+			t.Fatalf("%d: expected %d bytes allocated by the monitor, got %d", i, e, a)
+		}
+	}
+
+	// GrowUpTo only reserves whole pages too.
+	limited := mon.MakeMonitorWithLimit("limited", mon.MemoryResource, 10000, nil, nil, 1,
+		math.MaxInt64, st, mon.WithPageSize(mon.DefaultPageSize))
+	limited.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	acc := limited.MakeBoundAccount()
+	granted, err := acc.GrowUpTo(ctx, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := acc.Allocated(); granted != 8192 || a != 8192 {
+		t.Fatalf("expected 8192 bytes granted and allocated, got %d and %d", granted, a)
+	}
+	montest.AssertUsed(t, &limited, 8192)
+	acc.Close(ctx)
+	limited.Stop(ctx)
+
+	pages.Close(ctx)
+	bytes.Close(ctx)
+	montest.AssertEmpty(t, &m)
+	m.Stop(ctx)
+}
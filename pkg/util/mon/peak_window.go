@@ -0,0 +1,107 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "time"
+
+// peakWindowBuckets is the number of intervals over which a monitor tracks
+// its high-water mark. It bounds the window that can be queried to
+// peakWindowBuckets times the interval set with WithPeakWindow.
+const peakWindowBuckets = 64
+
+// WithPeakWindow makes the monitor track its high-water mark over each
+// interval of the given duration, for the last peakWindowBuckets intervals,
+// so that WindowedMaximum can report the peak usage over a recent window
+// (e.g. with a 10s interval, over up to the last 10 minutes). Time is
+// measured with the TimeSource of the monitor.
+func WithPeakWindow(interval time.Duration) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.peakInterval = interval
+	})
+}
+
+// peakWindow is a ring of the high-water marks of the last
+// peakWindowBuckets intervals.
+type peakWindow struct {
+	// buckets[i%peakWindowBuckets] is the maximum usage during interval i,
+	// where interval i starts at i*interval since the epoch.
+	buckets [peakWindowBuckets]int64
+	// last is the most recent interval with a bucket.
+	last int64
+}
+
+// advance moves the ring forward to the given interval. The buckets of the
+// intervals entered are initialized with cur, the usage that carried over
+// since the last update.
+func (p *peakWindow) advance(interval int64, cur int64) {
+	n := interval - p.last
+	if n > peakWindowBuckets {
+		n = peakWindowBuckets
+	}
+	for i := int64(0); i < n; i++ {
+		p.buckets[(interval-i)%peakWindowBuckets] = cur
+	}
+	if interval > p.last {
+		p.last = interval
+	}
+}
+
+// updatePeaksLocked records a change in the usage of the monitor at time
+// now, from before to the current allocation.
+func (mm *BytesMonitor) updatePeaksLocked(now time.Time, before int64) {
+	interval := now.UnixNano() / int64(mm.peakInterval)
+	p := mm.mu.peaks
+	if p == nil {
+		p = &peakWindow{last: interval}
+		p.buckets[interval%peakWindowBuckets] = before
+		mm.mu.peaks = p
+	}
+	p.advance(interval, before)
+	if b := &p.buckets[p.last%peakWindowBuckets]; *b < mm.mu.curAllocated {
+		*b = mm.mu.curAllocated
+	}
+}
+
+// WindowedMaximum returns the maximum number of bytes allocated by the
+// monitor at one time during the given window of time up to now, with the
+// granularity of the interval set with WithPeakWindow. Windows longer than
+// the tracked intervals are truncated. If the monitor doesn't track its
+// recent peaks, the maximum since it was started is returned.
+func (mm *BytesMonitor) WindowedMaximum(window time.Duration) int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.peakInterval <= 0 {
+		return mm.mu.maxAllocated
+	}
+	if mm.mu.peaks == nil {
+		// Nothing was allocated yet.
+		return mm.mu.curAllocated
+	}
+	p := mm.mu.peaks
+	p.advance(mm.clock().Now().UnixNano()/int64(mm.peakInterval), mm.mu.curAllocated)
+	n := int64((window + mm.peakInterval - 1) / mm.peakInterval)
+	if n < 1 {
+		n = 1
+	} else if n > peakWindowBuckets {
+		n = peakWindowBuckets
+	}
+	var max int64
+	for i := int64(0); i < n; i++ {
+		if b := p.buckets[(p.last-i)%peakWindowBuckets]; b > max {
+			max = b
+		}
+	}
+	return max
+}
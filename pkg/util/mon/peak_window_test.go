@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestWindowedMaximum(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, 1000, st,
+		mon.WithTimeSource(clock), mon.WithPeakWindow(time.Second),
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	expect := func(window time.Duration, expected int64) {
+		t.Helper()
+		if max := m.WindowedMaximum(window); max != expected {
+			t.Errorf("expected a maximum of %d over %s, got %d", expected, window, max)
+		}
+	}
+
+	// A peak of 500 bytes, back down to 100.
+	if err := acc.Grow(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	acc.Shrink(ctx, 400)
+	expect(time.Second, 500)
+
+	// Ten seconds later, the peak is only visible in long enough windows.
+	clock.Advance(10 * time.Second)
+	if err := acc.Grow(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	acc.Shrink(ctx, 50)
+	expect(time.Second, 200)
+	expect(10*time.Second, 200)
+	expect(11*time.Second, 500)
+	expect(time.Hour, 500)
+
+	// The usage that carries over into an interval counts as its peak.
+	clock.Advance(5 * time.Second)
+	expect(time.Second, 150)
+
+	// Once out of the tracked window, the peaks age out entirely.
+	clock.Advance(64 * time.Second)
+	expect(time.Hour, 150)
+	if max := m.MaximumBytes(); max != 500 {
+		t.Errorf("expected a maximum since the start of 500, got %d", max)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+// PendingGrow is a growth of an account charged from an estimate, waiting
+// to be corrected to the actual size; see GrowEstimated. It must be
+// completed with either Finalize or Abandon. In race builds, a PendingGrow
+// that is garbage collected without having been completed crashes the
+// process, reporting where it was made.
+type PendingGrow struct {
+	acc  *BoundAccount
+	est  int64
+	done bool
+	// stack is where the PendingGrow was made, in race builds.
+	stack []byte
+}
+
+// GrowEstimated grows the account by est bytes, the estimated size of an
+// object whose actual size is only known later, e.g. a batch before it is
+// materialized. The returned PendingGrow corrects the growth to the actual
+// size with Finalize, or releases it with Abandon.
+func (b *BoundAccount) GrowEstimated(ctx context.Context, est int64) (*PendingGrow, error) {
+	if err := b.Grow(ctx, est); err != nil {
+		return nil, err
+	}
+	p := &PendingGrow{acc: b, est: est}
+	if util.RaceEnabled {
+		p.stack = debug.Stack()
+		runtime.SetFinalizer(p, (*PendingGrow).checkCompleted)
+	}
+	return p, nil
+}
+
+// Estimate returns the number of bytes charged for the pending growth.
+func (p *PendingGrow) Estimate() int64 {
+	return p.est
+}
+
+// Finalize corrects the growth to the actual size of the object, growing or
+// shrinking the account by the difference with the estimate. Shrinking
+// always succeeds. If growing is refused, the error is returned and the
+// estimate stays charged, so that the caller can retry with a smaller size,
+// or Abandon the growth.
+func (p *PendingGrow) Finalize(ctx context.Context, actual int64) error {
+	p.checkPending("finalizing")
+	switch delta := actual - p.est; {
+	case delta > 0:
+		if err := p.acc.Grow(ctx, delta); err != nil {
+			return err
+		}
+	case delta < 0:
+		p.acc.Shrink(ctx, -delta)
+	}
+	p.complete()
+	return nil
+}
+
+// Abandon releases the estimate, e.g. when the object is not materialized
+// after all.
+func (p *PendingGrow) Abandon(ctx context.Context) {
+	p.checkPending("abandoning")
+	p.acc.Shrink(ctx, p.est)
+	p.complete()
+}
+
+func (p *PendingGrow) checkPending(op string) {
+	if p.done {
+		panic(fmt.Sprintf("%s: %s a completed pending growth of %d bytes",
+			p.acc.monitorName(), op, p.est))
+	}
+}
+
+func (p *PendingGrow) complete() {
+	p.done = true
+	if util.RaceEnabled {
+		runtime.SetFinalizer(p, nil)
+	}
+}
+
+// checkCompleted is the finalizer of a PendingGrow in race builds.
+func (p *PendingGrow) checkCompleted() {
+	if !p.done {
+		panic(fmt.Sprintf("%s: leaked pending growth of %d bytes, made at:\n%s",
+			p.acc.monitorName(), p.est, p.stack))
+	}
+}
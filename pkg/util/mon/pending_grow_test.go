@@ -0,0 +1,136 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestPendingGrow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("batches", MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	if _, err := acc.GrowEstimated(ctx, 2000); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	// Downward correction.
+	p, err := acc.GrowEstimated(ctx, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Finalize(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Used() != 300 || m.AllocBytes() != 300 {
+		t.Fatalf("expected 300 bytes charged, got %d (%d in monitor)", acc.Used(), m.AllocBytes())
+	}
+
+	// A refused upward correction leaves the estimate charged.
+	p, err = acc.GrowEstimated(ctx, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Finalize(ctx, 900); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if acc.Used() != 800 {
+		t.Fatalf("expected the estimate to stay charged, got %d bytes", acc.Used())
+	}
+	// The growth is still pending, and can be corrected again.
+	if err := p.Finalize(ctx, 600); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Used() != 900 {
+		t.Fatalf("expected 900 bytes charged, got %d", acc.Used())
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected finalizing twice to panic")
+			}
+		}()
+		_ = p.Finalize(ctx, 600)
+	}()
+
+	// Abandoned growth.
+	acc.Shrink(ctx, 800)
+	p, err = acc.GrowEstimated(ctx, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Abandon(ctx)
+	if acc.Used() != 100 {
+		t.Fatalf("expected the estimate to be released, got %d bytes", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
+
+const pendingGrowLeakChildEnv = "COCKROACH_TEST_PENDING_GROW_LEAK_CHILD"
+
+// TestPendingGrowLeak checks that a PendingGrow garbage collected without
+// having been completed crashes race builds. Since this kills the process,
+// the leak happens in a child process running this same test.
+func TestPendingGrowLeak(t *testing.T) {
+	if !util.RaceEnabled {
+		t.Skip("leaked pending growths are only detected in race builds")
+	}
+
+	if os.Getenv(pendingGrowLeakChildEnv) != "" {
+		ctx := context.Background()
+		st := cluster.MakeTestingClusterSettings()
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+		m.Start(ctx, nil, MakeStandaloneBudget(1<<20))
+		acc := m.MakeBoundAccount()
+		if _, err := acc.GrowEstimated(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPendingGrowLeak$", "-test.timeout=30s")
+	cmd.Env = append(os.Environ(), pendingGrowLeakChildEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the child process to fail, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "leaked pending growth of 100 bytes") ||
+		!strings.Contains(string(out), "TestPendingGrowLeak") {
+		t.Fatalf("expected a report of the leaked pending growth, got:\n%s", out)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "math"
+
+// Pressure returns how close the monitor is to running out of budget, from 0
+// (no usage) to 1 (no headroom left). It is the worst of:
+// - the ratio of the usage of the monitor, including its external usage, to
+//   its limit, if it has one;
+// - for a monitor without a pool, the ratio of its usage to its pre-reserved
+//   budget;
+// - the pressure of its pool, and so on up the chain of pools.
+//
+// A monitor without a limit thus only reflects the pressure of its pools,
+// and an unlimited monitor (see MakeUnlimitedMonitor) is never under
+// pressure. Pressure only takes the locks of the monitors in the chain one
+// after the other, and is cheap enough to be called on every request.
+func (mm *BytesMonitor) Pressure() float64 {
+	var pressure float64
+	for m := mm; m != nil; {
+		var p float64
+		p, m = m.localPressure()
+		if p > pressure {
+			pressure = p
+		}
+	}
+	if pressure > 1 {
+		pressure = 1
+	}
+	return pressure
+}
+
+// localPressure returns the pressure of the monitor disregarding its pool,
+// and its pool.
+func (mm *BytesMonitor) localPressure() (float64, *BytesMonitor) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.refreshLimitLocked()
+	return mm.localPressureLocked(), mm.mu.curBudget.mon
+}
+
+// localPressureLocked returns the pressure of the monitor disregarding its
+// pool.
+func (mm *BytesMonitor) localPressureLocked() float64 {
+	used := mm.mu.curAllocated + mm.externalUsageLocked()
+	var p float64
+	if mm.limit != math.MaxInt64 {
+		p = ratio(used, mm.limit)
+	}
+	if mm.mu.curBudget.mon == nil && mm.reserved.used != math.MaxInt64 {
+		if r := ratio(used, mm.reserved.used); r > p {
+			p = r
+		}
+	}
+	return p
+}
+
+func ratio(used, capacity int64) float64 {
+	if capacity <= 0 {
+		if used > 0 {
+			return 1
+		}
+		return 0
+	}
+	return float64(used) / float64(capacity)
+}
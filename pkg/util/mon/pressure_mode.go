@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "sync/atomic"
+
+// PressureMode is the memory pressure of the whole process, as set by
+// SetGlobalPressureMode. Above NormalPressure, all the monitors become more
+// conservative at once, to give memory back to the process sooner.
+type PressureMode int32
+
+const (
+	// NormalPressure leaves the monitors as configured. This is the default.
+	NormalPressure PressureMode = iota
+	// ElevatedPressure makes the monitors request budget from their pools in
+	// allocation blocks four times smaller, makes those with a hysteresis
+	// release policy keep at most one block of unused budget, and lowers the
+	// soft thresholds by a quarter: the pressure at which the heap profile
+	// hook fires and the top consumers are logged, and the threshold of
+	// SpillableAccounts.
+	ElevatedPressure
+	// CriticalPressure makes the allocation blocks sixteen times smaller,
+	// makes all the monitors release their unused budget immediately,
+	// whatever their release policy, and halves the soft thresholds.
+	CriticalPressure
+)
+
+// globalPressureMode holds the PressureMode. It is accessed atomically, so
+// that the monitors can consult it on every operation.
+var globalPressureMode int32
+
+// SetGlobalPressureMode sets the memory pressure of the process, typically
+// from the controller that watches the heap. The monitors pick up the mode
+// on their next operation; the budget they already hold is only released
+// as they shrink (or by a Reclaimer).
+func SetGlobalPressureMode(mode PressureMode) {
+	atomic.StoreInt32(&globalPressureMode, int32(mode))
+}
+
+// GlobalPressureMode returns the memory pressure of the process.
+func GlobalPressureMode() PressureMode {
+	return PressureMode(atomic.LoadInt32(&globalPressureMode))
+}
+
+// allocationSize returns the allocation unit of the monitor for requests to
+// its pool in the current pressure mode.
+func (mm *BytesMonitor) allocationSize() int64 {
+	var sz int64
+	switch GlobalPressureMode() {
+	case NormalPressure:
+		return mm.poolAllocationSize
+	case ElevatedPressure:
+		sz = mm.poolAllocationSize / 4
+	default:
+		sz = mm.poolAllocationSize / 16
+	}
+	if sz < 1 {
+		sz = 1
+	}
+	return sz
+}
+
+// effectiveReleaseKind returns the release policy of the monitor in the
+// current pressure mode, and the hysteresis in blocks if it applies.
+func (mm *BytesMonitor) effectiveReleaseKind() (releaseKind, int) {
+	switch GlobalPressureMode() {
+	case NormalPressure:
+		return mm.releaseKind, mm.maxAllocatedButUnusedBlocks
+	case ElevatedPressure:
+		if mm.releaseKind == releaseHysteresis && mm.maxAllocatedButUnusedBlocks > 1 {
+			return releaseHysteresis, 1
+		}
+		return mm.releaseKind, mm.maxAllocatedButUnusedBlocks
+	default:
+		return releaseImmediately, 0
+	}
+}
+
+// softThresholdFactor returns the factor applied to the soft thresholds in
+// the current pressure mode.
+func softThresholdFactor() float64 {
+	switch GlobalPressureMode() {
+	case NormalPressure:
+		return 1
+	case ElevatedPressure:
+		return 0.75
+	default:
+		return 0.5
+	}
+}
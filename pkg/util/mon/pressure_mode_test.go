@@ -0,0 +1,107 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestGlobalPressureMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+	defer mon.SetGlobalPressureMode(mon.NormalPressure)
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	testCases := []struct {
+		name string
+		mode mon.PressureMode
+		// granted is the budget granted by the pool after growing by 100
+		// bytes, and retained the budget it still grants after growing to
+		// 1000 bytes and shrinking back to 50.
+		granted, retained int64
+		// spilled is whether a spillable account with a threshold of 1000
+		// spills at 600 bytes.
+		spilled bool
+		// captured is whether a heap profile hook set at 80% of the limit
+		// fires at 70%.
+		captured bool
+	}{
+		{"normal", mon.NormalPressure, 1024, 1024, false, false},
+		{"elevated", mon.ElevatedPressure, 256, 256, false, true},
+		{"critical", mon.CriticalPressure, 128, 50, true, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mon.SetGlobalPressureMode(tc.mode)
+			defer mon.SetGlobalPressureMode(mon.NormalPressure)
+
+			pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+				mon.WithReservationPolicy(mon.ReleaseEagerly))
+			pool.Start(ctx, nil, mon.MakeStandaloneBudget(100000))
+			var captured bool
+			m := mon.MakeMonitorWithLimit("test", mon.MemoryResource, 10000, nil, nil, 1024, math.MaxInt64, st,
+				mon.WithHysteresis(10), mon.WithReservationPolicy(mon.ReleaseEagerly),
+				mon.WithHeapProfileHook(0.8, 0.1, time.Minute, func(context.Context) { captured = true }))
+			m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+
+			acc := m.MakeBoundAccount()
+			if err := acc.Grow(ctx, 100); err != nil {
+				t.Fatal(err)
+			}
+			if a := pool.AllocBytes(); a != tc.granted {
+				t.Errorf("expected %d bytes granted, got %d", tc.granted, a)
+			}
+			if err := acc.Grow(ctx, 900); err != nil {
+				t.Fatal(err)
+			}
+			acc.Shrink(ctx, 950)
+			if a := pool.AllocBytes(); a != tc.retained {
+				t.Errorf("expected %d bytes retained, got %d", tc.retained, a)
+			}
+
+			mem, disk := m.MakeBoundAccount(), m.MakeBoundAccount()
+			s := mon.MakeSpillableAccount(&mem, &disk, 1000)
+			if err := s.Grow(ctx, 600); err != nil {
+				t.Fatal(err)
+			}
+			if s.Spilled() != tc.spilled {
+				t.Errorf("expected spilled %t, got %t", tc.spilled, s.Spilled())
+			}
+			s.Close(ctx)
+
+			if err := acc.Grow(ctx, 6950); err != nil {
+				t.Fatal(err)
+			}
+			if captured != tc.captured {
+				t.Errorf("expected captured %t, got %t", tc.captured, captured)
+			}
+
+			acc.Close(ctx)
+			mem.Close(ctx)
+			disk.Close(ctx)
+			m.Stop(ctx)
+			pool.Stop(ctx)
+		})
+	}
+}
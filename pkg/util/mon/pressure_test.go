@@ -0,0 +1,91 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestPressure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	expect := func(m *BytesMonitor, expected float64) {
+		t.Helper()
+		if p := m.Pressure(); math.Abs(p-expected) > 1e-9 {
+			t.Errorf("%s: expected a pressure of %.2f, got %.2f", m.name, expected, p)
+		}
+	}
+
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+	limited := MakeMonitorWithLimit("limited", MemoryResource, 100, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	limited.Start(ctx, &pool, MakeStandaloneBudget(0))
+	unlimited := MakeMonitor("unlimited", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	unlimited.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	expect(&pool, 0)
+	expect(&limited, 0)
+
+	// Local limit.
+	a1 := limited.MakeBoundAccount()
+	if err := a1.Grow(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	expect(&limited, 0.5)
+	expect(&unlimited, 0.05)
+	expect(&pool, 0.05)
+
+	// The pool fills up and its pressure takes over.
+	a2 := unlimited.MakeBoundAccount()
+	if err := a2.Grow(ctx, 750); err != nil {
+		t.Fatal(err)
+	}
+	expect(&pool, 0.8)
+	expect(&limited, 0.8)
+	expect(&unlimited, 0.8)
+
+	// External usage counts too, and the pressure is capped at 1.
+	limited.RegisterExternalUsage("ext", func() int64 { return 1000 })
+	expect(&limited, 1)
+	expect(&pool, 0.8)
+
+	// An unlimited monitor is never under pressure.
+	root := MakeUnlimitedMonitor(ctx, "root", MemoryResource, nil, nil, 1000, st)
+	a3 := root.MakeBoundAccount()
+	if err := a3.Grow(ctx, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	expect(&root, 0)
+
+	a1.Close(ctx)
+	a2.Close(ctx)
+	a3.Close(ctx)
+	root.Stop(ctx)
+	limited.Stop(ctx)
+	unlimited.Stop(ctx)
+	pool.Stop(ctx)
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// TestReserve returns the error that reserving n bytes through the monitor
+// would return right now, or nil if the reservation would succeed, without
+// reserving anything. Unlike ApproxHeadroom, it takes the locks of the
+// monitor and its pools and performs the same checks as a reservation:
+// whether the monitor is stopped or frozen, the limit (including the burst
+// allowance and the enforcement mode) and the budget of the monitor and of
+// its pools, in that order.
+//
+// The answer is only valid at the time it is given: as nothing is held,
+// other allocations may consume the budget before the caller acts on it.
+// TestReserve also disregards the caches that an account would evict to
+// make room (see RegisterEvictableCache) and the testing failure injector.
+func (mm *BytesMonitor) TestReserve(ctx context.Context, n int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.mu.stopped {
+		return mm.errStopped()
+	}
+	if mm.mu.frozen {
+		return mm.errFrozen()
+	}
+	_, _, err := mm.admitLocked(ctx, n, true /* dryRun */)
+	return err
+}
+
+// testIncreaseBudgetLocked is the dry-run counterpart of increaseBudget.
+func (mm *BytesMonitor) testIncreaseBudgetLocked(ctx context.Context, minExtra int64) error {
+	pool := mm.mu.curBudget.mon
+	if pool == nil {
+		return mm.noPoolErrorLocked(minExtra, mm.mu.curAllocated)
+	}
+	// Mirror BoundAccount.Grow on the budget account of the monitor.
+	minExtra = mm.roundBudgetRequest(minExtra)
+	if mm.mu.curBudget.reserved >= minExtra {
+		return nil
+	}
+	return forwardedBy(pool.TestReserve(ctx, pool.roundSize(minExtra)), mm)
+}
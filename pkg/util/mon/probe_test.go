@@ -0,0 +1,135 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+)
+
+func TestTestReserve(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	rnd, _ := randutil.NewPseudoRand()
+
+	for _, increment := range []int64{1, 10, 64} {
+		t.Run(fmt.Sprintf("increment=%d", increment), func(t *testing.T) {
+			pool := MakeMonitor("pool", MemoryResource, nil, nil, increment, 1000, st)
+			pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+			m := MakeMonitorWithLimit("test", MemoryResource, 800, nil, nil, increment, 1e9, st)
+			m.Start(ctx, &pool, MakeStandaloneBudget(50))
+
+			// A competing monitor fills the pool independently.
+			other := MakeMonitor("other", MemoryResource, nil, nil, increment, 1e9, st)
+			other.Start(ctx, &pool, MakeStandaloneBudget(0))
+			otherAcc := other.MakeBoundAccount()
+
+			var reserved []int64
+			for i := 0; i < 500; i++ {
+				switch rnd.Intn(4) {
+				case 0:
+					if len(reserved) > 0 {
+						j := rnd.Intn(len(reserved))
+						m.releaseBytes(ctx, reserved[j])
+						reserved = append(reserved[:j], reserved[j+1:]...)
+					}
+					continue
+				case 1:
+					if n := otherAcc.Used(); n > 0 && rnd.Intn(2) == 0 {
+						otherAcc.Shrink(ctx, 1+rnd.Int63n(n))
+					} else {
+						_ = otherAcc.Grow(ctx, 1+rnd.Int63n(200))
+					}
+					continue
+				}
+
+				n := 1 + rnd.Int63n(300)
+				before, poolBefore := m.Snapshot(), pool.Snapshot()
+				probeErr := m.TestReserve(ctx, n)
+				if after, poolAfter := m.Snapshot(), pool.Snapshot(); !reflect.DeepEqual(before, after) ||
+					!reflect.DeepEqual(poolBefore, poolAfter) {
+					t.Fatalf("TestReserve modified the monitors: %+v -> %+v, pool %+v -> %+v",
+						before, after, poolBefore, poolAfter)
+				}
+				err := m.reserveBytes(ctx, n)
+				if fmt.Sprint(probeErr) != fmt.Sprint(err) {
+					t.Fatalf("TestReserve(%d) returned %v, but the reservation returned %v\n%s\n%s",
+						n, probeErr, err, m.DebugString(), pool.DebugString())
+				}
+				if err == nil {
+					reserved = append(reserved, n)
+				}
+			}
+
+			for _, n := range reserved {
+				m.releaseBytes(ctx, n)
+			}
+			otherAcc.Close(ctx)
+			other.Stop(ctx)
+			m.Stop(ctx)
+			pool.Stop(ctx)
+		})
+	}
+}
+
+func TestTestReserveStoppedFrozen(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitor("pool", MemoryResource, nil, nil, 1, 1000, st)
+	pool.Start(ctx, nil, MakeStandaloneBudget(1000))
+	// The monitor returns its budget to the pool right away, so that each
+	// reservation goes to the pool.
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1e9, st, WithHysteresis(0))
+	m.Start(ctx, &pool, MakeStandaloneBudget(0))
+
+	// The probe returns the error of the reservation, without reserving.
+	check := func(expectErr bool) {
+		t.Helper()
+		probeErr := m.TestReserve(ctx, 10)
+		if (probeErr != nil) != expectErr {
+			t.Fatalf("expected error: %t, got %v", expectErr, probeErr)
+		}
+		err := m.reserveBytes(ctx, 10)
+		if fmt.Sprint(probeErr) != fmt.Sprint(err) {
+			t.Fatalf("TestReserve returned %v, but the reservation returned %v", probeErr, err)
+		}
+		if err == nil {
+			m.releaseBytes(ctx, 10)
+		}
+	}
+	check(false)
+	pool.SetFrozen(true)
+	check(true)
+	pool.SetFrozen(false)
+	m.SetFrozen(true)
+	check(true)
+	m.SetFrozen(false)
+	check(false)
+	m.Stop(ctx)
+	check(true)
+	pool.Stop(ctx)
+}
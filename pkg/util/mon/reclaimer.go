@@ -0,0 +1,222 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// MonitorLister lists the monitors swept by a Reclaimer. StartedMonitors
+// lists all the monitors of the process.
+type MonitorLister func() []MonitorHandle
+
+// ReclaimerOptions configures a Reclaimer.
+type ReclaimerOptions struct {
+	// Interval is the time between two sweeps.
+	Interval time.Duration
+	// IdleThreshold is the time during which a monitor must have neither
+	// allocated nor released bytes for its unused budget to be reclaimed.
+	IdleThreshold time.Duration
+	// MaxBytesPerSweep and MaxMonitorsPerSweep cap the number of bytes
+	// reclaimed, and of monitors trimmed, by a sweep, so that sweeps stay
+	// cheap. 0 means no cap.
+	MaxBytesPerSweep    int64
+	MaxMonitorsPerSweep int
+	// TimeSource measures the intervals and idle times. It defaults to
+	// DefaultTimeSource.
+	TimeSource TimeSource
+	// Logger receives the log messages of the sweeps. It defaults to
+	// DefaultLogger.
+	Logger Logger
+	// ReclaimedBytes, if set, counts the bytes reclaimed, and
+	// TrimmedMonitors the number of times a monitor was trimmed.
+	ReclaimedBytes  Counter
+	TrimmedMonitors Counter
+}
+
+// Reclaimer periodically returns to their pools the budget that idle
+// monitors keep without using it, e.g. because of their hysteresis, so that
+// monitors don't need to time their own trimming. The monitors with the
+// most unused budget are trimmed first.
+//
+// A monitor is idle if it neither allocated nor released bytes during the
+// idle threshold. This is detected without locking the monitor, so that a
+// sweep never waits on busy monitors; only the idle ones are locked, to
+// trim them.
+type Reclaimer struct {
+	lister MonitorLister
+	opts   ReclaimerOptions
+
+	mu struct {
+		syncutil.Mutex
+		// observed holds the activity of the monitors as of the last sweep,
+		// by ID.
+		observed map[uint64]observedActivity
+		// stopper is closed to stop the background sweeps, if started, and
+		// done is closed once they stopped.
+		stopper chan struct{}
+		done    chan struct{}
+	}
+}
+
+// observedActivity is the activity counter of a monitor, and the time at
+// which the Reclaimer first observed it.
+type observedActivity struct {
+	activity uint64
+	since    time.Time
+}
+
+// NewReclaimer creates a Reclaimer sweeping the monitors listed by lister.
+// The sweeps start with Start, or can be run with Sweep.
+func NewReclaimer(lister MonitorLister, opts ReclaimerOptions) *Reclaimer {
+	if opts.TimeSource == nil {
+		opts.TimeSource = DefaultTimeSource
+	}
+	opts.Logger = loggerOrDefault(opts.Logger)
+	opts.ReclaimedBytes = counterOrNil(opts.ReclaimedBytes)
+	opts.TrimmedMonitors = counterOrNil(opts.TrimmedMonitors)
+	r := &Reclaimer{lister: lister, opts: opts}
+	r.mu.observed = make(map[uint64]observedActivity)
+	return r
+}
+
+// Start runs a sweep every Interval in the background, until Stop is
+// called.
+func (r *Reclaimer) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.stopper != nil {
+		panic("reclaimer already started")
+	}
+	stopper, done := make(chan struct{}), make(chan struct{})
+	r.mu.stopper, r.mu.done = stopper, done
+	go func() {
+		defer close(done)
+		for {
+			t := r.opts.TimeSource.NewTimer(r.opts.Interval)
+			select {
+			case <-t.C():
+				r.Sweep(ctx)
+			case <-stopper:
+				t.Stop()
+				return
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background sweeps, and waits for the current one to
+// complete.
+func (r *Reclaimer) Stop() {
+	r.mu.Lock()
+	stopper, done := r.mu.stopper, r.mu.done
+	r.mu.stopper, r.mu.done = nil, nil
+	r.mu.Unlock()
+	if stopper == nil {
+		return
+	}
+	close(stopper)
+	<-done
+}
+
+// reclaimCandidate is an idle monitor with unused budget.
+type reclaimCandidate struct {
+	h      MonitorHandle
+	unused int64
+}
+
+// Sweep trims the idle monitors, within the caps of the options, and returns
+// the number of bytes reclaimed.
+func (r *Reclaimer) Sweep(ctx context.Context) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.opts.TimeSource.Now()
+
+	observed := make(map[uint64]observedActivity, len(r.mu.observed))
+	var candidates []reclaimCandidate
+	for _, h := range r.lister() {
+		var activity uint64
+		if err := h.do(func(mm *BytesMonitor) {
+			activity = atomic.LoadUint64(&mm.activity)
+		}); err != nil {
+			// The monitor was stopped.
+			continue
+		}
+		o, ok := r.mu.observed[h.id]
+		if !ok || o.activity != activity {
+			// The monitor is new, or was used since the last sweep.
+			observed[h.id] = observedActivity{activity: activity, since: now}
+			continue
+		}
+		observed[h.id] = o
+		if now.Sub(o.since) < r.opts.IdleThreshold {
+			continue
+		}
+		var unused int64
+		_ = h.do(func(mm *BytesMonitor) {
+			mm.mu.Lock()
+			defer mm.mu.Unlock()
+			unused = mm.unusedPoolBudgetLocked()
+		})
+		if unused > 0 {
+			candidates = append(candidates, reclaimCandidate{h: h, unused: unused})
+		}
+	}
+	r.mu.observed = observed
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].unused > candidates[j].unused
+	})
+	var reclaimed int64
+	var trimmed int
+	for _, c := range candidates {
+		max := c.unused
+		if r.opts.MaxBytesPerSweep > 0 {
+			if left := r.opts.MaxBytesPerSweep - reclaimed; left < max {
+				max = left
+			}
+		}
+		if max <= 0 || (r.opts.MaxMonitorsPerSweep > 0 && trimmed >= r.opts.MaxMonitorsPerSweep) {
+			break
+		}
+		var n int64
+		_ = c.h.do(func(mm *BytesMonitor) {
+			n = mm.releaseUnused(ctx, max)
+		})
+		if n == 0 {
+			continue
+		}
+		reclaimed += n
+		trimmed++
+		if r.opts.ReclaimedBytes != nil {
+			r.opts.ReclaimedBytes.Inc(n)
+		}
+		if r.opts.TrimmedMonitors != nil {
+			r.opts.TrimmedMonitors.Inc(1)
+		}
+	}
+	if r.opts.Logger.V(1) && reclaimed > 0 {
+		r.opts.Logger.Infof(ctx, "reclaimed %d bytes from %d idle monitors", reclaimed, trimmed)
+	}
+	return reclaimed
+}
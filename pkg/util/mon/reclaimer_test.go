@@ -0,0 +1,205 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestReclaimer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(10000))
+	defer pool.Stop(ctx)
+
+	// Each monitor keeps its unused budget, until it is reclaimed.
+	type child struct {
+		m   *mon.BytesMonitor
+		acc mon.BoundAccount
+	}
+	var children []*child
+	makeChild := func(name string, grow, shrink int64) *child {
+		m := mon.MakeMonitor(name, mon.MemoryResource, nil, nil, 100, math.MaxInt64, st,
+			mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+			mon.WithHysteresis(100))
+		c := &child{m: &m}
+		c.m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+		c.acc = c.m.MakeBoundAccount()
+		if err := c.acc.Grow(ctx, grow); err != nil {
+			t.Fatal(err)
+		}
+		c.acc.Shrink(ctx, shrink)
+		children = append(children, c)
+		return c
+	}
+	makeChild("large", 450, 400)
+	makeChild("small", 250, 200)
+	busy := makeChild("busy", 250, 200)
+	defer func() {
+		for _, c := range children {
+			c.acc.Close(ctx)
+			c.m.Stop(ctx)
+		}
+	}()
+	use := func(c *child) {
+		if err := c.acc.Grow(ctx, 10); err != nil {
+			t.Fatal(err)
+		}
+		c.acc.Shrink(ctx, 10)
+	}
+	// The registry only lists the monitors of the test, so that the monitors
+	// of other tests aren't trimmed.
+	lister := func() []mon.MonitorHandle {
+		var res []mon.MonitorHandle
+		for _, c := range children {
+			h, err := mon.LookupMonitor(c.m.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, h)
+		}
+		return res
+	}
+
+	reclaimed := metric.NewCounter(metric.Metadata{Name: "test.reclaimed"})
+	trimmed := metric.NewCounter(metric.Metadata{Name: "test.trimmed"})
+	r := mon.NewReclaimer(lister, mon.ReclaimerOptions{
+		IdleThreshold:       time.Minute,
+		MaxBytesPerSweep:    400,
+		MaxMonitorsPerSweep: 1,
+		TimeSource:          clock,
+		ReclaimedBytes:      reclaimed,
+		TrimmedMonitors:     trimmed,
+	})
+
+	unused := func() []int64 {
+		res := make([]int64, len(children))
+		for i, c := range children {
+			s := c.m.Snapshot()
+			res[i] = s.PoolBudgetUsed - s.Allocated
+		}
+		return res
+	}
+	sweep := func(expected int64, expectedUnused ...int64) {
+		t.Helper()
+		if n := r.Sweep(ctx); n != expected {
+			t.Fatalf("expected %d bytes reclaimed, got %d", expected, n)
+		}
+		u := unused()
+		for i := range expectedUnused {
+			if u[i] != expectedUnused[i] {
+				t.Fatalf("expected unused budgets %v, got %v", expectedUnused, u)
+			}
+		}
+	}
+
+	// The first sweep only observes the monitors.
+	sweep(0, 450, 250, 250)
+	clock.Advance(30 * time.Second)
+	use(busy)
+	sweep(0, 450, 250, 250)
+	clock.Advance(31 * time.Second)
+	use(busy)
+	// The largest idle monitor is trimmed first, within the byte budget of
+	// the sweep, and one monitor is trimmed per sweep.
+	sweep(400, 50, 250, 250)
+	use(busy)
+	sweep(250, 50, 0, 250)
+	use(busy)
+	sweep(50, 0, 0, 250)
+	use(busy)
+	sweep(0, 0, 0, 250)
+	if c := reclaimed.Count(); c != 700 {
+		t.Errorf("expected 700 bytes reclaimed, got %d", c)
+	}
+	if c := trimmed.Count(); c != 3 {
+		t.Errorf("expected 3 trims, got %d", c)
+	}
+
+	// Once idle, the busy monitor is trimmed too.
+	clock.Advance(30 * time.Second)
+	sweep(0, 0, 0, 250)
+	clock.Advance(30 * time.Second)
+	sweep(250, 0, 0, 0)
+}
+
+func TestReclaimerBackground(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(10000))
+	m := mon.MakeMonitor("idle", mon.MemoryResource, nil, nil, 100, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+		mon.WithHysteresis(100))
+	m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	acc.Shrink(ctx, 500)
+
+	reclaimed := metric.NewCounter(metric.Metadata{Name: "test.reclaimed"})
+	lister := func() []mon.MonitorHandle {
+		h, err := mon.LookupMonitor(m.ID())
+		if err != nil {
+			return nil
+		}
+		return []mon.MonitorHandle{h}
+	}
+	r := mon.NewReclaimer(lister, mon.ReclaimerOptions{
+		Interval:       time.Second,
+		IdleThreshold:  time.Second,
+		TimeSource:     clock,
+		ReclaimedBytes: reclaimed,
+	})
+	r.Start(ctx)
+	// The monitor is observed by the first sweep, and trimmed by the second
+	// one.
+	for reclaimed.Count() == 0 {
+		for clock.NumTimers() == 0 {
+			runtime.Gosched()
+		}
+		clock.Advance(time.Second)
+	}
+	r.Stop()
+	montest.AssertEmpty(t, &pool)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+	pool.Stop(ctx)
+}
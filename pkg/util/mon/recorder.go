@@ -0,0 +1,122 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Recorder records the accounting operations (Grow, Shrink, Clear and Close)
+// performed on the accounts of the monitors it is attached to, as text with
+// one operation per line. Given a deterministic workload the recording is
+// deterministic, so tests can compare it against a golden file to review
+// the exact accounting behavior of a component.
+//
+// Accounts are identified by the names given with NameAccount, or else by
+// "acc" followed by the order in which the recorder first saw them.
+type Recorder struct {
+	// bucketSizes, if set, rounds sizes up to powers of two, so that small
+	// changes to the sizes estimated by a component don't change the
+	// recording.
+	bucketSizes bool
+
+	mu struct {
+		syncutil.Mutex
+		buf   bytes.Buffer
+		names map[*BoundAccount]string
+		// unnamed is the number of accounts named by the recorder.
+		unnamed int
+	}
+}
+
+// NewRecorder creates a Recorder. If bucketSizes is set, sizes are rounded up
+// to powers of two in the recording.
+func NewRecorder(bucketSizes bool) *Recorder {
+	r := &Recorder{bucketSizes: bucketSizes}
+	r.mu.names = make(map[*BoundAccount]string)
+	return r
+}
+
+// TestingSetRecorder makes the monitor record the operations on its accounts
+// into r. It must be called before the monitor is shared; a nil r disables
+// recording.
+func (mm *BytesMonitor) TestingSetRecorder(r *Recorder) {
+	mm.testingRecorder = r
+}
+
+// NameAccount sets the name identifying acc in the recording.
+func (r *Recorder) NameAccount(acc *BoundAccount, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.names[acc] = name
+}
+
+// String returns the recording.
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mu.buf.String()
+}
+
+// lastOps returns the last n operations of the recording.
+func (r *Recorder) lastOps(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := strings.Split(strings.TrimSuffix(r.mu.buf.String(), "\n"), "\n")
+	if len(ops) == 1 && ops[0] == "" {
+		return nil
+	}
+	if len(ops) > n {
+		ops = ops[len(ops)-n:]
+	}
+	return ops
+}
+
+// Reset discards the recording. Account names are retained.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.buf.Reset()
+}
+
+func (r *Recorder) bucket(sz int64) int64 {
+	if !r.bucketSizes || sz <= 0 {
+		return sz
+	}
+	return 1 << uint(bits.Len64(uint64(sz-1)))
+}
+
+// record appends an operation on acc to the recording. err is the outcome
+// of the operation, if it can fail.
+func (r *Recorder) record(acc *BoundAccount, op string, sz int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, ok := r.mu.names[acc]
+	if !ok {
+		r.mu.unnamed++
+		name = fmt.Sprintf("acc%d", r.mu.unnamed)
+		r.mu.names[acc] = name
+	}
+	fmt.Fprintf(&r.mu.buf, "%s/%s: %s %d", acc.mon.name, name, op, r.bucket(sz))
+	if err != nil {
+		r.mu.buf.WriteString(" (denied)")
+	}
+	r.mu.buf.WriteByte('\n')
+}
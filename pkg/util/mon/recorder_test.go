@@ -0,0 +1,118 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+var rewriteResultsInTestfiles = flag.Bool(
+	"rewrite-results-in-testfiles", false,
+	"ignore the expected results and rewrite the test files with the actual results from this "+
+		"run. Used to update tests when a change affects many cases; please verify the testfile "+
+		"diffs carefully!",
+)
+
+// recordWorkload runs a deterministic workload against a monitor with r
+// attached.
+func recordWorkload(t *testing.T, r *Recorder) {
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.TestingSetRecorder(r)
+	m.Start(ctx, nil, MakeStandaloneBudget(300))
+
+	rows := m.MakeBoundAccount()
+	r.NameAccount(&rows, "rows")
+	csvAcc := m.MakeBoundAccount()
+
+	input := "id,name\n1,alpha\n2,\"multi\nline\"\n3," + strings.Repeat("x", 250) + "\n"
+	cr := NewCSVReader(ctx, strings.NewReader(input), &csvAcc, 0 /* maxRecordSize */)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The last record doesn't fit in the budget.
+			break
+		}
+		var sz int64
+		for _, f := range record {
+			sz += StringSize(f)
+		}
+		if err := rows.Grow(ctx, sz); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cr.Close()
+	rows.Shrink(ctx, rows.Used()/2)
+	rows.Clear(ctx)
+	rows.Close(ctx)
+	csvAcc.Close(ctx)
+	m.Stop(ctx)
+}
+
+func TestRecorder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	testCases := []struct {
+		golden      string
+		bucketSizes bool
+	}{
+		{"recording", false},
+		{"recording_bucketed", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.golden, func(t *testing.T) {
+			r := NewRecorder(tc.bucketSizes)
+			recordWorkload(t, r)
+			actual := r.String()
+
+			path := filepath.Join("testdata", tc.golden)
+			if *rewriteResultsInTestfiles {
+				if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Fatalf("recording differs from %s (run with -rewrite-results-in-testfiles "+
+					"to update it):\nexpected:\n%s\nactual:\n%s", path, expected, actual)
+			}
+
+			// The recording is deterministic.
+			r2 := NewRecorder(tc.bucketSizes)
+			recordWorkload(t, r2)
+			if r2.String() != actual {
+				t.Fatalf("recording is not deterministic:\n%s\nvs:\n%s", actual, r2.String())
+			}
+		})
+	}
+}
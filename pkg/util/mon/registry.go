@@ -0,0 +1,266 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// debugMonitorRegistry, if set, makes the registry record the stack of the
+// goroutine that started each monitor, to help track down monitors that are
+// never stopped or that leak bytes. The stack is reported by
+// TestingVerifyAllStopped, in the snapshot of the monitor and when Stop finds
+// leaked bytes. When it is not set, no stack is captured.
+var debugMonitorRegistry = envutil.EnvOrDefaultBool("COCKROACH_DEBUG_MONITOR_REGISTRY", false)
+
+// monitorRegistry tracks the monitors that have been started and not yet
+// stopped. Monitors register themselves in Start, since the constructors
+// return them by value, and unregister in Stop and EmergencyStop. Monitors
+// are started and stopped on hot paths, e.g. for every SQL statement, so the
+// registry is a sync.Map rather than a map under a mutex of its own: its
+// reads don't lock, and its writes, which lock the sync.Map internally, are
+// only a store and a delete per monitor.
+var monitorRegistry struct {
+	// seq is incremented atomically every time a monitor is started. Its
+	// value is the ID of the monitor.
+	seq uint64
+	// monitors maps the IDs of the registered monitors to their
+	// *registeredMonitor.
+	monitors sync.Map
+}
+
+// registeredMonitor is the registry's record of a started monitor.
+type registeredMonitor struct {
+	// seq orders the monitors by the time they were started. It is also the
+	// ID of the monitor.
+	seq uint64
+	mm  *BytesMonitor
+	// owner is the test that started the monitor, if it was started with a
+	// context from TestingContextWithOwner.
+	owner testingT
+	// stack is the stack that started the monitor; only recorded if
+	// debugMonitorRegistry is set.
+	stack []byte
+
+	// mu is read-locked while a MonitorHandle uses the monitor, so that the
+	// monitor can't be stopped concurrently; see MonitorHandle.do.
+	mu struct {
+		syncutil.RWMutex
+		unregistered bool
+	}
+}
+
+func registerMonitor(ctx context.Context, mm *BytesMonitor) {
+	owner, _ := ctx.Value(testingOwnerKey{}).(testingT)
+	var stack []byte
+	if debugMonitorRegistry {
+		stack = debug.Stack()
+	}
+	id := atomic.AddUint64(&monitorRegistry.seq, 1)
+	mm.mu.Lock()
+	mm.mu.id = id
+	mm.mu.startStack = stack
+	mm.mu.Unlock()
+	monitorRegistry.monitors.Store(id, &registeredMonitor{seq: id, mm: mm, owner: owner, stack: stack})
+}
+
+// unregisterMonitor removes mm from the registry, and waits for the
+// MonitorHandles using it to be done.
+func unregisterMonitor(mm *BytesMonitor) {
+	id := mm.ID()
+	v, ok := monitorRegistry.monitors.Load(id)
+	if !ok || v.(*registeredMonitor).mm != mm {
+		return
+	}
+	monitorRegistry.monitors.Delete(id)
+	r := v.(*registeredMonitor)
+	r.mu.Lock()
+	r.mu.unregistered = true
+	r.mu.Unlock()
+}
+
+// ID returns the process-unique ID assigned to the monitor when it was last
+// started, or 0 if it was never started.
+func (mm *BytesMonitor) ID() uint64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.id
+}
+
+// ErrMonitorStopped is the cause of the errors returned by the operations of
+// a MonitorHandle whose monitor has been stopped, and by the reservations of
+// accounts whose monitor has been stopped, e.g. by straggling goroutines.
+var ErrMonitorStopped = errors.New("monitor stopped")
+
+// MonitorHandle refers to a started monitor by ID. It is only valid until
+// the monitor is stopped: it doesn't keep the monitor alive, and its
+// operations return ErrMonitorStopped from then on.
+type MonitorHandle struct {
+	id uint64
+}
+
+// LookupMonitor returns a handle to the started monitor with the given ID,
+// or ErrMonitorStopped if there is no such monitor.
+func LookupMonitor(id uint64) (MonitorHandle, error) {
+	if _, ok := monitorRegistry.monitors.Load(id); !ok {
+		return MonitorHandle{}, errors.Wrapf(ErrMonitorStopped, "no monitor with ID %d", id)
+	}
+	return MonitorHandle{id: id}, nil
+}
+
+// ID returns the ID of the monitor.
+func (h MonitorHandle) ID() uint64 {
+	return h.id
+}
+
+// Name returns the name of the monitor.
+func (h MonitorHandle) Name() (string, error) {
+	var name string
+	err := h.do(func(mm *BytesMonitor) { name = mm.name })
+	return name, err
+}
+
+// Snapshot returns a snapshot of the counters of the monitor.
+func (h MonitorHandle) Snapshot() (MonitorSnapshot, error) {
+	var s MonitorSnapshot
+	err := h.do(func(mm *BytesMonitor) { s = mm.Snapshot() })
+	return s, err
+}
+
+// DebugString returns the DebugString of the monitor.
+func (h MonitorHandle) DebugString() (string, error) {
+	var s string
+	err := h.do(func(mm *BytesMonitor) { s = mm.DebugString() })
+	return s, err
+}
+
+// do runs fn on the monitor if it is still started. The monitor can't be
+// stopped while fn runs (see doStop, which unregisters the monitor first),
+// but the rest of the registry isn't locked.
+func (h MonitorHandle) do(fn func(*BytesMonitor)) error {
+	v, ok := monitorRegistry.monitors.Load(h.id)
+	if !ok {
+		return errors.Wrapf(ErrMonitorStopped, "monitor %d", h.id)
+	}
+	r := v.(*registeredMonitor)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.unregistered {
+		return errors.Wrapf(ErrMonitorStopped, "monitor %d", h.id)
+	}
+	fn(r.mm)
+	return nil
+}
+
+// StartedMonitors returns handles to all the monitors started and not yet
+// stopped, in the order they were started. It is the list of monitors swept
+// by the Reclaimer of a node.
+func StartedMonitors() []MonitorHandle {
+	var res []MonitorHandle
+	monitorRegistry.monitors.Range(func(k, _ interface{}) bool {
+		res = append(res, MonitorHandle{id: k.(uint64)})
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res
+}
+
+// testingT is the subset of testing.TB used by TestingVerifyAllStopped. It
+// avoids linking the testing package into production binaries.
+type testingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+	Failed() bool
+}
+
+type testingOwnerKey struct{}
+
+// TestingContextWithOwner returns a context that makes t the owner of the
+// monitors started with it, for TestingVerifyAllStopped.
+func TestingContextWithOwner(ctx context.Context, t testingT) context.Context {
+	return context.WithValue(ctx, testingOwnerKey{}, t)
+}
+
+// TestingVerifyAllStopped checks that the monitors started under the test t
+// are stopped by the time the function it returns is called. It is meant to
+// be deferred at the top of a test, like leaktest.AfterTest, with the
+// monitors of the test started with a context from TestingContextWithOwner:
+//
+//   defer mon.TestingVerifyAllStopped(t)()
+//   ctx := mon.TestingContextWithOwner(context.Background(), t)
+//
+// The monitors owned by other tests are ignored, so that tests running in
+// parallel don't report each other's monitors. Monitors started without an
+// owner are reported if they were started after the call, as they can't be
+// told apart from the monitors of the test otherwise. The stacks that
+// started the leaked monitors are included when the
+// COCKROACH_DEBUG_MONITOR_REGISTRY environment variable is set. If the test
+// failed with metamorphic monitor parameters, the seed is logged so that the
+// failure can be reproduced.
+func TestingVerifyAllStopped(t testingT) func() {
+	checkpoint := atomic.LoadUint64(&monitorRegistry.seq)
+
+	return func() {
+		t.Helper()
+		type leak struct {
+			seq  uint64
+			desc string
+		}
+		var leaks []leak
+		monitorRegistry.monitors.Range(func(_, v interface{}) bool {
+			r := v.(*registeredMonitor)
+			if r.owner != t && (r.owner != nil || r.seq <= checkpoint) {
+				return true
+			}
+			desc := fmt.Sprintf("%s (id %d)", r.mm.name, r.seq)
+			if r.stack != nil {
+				desc = fmt.Sprintf("%s, started at:\n%s", desc, r.stack)
+			}
+			leaks = append(leaks, leak{seq: r.seq, desc: desc})
+			return true
+		})
+
+		if metamorphicParams {
+			defer func() {
+				if t.Failed() {
+					t.Logf("metamorphic monitor parameters: COCKROACH_MON_METAMORPHIC_SEED=%d",
+						metamorphic.seed)
+				}
+			}()
+		}
+		if len(leaks) == 0 {
+			return
+		}
+		sort.Slice(leaks, func(i, j int) bool { return leaks[i].seq < leaks[j].seq })
+		descs := make([]string, len(leaks))
+		for i := range leaks {
+			descs[i] = leaks[i].desc
+		}
+		t.Errorf("%d monitor(s) started during the test were not stopped:\n%s",
+			len(leaks), strings.Join(descs, "\n"))
+	}
+}
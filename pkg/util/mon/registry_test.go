@@ -0,0 +1,265 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// recordingT records the errors and messages reported through it.
+type recordingT struct {
+	errors []string
+	logs   []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingT) Failed() bool {
+	return len(r.errors) > 0
+}
+
+func TestTestingVerifyAllStopped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	var rt, other recordingT
+	rtCtx := TestingContextWithOwner(context.Background(), &rt)
+	otherCtx := TestingContextWithOwner(context.Background(), &other)
+	unowned := context.Background()
+
+	// An unowned monitor started before the checkpoint is not reported, but
+	// a monitor owned by the test is.
+	before := MakeMonitor("before", MemoryResource, nil, nil, 1, 1000, st)
+	before.Start(unowned, nil, MakeStandaloneBudget(100))
+	owned := MakeMonitor("owned", MemoryResource, nil, nil, 1, 1000, st)
+	owned.Start(rtCtx, nil, MakeStandaloneBudget(100))
+
+	verify := TestingVerifyAllStopped(&rt)
+
+	stopped := MakeMonitor("stopped", MemoryResource, nil, nil, 1, 1000, st)
+	stopped.Start(rtCtx, nil, MakeStandaloneBudget(100))
+	stopped.Stop(ctx)
+	leaked := MakeMonitor("leaked", MemoryResource, nil, nil, 1, 1000, st)
+	leaked.Start(unowned, nil, MakeStandaloneBudget(100))
+	// A monitor owned by another test running in parallel is not reported.
+	parallel := MakeMonitor("parallel", MemoryResource, nil, nil, 1, 1000, st)
+	parallel.Start(otherCtx, nil, MakeStandaloneBudget(100))
+
+	verify()
+	if len(rt.errors) != 1 || !strings.HasSuffix(rt.errors[0], fmt.Sprintf(
+		"not stopped:\nowned (id %d)\nleaked (id %d)", owned.ID(), leaked.ID())) {
+		t.Fatalf("expected only the owned and leaked monitors to be reported, got %q", rt.errors)
+	}
+
+	// Once stopped, the monitors are no longer reported.
+	rt.errors = nil
+	owned.Stop(ctx)
+	leaked.EmergencyStop(ctx)
+	verify()
+	if len(rt.errors) != 0 {
+		t.Fatalf("expected no monitors to be reported, got %q", rt.errors)
+	}
+
+	parallel.Stop(ctx)
+	before.Stop(ctx)
+}
+
+func TestLookupMonitor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("txn", MemoryResource, nil, nil, 1, 1000, st)
+	if id := m.ID(); id != 0 {
+		t.Fatalf("expected no ID before Start, got %d", id)
+	}
+
+	var prev uint64
+	for i := 0; i < 3; i++ {
+		m.Start(ctx, nil, MakeStandaloneBudget(100))
+		id := m.ID()
+		if id == 0 || id == prev {
+			t.Fatalf("expected a new ID at every Start, got %d after %d", id, prev)
+		}
+		if s := m.Snapshot(); s.ID != id {
+			t.Fatalf("expected ID %d in the snapshot, got %d", id, s.ID)
+		}
+		h, err := LookupMonitor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := h.Name(); err != nil || name != "txn" {
+			t.Fatalf("expected the handle to refer to txn, got %q, %v", name, err)
+		}
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, 42); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := h.Snapshot(); err != nil || s.Allocated != 42 {
+			t.Fatalf("expected 42 bytes allocated, got %+v, %v", s, err)
+		}
+		acc.Close(ctx)
+
+		// The registry isn't locked while a handle uses its monitor, so
+		// that other monitors can start and stop meanwhile.
+		if err := h.do(func(*BytesMonitor) {
+			other := MakeMonitor("other", MemoryResource, nil, nil, 1, 1000, st)
+			other.Start(ctx, nil, MakeStandaloneBudget(100))
+			if _, err := LookupMonitor(other.ID()); err != nil {
+				t.Error(err)
+			}
+			other.Stop(ctx)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The handle from the previous cycle stays invalid.
+		if prev != 0 {
+			if _, err := LookupMonitor(prev); errors.Cause(err) != ErrMonitorStopped {
+				t.Fatalf("expected ErrMonitorStopped, got %v", err)
+			}
+		}
+
+		m.Stop(ctx)
+		if _, err := h.DebugString(); errors.Cause(err) != ErrMonitorStopped {
+			t.Fatalf("expected ErrMonitorStopped, got %v", err)
+		}
+		if _, err := LookupMonitor(id); errors.Cause(err) != ErrMonitorStopped {
+			t.Fatalf("expected ErrMonitorStopped, got %v", err)
+		}
+		if m.ID() != id {
+			t.Fatalf("expected the ID to be kept after Stop, got %d", m.ID())
+		}
+		prev = id
+	}
+}
+
+func TestMonitorIDsConcurrent(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	const workers, monitorsPerWorker = 8, 100
+	ids := make([][]uint64, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			m := MakeMonitor("txn", MemoryResource, nil, nil, 1, 1000, st)
+			for i := 0; i < monitorsPerWorker; i++ {
+				m.Start(ctx, nil, MakeStandaloneBudget(100))
+				ids[w] = append(ids[w], m.ID())
+				m.Stop(ctx)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for _, workerIDs := range ids {
+		for _, id := range workerIDs {
+			if seen[id] {
+				t.Fatalf("ID %d assigned twice", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestMonitorStartStacks(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	const frame = "mon.TestMonitorStartStacks"
+
+	// No stack is captured when the flag is off.
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(100))
+	if s := m.Snapshot().StartStack; s != nil {
+		t.Errorf("expected no stack to be captured, got:\n%s", s)
+	}
+	m.Stop(ctx)
+
+	defer func(enabled bool) { debugMonitorRegistry = enabled }(debugMonitorRegistry)
+	debugMonitorRegistry = true
+
+	var rt recordingT
+	verify := TestingVerifyAllStopped(&rt)
+	m.Start(TestingContextWithOwner(ctx, &rt), nil, MakeStandaloneBudget(100))
+
+	// The stack is in the registry rows...
+	h, err := LookupMonitor(m.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := h.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(state.StartStack), frame) {
+		t.Errorf("expected %s in the start stack, got:\n%s", frame, state.StartStack)
+	}
+
+	// ... in the leak check failures...
+	verify()
+	if len(rt.errors) != 1 || !strings.Contains(rt.errors[0], frame) {
+		t.Errorf("expected %s in the leak check failure, got %q", frame, rt.errors)
+	}
+
+	// ... and in the report of bytes leaked at Stop.
+	acc := m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Fatal("expected a panic")
+			}
+			if msg := fmt.Sprint(r); !strings.Contains(msg, frame) {
+				t.Errorf("expected %s in the leak report, got:\n%s", frame, msg)
+			}
+		}()
+		m.Stop(ctx)
+	}()
+	m.EmergencyStop(ctx)
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// ReleasePolicy determines when a monitor returns the budget it doesn't use
+// any more to its pool; see WithReleasePolicy.
+type ReleasePolicy struct {
+	kind   releaseKind
+	blocks int
+	bytes  int64
+	delay  time.Duration
+}
+
+type releaseKind int
+
+const (
+	releaseHysteresis releaseKind = iota
+	releaseImmediately
+	releaseDelayed
+)
+
+// ReleaseImmediately returns the unused budget to the pool as soon as the
+// monitor shrinks. It suits short-lived monitors, e.g. those of operators,
+// which are unlikely to grow again.
+func ReleaseImmediately() ReleasePolicy {
+	return ReleasePolicy{kind: releaseImmediately}
+}
+
+// ReleaseWithHysteresis keeps up to blocks allocation blocks of unused
+// budget, and up to bytes if bytes is positive, as WithHysteresis and
+// WithMaxUnusedBytes do. This is the default, with the default number of
+// blocks and no cap in bytes.
+func ReleaseWithHysteresis(blocks int, bytes int64) ReleasePolicy {
+	return ReleasePolicy{kind: releaseHysteresis, blocks: blocks, bytes: bytes}
+}
+
+// ReleaseAfter keeps the unused budget until it has stayed unused for
+// delay, as measured by the TimeSource of the monitor. It suits monitors
+// that are likely to reuse their budget shortly, e.g. those of sessions.
+//
+// The budget is only returned by ReleaseIdleBudget, which must be called
+// periodically: the monitors don't run a goroutine each. A cap set by
+// WithMaxUnusedBytes still applies right away.
+func ReleaseAfter(delay time.Duration) ReleasePolicy {
+	return ReleasePolicy{kind: releaseDelayed, delay: delay}
+}
+
+// WithReleasePolicy sets the policy the monitor follows to return its unused
+// budget to its pool.
+func WithReleasePolicy(p ReleasePolicy) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.releaseKind = p.kind
+		o.releaseDelay = p.delay
+		if p.kind == releaseHysteresis {
+			o.maxAllocatedButUnusedBlocks = p.blocks
+			o.maxUnusedBytes = p.bytes
+			o.hysteresisSet = true
+		}
+	})
+}
+
+// releasePolicy returns the release policy of the monitor.
+func (mm *BytesMonitor) releasePolicy() ReleasePolicy {
+	return ReleasePolicy{
+		kind:   mm.releaseKind,
+		blocks: mm.maxAllocatedButUnusedBlocks,
+		bytes:  mm.maxUnusedBytes,
+		delay:  mm.releaseDelay,
+	}
+}
+
+// idleBudget tracks the budget that a monitor with a delayed release policy
+// leaves unused.
+type idleBudget struct {
+	// since is the start of the current observation window, or zero if the
+	// monitor had no unused budget.
+	since time.Time
+	// min is the lowest unused budget of the monitor since then, i.e. the
+	// budget that stayed unused during the whole window.
+	min int64
+}
+
+// noteIdleBudgetLocked records the current unused budget of a monitor with a
+// delayed release policy.
+func (mm *BytesMonitor) noteIdleBudgetLocked() {
+	unused := mm.unusedPoolBudgetLocked()
+	ib := &mm.mu.idle
+	if ib.since.IsZero() {
+		if unused > 0 {
+			ib.since = mm.clock().Now()
+			ib.min = unused
+		}
+		return
+	}
+	if unused < ib.min {
+		ib.min = unused
+	}
+}
+
+// ReleaseIdleBudget returns to their pools the budget that the monitor and
+// its descendants with a delayed release policy (see ReleaseAfter) left
+// unused for their delay, and returns the number of bytes released. It is
+// meant to be called periodically, e.g. by a server-wide maintenance loop,
+// on a root monitor.
+func (mm *BytesMonitor) ReleaseIdleBudget(ctx context.Context) int64 {
+	released := mm.releaseIdleBudget(ctx)
+	for _, c := range mm.childrenSnapshot() {
+		released += c.ReleaseIdleBudget(ctx)
+	}
+	return released
+}
+
+func (mm *BytesMonitor) releaseIdleBudget(ctx context.Context) int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	ib := &mm.mu.idle
+	if mm.releaseKind != releaseDelayed || mm.mu.stopped || ib.since.IsZero() ||
+		mm.clock().Now().Sub(ib.since) < mm.releaseDelay {
+		return 0
+	}
+	n := ib.min
+	if unused := mm.unusedPoolBudgetLocked(); n > unused {
+		n = unused
+	}
+	if n > 0 {
+		mm.returnBudgetLocked(ctx, n)
+	} else {
+		n = 0
+	}
+	// Start a new window with the budget that remains unused.
+	*ib = idleBudget{}
+	mm.noteIdleBudgetLocked()
+	return n
+}
+
+// ReleaseUnused returns all the budget that the monitor obtained from its
+// pool and doesn't use to the pool, regardless of its release policy, and
+// returns the number of bytes released.
+func (mm *BytesMonitor) ReleaseUnused(ctx context.Context) int64 {
+	return mm.releaseUnused(ctx, math.MaxInt64)
+}
+
+// releaseUnused is like ReleaseUnused, but releases at most max bytes.
+func (mm *BytesMonitor) releaseUnused(ctx context.Context, max int64) int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.mu.stopped {
+		return 0
+	}
+	n := mm.unusedPoolBudgetLocked()
+	if n > max {
+		n = max
+	}
+	if n <= 0 {
+		return 0
+	}
+	mm.returnBudgetLocked(ctx, n)
+	if mm.releaseKind == releaseDelayed {
+		mm.mu.idle = idleBudget{}
+		mm.noteIdleBudgetLocked()
+	}
+	return n
+}
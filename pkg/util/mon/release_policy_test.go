@@ -0,0 +1,99 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestReleasePolicies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	policies := []struct {
+		name   string
+		policy mon.ReleasePolicy
+	}{
+		{"immediate", mon.ReleaseImmediately()},
+		{"hysteresis", mon.ReleaseWithHysteresis(5, 0)},
+		{"hysteresis bytes", mon.ReleaseWithHysteresis(5, 120)},
+		{"delayed", mon.ReleaseAfter(10 * time.Second)},
+	}
+	// The monitor under test has an allocation size of 100 bytes. Each step
+	// is followed by a call to ReleaseIdleBudget on the pool, and lists the
+	// budget the pool is expected to have granted with each policy.
+	steps := []struct {
+		advance  time.Duration
+		grow     int64
+		expected [4]int64
+	}{
+		{grow: 250, expected: [4]int64{300, 300, 300, 300}},
+		{grow: -200, expected: [4]int64{50, 300, 170, 300}},
+		{advance: 5 * time.Second, expected: [4]int64{50, 300, 170, 300}},
+		// Reusing part of the unused budget leaves 150 bytes unused since
+		// the start.
+		{grow: 100, expected: [4]int64{150, 300, 170, 300}},
+		{advance: 6 * time.Second, expected: [4]int64{150, 300, 170, 150}},
+		{grow: -100, expected: [4]int64{50, 300, 170, 150}},
+		{advance: 9 * time.Second, expected: [4]int64{50, 300, 170, 150}},
+		{advance: time.Second, expected: [4]int64{50, 300, 170, 50}},
+	}
+
+	for i, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+			pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+				mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly))
+			pool.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+			parent := mon.MakeMonitor("parent", mon.MemoryResource, nil, nil, 100, math.MaxInt64, st,
+				mon.WithTimeSource(clock), mon.WithReservationPolicy(mon.ReleaseEagerly),
+				mon.WithReleasePolicy(p.policy))
+			// The monitor under test inherits its policy.
+			m := mon.MakeMonitorInheritWithLimit("test", math.MaxInt64, &parent)
+			m.Start(ctx, &pool, mon.MakeStandaloneBudget(0))
+			acc := m.MakeBoundAccount()
+
+			for j, s := range steps {
+				clock.Advance(s.advance)
+				if s.grow > 0 {
+					if err := acc.Grow(ctx, s.grow); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					acc.Shrink(ctx, -s.grow)
+				}
+				pool.ReleaseIdleBudget(ctx)
+				if a := pool.AllocBytes(); a != s.expected[i] {
+					t.Fatalf("step %d: expected %d bytes granted by the pool, got %d", j, s.expected[i], a)
+				}
+			}
+
+			acc.Close(ctx)
+			m.Stop(ctx)
+			pool.Stop(ctx)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReservationRateHalfLife is the half-life of the moving average of
+// the reservation rate of the monitors that don't set one.
+const DefaultReservationRateHalfLife = 10 * time.Second
+
+// WithReservationRateHalfLife sets the half-life of the exponentially-weighted
+// moving average of the rate of reservations of the monitor, reported by
+// ReservationRate. A spike of the rate is an early sign of a runaway query,
+// before its bytes accumulate.
+func WithReservationRateHalfLife(halfLife time.Duration) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.reservationRateHalfLife = halfLife
+	})
+}
+
+// reservationRate is a moving average of the rate of the reservations of a
+// monitor. The reservations are only counted, atomically, as they happen;
+// the average is brought up to date when it is read.
+type reservationRate struct {
+	// value is the average, in reservations per second, as of last.
+	value float64
+	last  time.Time
+	// seen is the count of reservations as of last.
+	seen uint64
+}
+
+// noteReservation counts a reservation, without locking the monitor.
+func (mm *BytesMonitor) noteReservation() {
+	atomic.AddUint64(&mm.reservations, 1)
+}
+
+// resetReservationRateLocked starts the moving average over at time now.
+func (mm *BytesMonitor) resetReservationRateLocked(now time.Time) {
+	mm.mu.resRate = reservationRate{last: now, seen: atomic.LoadUint64(&mm.reservations)}
+}
+
+// ReservationRate returns the moving average of the number of reservations
+// per second made through the monitor (see WithReservationRateHalfLife).
+func (mm *BytesMonitor) ReservationRate() float64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.reservationRateLocked()
+}
+
+func (mm *BytesMonitor) reservationRateLocked() float64 {
+	r := &mm.mu.resRate
+	now := mm.clock().Now()
+	elapsed := now.Sub(r.last)
+	if r.last.IsZero() || elapsed <= 0 {
+		return r.value
+	}
+	halfLife := mm.reservationRateHalfLife
+	if halfLife <= 0 {
+		halfLife = DefaultReservationRateHalfLife
+	}
+	// The reservations since the last update happened at a constant rate as
+	// far as the average can tell, and the weight of the old average halves
+	// every halfLife.
+	count := atomic.LoadUint64(&mm.reservations)
+	cur := float64(count-r.seen) / elapsed.Seconds()
+	w := math.Exp2(-float64(elapsed) / float64(halfLife))
+	r.value = cur + (r.value-cur)*w
+	r.last = now
+	r.seen = count
+	return r.value
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestReservationRate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithReservationRateHalfLife(10*time.Second))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+	acc := m.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	reserve := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := acc.Grow(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectRate := func(step string, expected float64) {
+		t.Helper()
+		if r := m.ReservationRate(); math.Abs(r-expected) > 1e-9 {
+			t.Fatalf("%s: expected a rate of %g reservations per second, got %g", step, expected, r)
+		}
+		if r := m.Snapshot().ReservationRate; math.Abs(r-expected) > 1e-9 {
+			t.Fatalf("%s: expected a state with a rate of %g, got %g", step, expected, r)
+		}
+	}
+
+	expectRate("start", 0)
+	// The reservations made at an instant only show when time passes.
+	reserve(1000)
+	expectRate("burst", 0)
+	// The burst averages to 100 reservations per second over a half-life,
+	// which weighs half as much as the rate before it.
+	clock.Advance(10 * time.Second)
+	expectRate("after burst", 50)
+	// Quiet periods decay the rate.
+	clock.Advance(10 * time.Second)
+	expectRate("quiet", 25)
+	clock.Advance(20 * time.Second)
+	expectRate("longer quiet", 6.25)
+	// A steady rate equal to the average keeps it.
+	reserve(125)
+	clock.Advance(20 * time.Second)
+	expectRate("steady", 6.25)
+	// Reads don't change the rate.
+	expectRate("reread", 6.25)
+
+	// A new start of the monitor starts over.
+	acc.Clear(ctx)
+	m.Stop(ctx)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	acc = m.MakeBoundAccount()
+	expectRate("restart", 0)
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// AccountRequest is a request to grow an account by a number of bytes, for
+// ReserveAll.
+type AccountRequest struct {
+	Account *BoundAccount
+	Bytes   int64
+}
+
+// ReserveAll grows several accounts, possibly bound to different monitors,
+// as a whole: either all the requests are granted, or none is. This
+// generalizes DualAccount.Grow, e.g. to admit a batch charging both a
+// network buffer and its decoded form.
+//
+// The accounts are grown in a deterministic order, by increasing ID of
+// their monitors, so that concurrent calls competing for the same monitors
+// acquire them in the same order. If a request is denied, the requests
+// already granted are rolled back, and the error identifies the request by
+// its index in reqs. On success, the returned function releases all the
+// requests; calling it again is a no-op.
+//
+// The accounts must not be used concurrently with ReserveAll and the
+// release function, like with any other operation on them.
+func ReserveAll(ctx context.Context, reqs []AccountRequest) (release func(), _ error) {
+	order := make([]int, len(reqs))
+	ids := make([]uint64, len(reqs))
+	for i, r := range reqs {
+		order[i] = i
+		if r.Account.mon != nil {
+			ids[i] = r.Account.mon.ID()
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return ids[order[i]] < ids[order[j]] })
+
+	shrinkAll := func(granted []int) {
+		for k := len(granted) - 1; k >= 0; k-- {
+			r := reqs[granted[k]]
+			r.Account.Shrink(ctx, r.Bytes)
+		}
+	}
+	for k, i := range order {
+		r := reqs[i]
+		if err := r.Account.Grow(ctx, r.Bytes); err != nil {
+			shrinkAll(order[:k])
+			name := "standalone budget"
+			if r.Account.mon != nil {
+				name = r.Account.mon.name
+			}
+			return nil, errors.Wrapf(err, "request %d of %d bytes on %s", i, r.Bytes, name)
+		}
+	}
+	var done bool
+	return func() {
+		if done {
+			return
+		}
+		done = true
+		shrinkAll(order)
+	}, nil
+}
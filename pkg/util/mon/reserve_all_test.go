@@ -0,0 +1,149 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestReserveAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	makeMonitor := func(name string, budget int64) *mon.BytesMonitor {
+		m := mon.MakeMonitor(name, mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+			mon.WithReservationPolicy(mon.ReleaseEagerly))
+		m.Start(ctx, nil, mon.MakeStandaloneBudget(budget))
+		return &m
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		network := makeMonitor("network", 1000)
+		decode := makeMonitor("decode", 100)
+		other := makeMonitor("other", 1000)
+		defer other.Stop(ctx)
+		defer decode.Stop(ctx)
+		defer network.Stop(ctx)
+		netAcc := network.MakeBoundAccount()
+		decodeAcc := decode.MakeBoundAccount()
+		otherAcc := other.MakeBoundAccount()
+		defer netAcc.Close(ctx)
+		defer decodeAcc.Close(ctx)
+		defer otherAcc.Close(ctx)
+
+		// The decode request is denied after the network one was granted.
+		_, err := mon.ReserveAll(ctx, []mon.AccountRequest{
+			{Account: &otherAcc, Bytes: 100},
+			{Account: &decodeAcc, Bytes: 200},
+			{Account: &netAcc, Bytes: 300},
+		})
+		if !mon.IsBudgetExceededError(err) ||
+			!strings.Contains(err.Error(), "request 1 of 200 bytes on decode") {
+			t.Fatalf("expected budget error on the decode request, got %v", err)
+		}
+		for _, m := range []*mon.BytesMonitor{network, decode, other} {
+			montest.AssertEmpty(t, m)
+		}
+
+		release, err := mon.ReserveAll(ctx, []mon.AccountRequest{
+			{Account: &otherAcc, Bytes: 100},
+			{Account: &decodeAcc, Bytes: 50},
+			{Account: &netAcc, Bytes: 300},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if netAcc.Used() != 300 || decodeAcc.Used() != 50 || otherAcc.Used() != 100 {
+			t.Fatalf("expected all the requests to be granted, got %d, %d and %d",
+				netAcc.Used(), decodeAcc.Used(), otherAcc.Used())
+		}
+		release()
+		// Releasing again is a no-op.
+		release()
+		if netAcc.Used() != 0 || decodeAcc.Used() != 0 || otherAcc.Used() != 0 {
+			t.Fatalf("expected all the requests to be released, got %d, %d and %d",
+				netAcc.Used(), decodeAcc.Used(), otherAcc.Used())
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		network := makeMonitor("network", 1000)
+		decode := makeMonitor("decode", 1000)
+		defer decode.Stop(ctx)
+		defer network.Stop(ctx)
+
+		const workers = 8
+		var wg sync.WaitGroup
+		errCh := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				netAcc, decodeAcc := network.MakeBoundAccount(), decode.MakeBoundAccount()
+				defer netAcc.Close(ctx)
+				defer decodeAcc.Close(ctx)
+				for j := 0; j < 100; j++ {
+					// Alternate the order of the requests; they are acquired in
+					// the same order anyway.
+					reqs := []mon.AccountRequest{
+						{Account: &netAcc, Bytes: 200},
+						{Account: &decodeAcc, Bytes: 300},
+					}
+					if i%2 == 1 {
+						reqs[0], reqs[1] = reqs[1], reqs[0]
+					}
+					release, err := mon.ReserveAll(ctx, reqs)
+					if err != nil {
+						if !mon.IsBudgetExceededError(err) {
+							errCh <- err
+							return
+						}
+						if netAcc.Used() != 0 || decodeAcc.Used() != 0 {
+							errCh <- fmt.Errorf("partial reservation left: %d and %d",
+								netAcc.Used(), decodeAcc.Used())
+							return
+						}
+						continue
+					}
+					if netAcc.Used() != 200 || decodeAcc.Used() != 300 {
+						errCh <- fmt.Errorf("incomplete reservation: %d and %d",
+							netAcc.Used(), decodeAcc.Used())
+						return
+					}
+					release()
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errCh)
+		for err := range errCh {
+			t.Error(err)
+		}
+		montest.AssertEmpty(t, network)
+		montest.AssertEmpty(t, decode)
+	})
+}
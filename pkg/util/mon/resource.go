@@ -61,3 +61,40 @@ func (d diskResource) NewBudgetExceededError(
 		budgetBytes,
 	)
 }
+
+// countResource is a Resource that represents units of a quota, e.g. the
+// slots of a Semaphore.
+type countResource struct{}
+
+// CountResource is a utility singleton used as an argument when creating a
+// BytesMonitor to indicate that the monitor will be tracking units of a
+// quota rather than bytes.
+var CountResource Resource = countResource{}
+
+// NewBudgetExceededError implements the Resource interface.
+func (c countResource) NewBudgetExceededError(
+	requestedUnits int64, reservedUnits int64, budgetUnits int64,
+) error {
+	return pgerror.NewErrorf(
+		pgerror.CodeInsufficientResourcesError,
+		"quota exceeded: %d units requested, %d currently acquired, %d units in budget",
+		requestedUnits,
+		reservedUnits,
+		budgetUnits,
+	)
+}
+
+// IsBudgetExceededError returns whether err, or its cause, is a budget error
+// created by MemoryResource, DiskResource or CountResource.
+func IsBudgetExceededError(err error) bool {
+	pgErr, ok := pgerror.GetPGCause(err)
+	if !ok {
+		return false
+	}
+	switch pgErr.Code {
+	case pgerror.CodeOutOfMemoryError, pgerror.CodeDiskFullError,
+		pgerror.CodeInsufficientResourcesError:
+		return true
+	}
+	return false
+}
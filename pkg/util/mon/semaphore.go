@@ -0,0 +1,248 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Semaphore is a quota semaphore whose units are accounted by a monitor of
+// CountResource, so that the quota gets the metrics, snapshots and
+// hierarchy of monitors instead of being kept in sync with one by hand.
+//
+// The semaphore may draw its units from a pool monitor of CountResource,
+// e.g. to share a global cap between several semaphores; units released by
+// any semaphore of the pool wake up the waiters of the others. Waiters are
+// admitted in FIFO order within a semaphore.
+type Semaphore struct {
+	mon  BytesMonitor
+	pool *BytesMonitor
+
+	mu struct {
+		syncutil.Mutex
+		acc     BoundAccount
+		waiters []*semaphoreWaiter
+		closed  bool
+	}
+}
+
+type semaphoreWaiter struct {
+	n int64
+	// granted is closed once the units were acquired for the waiter.
+	granted chan struct{}
+}
+
+// NewSemaphore creates a semaphore of limit units. If pool is nil, the
+// semaphore has a standalone budget of limit units; otherwise, its units are
+// also drawn from pool, and it must be closed before pool is stopped. The
+// pool should use the ReleaseEagerly reservation policy, so that the units
+// released by a semaphore are not kept aside for it.
+func NewSemaphore(
+	ctx context.Context, name string, limit int64, pool *BytesMonitor, st *cluster.Settings,
+) *Semaphore {
+	s := &Semaphore{pool: pool}
+	opts := []MonitorOption{WithReservationPolicy(ReleaseEagerly)}
+	if pool != nil {
+		// Return the released units to the pool right away, for the other
+		// semaphores.
+		opts = append(opts, WithHysteresis(0))
+	}
+	s.mon = MakeMonitorWithLimit(name, CountResource, limit, nil, nil, 1, math.MaxInt64, st, opts...)
+	if pool == nil {
+		s.mon.Start(ctx, nil, MakeStandaloneBudget(limit))
+	} else {
+		s.mon.Start(ctx, pool, BoundAccount{})
+		pool.semaphores.Lock()
+		if pool.semaphores.set == nil {
+			pool.semaphores.set = make(map[*Semaphore]struct{})
+		}
+		pool.semaphores.set[s] = struct{}{}
+		pool.semaphores.Unlock()
+	}
+	s.mu.acc = s.mon.MakeBoundAccount()
+	return s
+}
+
+// Monitor returns the monitor accounting for the units of the semaphore.
+func (s *Semaphore) Monitor() *BytesMonitor {
+	return &s.mon
+}
+
+// Acquired returns the number of units currently acquired.
+func (s *Semaphore) Acquired() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.acc.Used()
+}
+
+// Acquire acquires n units, blocking until they are available or ctx is
+// canceled. Acquisitions are served in FIFO order, so a large request is not
+// starved by smaller ones arriving after it. Requests for more units than
+// the limit of the semaphore, or for a negative number of units, fail right
+// away.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if err := s.checkLocked(n); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if len(s.mu.waiters) == 0 && s.mu.acc.Grow(ctx, n) == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	w := &semaphoreWaiter{n: n, granted: make(chan struct{})}
+	s.mu.waiters = append(s.mu.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case <-w.granted:
+		// The units were granted concurrently with the cancellation.
+		s.mu.Unlock()
+		_ = s.Release(ctx, n)
+	default:
+		for i, o := range s.mu.waiters {
+			if o == w {
+				s.mu.waiters = append(s.mu.waiters[:i], s.mu.waiters[i+1:]...)
+				break
+			}
+		}
+		// The waiters behind w may fit now.
+		s.admitLocked(ctx)
+		s.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+// TryAcquire acquires n units if they are available right away, and returns
+// a budget error otherwise, including when other acquisitions are waiting.
+func (s *Semaphore) TryAcquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLocked(n); err != nil {
+		return err
+	}
+	if len(s.mu.waiters) > 0 {
+		err := CountResource.NewBudgetExceededError(n, s.mu.acc.Used(), s.currentLimit())
+		return errors.Wrapf(err, "%s: %d acquisitions waiting", s.mon.name, len(s.mu.waiters))
+	}
+	return s.mu.acc.Grow(ctx, n)
+}
+
+// Release returns n units previously acquired, and wakes up the waiters
+// they allow to proceed, in this semaphore or the others of its pool. It
+// returns an error if n is negative.
+func (s *Semaphore) Release(ctx context.Context, n int64) error {
+	if n < 0 {
+		return errors.Errorf("%s: releasing a negative number of units: %d", s.mon.name, n)
+	}
+	s.mu.Lock()
+	if s.mu.acc.Used() < n {
+		panic(fmt.Sprintf("%s: releasing %d units, only %d acquired", s.mon.name, n, s.mu.acc.Used()))
+	}
+	s.mu.acc.Shrink(ctx, n)
+	s.admitLocked(ctx)
+	s.mu.Unlock()
+
+	if s.pool == nil {
+		return nil
+	}
+	s.pool.semaphores.Lock()
+	others := make([]*Semaphore, 0, len(s.pool.semaphores.set))
+	for o := range s.pool.semaphores.set {
+		if o != s {
+			others = append(others, o)
+		}
+	}
+	s.pool.semaphores.Unlock()
+	for _, o := range others {
+		o.mu.Lock()
+		o.admitLocked(ctx)
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+// Close stops the monitor of the semaphore. All the units must have been
+// released and no acquisition may be waiting.
+func (s *Semaphore) Close(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.closed {
+		return
+	}
+	if len(s.mu.waiters) > 0 {
+		panic(fmt.Sprintf("%s: closing semaphore with %d acquisitions waiting",
+			s.mon.name, len(s.mu.waiters)))
+	}
+	s.mu.closed = true
+	if s.pool != nil {
+		s.pool.semaphores.Lock()
+		delete(s.pool.semaphores.set, s)
+		s.pool.semaphores.Unlock()
+	}
+	s.mu.acc.Close(ctx)
+	s.mon.Stop(ctx)
+}
+
+// checkLocked returns an error if n units can never be acquired.
+func (s *Semaphore) checkLocked(n int64) error {
+	if s.mu.closed {
+		return errors.Errorf("%s: semaphore closed", s.mon.name)
+	}
+	if n < 0 {
+		return errors.Errorf("%s: acquiring a negative number of units: %d", s.mon.name, n)
+	}
+	if limit := s.currentLimit(); n > limit {
+		return errors.Wrapf(CountResource.NewBudgetExceededError(n, s.mu.acc.Used(), limit),
+			"%s", s.mon.name)
+	}
+	return nil
+}
+
+// currentLimit returns the limit of the semaphore, which can be changed
+// with SetLimit on its monitor.
+func (s *Semaphore) currentLimit() int64 {
+	s.mon.mu.Lock()
+	defer s.mon.mu.Unlock()
+	return s.mon.limit
+}
+
+// admitLocked grants the units of the waiters at the head of the queue, as
+// long as they are available.
+func (s *Semaphore) admitLocked(ctx context.Context) {
+	for len(s.mu.waiters) > 0 {
+		w := s.mu.waiters[0]
+		if s.mu.acc.Grow(ctx, w.n) != nil {
+			return
+		}
+		s.mu.waiters[0] = nil
+		s.mu.waiters = s.mu.waiters[1:]
+		close(w.granted)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// waitForWaiters waits until n acquisitions are queued on s.
+func waitForWaiters(s *Semaphore, n int) {
+	for {
+		s.mu.Lock()
+		l := len(s.mu.waiters)
+		s.mu.Unlock()
+		if l == n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestSemaphoreFIFO(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	s := NewSemaphore(ctx, "sem", 4, nil, st)
+
+	if err := s.Acquire(ctx, 5); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error for a request above the limit, got %v", err)
+	}
+	if err := s.Acquire(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TryAcquire(ctx, 1); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	granted := make(chan int64, 2)
+	acquire := func(n int64) {
+		go func() {
+			if err := s.Acquire(ctx, n); err != nil {
+				t.Error(err)
+			}
+			granted <- n
+		}()
+	}
+	acquire(3)
+	waitForWaiters(s, 1)
+	acquire(1)
+	waitForWaiters(s, 2)
+
+	// The small request doesn't overtake the large one queued before it,
+	// even though it fits.
+	s.Release(ctx, 1)
+	if err := s.TryAcquire(ctx, 1); !IsBudgetExceededError(err) {
+		t.Fatalf("expected TryAcquire to fail while acquisitions wait, got %v", err)
+	}
+	if a := s.Acquired(); a != 3 {
+		t.Fatalf("expected 3 units acquired, got %d", a)
+	}
+	s.Release(ctx, 2)
+	if n := <-granted; n != 3 {
+		t.Fatalf("expected the request for 3 units to be granted first, got %d", n)
+	}
+	s.Release(ctx, 1)
+	if n := <-granted; n != 1 {
+		t.Fatalf("expected the request for 1 unit to be granted, got %d", n)
+	}
+	if a := s.Acquired(); a != 4 {
+		t.Fatalf("expected 4 units acquired, got %d", a)
+	}
+
+	// A canceled waiter leaves the queue, and lets the waiters behind it
+	// proceed.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	canceled := make(chan error, 1)
+	go func() {
+		canceled <- s.Acquire(cancelCtx, 4)
+	}()
+	waitForWaiters(s, 1)
+	acquire(1)
+	waitForWaiters(s, 2)
+	s.Release(ctx, 1)
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if n := <-granted; n != 1 {
+		t.Fatalf("expected the request for 1 unit to be granted, got %d", n)
+	}
+
+	s.Release(ctx, 4)
+	if a := s.Monitor().AllocBytes(); a != 0 {
+		t.Fatalf("expected all the units to be released, got %d", a)
+	}
+
+	// Negative numbers of units are rejected.
+	if err := s.Acquire(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Acquire(ctx, -1); err == nil ||
+		!strings.Contains(err.Error(), "acquiring a negative number of units") {
+		t.Fatalf("expected a negative acquisition to be rejected, got %v", err)
+	}
+	if err := s.TryAcquire(ctx, -1); err == nil ||
+		!strings.Contains(err.Error(), "acquiring a negative number of units") {
+		t.Fatalf("expected a negative acquisition to be rejected, got %v", err)
+	}
+	if err := s.Release(ctx, -1); err == nil ||
+		!strings.Contains(err.Error(), "releasing a negative number of units") {
+		t.Fatalf("expected a negative release to be rejected, got %v", err)
+	}
+	if a := s.Acquired(); a != 1 {
+		t.Fatalf("expected 1 unit acquired, got %d", a)
+	}
+	if err := s.Release(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(ctx)
+}
+
+func TestSemaphorePool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	pool := MakeMonitorWithLimit("pool", CountResource, 5, nil, nil, 1, math.MaxInt64, st,
+		WithReservationPolicy(ReleaseEagerly))
+	pool.Start(ctx, nil, MakeStandaloneBudget(5))
+	a := NewSemaphore(ctx, "a", 4, &pool, st)
+	b := NewSemaphore(ctx, "b", 4, &pool, st)
+
+	if err := a.Acquire(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	// b is below its own limit, but the pool only has 1 unit left.
+	if err := b.TryAcquire(ctx, 2); !IsBudgetExceededError(err) {
+		t.Fatalf("expected budget error from the pool, got %v", err)
+	}
+	if err := b.Acquire(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if u := pool.AllocBytes(); u != 5 {
+		t.Fatalf("expected 5 units drawn from the pool, got %d", u)
+	}
+
+	// Units released by a wake up the waiters of b.
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- b.Acquire(ctx, 2)
+	}()
+	waitForWaiters(b, 1)
+	a.Release(ctx, 2)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if a.Acquired() != 2 || b.Acquired() != 3 || pool.AllocBytes() != 5 {
+		t.Fatalf("expected 2 and 3 units acquired out of 5, got %d and %d out of %d",
+			a.Acquired(), b.Acquired(), pool.AllocBytes())
+	}
+
+	a.Release(ctx, 2)
+	b.Release(ctx, 3)
+	a.Close(ctx)
+	b.Close(ctx)
+	if u := pool.AllocBytes(); u != 0 {
+		t.Fatalf("expected all the units to be returned to the pool, got %d", u)
+	}
+	pool.Stop(ctx)
+}
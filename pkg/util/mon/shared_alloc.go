@@ -0,0 +1,138 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// SharedAlloc accounts for an immutable allocation shared by several
+// consumers, e.g. a cached block, so that it is charged exactly once. The
+// allocation is charged to an owner account when the SharedAlloc is
+// created, consumers take references with Ref and drop them with Unref, and
+// the charge is released from the owner when the last reference is
+// dropped. The ownership, i.e. the account charged, can be transferred,
+// e.g. when the consumer that created the allocation goes away before the
+// others.
+//
+// A SharedAlloc is safe for concurrent use. Its owner account is only
+// touched by NewSharedAlloc, TransferOwnership and the last Unref, which
+// must not race with other uses of the account; a dedicated account avoids
+// the issue.
+type SharedAlloc struct {
+	size int64
+
+	mu struct {
+		syncutil.Mutex
+		refs  int
+		owner *BoundAccount
+	}
+}
+
+// NewSharedAlloc charges size bytes to owner, and returns a SharedAlloc
+// holding one reference to the allocation.
+func NewSharedAlloc(ctx context.Context, owner *BoundAccount, size int64) (*SharedAlloc, error) {
+	if err := owner.Grow(ctx, size); err != nil {
+		return nil, err
+	}
+	s := &SharedAlloc{size: size}
+	s.mu.refs = 1
+	s.mu.owner = owner
+	return s, nil
+}
+
+// Size returns the size of the allocation.
+func (s *SharedAlloc) Size() int64 {
+	return s.size
+}
+
+// Refs returns the number of references to the allocation.
+func (s *SharedAlloc) Refs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.refs
+}
+
+// Ref takes an additional reference to the allocation. It panics if the
+// allocation was already released.
+func (s *SharedAlloc) Ref() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.refs <= 0 {
+		panic(fmt.Sprintf("referencing a released shared allocation of %d bytes", s.size))
+	}
+	s.mu.refs++
+}
+
+// Unref drops a reference to the allocation. Dropping the last one releases
+// the charge from the owner account. If the allocation was already released,
+// an assertion error is returned without changing anything; in race builds,
+// Unref panics instead, to catch the bug in tests.
+func (s *SharedAlloc) Unref(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.refs <= 0 {
+		err := pgerror.NewAssertionErrorf("unreferencing a released shared allocation of %d bytes", s.size)
+		if util.RaceEnabled {
+			panic(err)
+		}
+		return err
+	}
+	s.mu.refs--
+	if s.mu.refs == 0 {
+		s.mu.owner.Shrink(ctx, s.size)
+		s.mu.owner = nil
+	}
+	return nil
+}
+
+// TransferOwnership moves the charge of the allocation to a new owner
+// account. If the accounts are bound to the same monitor, the charge moves
+// between them without going through the monitor, like with MergeInto.
+// Otherwise, the new owner is charged before the old one is released, so
+// nothing changes if the new owner can't take the allocation.
+func (s *SharedAlloc) TransferOwnership(ctx context.Context, owner *BoundAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.refs <= 0 {
+		return errors.Errorf("cannot transfer a released shared allocation of %d bytes", s.size)
+	}
+	if owner == s.mu.owner {
+		return nil
+	}
+	if old := s.mu.owner; old.mon != nil && old.mon == owner.mon {
+		old.canary.touch()
+		owner.canary.touch()
+		if old.used < s.size {
+			panic(fmt.Sprintf("%s: no bytes in account to transfer, current %d, transfer %d",
+				old.mon.name, old.used, s.size))
+		}
+		old.moveUsedTo(owner, s.size)
+	} else {
+		if err := owner.Grow(ctx, s.size); err != nil {
+			return err
+		}
+		old.Shrink(ctx, s.size)
+	}
+	s.mu.owner = owner
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestSharedAlloc(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	defer m.Stop(ctx)
+
+	t.Run("transfer", func(t *testing.T) {
+		first, second := m.MakeBoundAccount(), m.MakeBoundAccount()
+		defer first.Close(ctx)
+		defer second.Close(ctx)
+
+		s, err := mon.NewSharedAlloc(ctx, &first, 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A second consumer doesn't charge anything.
+		s.Ref()
+		if first.Used() != 600 || second.Used() != 0 || m.AllocBytes() != 600 {
+			t.Fatalf("expected the allocation to be charged once, got %d and %d",
+				first.Used(), second.Used())
+		}
+
+		// The owner can only hand the allocation over to an account that can
+		// take it.
+		tight := mon.MakeMonitor("tight", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		tight.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+		tightAcc := tight.MakeBoundAccount()
+		if err := s.TransferOwnership(ctx, &tightAcc); !mon.IsBudgetExceededError(err) {
+			t.Fatalf("expected budget error, got %v", err)
+		}
+		tightAcc.Close(ctx)
+		tight.Stop(ctx)
+		if first.Used() != 600 {
+			t.Fatalf("expected the owner to be unchanged, got %d bytes", first.Used())
+		}
+
+		if err := s.TransferOwnership(ctx, &second); err != nil {
+			t.Fatal(err)
+		}
+		if first.Used() != 0 || second.Used() != 600 || m.AllocBytes() != 600 {
+			t.Fatalf("expected the charge to move, got %d and %d", first.Used(), second.Used())
+		}
+
+		// The charge is released from the new owner with the last reference.
+		if err := s.Unref(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if second.Used() != 600 {
+			t.Fatalf("expected the charge to remain, got %d", second.Used())
+		}
+		if err := s.Unref(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if second.Used() != 0 || m.AllocBytes() != 0 {
+			t.Fatalf("expected the charge to be released, got %d", second.Used())
+		}
+		if err := s.TransferOwnership(ctx, &first); err == nil {
+			t.Fatal("expected an error transferring a released allocation")
+		}
+
+		// Unreferencing it again is caught, and changes nothing.
+		unref := func() (err error) {
+			if util.RaceEnabled {
+				defer func() {
+					if r := recover(); r != nil {
+						err = r.(error)
+					}
+				}()
+			}
+			return s.Unref(ctx)
+		}
+		if err := unref(); err == nil ||
+			!strings.Contains(err.Error(), "unreferencing a released shared allocation of 600 bytes") {
+			t.Fatalf("expected the misuse to be caught, got %v", err)
+		}
+		if s.Refs() != 0 || second.Used() != 0 || m.AllocBytes() != 0 {
+			t.Fatalf("expected the allocation to be left alone, got %d refs", s.Refs())
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		acc := m.MakeBoundAccount()
+		defer acc.Close(ctx)
+		s, err := mon.NewSharedAlloc(ctx, &acc, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const consumers = 10
+		var wg sync.WaitGroup
+		for i := 0; i < consumers; i++ {
+			s.Ref()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					s.Ref()
+					if err := s.Unref(ctx); err != nil {
+						t.Error(err)
+					}
+				}
+				if err := s.Unref(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if r := s.Refs(); r != 1 {
+			t.Fatalf("expected 1 reference left, got %d", r)
+		}
+		if err := s.Unref(ctx); err != nil {
+			t.Fatal(err)
+		}
+		montest.AssertEmpty(t, &m)
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+// The following constants are the canonical in-memory sizes of common Go
+// values on 64-bit platforms, for use by components that account for the
+// memory held by their data structures. They are spelled out rather than
+// computed with unsafe.Sizeof so that they are usable as untyped constants
+// everywhere; the tests verify that they match the current platform.
+const (
+	// SizeOfPtr is the size of a pointer.
+	SizeOfPtr = 8
+	// SizeOfInt is the size of an int.
+	SizeOfInt = 8
+	// SizeOfInt64 is the size of an int64.
+	SizeOfInt64 = 8
+	// SizeOfFloat64 is the size of a float64.
+	SizeOfFloat64 = 8
+	// SizeOfBool is the size of a bool.
+	SizeOfBool = 1
+	// SizeOfString is the size of a string header, excluding the bytes it
+	// points to.
+	SizeOfString = 16
+	// SizeOfSliceHeader is the size of a slice header, excluding the backing
+	// array it points to.
+	SizeOfSliceHeader = 24
+	// SizeOfInterface is the size of an interface value, excluding the value
+	// it points to.
+	SizeOfInterface = 16
+	// SizeOfMap is the size of a map value, which is a pointer to the map's
+	// internal structure.
+	SizeOfMap = SizeOfPtr
+	// SizeOfTime is the size of a time.Time.
+	SizeOfTime = 24
+	// SizeOfDuration is the size of a time.Duration.
+	SizeOfDuration = 8
+)
+
+// StringSize returns the number of bytes to account for a string: its header
+// plus its contents.
+func StringSize(s string) int64 {
+	return SizeOfString + int64(len(s))
+}
+
+// BytesSize returns the number of bytes to account for a byte slice: its
+// header plus its backing array. Like all accounting in this package, it is
+// based on the slice's capacity rather than its length.
+func BytesSize(b []byte) int64 {
+	return SliceSize(int64(len(b)), int64(cap(b)), 1)
+}
+
+// SliceSize returns the number of bytes to account for a slice of the given
+// length and capacity whose elements are elemSize bytes each: its header plus
+// its backing array, sized by the capacity. A capacity lower than the length,
+// e.g. 0 for a slice whose capacity is not known yet, stands for the length.
+// The elements' own out-of-line allocations, if any, are not included.
+func SliceSize(length, capacity, elemSize int64) int64 {
+	if capacity < length {
+		capacity = length
+	}
+	return SizeOfSliceHeader + capacity*elemSize
+}
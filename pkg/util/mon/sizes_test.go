@@ -0,0 +1,67 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"strconv"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestSizeOfConstants(t *testing.T) {
+	if strconv.IntSize != 64 {
+		t.Skipf("size constants describe 64-bit platforms, running on %d-bit", strconv.IntSize)
+	}
+
+	var i interface{}
+	testCases := []struct {
+		name     string
+		constant int64
+		actual   uintptr
+	}{
+		{"SizeOfPtr", SizeOfPtr, unsafe.Sizeof(&i)},
+		{"SizeOfInt", SizeOfInt, unsafe.Sizeof(int(0))},
+		{"SizeOfInt64", SizeOfInt64, unsafe.Sizeof(int64(0))},
+		{"SizeOfFloat64", SizeOfFloat64, unsafe.Sizeof(float64(0))},
+		{"SizeOfBool", SizeOfBool, unsafe.Sizeof(false)},
+		{"SizeOfString", SizeOfString, unsafe.Sizeof("")},
+		{"SizeOfSliceHeader", SizeOfSliceHeader, unsafe.Sizeof([]byte(nil))},
+		{"SizeOfInterface", SizeOfInterface, unsafe.Sizeof(i)},
+		{"SizeOfMap", SizeOfMap, unsafe.Sizeof(map[int]int(nil))},
+		{"SizeOfTime", SizeOfTime, unsafe.Sizeof(time.Time{})},
+		{"SizeOfDuration", SizeOfDuration, unsafe.Sizeof(time.Duration(0))},
+	}
+	for _, tc := range testCases {
+		if tc.constant != int64(tc.actual) {
+			t.Errorf("%s is %d, but unsafe.Sizeof reports %d", tc.name, tc.constant, tc.actual)
+		}
+	}
+}
+
+func TestSizeHelpers(t *testing.T) {
+	if s := StringSize("hello"); s != SizeOfString+5 {
+		t.Errorf("expected StringSize %d, got %d", SizeOfString+5, s)
+	}
+	if s := BytesSize(make([]byte, 3, 10)); s != SizeOfSliceHeader+10 {
+		t.Errorf("expected BytesSize %d, got %d", SizeOfSliceHeader+10, s)
+	}
+	if s := SliceSize(2, 4, SizeOfTime); s != SizeOfSliceHeader+4*SizeOfTime {
+		t.Errorf("expected SliceSize %d, got %d", SizeOfSliceHeader+4*SizeOfTime, s)
+	}
+	if s := SliceSize(3, 0, SizeOfTime); s != SizeOfSliceHeader+3*SizeOfTime {
+		t.Errorf("expected SliceSize to fall back to the length, got %d", s)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"math"
+	"time"
+)
+
+// WithSmoothingHalfLife makes the monitor maintain an exponentially-weighted
+// moving average of its usage, reported by SmoothedUsage, in which the usage
+// from halfLife ago weighs half as much as the current usage. It gives
+// admission control a signal of memory pressure that ignores short spikes.
+// Time is measured with the TimeSource of the monitor.
+func WithSmoothingHalfLife(halfLife time.Duration) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.smoothingHalfLife = halfLife
+	})
+}
+
+// smoothedUsage is an exponentially-weighted moving average of a usage that
+// only changes at the times it is updated.
+type smoothedUsage struct {
+	value float64
+	// last is the time of the last update, or zero if there was none.
+	last time.Time
+}
+
+// decayed returns the average at time now, given that the usage has been
+// cur since the last update.
+func (s *smoothedUsage) decayed(now time.Time, cur int64, halfLife time.Duration) float64 {
+	if s.last.IsZero() {
+		return float64(cur)
+	}
+	elapsed := now.Sub(s.last)
+	if elapsed <= 0 {
+		return s.value
+	}
+	// The weight of the old average halves every halfLife.
+	w := math.Exp2(-float64(elapsed) / float64(halfLife))
+	return float64(cur) + (s.value-float64(cur))*w
+}
+
+// update records that the usage, before until now, changes at time now.
+func (s *smoothedUsage) update(now time.Time, before int64, halfLife time.Duration) {
+	s.value = s.decayed(now, before, halfLife)
+	s.last = now
+}
+
+// SmoothedUsage returns the moving average of the usage of the monitor (see
+// WithSmoothingHalfLife). If the monitor doesn't maintain one, the current
+// usage is returned.
+func (mm *BytesMonitor) SmoothedUsage() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.smoothingHalfLife <= 0 {
+		return mm.mu.curAllocated
+	}
+	return int64(math.Round(mm.mu.smoothed.decayed(
+		mm.clock().Now(), mm.mu.curAllocated, mm.smoothingHalfLife)))
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestSmoothedUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, 1000, st,
+		mon.WithTimeSource(clock), mon.WithSmoothingHalfLife(10*time.Second),
+		mon.WithReservationPolicy(mon.ReleaseEagerly))
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(10000))
+	acc := m.MakeBoundAccount()
+
+	expect := func(expected int64) {
+		t.Helper()
+		if s := m.SmoothedUsage(); s != expected {
+			t.Errorf("expected a smoothed usage of %d, got %d", expected, s)
+		}
+	}
+
+	// A step up from 0 to 1024 bytes: the average closes half of the gap
+	// every half-life.
+	if err := acc.Grow(ctx, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expect(0)
+	clock.Advance(10 * time.Second)
+	expect(512)
+	clock.Advance(10 * time.Second)
+	expect(768)
+	clock.Advance(time.Hour)
+	expect(1024)
+
+	// A short spike barely moves the average.
+	if err := acc.Grow(ctx, 8192); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(100 * time.Millisecond)
+	acc.Shrink(ctx, 8192)
+	if s := m.SmoothedUsage(); s < 1024 || s > 1100 {
+		t.Errorf("expected the spike to be smoothed out, got %d", s)
+	}
+
+	// A step down converges the same way.
+	clock.Advance(time.Hour)
+	acc.Shrink(ctx, 1024)
+	clock.Advance(10 * time.Second)
+	expect(512)
+	clock.Advance(time.Hour)
+	expect(0)
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
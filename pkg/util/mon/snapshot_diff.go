@@ -0,0 +1,360 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// MonitorEntry is the state of a monitor in a snapshot of the monitors of
+// the process; see SnapshotMonitors.
+type MonitorEntry struct {
+	// ID is the ID of the monitor (see BytesMonitor.ID).
+	ID   uint64
+	Name string
+	// ParentID and Parent identify the pool of the monitor; ParentID is 0
+	// and Parent is empty for root monitors.
+	ParentID uint64
+	Parent   string
+	// Used and Max are the current and maximum number of bytes allocated
+	// through the monitor.
+	Used int64
+	Max  int64
+	// External is the usage reported by the sources registered with
+	// RegisterExternalUsage, which is not part of Used.
+	External int64
+	// Accounts is the number of accounts opened with OpenAccount that are
+	// still open.
+	Accounts int
+	// Labels are the labels of the monitor; see WithLabels.
+	Labels []Label
+	// Frozen is set if the monitor is frozen; see SetFrozen.
+	Frozen bool
+	// OpenAccounts describes the open accounts of the monitor, if it has an
+	// account registry; see OpenAccounts.
+	OpenAccounts []AccountInfo
+}
+
+// SnapshotMonitors returns the state of all the monitors started and not
+// yet stopped, in the order they were started.
+func SnapshotMonitors() []MonitorEntry {
+	var entries []MonitorEntry
+	for _, h := range StartedMonitors() {
+		_ = h.do(func(mm *BytesMonitor) {
+			entries = append(entries, mm.monitorEntry())
+		})
+	}
+	return entries
+}
+
+func (mm *BytesMonitor) monitorEntry() MonitorEntry {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	e := MonitorEntry{
+		ID:           mm.mu.id,
+		Name:         mm.name,
+		Used:         mm.mu.curAllocated,
+		Max:          mm.mu.maxAllocated,
+		External:     mm.externalUsageLocked(),
+		Accounts:     mm.mu.openAccounts,
+		Labels:       append([]Label(nil), mm.mu.labels...),
+		Frozen:       mm.mu.frozen,
+		OpenAccounts: mm.openAccountsLocked(),
+	}
+	if pool := mm.mu.curBudget.mon; pool != nil {
+		// A monitor may lock its pool, as when it asks it for budget.
+		e.ParentID = pool.ID()
+		e.Parent = pool.name
+	}
+	return e
+}
+
+// MonitorDelta is the change of a monitor between two snapshots; see
+// DiffSnapshots.
+type MonitorDelta struct {
+	// ID, Name and Parent identify the monitor as of the later snapshot,
+	// or the earlier one if it was removed.
+	ID     uint64
+	Name   string
+	Parent string
+	// Added and Removed are set if the monitor is only in the later, or
+	// the earlier, snapshot.
+	Added   bool
+	Removed bool
+	// Used and Max are the state of the monitor as of the later snapshot,
+	// or zero if it was removed.
+	Used int64
+	Max  int64
+	// UsedDelta, MaxDelta, ExternalDelta and AccountsDelta are the changes
+	// between the snapshots. A monitor that was added or removed is compared
+	// with zeroes.
+	UsedDelta     int64
+	MaxDelta      int64
+	ExternalDelta int64
+	AccountsDelta int
+}
+
+// changed returns whether the monitor changed between the snapshots.
+func (d MonitorDelta) changed() bool {
+	return d.Added || d.Removed || d.UsedDelta != 0 || d.MaxDelta != 0 || d.ExternalDelta != 0 ||
+		d.AccountsDelta != 0
+}
+
+// DiffSnapshots compares two snapshots of the monitors taken by
+// SnapshotMonitors, e.g. minutes apart to investigate a slow leak, and
+// returns the changes of all their monitors by decreasing absolute growth
+// of their usage. The entries are matched by ID; those left over, e.g.
+// because their monitor was restarted in between, are then matched by name
+// and name of their parent. The entries that still have no match are
+// reported as added or removed.
+func DiffSnapshots(before, after []MonitorEntry) []MonitorDelta {
+	type nameKey struct{ name, parent string }
+	byID := make(map[uint64]int, len(before))
+	byName := make(map[nameKey][]int)
+	for i, e := range before {
+		byID[e.ID] = i
+	}
+	matched := make([]bool, len(before))
+	pending := make([]int, 0, len(after))
+	deltas := make([]MonitorDelta, 0, len(after))
+	for j, e := range after {
+		if i, ok := byID[e.ID]; ok {
+			matched[i] = true
+			deltas = append(deltas, diffEntries(&before[i], &after[j]))
+			continue
+		}
+		pending = append(pending, j)
+	}
+	for i, e := range before {
+		if !matched[i] {
+			k := nameKey{e.Name, e.Parent}
+			byName[k] = append(byName[k], i)
+		}
+	}
+	for _, j := range pending {
+		k := nameKey{after[j].Name, after[j].Parent}
+		if is := byName[k]; len(is) > 0 {
+			byName[k] = is[1:]
+			matched[is[0]] = true
+			deltas = append(deltas, diffEntries(&before[is[0]], &after[j]))
+			continue
+		}
+		deltas = append(deltas, diffEntries(nil, &after[j]))
+	}
+	for i := range before {
+		if !matched[i] {
+			deltas = append(deltas, diffEntries(&before[i], nil))
+		}
+	}
+
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	sort.SliceStable(deltas, func(i, j int) bool {
+		if a, b := abs(deltas[i].UsedDelta), abs(deltas[j].UsedDelta); a != b {
+			return a > b
+		}
+		return deltas[i].ID < deltas[j].ID
+	})
+	return deltas
+}
+
+// diffEntries returns the change of a monitor from before to after, either
+// of which is nil if the monitor was added or removed.
+func diffEntries(before, after *MonitorEntry) MonitorDelta {
+	var d MonitorDelta
+	if after != nil {
+		d = MonitorDelta{
+			ID:            after.ID,
+			Name:          after.Name,
+			Parent:        after.Parent,
+			Used:          after.Used,
+			Max:           after.Max,
+			UsedDelta:     after.Used,
+			MaxDelta:      after.Max,
+			ExternalDelta: after.External,
+			AccountsDelta: after.Accounts,
+		}
+	} else {
+		d = MonitorDelta{ID: before.ID, Name: before.Name, Parent: before.Parent}
+	}
+	if before != nil {
+		d.UsedDelta -= before.Used
+		d.MaxDelta -= before.Max
+		d.ExternalDelta -= before.External
+		d.AccountsDelta -= before.Accounts
+	}
+	d.Added = before == nil
+	d.Removed = after == nil
+	return d
+}
+
+// WriteDeltas renders the changes returned by DiffSnapshots as text, one
+// line per monitor that changed, e.g.:
+//
+//   +12 MiB  sql (id 3, parent root): used 20 MiB (max +12 MiB), accounts +2
+//
+// The changes of the external usage, if any, are appended, e.g.
+// ", external +1 GiB".
+func WriteDeltas(w io.Writer, deltas []MonitorDelta) error {
+	var unchanged int
+	for _, d := range deltas {
+		if !d.changed() {
+			unchanged++
+			continue
+		}
+		var status string
+		if d.ExternalDelta != 0 {
+			status = ", external " + signedIBytes(d.ExternalDelta)
+		}
+		switch {
+		case d.Added:
+			status += " [added]"
+		case d.Removed:
+			status += " [removed]"
+		}
+		if _, err := fmt.Fprintf(w, "%-9s %s (id %d, parent %s): used %s (max %s), accounts %+d%s\n",
+			signedIBytes(d.UsedDelta), d.Name, d.ID, parentName(d.Parent), humanizeutil.IBytes(d.Used),
+			signedIBytes(d.MaxDelta), d.AccountsDelta, status); err != nil {
+			return err
+		}
+	}
+	if unchanged > 0 {
+		if _, err := fmt.Fprintf(w, "%d unchanged monitors\n", unchanged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentName renders the name of the parent of a monitor.
+func parentName(parent string) string {
+	if parent == "" {
+		return "(none)"
+	}
+	return parent
+}
+
+// signedIBytes is like humanizeutil.IBytes, but with a sign on growths.
+func signedIBytes(n int64) string {
+	if n > 0 {
+		return "+" + humanizeutil.IBytes(n)
+	}
+	return humanizeutil.IBytes(n)
+}
+
+// retainedDebugSnapshots is the number of the snapshots taken by
+// HandleDebug that are kept to be diffed against.
+const retainedDebugSnapshots = 8
+
+// debugSnapshot is a snapshot taken by HandleDebug.
+type debugSnapshot struct {
+	id      uint64
+	time    time.Time
+	entries []MonitorEntry
+}
+
+// debugSnapshots holds the most recent snapshots taken by HandleDebug, in a
+// ring.
+var debugSnapshots struct {
+	syncutil.Mutex
+	seq  uint64
+	ring [retainedDebugSnapshots]debugSnapshot
+}
+
+// retainDebugSnapshot retains the snapshot s, evicting the oldest one if
+// needed, and returns its ID.
+func retainDebugSnapshot(s debugSnapshot) uint64 {
+	debugSnapshots.Lock()
+	defer debugSnapshots.Unlock()
+	debugSnapshots.seq++
+	s.id = debugSnapshots.seq
+	debugSnapshots.ring[s.id%retainedDebugSnapshots] = s
+	return s.id
+}
+
+// lookupDebugSnapshot returns the snapshot with the given ID, if it is
+// still retained.
+func lookupDebugSnapshot(id uint64) (debugSnapshot, bool) {
+	debugSnapshots.Lock()
+	defer debugSnapshots.Unlock()
+	s := debugSnapshots.ring[id%retainedDebugSnapshots]
+	return s, id != 0 && s.id == id
+}
+
+// HandleDebug responds with a snapshot of the monitors of the process, as
+// text. The snapshot is retained, along with a few of the previous ones, so
+// that a later request with "?diff=<id>" responds with the changes since
+// the snapshot with that ID instead; see DiffSnapshots.
+func HandleDebug(w http.ResponseWriter, r *http.Request) {
+	var prev debugSnapshot
+	if s := r.URL.Query().Get("diff"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid snapshot ID %q", s), http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if prev, ok = lookupDebugSnapshot(id); !ok {
+			http.Error(w, fmt.Sprintf("snapshot %d is not retained", id), http.StatusNotFound)
+			return
+		}
+	}
+	cur := debugSnapshot{time: DefaultTimeSource.Now(), entries: SnapshotMonitors()}
+	cur.id = retainDebugSnapshot(cur)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "snapshot %d at %s: %d monitors\n", cur.id, cur.time.Format(time.RFC3339), len(cur.entries))
+	if prev.id != 0 {
+		fmt.Fprintf(w, "changes since snapshot %d at %s (%s ago):\n",
+			prev.id, prev.time.Format(time.RFC3339), cur.time.Sub(prev.time))
+		_ = WriteDeltas(w, DiffSnapshots(prev.entries, cur.entries))
+		return
+	}
+	for _, e := range cur.entries {
+		var external, labels, frozen string
+		if e.External != 0 {
+			external = ", external " + humanizeutil.IBytes(e.External)
+		}
+		if len(e.Labels) > 0 {
+			labels = " [" + formatLabels(e.Labels) + "]"
+		}
+		if e.Frozen {
+			frozen = " (frozen)"
+		}
+		fmt.Fprintf(w, "%s (id %d, parent %s)%s: used %s (max %s), accounts %d%s%s\n",
+			e.Name, e.ID, parentName(e.Parent), labels, humanizeutil.IBytes(e.Used),
+			humanizeutil.IBytes(e.Max), e.Accounts, external, frozen)
+		for _, a := range e.OpenAccounts {
+			name := a.Name
+			if name == "" {
+				name = "<unnamed>"
+			}
+			fmt.Fprintf(w, "  account %s: used %s, opened at %s\n",
+				name, humanizeutil.IBytes(a.Used), a.Created.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	before := []mon.MonitorEntry{
+		{ID: 1, Name: "root", Used: 1000, Max: 1000, External: 100},
+		{ID: 2, Name: "sql", ParentID: 1, Parent: "root", Used: 500, Max: 800, Accounts: 2},
+		{ID: 3, Name: "session", ParentID: 2, Parent: "sql", Used: 100, Max: 100},
+		{ID: 4, Name: "gone", ParentID: 1, Parent: "root", Used: 300, Max: 300},
+		{ID: 5, Name: "idle", ParentID: 1, Parent: "root", Used: 10, Max: 10},
+	}
+	after := []mon.MonitorEntry{
+		{ID: 1, Name: "root", Used: 1500, Max: 1600, External: 300},
+		{ID: 2, Name: "sql", ParentID: 1, Parent: "root", Used: 1400, Max: 1400, Accounts: 5},
+		// The session monitor was restarted, and got a new ID.
+		{ID: 7, Name: "session", ParentID: 2, Parent: "sql", Used: 50, Max: 50},
+		{ID: 5, Name: "idle", ParentID: 1, Parent: "root", Used: 10, Max: 10},
+		{ID: 8, Name: "new", ParentID: 1, Parent: "root", Used: 200, Max: 250, Accounts: 1},
+	}
+	expected := []mon.MonitorDelta{
+		{ID: 2, Name: "sql", Parent: "root", Used: 1400, Max: 1400,
+			UsedDelta: 900, MaxDelta: 600, AccountsDelta: 3},
+		{ID: 1, Name: "root", Used: 1500, Max: 1600, UsedDelta: 500, MaxDelta: 600,
+			ExternalDelta: 200},
+		{ID: 4, Name: "gone", Parent: "root", Removed: true, UsedDelta: -300, MaxDelta: -300},
+		{ID: 8, Name: "new", Parent: "root", Added: true, Used: 200, Max: 250,
+			UsedDelta: 200, MaxDelta: 250, AccountsDelta: 1},
+		{ID: 7, Name: "session", Parent: "sql", Used: 50, Max: 50, UsedDelta: -50, MaxDelta: -50},
+		{ID: 5, Name: "idle", Parent: "root", Used: 10, Max: 10},
+	}
+	deltas := mon.DiffSnapshots(before, after)
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("expected:\n%+v\ngot:\n%+v", expected, deltas)
+	}
+
+	var buf bytes.Buffer
+	if err := mon.WriteDeltas(&buf, deltas); err != nil {
+		t.Fatal(err)
+	}
+	const expectedText = `+900 B    sql (id 2, parent root): used 1400 B (max +600 B), accounts +3
++500 B    root (id 1, parent (none)): used 1500 B (max +600 B), accounts +0, external +200 B
+-300 B    gone (id 4, parent root): used 0 B (max -300 B), accounts +0 [removed]
++200 B    new (id 8, parent root): used 200 B (max +250 B), accounts +1 [added]
+-50 B     session (id 7, parent sql): used 50 B (max -50 B), accounts +0
+1 unchanged monitors
+`
+	if s := buf.String(); s != expectedText {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expectedText, s)
+	}
+}
+
+func TestHandleDebug(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	root := mon.MakeMonitor("debug-root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer root.Stop(ctx)
+	child := mon.MakeMonitor("debug-child", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	child.Start(ctx, &root, mon.MakeStandaloneBudget(0))
+	defer child.Stop(ctx)
+	acc := child.MakeBoundAccount()
+	defer acc.Close(ctx)
+
+	get := func(query string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mon.HandleDebug(w, httptest.NewRequest("GET", "/debug/monitors"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	var id uint64
+	if _, err := fmt.Sscanf(body, "snapshot %d", &id); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if !strings.Contains(body, fmt.Sprintf("debug-child (id %d, parent debug-root): used 0 B",
+		child.ID())) {
+		t.Fatalf("expected the child in the snapshot, got:\n%s", body)
+	}
+
+	if err := acc.Grow(ctx, 1024); err != nil {
+		t.Fatal(err)
+	}
+	added := mon.MakeMonitor("debug-added", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	added.Start(ctx, &root, mon.MakeStandaloneBudget(0))
+	defer added.Stop(ctx)
+
+	code, body = get(fmt.Sprintf("?diff=%d", id))
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	for _, s := range []string{
+		fmt.Sprintf("changes since snapshot %d", id),
+		fmt.Sprintf("+1024 B   debug-child (id %d, parent debug-root): used 1024 B", child.ID()),
+		fmt.Sprintf("debug-added (id %d, parent debug-root): used 0 B (max 0 B), accounts +0 [added]",
+			added.ID()),
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("expected %q in:\n%s", s, body)
+		}
+	}
+
+	if code, body := get("?diff=1000000"); code != http.StatusNotFound {
+		t.Fatalf("expected a missing snapshot, got %d: %s", code, body)
+	}
+	if code, body := get("?diff=x"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid snapshot ID, got %d: %s", code, body)
+	}
+}
+
+func TestHandleDebugDetails(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("debug-details", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithLabels(mon.Label{Key: "tenant", Value: "7"}), mon.WithAccountRegistry())
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+	defer m.Stop(ctx)
+	var acc mon.BoundAccount
+	if err := m.OpenAccountAt(&acc, mon.WithAccountName("hash table")); err != nil {
+		t.Fatal(err)
+	}
+	defer acc.Close(ctx)
+	if err := acc.Grow(ctx, 2048); err != nil {
+		t.Fatal(err)
+	}
+	m.SetFrozen(true)
+
+	w := httptest.NewRecorder()
+	mon.HandleDebug(w, httptest.NewRequest("GET", "/debug/monitors", nil))
+	body := w.Body.String()
+	for _, s := range []string{
+		fmt.Sprintf("debug-details (id %d, parent (none)) [tenant=7]: used 2.0 KiB", m.ID()),
+		"accounts 1 (frozen)",
+		"  account hash table: used 2.0 KiB, opened at ",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("expected %q in:\n%s", s, body)
+		}
+	}
+}
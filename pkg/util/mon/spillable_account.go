@@ -0,0 +1,133 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "context"
+
+// SpillableAccount implements the accounting side of the "grow in memory,
+// switch to disk when memory runs out" pattern used by operators that spill.
+// It charges a memory account until the memory monitor denies a request or a
+// soft threshold is reached, at which point the whole usage moves to a disk
+// account and subsequent requests are charged to disk. Unspill moves the
+// usage back to memory once it fits again.
+//
+// During a transition, the destination is charged before the source is
+// released, so that a failure leaves the original charge in place: the
+// usage is briefly charged to both accounts, which are normally on separate
+// monitors, but it is never left uncharged.
+//
+// A SpillableAccount is not safe for concurrent use.
+type SpillableAccount struct {
+	mem  *BoundAccount
+	disk *BoundAccount
+
+	// threshold is the soft limit on memory usage; 0 or lower means only the
+	// memory monitor's budget applies.
+	threshold int64
+	spilled   bool
+	used      int64
+}
+
+// MakeSpillableAccount creates a SpillableAccount charging mem and, once
+// spilled, disk. The accounts must not be used by anything else.
+func MakeSpillableAccount(mem, disk *BoundAccount, threshold int64) SpillableAccount {
+	return SpillableAccount{mem: mem, disk: disk, threshold: threshold}
+}
+
+// Used returns the number of bytes currently charged through the account.
+func (s *SpillableAccount) Used() int64 {
+	return s.used
+}
+
+// Spilled returns whether the usage is currently charged to disk.
+func (s *SpillableAccount) Spilled() bool {
+	return s.spilled
+}
+
+// Grow charges n more bytes. If the account hasn't spilled yet and the memory
+// account cannot take the request, the account spills: the existing usage
+// and the request are charged to disk instead. An error is returned only if
+// the disk account denies the request.
+func (s *SpillableAccount) Grow(ctx context.Context, n int64) error {
+	if s.spilled {
+		if err := s.disk.Grow(ctx, n); err != nil {
+			return err
+		}
+		s.used += n
+		return nil
+	}
+	if threshold := s.softThreshold(); threshold <= 0 || s.used+n <= threshold {
+		if err := s.mem.Grow(ctx, n); err == nil {
+			s.used += n
+			return nil
+		}
+	}
+	if err := s.move(ctx, s.mem, s.disk, n); err != nil {
+		return err
+	}
+	s.used += n
+	s.spilled = true
+	return nil
+}
+
+// Shrink releases n bytes from whichever account currently holds the usage.
+func (s *SpillableAccount) Shrink(ctx context.Context, n int64) {
+	if s.spilled {
+		s.disk.Shrink(ctx, n)
+	} else {
+		s.mem.Shrink(ctx, n)
+	}
+	s.used -= n
+}
+
+// Unspill moves the usage back to the memory account, if the account has
+// spilled and the usage fits under the threshold and in the memory budget.
+// It returns whether the account is back in memory.
+func (s *SpillableAccount) Unspill(ctx context.Context) bool {
+	if !s.spilled {
+		return true
+	}
+	if threshold := s.softThreshold(); threshold > 0 && s.used > threshold {
+		return false
+	}
+	if err := s.move(ctx, s.disk, s.mem, 0 /* extra */); err != nil {
+		return false
+	}
+	s.spilled = false
+	return true
+}
+
+// move moves the usage of the account from src to dst, growing dst by extra
+// more bytes. dst is charged before src is released, so that if dst refuses
+// the usage, src is left untouched and the error of dst is returned.
+func (s *SpillableAccount) move(ctx context.Context, src, dst *BoundAccount, extra int64) error {
+	if err := dst.Grow(ctx, s.used+extra); err != nil {
+		return err
+	}
+	src.Shrink(ctx, s.used)
+	return nil
+}
+
+// softThreshold returns the threshold of the account, lowered in the
+// elevated pressure modes (see SetGlobalPressureMode).
+func (s *SpillableAccount) softThreshold() int64 {
+	return int64(float64(s.threshold) * softThresholdFactor())
+}
+
+// Close releases the usage from whichever account holds it.
+func (s *SpillableAccount) Close(ctx context.Context) {
+	s.Shrink(ctx, s.used)
+	s.spilled = false
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestSpillableAccount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	memMon := MakeMonitor("test-mem", MemoryResource, nil, nil, 1, 1000, st)
+	memMon.Start(ctx, nil, MakeStandaloneBudget(100))
+	diskMon := MakeMonitor("test-disk", DiskResource, nil, nil, 1, 1000, st)
+	diskMon.Start(ctx, nil, MakeStandaloneBudget(500))
+
+	testCases := []struct {
+		name      string
+		threshold int64
+		// spillAt is the usage beyond which the account is expected to spill.
+		spillAt int64
+	}{
+		{"memory-budget", 0, 100},
+		{"threshold", 60, 60},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := memMon.MakeBoundAccount()
+			disk := diskMon.MakeBoundAccount()
+			s := MakeSpillableAccount(&mem, &disk, tc.threshold)
+
+			check := func(spilled bool) {
+				t.Helper()
+				if s.Spilled() != spilled {
+					t.Fatalf("expected spilled=%t at %d bytes", spilled, s.Used())
+				}
+				memUsed, diskUsed := int64(0), s.Used()
+				if !spilled {
+					memUsed, diskUsed = s.Used(), 0
+				}
+				if mem.Used() != memUsed || disk.Used() != diskUsed {
+					t.Fatalf("expected memory %d and disk %d, got %d and %d",
+						memUsed, diskUsed, mem.Used(), disk.Used())
+				}
+			}
+
+			for s.Used()+20 <= tc.spillAt {
+				if err := s.Grow(ctx, 20); err != nil {
+					t.Fatal(err)
+				}
+				check(false)
+			}
+			if err := s.Grow(ctx, 20); err != nil {
+				t.Fatal(err)
+			}
+			check(true)
+			if err := s.Grow(ctx, 100); err != nil {
+				t.Fatal(err)
+			}
+			check(true)
+
+			// The disk budget still applies.
+			if err := s.Grow(ctx, 1000); err == nil {
+				t.Fatal("expected disk budget error")
+			}
+			check(true)
+
+			// Unspilling requires the usage to fit in memory again.
+			if s.Unspill(ctx) {
+				t.Fatal("expected unspill to fail")
+			}
+			check(true)
+			s.Shrink(ctx, s.Used()-40)
+			if !s.Unspill(ctx) {
+				t.Fatal("expected unspill to succeed")
+			}
+			check(false)
+
+			s.Close(ctx)
+			check(false)
+			mem.Close(ctx)
+			disk.Close(ctx)
+		})
+	}
+
+	memMon.Stop(ctx)
+	diskMon.Stop(ctx)
+}
+
+// TestSpillableAccountTransitions verifies that a refused transition leaves
+// the usage charged to the account it was on, and nothing charged to the
+// other one, even when other accounts compete for the budget of the source.
+func TestSpillableAccountTransitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	memMon := MakeMonitor("test-mem", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	memMon.Start(ctx, nil, MakeStandaloneBudget(100))
+	diskMon := MakeMonitor("test-disk", DiskResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	diskMon.Start(ctx, nil, MakeStandaloneBudget(120))
+
+	mem := memMon.MakeBoundAccount()
+	disk := diskMon.MakeBoundAccount()
+	s := MakeSpillableAccount(&mem, &disk, 0 /* threshold */)
+	check := func(spilled bool, memUsed, diskUsed int64) {
+		t.Helper()
+		if s.Spilled() != spilled || mem.Used() != memUsed || disk.Used() != diskUsed {
+			t.Fatalf("expected spilled=%t with memory %d and disk %d, got spilled=%t with %d and %d",
+				spilled, memUsed, diskUsed, s.Spilled(), mem.Used(), disk.Used())
+		}
+		if memMon.AllocBytes() != memUsed || diskMon.AllocBytes() != diskUsed {
+			t.Fatalf("expected monitors at %d and %d, got\n%s\n%s",
+				memUsed, diskUsed, memMon.DebugString(), diskMon.DebugString())
+		}
+	}
+
+	if err := s.Grow(ctx, 90); err != nil {
+		t.Fatal(err)
+	}
+	// A refused spill leaves the usage in memory.
+	if err := s.Grow(ctx, 40); err == nil {
+		t.Fatal("expected the spill to be refused")
+	}
+	check(false /* spilled */, 90, 0)
+	if err := s.Grow(ctx, 30); err != nil {
+		t.Fatal(err)
+	}
+	check(true /* spilled */, 0, 120)
+
+	// A refused unspill leaves the usage on disk.
+	if s.Unspill(ctx) {
+		t.Fatal("expected unspill to fail")
+	}
+	check(true /* spilled */, 0, 120)
+
+	// The usage stays on disk while the memory it would move to is taken by
+	// another account.
+	s.Shrink(ctx, 40)
+	other := memMon.MakeBoundAccount()
+	if err := other.Grow(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if s.Unspill(ctx) {
+		t.Fatal("expected unspill to fail")
+	}
+	if s.Used() != 80 || mem.Used() != 0 || disk.Used() != 80 {
+		t.Fatalf("expected the usage to stay on disk, got memory %d and disk %d", mem.Used(), disk.Used())
+	}
+	other.Close(ctx)
+	if !s.Unspill(ctx) {
+		t.Fatal("expected unspill to succeed")
+	}
+	check(false /* spilled */, 80, 0)
+
+	s.Close(ctx)
+	mem.Close(ctx)
+	disk.Close(ctx)
+	memMon.Stop(ctx)
+	diskMon.Stop(ctx)
+}
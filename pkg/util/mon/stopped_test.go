@@ -0,0 +1,107 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// TestGrowAfterStop races the Stop of a monitor with accounts growing
+// through it and through a child of it, and checks that the accounts only
+// ever get ErrMonitorStopped and can still be closed.
+func TestGrowAfterStop(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	for i := 0; i < 20; i++ {
+		m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+			mon.WithLeakReaction(mon.LeakLogAndRelease))
+		m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+		child := mon.MakeMonitor("child", mon.MemoryResource, nil, nil, 10, math.MaxInt64, st,
+			mon.WithLeakReaction(mon.LeakLogAndRelease))
+		child.Start(ctx, &m, mon.MakeStandaloneBudget(0))
+
+		const workers = 4
+		var wg sync.WaitGroup
+		errCh := make(chan error, 2*workers)
+		grow := func(acc mon.BoundAccount) {
+			defer wg.Done()
+			defer acc.Close(ctx)
+			for {
+				if err := acc.Grow(ctx, 1); err != nil {
+					errCh <- err
+					// Releases after the Stop are ignored.
+					acc.Shrink(ctx, acc.Used()/2)
+					return
+				}
+			}
+		}
+		for j := 0; j < workers; j++ {
+			wg.Add(2)
+			go grow(m.MakeBoundAccount())
+			go grow(child.MakeBoundAccount())
+		}
+		m.Stop(ctx)
+		wg.Wait()
+		child.Stop(ctx)
+
+		close(errCh)
+		for err := range errCh {
+			if errors.Cause(err) != mon.ErrMonitorStopped {
+				t.Fatalf("expected ErrMonitorStopped, got %v", err)
+			}
+		}
+	}
+}
+
+func TestReserveAfterStop(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+	m.Stop(ctx)
+
+	if err := acc.Grow(ctx, 10); errors.Cause(err) != mon.ErrMonitorStopped {
+		t.Fatalf("expected ErrMonitorStopped, got %v", err)
+	}
+	if _, err := acc.GrowUpTo(ctx, 10); errors.Cause(err) != mon.ErrMonitorStopped {
+		t.Fatalf("expected ErrMonitorStopped, got %v", err)
+	}
+
+	// The monitor can be started again.
+	m.Start(ctx, nil, mon.MakeStandaloneBudget(100))
+	acc = m.MakeBoundAccount()
+	if err := acc.Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+)
+
+// StopSubtree stops the descendants of the monitor, i.e. the monitors
+// started with it as their pool and theirs, deepest first, e.g. to tear
+// down the session monitors under a SQL pool on server drain without
+// waiting for their owners. The monitor itself stays started.
+//
+// A descendant whose accounts still hold bytes is stopped with
+// EmergencyStop if force is set. Otherwise it is left started, along with
+// its ancestors, which still hold its budget, and an error listing the
+// descendants holding bytes is returned.
+//
+// Monitors can't start with the monitor or one of its descendants as their
+// pool while the cascade reaches them: TryStart returns an error, and Start
+// panics. Owners that may race with StopSubtree should use TryStart.
+func (mm *BytesMonitor) StopSubtree(ctx context.Context, force bool) error {
+	mm.setDraining(true)
+	defer mm.setDraining(false)
+	var holding []string
+	mm.stopDescendants(ctx, force, &holding)
+	if len(holding) > 0 {
+		return errors.Errorf("%s: cannot stop the subtree, monitors still holding bytes: %s",
+			mm.name, strings.Join(holding, ", "))
+	}
+	return nil
+}
+
+// stopDescendants stops the descendants of mm, deepest first, and returns
+// whether they were all stopped. The descendants left started because they
+// hold bytes are appended to holding.
+func (mm *BytesMonitor) stopDescendants(
+	ctx context.Context, force bool, holding *[]string,
+) (allStopped bool) {
+	children := mm.childrenSnapshot()
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	allStopped = true
+	for _, c := range children {
+		// The child is marked before its children are listed, so that the
+		// monitors starting concurrently are either listed or rejected.
+		c.setDraining(true)
+		stopped := c.stopDescendants(ctx, force, holding)
+		switch {
+		case stopped && force:
+			c.EmergencyStop(ctx)
+		case stopped && c.stopIfUnused(ctx, holding):
+		default:
+			c.setDraining(false)
+			allStopped = false
+		}
+	}
+	return allStopped
+}
+
+// stopIfUnused stops mm unless its accounts hold bytes, in which case it is
+// appended to holding. The check and the stop are atomic with respect to
+// the reservations.
+func (mm *BytesMonitor) stopIfUnused(ctx context.Context, holding *[]string) bool {
+	mm.mu.Lock()
+	if used := mm.mu.curAllocated; used != 0 {
+		mm.mu.Unlock()
+		*holding = append(*holding, fmt.Sprintf("%s (%s)", mm.name, humanizeutil.IBytes(used)))
+		return false
+	}
+	// Marking the monitor as stopped here keeps reservations from sneaking
+	// in before Stop.
+	mm.mu.stopped = true
+	atomic.StoreInt32(&mm.stoppedFlag, 1)
+	mm.mu.Unlock()
+	mm.Stop(ctx)
+	return true
+}
+
+// setDraining sets whether mm rejects new children; see StopSubtree.
+func (mm *BytesMonitor) setDraining(draining bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.mu.draining = draining
+}
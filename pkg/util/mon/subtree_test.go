@@ -0,0 +1,157 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+// subtree is a tree of monitors: root has children a and b, a has children
+// a1 and a2, and b has child b1. a1 and b1 hold bytes.
+type subtree struct {
+	root, a, b, a1, a2, b1 *mon.BytesMonitor
+	a1Acc, b1Acc           mon.BoundAccount
+}
+
+// stopByOwners stops the descendants of the root, deepest first, as their
+// owners do whether or not StopSubtree stopped them already.
+func (s *subtree) stopByOwners(ctx context.Context) {
+	for _, m := range []*mon.BytesMonitor{s.a1, s.a2, s.b1, s.a, s.b} {
+		m.Stop(ctx)
+	}
+}
+
+func makeSubtree(ctx context.Context, t *testing.T, st *cluster.Settings) *subtree {
+	newMon := func(name string, pool *mon.BytesMonitor) *mon.BytesMonitor {
+		m := mon.MakeMonitor(name, mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		if pool == nil {
+			m.Start(ctx, nil, mon.MakeStandaloneBudget(math.MaxInt64))
+		} else {
+			m.Start(ctx, pool, mon.MakeStandaloneBudget(0))
+		}
+		return &m
+	}
+	s := &subtree{}
+	s.root = newMon("root", nil)
+	s.a = newMon("a", s.root)
+	s.b = newMon("b", s.root)
+	s.a1 = newMon("a1", s.a)
+	s.a2 = newMon("a2", s.a)
+	s.b1 = newMon("b1", s.b)
+	s.a1Acc = s.a1.MakeBoundAccount()
+	s.b1Acc = s.b1.MakeBoundAccount()
+	for _, acc := range []*mon.BoundAccount{&s.a1Acc, &s.b1Acc} {
+		if err := acc.Grow(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestStopSubtree(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	t.Run("graceful", func(t *testing.T) {
+		s := makeSubtree(ctx, t, st)
+		s.b1Acc.Close(ctx)
+
+		err := s.root.StopSubtree(ctx, false /* force */)
+		if err == nil || !strings.Contains(err.Error(), "a1 (100 B)") || strings.Contains(err.Error(), "b1") {
+			t.Fatalf("expected an error listing a1 only, got %v", err)
+		}
+		// The monitors holding bytes and their ancestors are left started.
+		for _, m := range []*mon.BytesMonitor{s.a1, s.a} {
+			acc := m.MakeBoundAccount()
+			if err := acc.Grow(ctx, 1); err != nil {
+				t.Fatalf("expected the monitor to be started, got %v", err)
+			}
+			acc.Close(ctx)
+		}
+		for _, m := range []*mon.BytesMonitor{s.a2, s.b1, s.b} {
+			acc := m.MakeBoundAccount()
+			if err := acc.Grow(ctx, 1); errors.Cause(err) != mon.ErrMonitorStopped {
+				t.Fatalf("expected the monitor to be stopped, got %v", err)
+			}
+		}
+
+		s.a1Acc.Close(ctx)
+		if err := s.root.StopSubtree(ctx, false /* force */); err != nil {
+			t.Fatal(err)
+		}
+		montest.AssertEmpty(t, s.root)
+		// The root can still start children.
+		c := mon.MakeMonitor("c", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+		if err := c.TryStart(ctx, s.root, mon.MakeStandaloneBudget(0)); err != nil {
+			t.Fatal(err)
+		}
+		c.Stop(ctx)
+		s.stopByOwners(ctx)
+		s.root.Stop(ctx)
+	})
+
+	t.Run("force", func(t *testing.T) {
+		s := makeSubtree(ctx, t, st)
+		if err := s.root.StopSubtree(ctx, true /* force */); err != nil {
+			t.Fatal(err)
+		}
+		montest.AssertEmpty(t, s.root)
+		// The owners can still close their accounts, and stop their
+		// monitors.
+		s.a1Acc.Close(ctx)
+		s.b1Acc.Close(ctx)
+		s.stopByOwners(ctx)
+		s.root.Stop(ctx)
+	})
+
+	t.Run("concurrent start", func(t *testing.T) {
+		s := makeSubtree(ctx, t, st)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Start children of a until the cascade rejects them. Those that
+			// start are stopped by the cascade.
+			for {
+				c := mon.MakeMonitor("c", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+				if err := c.TryStart(ctx, s.a, mon.MakeStandaloneBudget(0)); err != nil {
+					return
+				}
+			}
+		}()
+		if err := s.root.StopSubtree(ctx, true /* force */); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		s.a1Acc.Close(ctx)
+		s.b1Acc.Close(ctx)
+		s.stopByOwners(ctx)
+		s.root.Stop(ctx)
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import "github.com/cockroachdb/cockroach/pkg/util/syncutil"
+
+// Monitors can be tagged, e.g. with the fingerprint of the statement that a
+// session is running, to find out which statements are responsible for the
+// memory in use across all sessions. The usage of every tagged monitor is
+// added up per tag in a package-level aggregation, sharded by tag so that it
+// doesn't become a point of contention between monitors.
+
+// numTagShards is the number of shards of the tag aggregation.
+const numTagShards = 16
+
+type tagShard struct {
+	syncutil.Mutex
+	usage map[string]int64
+}
+
+var tagUsage [numTagShards]tagShard
+
+// FNV-1a parameters, see hash/fnv. The hash is computed inline, as hash/fnv
+// would allocate on every Grow and Shrink of a tagged monitor.
+const (
+	tagHashOffset32 = 2166136261
+	tagHashPrime32  = 16777619
+)
+
+func tagShardFor(tag string) *tagShard {
+	h := uint32(tagHashOffset32)
+	for i := 0; i < len(tag); i++ {
+		h ^= uint32(tag[i])
+		h *= tagHashPrime32
+	}
+	return &tagUsage[h%numTagShards]
+}
+
+// addTagUsage adds delta to the usage attributed to tag.
+func addTagUsage(tag string, delta int64) {
+	if tag == "" || delta == 0 {
+		return
+	}
+	s := tagShardFor(tag)
+	s.Lock()
+	defer s.Unlock()
+	if s.usage == nil {
+		s.usage = make(map[string]int64)
+	}
+	if u := s.usage[tag] + delta; u != 0 {
+		s.usage[tag] = u
+	} else {
+		delete(s.usage, tag)
+	}
+}
+
+// SetCurrentTag attributes the bytes allocated through the monitor, now and
+// until the tag changes again, to tag. The empty tag stops the attribution.
+// The bytes already allocated are moved from the previous tag to the new
+// one, so that UsageByTag reflects the current tags of the monitors.
+func (mm *BytesMonitor) SetCurrentTag(tag string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if tag == mm.mu.tag {
+		return
+	}
+	addTagUsage(mm.mu.tag, -mm.mu.curAllocated)
+	addTagUsage(tag, mm.mu.curAllocated)
+	mm.mu.tag = tag
+}
+
+// CurrentTag returns the tag set with SetCurrentTag.
+func (mm *BytesMonitor) CurrentTag() string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.mu.tag
+}
+
+// UsageByTag returns the number of bytes currently allocated through the
+// monitors with each tag (see SetCurrentTag). Tags without any bytes
+// allocated are omitted. The shards are read one after the other, so the
+// result is not an atomic snapshot of all the tags.
+func UsageByTag() map[string]int64 {
+	res := make(map[string]int64)
+	for i := range tagUsage {
+		s := &tagUsage[i]
+		s.Lock()
+		for tag, u := range s.usage {
+			res[tag] = u
+		}
+		s.Unlock()
+	}
+	return res
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestUsageByTag(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m1 := MakeMonitor("session1", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m1.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m2 := MakeMonitor("session2", MemoryResource, nil, nil, 1, 1000, st,
+		WithReservationPolicy(ReleaseEagerly))
+	m2.Start(ctx, nil, MakeStandaloneBudget(1000))
+	a1, a2 := m1.MakeBoundAccount(), m2.MakeBoundAccount()
+
+	grow := func(acc *BoundAccount, n int64) {
+		t.Helper()
+		if err := acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(expected map[string]int64) {
+		t.Helper()
+		if usage := UsageByTag(); !reflect.DeepEqual(usage, expected) {
+			t.Fatalf("expected %v, got %v", expected, usage)
+		}
+	}
+
+	// Untagged usage is not attributed.
+	grow(&a1, 10)
+	expect(map[string]int64{})
+
+	// Tagging moves the current usage to the tag.
+	m1.SetCurrentTag("SELECT _")
+	expect(map[string]int64{"SELECT _": 10})
+	m2.SetCurrentTag("SELECT _")
+	grow(&a1, 20)
+	grow(&a2, 5)
+	expect(map[string]int64{"SELECT _": 35})
+
+	// The second session moves on to another statement mid-stream.
+	m2.SetCurrentTag("INSERT INTO _ VALUES (_)")
+	expect(map[string]int64{"SELECT _": 30, "INSERT INTO _ VALUES (_)": 5})
+	grow(&a2, 15)
+	a1.Shrink(ctx, 25)
+	expect(map[string]int64{"SELECT _": 5, "INSERT INTO _ VALUES (_)": 20})
+	if tag := m2.CurrentTag(); tag != "INSERT INTO _ VALUES (_)" {
+		t.Errorf("unexpected tag %q", tag)
+	}
+
+	// Tags without usage are dropped.
+	a2.Clear(ctx)
+	expect(map[string]int64{"SELECT _": 5})
+	m1.SetCurrentTag("")
+	expect(map[string]int64{})
+
+	a1.Close(ctx)
+	a2.Close(ctx)
+	m1.Stop(ctx)
+	m2.Stop(ctx)
+}
+
+func TestTagShardFor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tag := range []string{"", "a", "SELECT * FROM t WHERE k = _", "héllo"} {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(tag))
+		if s, expected := tagShardFor(tag), &tagUsage[h.Sum32()%numTagShards]; s != expected {
+			t.Errorf("%q: expected the shard of the FNV-1a hash of the tag", tag)
+		}
+	}
+	tag := "SELECT * FROM t WHERE k = _"
+	if n := testing.AllocsPerRun(100, func() { tagShardFor(tag) }); n != 0 {
+		t.Fatalf("expected no allocation, got %.1f", n)
+	}
+}
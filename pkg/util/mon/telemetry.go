@@ -0,0 +1,88 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// TelemetryCounter counts the telemetry events of the package by key. The
+// server plugs in the telemetry package, which this package can't import,
+// with SetTelemetryCounter.
+type TelemetryCounter interface {
+	Inc(key string)
+}
+
+// telemetryCounter holds the TelemetryCounter of the process, if any.
+var telemetryCounter struct {
+	syncutil.Mutex
+	c TelemetryCounter
+}
+
+// SetTelemetryCounter sets the TelemetryCounter of the process, and returns
+// a function restoring the previous one.
+func SetTelemetryCounter(c TelemetryCounter) (restore func()) {
+	telemetryCounter.Lock()
+	defer telemetryCounter.Unlock()
+	prev := telemetryCounter.c
+	telemetryCounter.c = c
+	return func() {
+		telemetryCounter.Lock()
+		defer telemetryCounter.Unlock()
+		telemetryCounter.c = prev
+	}
+}
+
+// countTelemetry increments the telemetry counter of key, if a
+// TelemetryCounter is set.
+func countTelemetry(key string) {
+	telemetryCounter.Lock()
+	c := telemetryCounter.c
+	telemetryCounter.Unlock()
+	if c != nil {
+		c.Inc(key)
+	}
+}
+
+// limitHitTelemetryKey returns the key of the telemetry counter of the
+// monitors named name hitting their limit: "mon.limit-hit." followed by the
+// prefix of the name made of letters, '-' and '_', so that the monitors of
+// a subsystem share a key, e.g. "sql-session" for "sql-session 42".
+func limitHitTelemetryKey(name string) string {
+	end := strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-' || r == '_')
+	})
+	if end >= 0 {
+		name = name[:end]
+	}
+	name = strings.TrimRight(name, "-_")
+	if name == "" {
+		name = "unnamed"
+	}
+	return "mon.limit-hit." + name
+}
+
+// noteLimitHitLocked records that mm denied a request, and returns whether
+// this is the first denial of its lifetime, to be reported to telemetry
+// once the monitor is unlocked.
+func (mm *BytesMonitor) noteLimitHitLocked() bool {
+	if mm.mu.limitHitReported {
+		return false
+	}
+	mm.mu.limitHitReported = true
+	return true
+}
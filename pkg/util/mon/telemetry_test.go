@@ -0,0 +1,108 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+type fakeTelemetryCounter struct {
+	syncutil.Mutex
+	counts map[string]int
+}
+
+func (c *fakeTelemetryCounter) Inc(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[key]++
+}
+
+func TestLimitHitTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	c := &fakeTelemetryCounter{counts: make(map[string]int)}
+	defer SetTelemetryCounter(c)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	root := MakeMonitor("root", MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	root.Start(ctx, nil, MakeStandaloneBudget(1000))
+	m := MakeMonitorWithLimit("sql-session 42", MemoryResource, 100, nil, nil, 1, math.MaxInt64, st)
+
+	expect := func(expected map[string]int) {
+		t.Helper()
+		c.Lock()
+		defer c.Unlock()
+		if !reflect.DeepEqual(c.counts, expected) {
+			t.Fatalf("expected %v, got %v", expected, c.counts)
+		}
+	}
+
+	m.Start(ctx, &root, BoundAccount{})
+	acc := m.MakeBoundAccount()
+	for i := 0; i < 3; i++ {
+		if err := acc.Grow(ctx, 200); err == nil {
+			t.Fatal("expected the growth to be denied")
+		}
+	}
+	expect(map[string]int{"mon.limit-hit.sql-session": 1})
+	acc.Close(ctx)
+	m.Stop(ctx)
+
+	// A new lifetime of the monitor is counted again. The denials by the
+	// pool are counted for both monitors.
+	m.Start(ctx, &root, BoundAccount{})
+	rootAcc := root.MakeBoundAccount()
+	if err := rootAcc.Grow(ctx, 950); err != nil {
+		t.Fatal(err)
+	}
+	acc = m.MakeBoundAccount()
+	for i := 0; i < 3; i++ {
+		if err := acc.Grow(ctx, 90); err == nil {
+			t.Fatal("expected the growth to be denied")
+		}
+	}
+	expect(map[string]int{"mon.limit-hit.sql-session": 2, "mon.limit-hit.root": 1})
+
+	acc.Close(ctx)
+	rootAcc.Close(ctx)
+	m.Stop(ctx)
+	root.Stop(ctx)
+}
+
+func TestLimitHitTelemetryKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for name, expected := range map[string]string{
+		"root":                  "mon.limit-hit.root",
+		"sql-session 42":        "mon.limit-hit.sql-session",
+		"internal-planner.scan": "mon.limit-hit.internal-planner",
+		"flow-3f2a":             "mon.limit-hit.flow",
+		"txn_":                  "mon.limit-hit.txn",
+		"42":                    "mon.limit-hit.unnamed",
+	} {
+		if key := limitHitTelemetryKey(name); key != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, key)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// PressureSource provides a memory pressure between 0 and 1, like
+// BytesMonitor.Pressure.
+type PressureSource interface {
+	Pressure() float64
+}
+
+var _ PressureSource = &BytesMonitor{}
+
+// ThrottlePolicy configures the delays of ThrottledReader.
+type ThrottlePolicy struct {
+	// Floor is the pressure up to which reads are never delayed.
+	Floor float64
+	// Delay maps a pressure above Floor to the delay inserted before a read.
+	Delay func(pressure float64) time.Duration
+	// TimeSource measures the delays. If nil, the TimeSource of the monitor
+	// is used if the pressure source is a BytesMonitor, or else
+	// DefaultTimeSource.
+	TimeSource TimeSource
+}
+
+// LinearThrottleDelay returns a ThrottlePolicy.Delay growing linearly from 0
+// at the floor pressure to max at full pressure.
+func LinearThrottleDelay(floor float64, max time.Duration) func(float64) time.Duration {
+	return func(pressure float64) time.Duration {
+		if pressure <= floor || floor >= 1 {
+			return 0
+		}
+		if pressure > 1 {
+			pressure = 1
+		}
+		return time.Duration(float64(max) * (pressure - floor) / (1 - floor))
+	}
+}
+
+// throttledReader is the io.Reader returned by ThrottledReader.
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	src    PressureSource
+	policy ThrottlePolicy
+}
+
+// ThrottledReader wraps r so that reads slow down as the memory pressure
+// reported by src, typically the monitor accounting for the data read,
+// rises: before every read, it waits for the delay that the policy maps the
+// current pressure to. This lets ingestion pipelines apply backpressure to
+// their inputs instead of failing later for lack of memory. The cancellation
+// of ctx interrupts the wait, and the read then returns the error of ctx.
+func ThrottledReader(
+	ctx context.Context, r io.Reader, src PressureSource, policy ThrottlePolicy,
+) io.Reader {
+	if policy.TimeSource == nil {
+		policy.TimeSource = DefaultTimeSource
+		if m, ok := src.(*BytesMonitor); ok {
+			policy.TimeSource = m.clock()
+		}
+	}
+	return &throttledReader{ctx: ctx, r: r, src: src, policy: policy}
+}
+
+// Read implements the io.Reader interface.
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if d := t.delay(); d > 0 {
+		timer := t.policy.TimeSource.NewTimer(d)
+		select {
+		case <-timer.C():
+		case <-t.ctx.Done():
+			timer.Stop()
+			return 0, t.ctx.Err()
+		}
+	}
+	return t.r.Read(p)
+}
+
+// delay returns the delay to insert before the next read.
+func (t *throttledReader) delay() time.Duration {
+	if t.policy.Delay == nil {
+		return 0
+	}
+	pressure := t.src.Pressure()
+	if pressure <= t.policy.Floor {
+		return 0
+	}
+	return t.policy.Delay(pressure)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+// fakePressure is a mon.PressureSource set by the test.
+type fakePressure struct {
+	bits uint64
+}
+
+func (f *fakePressure) set(p float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(p))
+}
+
+func (f *fakePressure) Pressure() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func TestThrottledReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	var pressure fakePressure
+	policy := mon.ThrottlePolicy{
+		Floor:      0.5,
+		Delay:      mon.LinearThrottleDelay(0.5, 10*time.Second),
+		TimeSource: clock,
+	}
+
+	// read performs a one byte read, and returns the time it waited for.
+	read := func(ctx context.Context, r io.Reader) (time.Duration, error) {
+		t.Helper()
+		start := clock.Now()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 1))
+			errCh <- err
+		}()
+		for {
+			select {
+			case err := <-errCh:
+				return clock.Now().Sub(start), err
+			default:
+			}
+			if clock.NumTimers() > 0 {
+				clock.Advance(time.Second)
+			} else {
+				runtime.Gosched()
+			}
+		}
+	}
+
+	// The delay grows with the pressure above the floor.
+	input := strings.NewReader(strings.Repeat("x", 10))
+	r := mon.ThrottledReader(context.Background(), input, &pressure, policy)
+	for _, tc := range []struct {
+		pressure float64
+		delay    time.Duration
+	}{
+		{0, 0},
+		{0.5, 0},
+		{0.6, 2 * time.Second},
+		{0.8, 6 * time.Second},
+		{1, 10 * time.Second},
+	} {
+		pressure.set(tc.pressure)
+		d, err := read(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != tc.delay {
+			t.Errorf("pressure %.1f: expected a delay of %s, got %s", tc.pressure, tc.delay, d)
+		}
+	}
+
+	// Cancellation interrupts the wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	r = mon.ThrottledReader(ctx, strings.NewReader("x"), &pressure, policy)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	for clock.NumTimers() == 0 {
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected the read to be canceled, got %v", err)
+	}
+	if n := clock.NumTimers(); n != 0 {
+		t.Fatalf("expected the timer to be stopped, got %d timers", n)
+	}
+}
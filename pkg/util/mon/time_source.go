@@ -0,0 +1,76 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// TimeSource provides the current time and timers to the time-based
+// features of monitors. Monitors never call time.Now or create timers
+// directly, so that tests can substitute a manual source (see
+// montest.ManualTimeSource) and advance time deterministically.
+type TimeSource interface {
+	Now() time.Time
+	// NewTimer creates a timer that delivers the current time on its channel
+	// after at least d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a TimeSource.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer
+	// fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// DefaultTimeSource is the TimeSource of monitors that don't specify one.
+// It uses the system clock.
+var DefaultTimeSource TimeSource = systemTimeSource{}
+
+type systemTimeSource struct{}
+
+func (systemTimeSource) Now() time.Time {
+	return timeutil.Now()
+}
+
+func (systemTimeSource) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// clock returns the TimeSource of the monitor.
+func (mm *BytesMonitor) clock() TimeSource {
+	if mm.timeSource == nil {
+		return DefaultTimeSource
+	}
+	return mm.timeSource
+}
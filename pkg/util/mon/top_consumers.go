@@ -0,0 +1,134 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type topConsumersConfig struct {
+	fraction float64
+	k        int
+	interval time.Duration
+}
+
+// WithTopConsumersLog makes the monitor log, when its pressure (see
+// Pressure) reaches fraction, a TopConsumersEvent naming the k children
+// using the most memory, so that a pool running out of budget is noticed
+// before allocations get refused. The event is logged at most once every
+// interval, measured with the TimeSource of the monitor. It is meant for
+// root monitors, with many children.
+func WithTopConsumersLog(fraction float64, k int, interval time.Duration) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.topConsumers = topConsumersConfig{fraction: fraction, k: k, interval: interval}
+	})
+}
+
+// MonitorUsage is the usage of a monitor, as reported in a
+// TopConsumersEvent.
+type MonitorUsage struct {
+	Name      string
+	Allocated int64
+}
+
+// TopConsumersEvent is logged by a monitor configured with
+// WithTopConsumersLog when it comes under pressure.
+type TopConsumersEvent struct {
+	// Monitor is the name of the monitor under pressure.
+	Monitor string
+	// Pressure is the pressure of the monitor; see Pressure.
+	Pressure float64
+	// Allocated is the number of bytes allocated through the monitor, and
+	// Budget the budget obtained from its pool plus its pre-reserved budget.
+	Allocated int64
+	Budget    int64
+	// Children is the number of children of the monitor, and Top the ones
+	// using the most memory, by decreasing usage.
+	Children int
+	Top      []MonitorUsage
+}
+
+func (ev TopConsumersEvent) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: memory pressure at %.0f%% (%d bytes allocated, %d bytes of budget), "+
+		"top %d of %d children:", ev.Monitor, ev.Pressure*100, ev.Allocated, ev.Budget,
+		len(ev.Top), ev.Children)
+	for i, u := range ev.Top {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, " %s %d bytes", u.Name, u.Allocated)
+	}
+	return buf.String()
+}
+
+// shouldLogTopConsumersLocked returns whether the monitor crossed the
+// pressure threshold set with WithTopConsumersLog and is due for a log
+// message. If so, the message is accounted for in the rate limit, and it is
+// up to the caller to call logTopConsumers once the monitor is unlocked.
+func (mm *BytesMonitor) shouldLogTopConsumersLocked() bool {
+	if mm.topConsumers.k <= 0 ||
+		mm.localPressureLocked() < mm.topConsumers.fraction*softThresholdFactor() {
+		return false
+	}
+	now := mm.clock().Now()
+	if last := mm.mu.lastTopConsumersLog; !last.IsZero() && now.Sub(last) < mm.topConsumers.interval {
+		return false
+	}
+	mm.mu.lastTopConsumersLog = now
+	return true
+}
+
+// logTopConsumers logs a TopConsumersEvent. The monitor must not be locked.
+// It can be called while the child asking the monitor for budget is locked,
+// so the usage of the children is read without locking them, and the usage
+// of that child doesn't include the allocation it is asking budget for.
+func (mm *BytesMonitor) logTopConsumers(ctx context.Context) {
+	mm.log().Infof(ctx, "%s", mm.topConsumersEvent())
+}
+
+func (mm *BytesMonitor) topConsumersEvent() TopConsumersEvent {
+	mm.mu.Lock()
+	ev := TopConsumersEvent{
+		Monitor:   mm.name,
+		Pressure:  mm.localPressureLocked(),
+		Allocated: mm.mu.curAllocated,
+		Budget:    saturatingAdd(mm.mu.curBudget.allocated(), mm.reserved.used),
+	}
+	mm.mu.Unlock()
+
+	children := mm.childrenSnapshot()
+	ev.Children = len(children)
+	usage := make([]MonitorUsage, len(children))
+	for i, c := range children {
+		usage[i] = MonitorUsage{Name: c.name, Allocated: atomic.LoadInt64(&c.approxAllocated)}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Allocated != usage[j].Allocated {
+			return usage[i].Allocated > usage[j].Allocated
+		}
+		return usage[i].Name < usage[j].Name
+	})
+	if len(usage) > mm.topConsumers.k {
+		usage = usage[:mm.topConsumers.k]
+	}
+	ev.Top = usage
+	return ev
+}
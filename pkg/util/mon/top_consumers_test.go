@@ -0,0 +1,127 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/mon/montest"
+)
+
+func TestTopConsumersLog(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+	s := log.ScopeWithoutShowLogs(t)
+	defer s.Close(t)
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	clock := montest.NewManualTimeSource(time.Unix(1000, 0))
+	root := mon.MakeMonitor("root", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithTimeSource(clock), mon.WithTopConsumersLog(0.85, 2, 5*time.Minute))
+	root.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+
+	// Start three sessions, using 100, 300 and 200 bytes.
+	var sessions []*mon.BytesMonitor
+	var accounts []*mon.BoundAccount
+	for i, n := range []int64{100, 300, 200} {
+		m := mon.MakeMonitor(fmt.Sprintf("session%d", i+1), mon.MemoryResource, nil, nil, 1,
+			math.MaxInt64, st)
+		m.Start(ctx, &root, mon.MakeStandaloneBudget(0))
+		acc := m.MakeBoundAccount()
+		if err := acc.Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, &m)
+		accounts = append(accounts, &acc)
+	}
+
+	messages := func() []string {
+		t.Helper()
+		log.Flush()
+		entries, err := log.FetchEntriesFromFiles(0, math.MaxInt64, 100,
+			regexp.MustCompile("root: memory pressure"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, e := range entries {
+			res = append(res, e.Message)
+		}
+		return res
+	}
+	if msgs := messages(); len(msgs) != 0 {
+		t.Fatalf("expected no message below the threshold, got %q", msgs)
+	}
+
+	if err := accounts[0].Grow(ctx, 240); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := messages(); len(msgs) != 0 {
+		t.Fatalf("expected no message below the threshold, got %q", msgs)
+	}
+
+	// Crossing 85% logs the two largest sessions.
+	if err := accounts[2].Grow(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	msgs := messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %q", msgs)
+	}
+	if !strings.Contains(msgs[0], "top 2 of 3 children: session1 340 bytes, session2 300 bytes") ||
+		strings.Contains(msgs[0], "session3") {
+		t.Fatalf("expected session1 and session2 to be named, got %q", msgs[0])
+	}
+	if !strings.Contains(msgs[0], "850 bytes allocated") {
+		t.Fatalf("expected the pool totals, got %q", msgs[0])
+	}
+
+	// Further allocations under pressure are not logged until the interval
+	// passes.
+	grow := func(n int64) {
+		t.Helper()
+		if err := accounts[2].Grow(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grow(10)
+	clock.Advance(4 * time.Minute)
+	grow(10)
+	if msgs := messages(); len(msgs) != 1 {
+		t.Fatalf("expected the messages to be rate limited, got %q", msgs)
+	}
+	clock.Advance(time.Minute)
+	grow(10)
+	if msgs := messages(); len(msgs) != 2 {
+		t.Fatalf("expected a second message, got %q", msgs)
+	}
+
+	for i, acc := range accounts {
+		acc.Close(ctx)
+		sessions[i].Stop(ctx)
+	}
+	root.Stop(ctx)
+}
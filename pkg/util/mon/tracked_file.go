@@ -0,0 +1,186 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// TrackedFile wraps a file so that its logical size is charged to an account,
+// typically bound to a monitor tracking DiskResource. Writes and truncations
+// that extend the file grow the account by the size delta before performing
+// the I/O, and are refused if the account denies the growth. Writes past the
+// end of the file (after a Seek, or via WriteAt) charge for the resulting
+// logical size, including any hole, since the space may be materialized by
+// the filesystem.
+//
+// A TrackedFile is not safe for concurrent use.
+type TrackedFile struct {
+	ctx  context.Context
+	f    *os.File
+	acc  *BoundAccount
+	size int64
+	// append is set if the file was opened with O_APPEND; see Write.
+	append bool
+}
+
+var _ io.Writer = &TrackedFile{}
+var _ io.WriterAt = &TrackedFile{}
+
+// NewTrackedFile wraps f, charging its current size to acc. An error is
+// returned if the size cannot be determined or the account denies it.
+func NewTrackedFile(ctx context.Context, f *os.File, acc *BoundAccount) (*TrackedFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := acc.Grow(ctx, fi.Size()); err != nil {
+		return nil, err
+	}
+	return &TrackedFile{
+		ctx: ctx, f: f, acc: acc, size: fi.Size(), append: openedForAppend(f),
+	}, nil
+}
+
+// File returns the underlying file. Writes performed directly on it are not
+// accounted for.
+func (t *TrackedFile) File() *os.File {
+	return t.f
+}
+
+// Size returns the logical size of the file, as charged to the account.
+func (t *TrackedFile) Size() int64 {
+	return t.size
+}
+
+// Write implements the io.Writer interface. Only the bytes written past the
+// end of the file are charged, so overwriting existing bytes in place is
+// free. If the file was opened with O_APPEND, the write happens at the end
+// of the file whatever its offset, so it is charged as if it ended past both
+// the offset and the end of the file, and the charge is settled once the
+// offset where it actually ended is known.
+func (t *TrackedFile) Write(p []byte) (int, error) {
+	off, err := t.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if !t.append {
+		prev := t.size
+		if err := t.reserve(off + int64(len(p))); err != nil {
+			return 0, err
+		}
+		n, err := t.f.Write(p)
+		t.settle(prev, off+int64(n))
+		return n, err
+	}
+	start := off
+	if t.size > start {
+		start = t.size
+	}
+	prev := t.size
+	if err := t.reserve(start + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := t.f.Write(p)
+	end, seekErr := t.f.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		// Keep the whole reservation if the write may have been appended.
+		end = start + int64(n)
+	}
+	t.settle(prev, end)
+	return n, err
+}
+
+// WriteAt implements the io.WriterAt interface.
+func (t *TrackedFile) WriteAt(p []byte, off int64) (int, error) {
+	prev := t.size
+	if err := t.reserve(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := t.f.WriteAt(p, off)
+	t.settle(prev, off+int64(n))
+	return n, err
+}
+
+// Seek sets the offset for the next Write. Seeking past the end of the file
+// is not charged until something is written there.
+func (t *TrackedFile) Seek(offset int64, whence int) (int64, error) {
+	return t.f.Seek(offset, whence)
+}
+
+// Truncate changes the size of the file, growing the account beforehand if
+// the file is extended and shrinking it afterwards if the file is shortened.
+func (t *TrackedFile) Truncate(size int64) error {
+	if size > t.size {
+		if err := t.acc.Grow(t.ctx, size-t.size); err != nil {
+			return err
+		}
+		if err := t.f.Truncate(size); err != nil {
+			t.acc.Shrink(t.ctx, size-t.size)
+			return err
+		}
+		t.size = size
+		return nil
+	}
+	if err := t.f.Truncate(size); err != nil {
+		return err
+	}
+	t.acc.Shrink(t.ctx, t.size-size)
+	t.size = size
+	return nil
+}
+
+// CloseAndRemove closes and removes the file, then releases its size from the
+// account.
+func (t *TrackedFile) CloseAndRemove() error {
+	closeErr := t.f.Close()
+	removeErr := os.Remove(t.f.Name())
+	t.acc.Shrink(t.ctx, t.size)
+	t.size = 0
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+// reserve grows the account ahead of a write that would make the file end at
+// end, if that extends the file. The reservation is recorded in t.size and
+// adjusted by settle once the outcome of the write is known.
+func (t *TrackedFile) reserve(end int64) error {
+	if end <= t.size {
+		return nil
+	}
+	if err := t.acc.Grow(t.ctx, end-t.size); err != nil {
+		return err
+	}
+	t.size = end
+	return nil
+}
+
+// settle releases the part of a reservation that a short write did not use,
+// given the size of the file before the write and the actual end of the
+// write.
+func (t *TrackedFile) settle(prev, end int64) {
+	if end >= t.size {
+		return
+	}
+	if end < prev {
+		end = prev
+	}
+	t.acc.Shrink(t.ctx, t.size-end)
+	t.size = end
+}
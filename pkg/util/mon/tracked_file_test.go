@@ -0,0 +1,158 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestTrackedFile(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	dir, err := ioutil.TempDir("", "tracked-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	m := MakeMonitor("test-disk", DiskResource, nil, nil, 1, 1000, st)
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	acc := m.MakeBoundAccount()
+
+	path := filepath.Join(dir, "spill")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := NewTrackedFile(ctx, f, &acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSize := func(expected int64) {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != expected || tf.Size() != expected || acc.Used() != expected {
+			t.Fatalf("expected size %d, got file %d, tracked %d, account %d",
+				expected, fi.Size(), tf.Size(), acc.Used())
+		}
+	}
+
+	if _, err := tf.Write(make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(300)
+
+	// Overwriting existing bytes doesn't charge anything.
+	if _, err := tf.WriteAt(make([]byte, 100), 50); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(300)
+
+	// A sparse write past the end charges the logical size.
+	if _, err := tf.Seek(800, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(900)
+
+	// Writes exceeding the budget are refused before touching the file.
+	_, err = tf.Write(make([]byte, 200))
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeDiskFullError {
+		t.Fatalf("expected disk full error, got %v", err)
+	}
+	checkSize(900)
+	if err := tf.Truncate(1200); err == nil {
+		t.Fatal("expected truncate beyond the budget to be refused")
+	}
+	checkSize(900)
+
+	if err := tf.Truncate(400); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(400)
+	if err := tf.Truncate(600); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(600)
+
+	// A file using up the budget can still rewrite its own bytes in place.
+	if err := tf.Truncate(1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("expected the header to be rewritten in place, got %v", err)
+	}
+	checkSize(1000)
+
+	if err := tf.CloseAndRemove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed, got %v", err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected account to be empty, got %d", acc.Used())
+	}
+
+	// In append mode, writes happen at the end of the file, whatever the
+	// offset.
+	if err := ioutil.WriteFile(path, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tf, err = NewTrackedFile(ctx, f, &acc); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(100)
+	for i := 1; i <= 2; i++ {
+		if _, err := tf.Write(make([]byte, 50)); err != nil {
+			t.Fatal(err)
+		}
+		checkSize(100 + int64(i)*50)
+	}
+	if err := tf.CloseAndRemove(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
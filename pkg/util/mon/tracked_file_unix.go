@@ -0,0 +1,34 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build !windows
+
+package mon
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openedForAppend returns whether f was opened with O_APPEND, in which case
+// its writes happen at the end of the file whatever its offset. If the flags
+// of f can't be read, it assumes the worst.
+func openedForAppend(f *os.File) bool {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return true
+	}
+	return flags&unix.O_APPEND != 0
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+)
+
+// DefaultUnmarshalExpansionFactor is the expansion factor used by Unmarshal
+// for the accounts of monitors built without WithUnmarshalExpansionFactor.
+// The serialized encoding is compact (varints, no pointers, no slice
+// headers), so the decoded form is typically larger.
+const DefaultUnmarshalExpansionFactor = 2
+
+// WithUnmarshalExpansionFactor sets the ratio between the in-memory size of
+// a message decoded by Unmarshal and its serialized size, which Unmarshal
+// charges to the accounts of the monitor. 0 or less means
+// DefaultUnmarshalExpansionFactor.
+func WithUnmarshalExpansionFactor(factor float64) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.unmarshalExpansionFactor = factor
+	})
+}
+
+// UnmarshalSize returns the number of bytes Unmarshal charges to the
+// accounts of the monitor for a message serialized into dataLen bytes. The
+// caller of Unmarshal shrinks the account by that amount when it drops the
+// message.
+func (mm *BytesMonitor) UnmarshalSize(dataLen int) int64 {
+	factor := float64(DefaultUnmarshalExpansionFactor)
+	if mm != nil && mm.unmarshalExpansionFactor > 0 {
+		factor = mm.unmarshalExpansionFactor
+	}
+	return int64(float64(dataLen) * factor)
+}
+
+// Unmarshal decodes data into msg after growing acc by an estimate of the
+// decoded message's footprint (see BytesMonitor.UnmarshalSize). If the
+// account denies the allocation, the error is returned before anything is
+// decoded.
+//
+// On success the charge stays on acc; the caller is responsible for
+// shrinking the account by acc.Monitor().UnmarshalSize(len(data)) when the
+// message is dropped. If decoding fails, the charge is released before
+// returning.
+func Unmarshal(ctx context.Context, acc *BoundAccount, data []byte, msg protoutil.Message) error {
+	sz := acc.Monitor().UnmarshalSize(len(data))
+	if err := acc.Grow(ctx, sz); err != nil {
+		return err
+	}
+	if err := protoutil.Unmarshal(data, msg); err != nil {
+		acc.Shrink(ctx, sz)
+		return err
+	}
+	return nil
+}
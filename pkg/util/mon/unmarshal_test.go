@@ -0,0 +1,119 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// testMessage is a trivial protoutil.Message whose encoding is its payload.
+// Payloads starting with 0xff fail to decode.
+type testMessage struct {
+	payload []byte
+}
+
+func (m *testMessage) Reset()         { *m = testMessage{} }
+func (m *testMessage) String() string { return string(m.payload) }
+func (*testMessage) ProtoMessage()    {}
+func (m *testMessage) Size() int      { return len(m.payload) }
+
+func (m *testMessage) MarshalTo(data []byte) (int, error) {
+	return copy(data, m.payload), nil
+}
+
+func (m *testMessage) Unmarshal(data []byte) error {
+	if len(data) > 0 && data[0] == 0xff {
+		return errors.New("corrupt message")
+	}
+	m.payload = append([]byte(nil), data...)
+	return nil
+}
+
+func TestUnmarshal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer TestingVerifyAllStopped(t)()
+
+	ctx := TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+	data := bytes.Repeat([]byte("a"), 100)
+	for _, tc := range []struct {
+		factor   float64
+		expected int64
+	}{
+		{0, 100 * DefaultUnmarshalExpansionFactor},
+		{1, 100},
+		{2.5, 250},
+		{4, 400},
+	} {
+		m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+			WithUnmarshalExpansionFactor(tc.factor))
+		m.Start(ctx, nil, MakeStandaloneBudget(1000))
+		acc := m.MakeBoundAccount()
+		var msg testMessage
+		if err := Unmarshal(ctx, &acc, data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if sz := m.UnmarshalSize(len(data)); sz != tc.expected || acc.Used() != tc.expected {
+			t.Fatalf("factor %.1f: expected %d bytes charged, got %d (account %d)",
+				tc.factor, tc.expected, sz, acc.Used())
+		}
+		if !bytes.Equal(msg.payload, data) {
+			t.Fatalf("unexpected payload %q", msg.payload)
+		}
+		acc.Shrink(ctx, m.UnmarshalSize(len(data)))
+		if acc.Used() != 0 {
+			t.Fatalf("factor %.1f: expected the charge to be released, got %d", tc.factor, acc.Used())
+		}
+		acc.Close(ctx)
+		m.Stop(ctx)
+	}
+
+	m := MakeMonitor("test", MemoryResource, nil, nil, 1, 1000, st,
+		WithUnmarshalExpansionFactor(20))
+	m.Start(ctx, nil, MakeStandaloneBudget(1000))
+	if child := MakeMonitorInheritWithLimit("child", 100, &m); child.UnmarshalSize(10) != 200 {
+		t.Errorf("expected the expansion factor to be inherited, got %d", child.UnmarshalSize(10))
+	}
+	acc := m.MakeBoundAccount()
+
+	// A message whose estimate exceeds the budget is denied before decoding.
+	var msg testMessage
+	err := Unmarshal(ctx, &acc, data, &msg)
+	if pgErr, ok := pgerror.GetPGCause(err); !ok || pgErr.Code != pgerror.CodeOutOfMemoryError {
+		t.Fatalf("expected out of memory error, got %v", err)
+	}
+	if msg.payload != nil {
+		t.Fatalf("expected message to be left untouched, got %q", msg.payload)
+	}
+
+	// A decoding error releases the charge.
+	if err := Unmarshal(ctx, &acc, []byte{0xff, 1, 2}, &msg); err == nil || err.Error() != "corrupt message" {
+		t.Fatalf("expected decoding error, got %v", err)
+	}
+	if acc.Used() != 0 {
+		t.Fatalf("expected charge released on error, got %d", acc.Used())
+	}
+
+	acc.Close(ctx)
+	m.Stop(ctx)
+}
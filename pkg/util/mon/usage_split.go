@@ -0,0 +1,79 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon
+
+// The allocations of a monitor are served from its pre-reserved budget
+// first, and from the budget obtained from its pool beyond it. The split of
+// the usage between the two matters for capacity planning: the pre-reserved
+// budget is set aside for the monitor, whereas the pool is shared.
+
+// WithUsageSplitGauges sets gauges that track the bytes allocated through
+// the monitor out of its pre-reserved budget and out of the budget obtained
+// from its pool, respectively. Either gauge can be nil.
+func WithUsageSplitGauges(reserved, pool BytesGauge) MonitorOption {
+	return optionFunc(func(o *monitorOptions) {
+		o.reservedUsageGauge = gaugeOrNil(reserved)
+		o.poolUsageGauge = gaugeOrNil(pool)
+	})
+}
+
+// ReservedUsage returns the number of bytes currently allocated through the
+// monitor out of its pre-reserved budget.
+func (mm *BytesMonitor) ReservedUsage() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	reserved, _ := mm.usageSplitLocked()
+	return reserved
+}
+
+// PoolUsage returns the number of bytes currently allocated through the
+// monitor out of the budget obtained from its pool. ReservedUsage and
+// PoolUsage add up to AllocBytes.
+func (mm *BytesMonitor) PoolUsage() int64 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	_, pool := mm.usageSplitLocked()
+	return pool
+}
+
+// usageSplitLocked returns the current usage of the monitor out of its
+// pre-reserved budget and out of the budget obtained from its pool.
+func (mm *BytesMonitor) usageSplitLocked() (reserved, pool int64) {
+	reserved = mm.mu.curAllocated
+	if reserved > mm.reserved.used {
+		reserved = mm.reserved.used
+	}
+	return reserved, mm.mu.curAllocated - reserved
+}
+
+// updateUsageSplitLocked reflects the current split of the usage in the
+// gauges set by WithUsageSplitGauges. It is called whenever the usage or the
+// pre-reserved budget of the monitor changes.
+func (mm *BytesMonitor) updateUsageSplitLocked() {
+	if mm.reservedUsageGauge == nil && mm.poolUsageGauge == nil {
+		return
+	}
+	reserved, pool := mm.usageSplitLocked()
+	if mm.mu.stopped {
+		reserved, pool = 0, 0
+	}
+	if mm.reservedUsageGauge != nil {
+		updateGauge(mm.reservedUsageGauge, reserved-mm.mu.gaugedSplit.reserved)
+	}
+	if mm.poolUsageGauge != nil {
+		updateGauge(mm.poolUsageGauge, pool-mm.mu.gaugedSplit.pool)
+	}
+	mm.mu.gaugedSplit.reserved, mm.mu.gaugedSplit.pool = reserved, pool
+}
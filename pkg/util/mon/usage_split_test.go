@@ -0,0 +1,98 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package mon_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+func TestUsageSplit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer mon.TestingVerifyAllStopped(t)()
+
+	ctx := mon.TestingContextWithOwner(context.Background(), t)
+	st := cluster.MakeTestingClusterSettings()
+
+	reservedGauge := metric.NewGauge(metric.Metadata{Name: "test.reserved"})
+	poolGauge := metric.NewGauge(metric.Metadata{Name: "test.pool"})
+	pool := mon.MakeMonitor("pool", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st)
+	pool.Start(ctx, nil, mon.MakeStandaloneBudget(1000))
+	m := mon.MakeMonitor("test", mon.MemoryResource, nil, nil, 1, math.MaxInt64, st,
+		mon.WithUsageSplitGauges(reservedGauge, poolGauge),
+		// The steps below expect the accounts to keep a block in reserve.
+		mon.WithReservationPolicy(mon.RetainQuantum))
+	m.Start(ctx, &pool, mon.MakeStandaloneBudget(100))
+	acc := m.MakeBoundAccount()
+
+	check := func(step string, reserved, fromPool int64) {
+		t.Helper()
+		if r, p := m.ReservedUsage(), m.PoolUsage(); r != reserved || p != fromPool {
+			t.Fatalf("%s: expected %d bytes from the reserved budget and %d from the pool, got %d and %d",
+				step, reserved, fromPool, r, p)
+		}
+		if s := m.Snapshot(); s.ReservedUsage != reserved || s.PoolUsage != fromPool {
+			t.Fatalf("%s: expected a state with %d and %d bytes, got %d and %d",
+				step, reserved, fromPool, s.ReservedUsage, s.PoolUsage)
+		}
+		if r, p := reservedGauge.Value(), poolGauge.Value(); r != reserved || p != fromPool {
+			t.Fatalf("%s: expected gauges at %d and %d bytes, got %d and %d",
+				step, reserved, fromPool, r, p)
+		}
+	}
+
+	steps := []struct {
+		grow               int64
+		reserved, fromPool int64
+	}{
+		{grow: 60, reserved: 60},
+		// The allocation straddles the end of the reserved budget.
+		{grow: 80, reserved: 100, fromPool: 40},
+		{grow: 30, reserved: 100, fromPool: 70},
+		// Shrinking frees the bytes from the pool first. The account keeps
+		// a byte of its allocation in reserve.
+		{grow: -80, reserved: 91},
+		{grow: 30, reserved: 100, fromPool: 21},
+	}
+	for i, s := range steps {
+		if s.grow > 0 {
+			if err := acc.Grow(ctx, s.grow); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			acc.Shrink(ctx, -s.grow)
+		}
+		check(fmt.Sprintf("step %d", i), s.reserved, s.fromPool)
+	}
+
+	// Giving back part of the reserved budget moves the usage to the pool.
+	if err := m.ReleaseReserved(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	check("release reserved", 50, 71)
+
+	acc.Close(ctx)
+	check("close", 0, 0)
+	m.Stop(ctx)
+	check("stop", 0, 0)
+	pool.Stop(ctx)
+}